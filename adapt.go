@@ -0,0 +1,68 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var adapt bool
+
+func init() {
+	flag.BoolVar(&adapt, "adapt", false, "in a session spread across several instance types, move instances to the types producing matching failures, in proportion to how many each has produced, keeping at least one instance of every type (useful with -soak)")
+}
+
+// retypeError indicates that an instance should be replaced with one of
+// another type, typ, under -adapt.
+type retypeError struct {
+	inst string
+	typ  string
+}
+
+func (e *retypeError) Error() string {
+	return fmt.Sprintf("moving %s to %s", e.inst, e.typ)
+}
+
+// typeWeight returns the weight of type typ in the pool: its -type-weight,
+// multiplied, with -adapt, by one more than the number of matching
+// failures on the type so far. s.mu must be held.
+func (s *session) typeWeight(typ string) float64 {
+	w := weightOf(typ)
+	if adapt {
+		matched := 0
+		for _, c := range s.perInstance {
+			if c.Type == typ {
+				matched += c.Matched
+			}
+		}
+		w *= float64(1 + matched)
+	}
+	return w
+}
+
+// retype returns a retypeError if, under -adapt, the instance inst, of
+// type typ, should be replaced with one of a type that has a smaller share
+// of the pool than its weight calls for.
+func (s *session) retype(inst, typ string) error {
+	if !adapt || len(s.types) < 2 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.liveByType()
+	if live[typ] <= 1 {
+		return nil
+	}
+	to := s.leastUsedType()
+	if to == "" || to == typ {
+		return nil
+	}
+	// Don't move the instance if that just tips the balance the other way.
+	if float64(live[typ]-1)/s.typeWeight(typ) < float64(live[to]+1)/s.typeWeight(to) {
+		return nil
+	}
+	return &retypeError{inst, to}
+}
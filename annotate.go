@@ -0,0 +1,240 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	annotateIssues      stringSetVar
+	annotateKnown       bool
+	annotateArtifactURL string
+)
+
+func init() {
+	flag.Var(&annotateIssues, "annotate-issue", "GitHub issue, like golang/go#12345, to comment on with the session's results (flake rate, instance types affected, and artifacts) once it ends, with the token in $GITHUB_TOKEN; may be repeated")
+	flag.BoolVar(&annotateKnown, "annotate-known", false, "once the session ends, comment on the issue of each -known-issues issue its failures matched, as with -annotate-issue")
+	flag.StringVar(&annotateArtifactURL, "annotate-artifact-url", "", "URL at which the artifacts directory is published, to link to artifacts from -annotate-issue comments, rather than just name them")
+}
+
+// maxAnnotatedFailures is the most failures an issue comment lists.
+const maxAnnotatedFailures = 20
+
+// issueRe matches a GitHub issue: owner/repo#number, or the issue's URL.
+var issueRe = regexp.MustCompile(`^(?:https://github\.com/)?([\w.-]+)/([\w.-]+)(?:#|/issues/)(\d+)$`)
+
+// githubIssue is an issue on GitHub.
+type githubIssue struct {
+	owner, repo string
+	number      int
+}
+
+func (i githubIssue) String() string {
+	return fmt.Sprintf("%s/%s#%d", i.owner, i.repo, i.number)
+}
+
+// parseIssue parses a GitHub issue reference, taking bare numbers to be
+// issues of golang/go.
+func parseIssue(s string) (githubIssue, error) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(s, "#")); err == nil {
+		return githubIssue{"golang", "go", n}, nil
+	}
+	m := issueRe.FindStringSubmatch(s)
+	if m == nil {
+		return githubIssue{}, fmt.Errorf("%q is not a GitHub issue like golang/go#12345", s)
+	}
+	n, _ := strconv.Atoi(m[3])
+	return githubIssue{m[1], m[2], n}, nil
+}
+
+// setUpAnnotate checks the -annotate-issue configuration up front, rather
+// than once the session is over.
+func setUpAnnotate() error {
+	if len(annotateIssues) == 0 && !annotateKnown {
+		return nil
+	}
+	for _, s := range annotateIssues {
+		if _, err := parseIssue(s); err != nil {
+			return err
+		}
+	}
+	if annotateKnown && knownIssuesFile == "" {
+		return fmt.Errorf("-annotate-known needs -known-issues")
+	}
+	if os.Getenv("GITHUB_TOKEN") == "" {
+		return fmt.Errorf("$GITHUB_TOKEN must be set to comment on issues")
+	}
+	return nil
+}
+
+// annotateIssuesAtEnd comments on the -annotate-issue issues with the
+// results of the session, and with -annotate-known, on the known issues
+// its failures matched with just those failures.
+func annotateIssuesAtEnd() {
+	if dryRun || (len(annotateIssues) == 0 && !annotateKnown) {
+		return
+	}
+	st := sess.status()
+	for _, s := range annotateIssues {
+		issue, _ := parseIssue(s)
+		postIssueComment(issue, issueComment(st, st.Failures))
+	}
+	if !annotateKnown {
+		return
+	}
+	byIssue := make(map[string][]failureRecord)
+	for _, f := range st.Failures {
+		if f.Known != "" && !slices.Contains(annotateIssues, f.Known) {
+			byIssue[f.Known] = append(byIssue[f.Known], f)
+		}
+	}
+	for known, failures := range byIssue {
+		issue, err := parseIssue(known)
+		if err != nil {
+			log.Printf("Not commenting on known issue %s: %v", known, err)
+			continue
+		}
+		postIssueComment(issue, issueComment(st, failures))
+	}
+}
+
+// issueComment returns a Markdown comment reporting failures, of the
+// session st.
+func issueComment(st *sessionStatus, failures []failureRecord) string {
+	var b strings.Builder
+	n := st.iterations()
+	types := st.Types
+	if len(types) == 0 {
+		types = []string{st.Type}
+	}
+	fmt.Fprintf(&b, "[goswarm](https://github.com/mknyszek/goswarm) ran `%s` on %s", strings.Join(st.Command, " "), strings.Join(types, ", "))
+	if goroot, _ := pushRoot(); goroot != "" {
+		if commit, _ := gorootCommit(goroot); commit != "" {
+			fmt.Fprintf(&b, " at %s", commit)
+		}
+	}
+	fmt.Fprintf(&b, " for %s.\n\n", time.Since(st.Start).Round(time.Second))
+	rate := 0.0
+	if n > 0 {
+		rate = float64(len(failures)) / float64(n)
+	}
+	fmt.Fprintf(&b, "Observed **%d failures in %d iterations (%.2f%%)**", len(failures), n, 100*rate)
+	if errMatch != "" {
+		fmt.Fprintf(&b, " matching `%s`", errMatch)
+	}
+	b.WriteString(".\n\n")
+
+	// Per instance type, to show which builders are affected.
+	iters := make(map[string]int)
+	for _, c := range st.PerInstance {
+		iters[c.Type] += c.Iterations
+	}
+	failed := make(map[string]int)
+	for _, f := range failures {
+		failed[f.InstanceType]++
+	}
+	if len(types) > 1 || len(failed) > 0 {
+		b.WriteString("| Instance type | Iterations | Failures | Rate |\n|---|---:|---:|---:|\n")
+		for _, typ := range types {
+			rate := 0.0
+			if iters[typ] > 0 {
+				rate = float64(failed[typ]) / float64(iters[typ])
+			}
+			fmt.Fprintf(&b, "| %s | %d | %d | %.2f%% |\n", typ, iters[typ], failed[typ], 100*rate)
+		}
+		b.WriteString("\n")
+	}
+
+	if len(failures) > 0 {
+		b.WriteString("<details><summary>Failures</summary>\n\n")
+		sorted := slices.Clone(failures)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+		for i, f := range sorted {
+			if i == maxAnnotatedFailures {
+				fmt.Fprintf(&b, "- and %d more\n", len(sorted)-i)
+				break
+			}
+			fmt.Fprintf(&b, "- %s, seed %d", f.InstanceType, f.Seed)
+			if f.ExitStatus != "" {
+				fmt.Fprintf(&b, ", %s", f.ExitStatus)
+			}
+			b.WriteString(":")
+			if len(f.Tests) > 0 {
+				fmt.Fprintf(&b, " %s:", strings.Join(f.Tests, ", "))
+			}
+			for _, a := range f.artifacts() {
+				fmt.Fprintf(&b, " %s", artifactMarkdown(a))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n</details>\n")
+	}
+	return redactString(b.String())
+}
+
+// artifactMarkdown returns a reference to the artifact at path: a link
+// under -annotate-artifact-url, or else just its name.
+func artifactMarkdown(path string) string {
+	name := filepath.Base(path)
+	if annotateArtifactURL == "" {
+		return "`" + name + "`"
+	}
+	rel, err := filepath.Rel(artifactsDir, path)
+	if err != nil {
+		rel = name
+	}
+	return fmt.Sprintf("[%s](%s/%s)", name, strings.TrimSuffix(annotateArtifactURL, "/"), filepath.ToSlash(rel))
+}
+
+// postIssueComment posts body as a comment on issue, logging any error.
+func postIssueComment(issue githubIssue, body string) {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	u := fmt.Sprintf("%s/repos/%s/%s/issues/%d/comments", strings.TrimSuffix(api, "/"), url.PathEscape(issue.owner), url.PathEscape(issue.repo), issue.number)
+	b, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		log.Printf("Failed to comment on %s: %v", issue, err)
+		return
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Failed to comment on %s: %v", issue, err)
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("GITHUB_TOKEN"))
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to comment on %s: %v", issue, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Failed to comment on %s: GitHub returned %s", issue, resp.Status)
+		return
+	}
+	var comment struct {
+		URL string `json:"html_url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&comment)
+	log.Printf("Commented on %s: %s", issue, comment.URL)
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	noArchive  bool
+	maxArchive uint
+)
+
+func init() {
+	flag.BoolVar(&noArchive, "no-archive", false, "don't download an archive of the instance's work directory on matching failures")
+	flag.UintVar(&maxArchive, "max-archive", 2048, "skip downloading archives of work directories larger than this many MiB, and stop downloads that grow past it (0 means no limit)")
+}
+
+// errArchiveTooLarge is returned by a limitWriter that reaches its limit.
+var errArchiveTooLarge = errors.New("archive too large")
+
+// limitWriter is a writer that fails once more than n bytes are written.
+type limitWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > l.n {
+		l.exceeded = true
+		return 0, errArchiveTooLarge
+	}
+	l.n -= int64(len(b))
+	return l.w.Write(b)
+}
+
+// downloadArchive downloads an archive of inst's work directory to the
+// artifacts directory, as name.tar.gz, returning its path. If the archive
+// isn't downloaded, for example because it's too large, it returns an
+// empty path and a note explaining why.
+func downloadArchive(ctx context.Context, inst, name string) (path, note string, err error) {
+	return fetchArchive(ctx, inst, name, nil)
+}
+
+// fetchArchive is downloadArchive for just dirs, relative to inst's work
+// directory, or for the whole work directory if dirs is nil.
+func fetchArchive(ctx context.Context, inst, name string, dirs []string) (path, note string, err error) {
+	if noArchive {
+		return "", "disabled by -no-archive", nil
+	}
+	if overBudget() {
+		return "", "skipped, artifacts reached -artifact-budget", nil
+	}
+	var get func(ctx context.Context, w io.Writer) error
+	if dirs == nil {
+		archiver, ok := backend.(swarm.Archiver)
+		if !ok {
+			return "", fmt.Sprintf("not supported by the %s backend", backendName), nil
+		}
+		get = func(ctx context.Context, w io.Writer) error { return archiver.Get(ctx, inst, w) }
+	} else {
+		archiver, ok := backend.(swarm.DirArchiver)
+		if !ok {
+			return "", fmt.Sprintf("archiving directories is not supported by the %s backend", backendName), nil
+		}
+		get = func(ctx context.Context, w io.Writer) error { return getDirs(ctx, archiver, inst, dirs, w) }
+	}
+	limit := int64(maxArchive) << 20
+	if maxArchive > 0 && dirs == nil {
+		// The work directory's size is an overestimate of the compressed
+		// archive's, but skipping an archive that's too large up front
+		// beats downloading most of it first.
+		var size int64
+		if dr, ok := backend.(swarm.DiskReporter); ok {
+			size, err = dr.DiskUsage(ctx, inst)
+		}
+		if err == nil && size > limit {
+			note = fmt.Sprintf("skipped, work directory is %d MiB, over -max-archive", size>>20)
+			instWarnf(inst, "Not downloading archive of %s: %s.", inst, note)
+			return "", note, nil
+		}
+	}
+	tarName := filepath.Join(artifactsDir, name+".tar.gz")
+	f, err := os.Create(tarName)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create archive for %s: %v", inst, err)
+	}
+	defer f.Close()
+	limitNote := fmt.Sprintf("grew past -max-archive (%d MiB)", maxArchive)
+	if left, ok := budgetLeft(); ok && (maxArchive == 0 || left < limit) {
+		limit = left
+		limitNote = fmt.Sprintf("would exceed -artifact-budget (%d MiB)", artifactBudget)
+	}
+	var w io.Writer = f
+	lw := &limitWriter{w: f, n: limit}
+	if maxArchive > 0 || artifactBudget > 0 {
+		w = lw
+	}
+	err = retry(ctx, "gettar", inst, func(ctx context.Context) error {
+		// Start over after a failed attempt.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		lw.n = limit
+		err := limitTransfer(ctx, func() error {
+			return limitOp(ctx, func() error { return get(ctx, throttle(ctx, w)) })
+		})
+		if lw.exceeded {
+			return nil
+		}
+		return err
+	})
+	if lw.exceeded {
+		// gomote may fail with a broken pipe rather than returning
+		// errArchiveTooLarge, so don't rely on the error.
+		f.Close()
+		os.Remove(tarName)
+		note = "stopped, archive " + limitNote
+		instWarnf(inst, "Not downloading archive of %s: %s.", inst, note)
+		return "", note, nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to download archive for %s: %v", inst, err)
+	}
+	addArtifact(tarName)
+	instLogf(inst, "Downloaded archive of %s to %s.", inst, tarName)
+	return tarName, "", nil
+}
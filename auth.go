@@ -0,0 +1,81 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// gomoteInstall is how to install or update gomote.
+const gomoteInstall = "go install golang.org/x/build/cmd/gomote@latest"
+
+// Substrings of gomote's error output indicating that it isn't logged in,
+// or that it's too old for the current build infrastructure.
+var (
+	gomoteAuthErrors = []string{
+		"unauthenticated",
+		"not logged in",
+		"login required",
+		"luci-auth login",
+		"credentials",
+		"permission denied",
+		"permissiondenied",
+		"401",
+		"403",
+	}
+	gomoteVersionErrors = []string{
+		"flag provided but not defined",
+		"unknown command",
+		"unknown subcommand",
+		"unimplemented",
+	}
+)
+
+// errGomoteAuth is wrapped by errors from gomoteProblem about
+// authentication.
+var errGomoteAuth = errors.New("gomote isn't authenticated")
+
+// checkGomote checks that gomote works at all, with a cheap gomote list,
+// before any instances are created. Otherwise, every instance would fail
+// to be created with the same opaque error.
+func checkGomote(ctx context.Context) error {
+	if backendName != "gomote" {
+		return nil
+	}
+	if _, err := backend.List(ctx); err != nil {
+		return gomoteProblem(err)
+	}
+	return nil
+}
+
+// gomoteProblem explains how to fix err, returned by a gomote invocation
+// that shouldn't fail.
+func gomoteProblem(err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("gomote isn't installed, or isn't in $PATH; install it with\n\t%s", gomoteInstall)
+	}
+	detail := err.Error()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && len(bytes.TrimSpace(ee.Stderr)) > 0 {
+		detail = string(bytes.TrimSpace(ee.Stderr))
+	}
+	msg := strings.ToLower(detail)
+	for _, s := range gomoteAuthErrors {
+		if strings.Contains(msg, s) {
+			return fmt.Errorf("%w; log in with\n\tluci-auth login\nand try again (%s)", errGomoteAuth, detail)
+		}
+	}
+	for _, s := range gomoteVersionErrors {
+		if strings.Contains(msg, s) {
+			return fmt.Errorf("gomote is too old for the build infrastructure; update it with\n\t%s\nand try again (%s)", gomoteInstall, detail)
+		}
+	}
+	return fmt.Errorf("gomote can't reach the coordinator; check your network connection and any -gomote-flag or -gomote-env (%s)", detail)
+}
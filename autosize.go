@@ -0,0 +1,98 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// instancesAuto is set by -i auto.
+var instancesAuto bool
+
+// poolSizeVar is the value of -i: a number of instances, or auto.
+type poolSizeVar struct {
+	n    *uint
+	auto *bool
+}
+
+func (v *poolSizeVar) String() string {
+	switch {
+	case v.n == nil:
+		return ""
+	case *v.auto:
+		return "auto"
+	}
+	return strconv.FormatUint(uint64(*v.n), 10)
+}
+
+func (v *poolSizeVar) Set(s string) error {
+	if s == "auto" {
+		*v.auto = true
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 0)
+	if err != nil {
+		return fmt.Errorf("expected a number of instances or auto")
+	}
+	*v.n = uint(n)
+	*v.auto = false
+	return nil
+}
+
+// autoPoolFraction is the fraction of what's left of -quota that -i auto
+// uses, leaving the rest for others and for replacements.
+const autoPoolFraction = 0.75
+
+// sizePool sizes the pool of instances of the types typs for -i auto, at
+// what the backend has room for: a fraction of what's left of -quota for
+// gomote, every host of those types for ssh, and a CPU apiece for local.
+// During the session, the pool shrinks further whenever the type runs out
+// of capacity.
+func sizePool(ctx context.Context, typs []string) error {
+	if !instancesAuto {
+		return nil
+	}
+	var avail int
+	switch backendName {
+	case "gomote":
+		if quota == 0 {
+			return usageErrorf("-i auto needs -quota with the gomote backend, which can't tell how many instances you may have")
+		}
+		room, err := quotaRoom(ctx)
+		if err != nil {
+			return err
+		}
+		avail = room
+		instances = uint(max(1, int(autoPoolFraction*float64(avail))))
+	case "ssh":
+		for _, typ := range typs {
+			avail += len(userConfig["ssh"][typ])
+		}
+		if avail == 0 {
+			return usageErrorf("-i auto found no hosts of types %s in the [ssh] table of %s", strings.Join(typs, ","), configFile)
+		}
+		instances = uint(avail)
+	case "local":
+		avail = runtime.NumCPU()
+		instances = uint(avail)
+	default:
+		return usageErrorf("-i auto can't tell how many instances the %s backend has room for; pass -i a number of instances", backendName)
+	}
+	log.Printf("Sizing the pool at %d instances, of the %d available.", instances, avail)
+	return nil
+}
+
+// shrinkForCapacity reports whether, with -i auto, a slot whose instance
+// couldn't be created for lack of capacity should leave the pool, rather
+// than wait for capacity to free up. The pool never shrinks below one
+// instance this way.
+func shrinkForCapacity() bool {
+	return instancesAuto && poolSize() > 1
+}
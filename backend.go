@@ -0,0 +1,135 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	backendName  string
+	fakeFailRate float64
+	fakeLatency  time.Duration
+	sshDir       string
+
+	containerRuntime string
+	containerImage   string
+
+	k8sContext   string
+	k8sNamespace string
+	k8sImage     string
+	k8sCPU       string
+	k8sMemory    string
+)
+
+func init() {
+	flag.StringVar(&backendName, "backend", "gomote", "where to run the command: gomote, local for subprocesses on this machine (no instance type is expected), ssh for the hosts in the configuration file's [ssh] table, container for Docker or Podman containers on this machine, kubernetes for pods on a Kubernetes cluster, or fake to simulate instances without using any gomotes")
+	flag.Float64Var(&fakeFailRate, "fake-fail-rate", 0.01, "with -backend=fake, the probability that an iteration fails")
+	flag.DurationVar(&fakeLatency, "fake-latency", time.Second, "with -backend=fake, the average time each simulated operation takes")
+	flag.StringVar(&sshDir, "ssh-dir", "goswarm", "with -backend=ssh, the work directory on each host, relative to the home directory")
+	flag.StringVar(&containerRuntime, "container-runtime", "docker", "with -backend=container, the container runtime: docker or podman")
+	flag.StringVar(&containerImage, "container-image", "debian:stable", "with -backend=container, the image to run")
+	flag.StringVar(&k8sContext, "k8s-context", "", "with -backend=kubernetes, the kubeconfig context to use, if not the current one")
+	flag.StringVar(&k8sNamespace, "k8s-namespace", "", "with -backend=kubernetes, the namespace in which to create pods, if not the context's")
+	flag.StringVar(&k8sImage, "k8s-image", "debian:stable", "with -backend=kubernetes, the image to run")
+	flag.StringVar(&k8sCPU, "k8s-cpu", "", "with -backend=kubernetes, the CPU to request for each pod, like '2'")
+	flag.StringVar(&k8sMemory, "k8s-memory", "", "with -backend=kubernetes, the memory to request for each pod, like '4Gi'")
+}
+
+// setUpBackend sets backend according to -backend.
+func setUpBackend() error {
+	if err := setUpGomote(); err != nil {
+		return err
+	}
+	goroot, err := pushRoot()
+	if err != nil {
+		return fmt.Errorf("-goroot: %v", err)
+	}
+	if gorootDir != "" {
+		// Record it as an absolute path for -resume.
+		gorootDir = goroot
+	}
+	switch backendName {
+	case "gomote":
+		backend = swarm.GomoteBackend{Dir: runDir, RunArgs: runArgs, GOROOT: goroot, CreateArgs: typeCreateArgs()}
+	case "local":
+		backend = &swarm.Local{GOROOT: goroot}
+		// Local instances don't outlive goswarm, so don't leave their
+		// work directories behind.
+		if !clean.AtExit() {
+			clean = swarm.CleanExit
+		}
+	case "ssh":
+		hosts := userConfig["ssh"]
+		if len(hosts) == 0 {
+			return fmt.Errorf("-backend=ssh needs hosts in the [ssh] table of %s", configFile)
+		}
+		backend = &swarm.SSH{Hosts: hosts, Dir: sshDir, GOROOT: goroot}
+	case "container":
+		backend = &swarm.Container{Runtime: containerRuntime, Image: containerImage, GOROOT: goroot}
+	case "kubernetes":
+		backend = &swarm.Kubernetes{
+			Context:   k8sContext,
+			Namespace: k8sNamespace,
+			Image:     k8sImage,
+			CPU:       k8sCPU,
+			Memory:    k8sMemory,
+			GOROOT:    goroot,
+		}
+	case "fake":
+		if fakeFailRate < 0 || fakeFailRate > 1 {
+			return fmt.Errorf("-fake-fail-rate must be between 0 and 1")
+		}
+		backend = newSimulator()
+	default:
+		return fmt.Errorf("unknown backend %q", backendName)
+	}
+	return nil
+}
+
+// simulatedFailures are the outputs of the simulator's failures, so that
+// -match has something to tell apart.
+var simulatedFailures = []swarm.FakeOutcome{
+	{
+		Output:   "fatal error: simulated runtime crash\n\ngoroutine 1 gp=0xc000002380 m=0 mp=0x5a7b40 [running]:\nruntime.throw({0x4b1f2c?, 0x0?})\n\truntime/panic.go:1023 +0x5c\n",
+		ExitCode: 2,
+	},
+	{
+		Output:   "--- FAIL: TestSimulated (0.52s)\n    simulated_test.go:42: simulated flake\nFAIL\nFAIL\tsimulated\t0.617s\n",
+		ExitCode: 1,
+	},
+}
+
+// newSimulator returns a fake backend whose iterations fail at random
+// with probability -fake-fail-rate, and whose operations take about
+// -fake-latency.
+func newSimulator() *swarm.Fake {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random := func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64()
+	}
+	return &swarm.Fake{
+		Outcome: func(inst string, n int) swarm.FakeOutcome {
+			if x := random(); x < fakeFailRate {
+				// Reuse the draw to pick a failure.
+				return simulatedFailures[int(x/fakeFailRate*float64(len(simulatedFailures)))]
+			}
+			return swarm.FakeOutcome{Output: "ok  \tsimulated\t0.617s\n"}
+		},
+		Latency: func(op string) time.Duration {
+			// Vary by up to 50% either way.
+			return time.Duration(float64(fakeLatency) * (0.5 + random()))
+		},
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/gomote"
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// batchWindow is how long a batched creation waits for more instances of
+// the same type to be requested, before creating them all at once.
+const batchWindow = 100 * time.Millisecond
+
+// errUnbatched is sent to an instance whose batch had no one else in it,
+// so it's cheaper for it to be created on its own.
+var errUnbatched = errors.New("nothing to batch with")
+
+// batchResult is the outcome of a batched creation, for one instance.
+type batchResult struct {
+	inst string
+	err  error
+}
+
+// createBatcher gathers instances of the same type requested at about
+// the same time, like when the pool is filled, and creates them with a
+// single backend call.
+type createBatcher struct {
+	mu       sync.Mutex
+	disabled bool                          // the backend can't batch after all
+	pending  map[string][]chan batchResult // by instance type
+}
+
+var batcher createBatcher
+
+// batchCreate creates an instance of type typ along with any others being
+// created at the same time. It reports false if the instance should be
+// created on its own instead, because the backend can't create instances
+// in batches, -create-concurrency or -create-interval ask to stagger them,
+// or the batch failed.
+func batchCreate(ctx context.Context, typ string) (string, bool) {
+	bc, ok := backend.(swarm.BatchCreator)
+	if !ok || createConcurrency > 0 || createInterval > 0 {
+		return "", false
+	}
+	b := &batcher
+	b.mu.Lock()
+	if b.disabled {
+		b.mu.Unlock()
+		return "", false
+	}
+	if b.pending == nil {
+		b.pending = make(map[string][]chan batchResult)
+	}
+	c := make(chan batchResult, 1)
+	first := len(b.pending[typ]) == 0
+	b.pending[typ] = append(b.pending[typ], c)
+	b.mu.Unlock()
+	if first {
+		go b.create(ctx, bc, typ)
+	}
+	select {
+	case r := <-c:
+		return r.inst, r.err == nil
+	case <-ctx.Done():
+		// Don't leak the instance created on our behalf.
+		go func() {
+			if r := <-c; r.err == nil {
+				backend.Destroy(context.Background(), r.inst)
+			}
+		}()
+		return "", false
+	}
+}
+
+// create waits out batchWindow, then creates the instances of type typ
+// requested in the meantime.
+func (b *createBatcher) create(ctx context.Context, bc swarm.BatchCreator, typ string) {
+	time.Sleep(batchWindow)
+	b.mu.Lock()
+	waiters := b.pending[typ]
+	delete(b.pending, typ)
+	b.mu.Unlock()
+	if len(waiters) == 1 {
+		waiters[0] <- batchResult{err: errUnbatched}
+		return
+	}
+	var insts []string
+	err := limitOp(ctx, func() (err error) {
+		insts, err = bc.CreateBatch(ctx, typ, len(waiters))
+		return err
+	})
+	switch {
+	case errors.Is(err, gomote.ErrNoBatch):
+		b.mu.Lock()
+		if !b.disabled {
+			log.Printf("gomote can't create instances in batches, creating them one at a time.")
+			b.disabled = true
+		}
+		b.mu.Unlock()
+	case err != nil:
+		log.Printf("Failed to create %d instances of %s at once, creating the rest one at a time: %v", len(waiters), typ, unwrap(err))
+	default:
+		log.Printf("Created %d instances of %s at once.", len(insts), typ)
+	}
+	for i, c := range waiters {
+		if i < len(insts) {
+			c <- batchResult{inst: insts[i]}
+		} else {
+			c <- batchResult{err: err}
+		}
+	}
+}
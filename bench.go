@@ -0,0 +1,378 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+var (
+	benchIters uint
+	benchArms  benchArmsVar
+)
+
+func init() {
+	flag.UintVar(&benchIters, "bench", 0, "benchmark mode: run the command, a Go benchmark, this many times across the pool, then compare its results")
+	flag.Var(&benchArms, "bench-arm", "with -bench, an arm of the comparison of the form name:VAR=value[,VAR=value...], may be specified multiple times; iterations alternate between arms")
+}
+
+// benchArm is one side of a benchmark comparison: the command, run with
+// some extra environment variables.
+type benchArm struct {
+	name string
+	env  []string
+
+	// Guarded by bench.mu.
+	samples map[benchKey][]float64
+	keys    []benchKey // in the order they were first seen
+	written bool       // whether this session has written to the arm's file
+}
+
+// benchKey identifies one series of benchmark results.
+type benchKey struct {
+	name, unit string
+}
+
+type benchArmsVar []*benchArm
+
+// String returns a in the form passed to -bench-arm.
+func (a *benchArm) String() string {
+	return a.name + ":" + strings.Join(a.env, ",")
+}
+
+func (b *benchArmsVar) String() string {
+	var s []string
+	for _, a := range *b {
+		s = append(s, a.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (b *benchArmsVar) Set(s string) error {
+	name, env, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name:VAR=value[,VAR=value...]")
+	}
+	a := &benchArm{name: name}
+	if env != "" {
+		for _, v := range strings.Split(env, ",") {
+			if !strings.Contains(v, "=") {
+				return fmt.Errorf("expected VAR=value, got %q", v)
+			}
+			a.env = append(a.env, v)
+		}
+	}
+	*b = append(*b, a)
+	return nil
+}
+
+// bench collects benchmark results across the session.
+var bench struct {
+	mu   sync.Mutex
+	arms []*benchArm
+	next int // the arm of the next iteration
+	runs int // iterations whose results were recorded
+}
+
+// setUpBench validates the benchmark flags.
+func setUpBench() error {
+	if benchIters == 0 {
+		if len(benchArms) > 0 {
+			return fmt.Errorf("-bench-arm requires -bench")
+		}
+		return nil
+	}
+	bench.arms = benchArms
+	if len(bench.arms) == 0 {
+		bench.arms = []*benchArm{{name: "results"}}
+	}
+	seen := make(map[string]bool)
+	for _, a := range bench.arms {
+		if seen[a.name] {
+			return fmt.Errorf("duplicate -bench-arm %s", a.name)
+		}
+		seen[a.name] = true
+		a.samples = make(map[benchKey][]float64)
+	}
+	return nil
+}
+
+// nextBenchArm returns the arm for the next iteration, or nil if not in
+// benchmark mode. Iterations alternate between arms, so that they all see
+// the same conditions over time.
+func nextBenchArm() *benchArm {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	if len(bench.arms) == 0 {
+		return nil
+	}
+	a := bench.arms[bench.next%len(bench.arms)]
+	bench.next++
+	return a
+}
+
+// file returns the path of the file collecting arm's raw results.
+func (a *benchArm) file() string {
+	return filepath.Join(artifactsDir, "bench-"+a.name+".txt")
+}
+
+// recordBench records the benchmark results in the output of an iteration
+// of arm, and appends them to the arm's file, in the format benchstat
+// expects.
+func recordBench(arm *benchArm, output []byte) error {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	var raw bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	for sc.Scan() {
+		line := sc.Text()
+		if isBenchConfig(line) {
+			raw.WriteString(line + "\n")
+			continue
+		}
+		name, samples, ok := parseBenchLine(line)
+		if !ok {
+			continue
+		}
+		raw.WriteString(line + "\n")
+		for unit, v := range samples {
+			k := benchKey{name, unit}
+			if _, ok := arm.samples[k]; !ok {
+				arm.keys = append(arm.keys, k)
+			}
+			arm.samples[k] = append(arm.samples[k], v)
+		}
+	}
+	bench.runs++
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if !arm.written {
+		// Don't mix in results from a previous session.
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(arm.file(), flags, 0o644)
+	if err != nil {
+		return err
+	}
+	arm.written = true
+	defer f.Close()
+	_, err = f.Write(raw.Bytes())
+	return err
+}
+
+// benchmarkDone reports whether enough iterations have been recorded.
+func benchmarkDone() bool {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	return benchIters > 0 && bench.runs >= int(benchIters)
+}
+
+// isBenchConfig reports whether line is one of the configuration lines
+// go test prints before benchmark results, like "goos: linux".
+func isBenchConfig(line string) bool {
+	key, _, ok := strings.Cut(line, ":")
+	return ok && (key == "goos" || key == "goarch" || key == "pkg" || key == "cpu")
+}
+
+// parseBenchLine parses a line of benchmark results, like
+//
+//	BenchmarkFoo-8   1000000   1234 ns/op   56 B/op
+//
+// returning the benchmark's name and its values by unit.
+func parseBenchLine(line string) (string, map[string]float64, bool) {
+	f := strings.Fields(line)
+	if len(f) < 4 || len(f)%2 != 0 || !strings.HasPrefix(f[0], "Benchmark") {
+		return "", nil, false
+	}
+	if _, err := strconv.Atoi(f[1]); err != nil {
+		return "", nil, false
+	}
+	samples := make(map[string]float64)
+	for i := 2; i+1 < len(f); i += 2 {
+		v, err := strconv.ParseFloat(f[i], 64)
+		if err != nil {
+			return "", nil, false
+		}
+		samples[f[i+1]] = v
+	}
+	return f[0], samples, true
+}
+
+// writeBenchSummary writes a benchstat-style summary of the results of
+// every arm, comparing each to the first.
+func writeBenchSummary(w io.Writer) {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+	if len(bench.arms) == 0 {
+		return
+	}
+	base := bench.arms[0]
+	var units []string
+	byUnit := make(map[string][]string)
+	for _, a := range bench.arms {
+		for _, k := range a.keys {
+			if _, ok := byUnit[k.unit]; !ok {
+				units = append(units, k.unit)
+			}
+			if !slices.Contains(byUnit[k.unit], k.name) {
+				byUnit[k.unit] = append(byUnit[k.unit], k.name)
+			}
+		}
+	}
+	if len(units) == 0 {
+		fmt.Fprintf(w, "No benchmark results.\n")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, unit := range units {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "name")
+		for j, a := range bench.arms {
+			fmt.Fprintf(tw, "\t%s (%s)", a.name, unit)
+			if j > 0 {
+				fmt.Fprintf(tw, "\tvs %s", base.name)
+			}
+		}
+		fmt.Fprintln(tw)
+		for _, name := range byUnit[unit] {
+			k := benchKey{name, unit}
+			fmt.Fprintf(tw, "%s", name)
+			for j, a := range bench.arms {
+				fmt.Fprintf(tw, "\t%s", formatSamples(a.samples[k]))
+				if j > 0 {
+					fmt.Fprintf(tw, "\t%s", compareSamples(base.samples[k], a.samples[k]))
+				}
+			}
+			fmt.Fprintln(tw)
+		}
+	}
+	tw.Flush()
+	for _, a := range bench.arms {
+		fmt.Fprintf(w, "Raw results of %s are in %s.\n", a.name, a.file())
+	}
+}
+
+// withoutOutliers returns the samples within 1.5 interquartile ranges of
+// the quartiles, sorted.
+func withoutOutliers(samples []float64) []float64 {
+	s := append([]float64(nil), samples...)
+	sort.Float64s(s)
+	if len(s) < 4 {
+		return s
+	}
+	q1, q3 := s[len(s)/4], s[len(s)*3/4]
+	lo, hi := q1-1.5*(q3-q1), q3+1.5*(q3-q1)
+	var kept []float64
+	for _, v := range s {
+		if v >= lo && v <= hi {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// formatSamples formats the mean of samples, with outliers removed, and
+// their largest deviation from it.
+func formatSamples(samples []float64) string {
+	s := withoutOutliers(samples)
+	if len(s) == 0 {
+		return "-"
+	}
+	mean := 0.0
+	for _, v := range s {
+		mean += v
+	}
+	mean /= float64(len(s))
+	dev := 0.0
+	for _, v := range s {
+		dev = math.Max(dev, math.Abs(v-mean))
+	}
+	if mean == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.4g ±%2.0f%%", mean, 100*dev/mean)
+}
+
+// compareSamples compares two sets of samples with a Mann-Whitney U test,
+// reporting the change in mean if it's significant, like benchstat.
+func compareSamples(old, new []float64) string {
+	o, n := withoutOutliers(old), withoutOutliers(new)
+	if len(o) == 0 || len(n) == 0 {
+		return "-"
+	}
+	p := mannWhitneyU(o, n)
+	counts := fmt.Sprintf("(p=%.3f n=%d+%d)", p, len(o), len(n))
+	if p > 0.05 {
+		return "~ " + counts
+	}
+	om, nm := mean(o), mean(n)
+	if om == 0 {
+		return counts
+	}
+	return fmt.Sprintf("%+.2f%% %s", 100*(nm-om)/om, counts)
+}
+
+func mean(s []float64) float64 {
+	sum := 0.0
+	for _, v := range s {
+		sum += v
+	}
+	return sum / float64(len(s))
+}
+
+// mannWhitneyU returns the two-sided p-value of a Mann-Whitney U test of
+// whether x and y come from the same distribution, using the normal
+// approximation.
+func mannWhitneyU(x, y []float64) float64 {
+	type ranked struct {
+		v     float64
+		fromX bool
+	}
+	all := make([]ranked, 0, len(x)+len(y))
+	for _, v := range x {
+		all = append(all, ranked{v, true})
+	}
+	for _, v := range y {
+		all = append(all, ranked{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+	// Sum the ranks of x, giving ties their average rank.
+	rx := 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromX {
+				rx += rank
+			}
+		}
+		i = j
+	}
+	n1, n2 := float64(len(x)), float64(len(y))
+	u := rx - n1*(n1+1)/2
+	sigma := math.Sqrt(n1 * n2 * (n1 + n2 + 1) / 12)
+	if sigma == 0 {
+		return 1
+	}
+	z := (u - n1*n2/2) / sigma
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
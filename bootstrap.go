@@ -0,0 +1,63 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	bootstrapMode string
+
+	// putBootstrap is whether to push a bootstrap toolchain to each
+	// instance during setup.
+	putBootstrap bool
+)
+
+func init() {
+	flag.StringVar(&bootstrapMode, "bootstrap", "auto", "whether to push a bootstrap toolchain to each instance after pushing GOROOT: on, off, or auto to push one with -make or when the command builds Go, like make.bash or all.bash")
+}
+
+// buildScripts are the scripts that build Go from source, and so need a
+// bootstrap toolchain.
+var buildScripts = []string{
+	"make.bash", "all.bash", "race.bash",
+	"make.bat", "all.bat", "race.bat",
+	"make.rc", "all.rc",
+}
+
+// setUpBootstrap sets putBootstrap according to -bootstrap and cmd.
+func setUpBootstrap(cmd []string) error {
+	_, ok := backend.(swarm.Bootstrapper)
+	switch bootstrapMode {
+	case "on":
+		if !ok {
+			return fmt.Errorf("not supported by the %s backend", backendName)
+		}
+		putBootstrap = true
+	case "off":
+		putBootstrap = false
+	case "auto":
+		putBootstrap = ok && (makeGo || buildsGo(cmd))
+	default:
+		return fmt.Errorf("unknown mode %q, expected on, off, or auto", bootstrapMode)
+	}
+	return nil
+}
+
+// buildsGo reports whether cmd, or any -step, appears to build Go.
+func buildsGo(cmd []string) bool {
+	s := strings.Join(append(cmd, steps...), " ")
+	for _, b := range buildScripts {
+		if strings.Contains(s, b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var brokenRate float64
+
+func init() {
+	flag.Float64Var(&brokenRate, "broken-rate", 0.9, "stop the session if at least this fraction of the early iterations fail without matching -match, since the build or command is probably broken (0 disables)")
+}
+
+// minEarlyIterations is the smallest number of iterations considered
+// when deciding whether the build is broken. Otherwise, the first
+// iteration on every instance is.
+const minEarlyIterations = 5
+
+// checkBroken reports, once enough iterations have run, whether the early
+// iterations of the session failed so consistently without matching that
+// the build or command must be broken.
+func (s *session) checkBroken() error {
+	if brokenRate <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.brokenChecked {
+		return nil
+	}
+	unmatched := s.results[swarm.FailUnmatched.String()]
+	n := s.results[swarm.Pass.String()] + unmatched + s.results[swarm.FailMatched.String()]
+	if n < max(int(instances), minEarlyIterations) {
+		return nil
+	}
+	s.brokenChecked = true
+	if float64(unmatched) < brokenRate*float64(n) {
+		return nil
+	}
+	err := fmt.Errorf("%d of the first %d iterations failed without matching -match, the build or command looks broken", unmatched, n)
+	var common *unmatchedOutput
+	for _, u := range s.unmatched {
+		if common == nil || u.Count > common.Count {
+			common = u
+		}
+	}
+	if common != nil {
+		err = fmt.Errorf("%v; see %s", err, common.Path)
+	}
+	log.Printf("Stopping: %v.", err)
+	return &exitError{exitInfra, err}
+}
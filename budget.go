@@ -0,0 +1,83 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+var artifactBudget uint
+
+func init() {
+	flag.UintVar(&artifactBudget, "artifact-budget", 0, "once the artifacts written by the session total this many MiB, warn and stop downloading archives of work directories, so long sessions don't fill the disk (0 means no limit)")
+}
+
+var (
+	// artifactBytes is the total size of the artifacts the session has
+	// written and not deleted.
+	artifactBytes atomic.Int64
+
+	// budgetWarned is whether the session has warned that it's over
+	// -artifact-budget.
+	budgetWarned atomic.Bool
+)
+
+// addArtifact counts the artifact at path toward -artifact-budget, and
+// records it for pruning by -retain-age and -retain-size.
+func addArtifact(path string) {
+	recordArtifact(path)
+	if info, err := os.Stat(path); err == nil {
+		artifactBytes.Add(info.Size())
+	}
+}
+
+// removeArtifact deletes the artifact at path, no longer counting it
+// toward -artifact-budget.
+func removeArtifact(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	artifactBytes.Add(-info.Size())
+	return nil
+}
+
+// budgetLeft returns how many more bytes of artifacts -artifact-budget
+// allows, and false if it's unlimited.
+func budgetLeft() (int64, bool) {
+	if artifactBudget == 0 {
+		return 0, false
+	}
+	return max(int64(artifactBudget)<<20-artifactBytes.Load(), 0), true
+}
+
+// overBudget reports whether the session's artifacts have used up
+// -artifact-budget, warning the first time they have.
+func overBudget() bool {
+	if left, ok := budgetLeft(); !ok || left > 0 {
+		return false
+	}
+	if !budgetWarned.Swap(true) {
+		log.Printf("Warning: artifacts of this session total %d MiB, reaching -artifact-budget; no longer downloading archives.", artifactBytes.Load()>>20)
+	}
+	return true
+}
+
+// writeArtifactBudget writes how much of -artifact-budget the session's
+// artifacts use, if it's set.
+func (st *sessionStatus) writeArtifactBudget(w io.Writer) {
+	if artifactBudget == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  artifacts: %d of %d MiB\n", st.ArtifactBytes>>20, artifactBudget)
+}
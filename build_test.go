@@ -0,0 +1,53 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCrossCompile vets the module for the platforms with their own
+// files, so that a change to a shared signature can't leave them broken
+// unnoticed.
+func TestCrossCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cross-compilation in short mode")
+	}
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not found: %v", err)
+	}
+	// The test cache only invalidates a result on changes to the files
+	// the test itself looks at, so look at every source file go vet does.
+	err = filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, ".go") {
+			_, err = os.Stat(path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []struct{ goos, goarch string }{
+		{"linux", "amd64"},
+		{"darwin", "arm64"},
+		{"windows", "amd64"},
+		{"plan9", "amd64"},
+		{"js", "wasm"},
+	} {
+		t.Run(p.goos+"/"+p.goarch, func(t *testing.T) {
+			cmd := exec.Command(gocmd, "vet", "./...")
+			cmd.Env = append(os.Environ(), "GOOS="+p.goos, "GOARCH="+p.goarch, "CGO_ENABLED=0")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("GOOS=%s GOARCH=%s go vet ./...: %v\n%s", p.goos, p.goarch, err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// builderTime accounts for the builder capacity a session consumes: how
+// long it holds each of its instances, from when it starts creating or
+// adopts the instance until it destroys the instance or the session ends.
+type builderTime struct {
+	held      map[string]time.Time // when the session took each instance it holds, by name
+	released  time.Duration        // held by instances the session no longer holds
+	instances int                  // ever held
+}
+
+// holdInstance records that the session has held the instance name since
+// the time since, unless it already holds it.
+func (s *session) holdInstance(name string, since time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.builders.held[name]; ok {
+		return
+	}
+	if s.builders.held == nil {
+		s.builders.held = make(map[string]time.Time)
+	}
+	s.builders.held[name] = since
+	s.builders.instances++
+}
+
+// releaseInstance records that the session no longer holds the instance
+// name, because it destroyed it.
+func (s *session) releaseInstance(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since, ok := s.builders.held[name]
+	if !ok {
+		return
+	}
+	s.builders.released += time.Since(since)
+	delete(s.builders.held, name)
+}
+
+// total returns the builder time consumed so far. s.mu must be held.
+func (b *builderTime) total() time.Duration {
+	d := b.released
+	for _, since := range b.held {
+		d += time.Since(since)
+	}
+	return d
+}
+
+// writeBuilderTime writes the builder time the session consumed, if any.
+func (st *sessionStatus) writeBuilderTime(w io.Writer) {
+	if st.BuilderInstances == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  builder time: %s across %d instances (%.2f builder-hours)\n", st.BuilderTime.Round(time.Second), st.BuilderInstances, st.BuilderTime.Hours())
+}
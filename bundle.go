@@ -0,0 +1,199 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	bundleFailures bool
+	bundleInclude  stringSetVar
+)
+
+func init() {
+	flag.BoolVar(&bundleFailures, "bundle", false, "bundle each matching failure's output, metadata, report, archive, environment, and command into a single timestamped zip file")
+	flag.Var(&bundleInclude, "bundle-include", "with -bundle, a glob pattern (as in path.Match) selecting files from the archive to include, instead of the whole archive, may be specified multiple times")
+}
+
+// bundleFailure bundles the artifacts of f, whose output is output, into a
+// zip file in the artifacts directory named after the time of the failure,
+// along with its report, the environment and command, runEnv and cmd, the
+// iteration ran exactly, and its repro script, if any. It removes the loose
+// artifacts, and returns f updated to refer to the bundle.
+func bundleFailure(f failureRecord, output []byte, runEnv, cmd []string, script []byte) (failureRecord, error) {
+	name := fmt.Sprintf("failure-%s-%s.zip", f.Time.Format("20060102T150405"), f.Instance)
+	bundle := uniquePath(filepath.Join(artifactsDir, name))
+	out, err := os.Create(bundle)
+	if err != nil {
+		return f, err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	add := func(name string, data []byte, mode os.FileMode) error {
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: f.Time}
+		fh.SetMode(mode)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	if err := add("output.txt", output, 0o644); err != nil {
+		return f, err
+	}
+	meta := newFailureMetadata(f)
+	meta.Output, meta.Archive = "output.txt", ""
+	if f.Archive != "" {
+		if err := bundleArchive(zw, f.Archive); err != nil {
+			return f, fmt.Errorf("bundling archive: %v", err)
+		}
+		meta.Archive = "archive.tar.gz"
+		if len(bundleInclude) > 0 {
+			meta.Archive = "archive/"
+		}
+	}
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return f, err
+	}
+	if err := add("failure.json", append(b, '\n'), 0o644); err != nil {
+		return f, err
+	}
+	var envText strings.Builder
+	for _, kv := range redactEnv(runEnv) {
+		envText.WriteString(kv + "\n")
+	}
+	if err := add("env.txt", []byte(envText.String()), 0o644); err != nil {
+		return f, err
+	}
+	if err := add("command.sh", bundleScript(f, runEnv, cmd), 0o755); err != nil {
+		return f, err
+	}
+	if script != nil {
+		if err := add("repro.sh", script, 0o755); err != nil {
+			return f, err
+		}
+	}
+	bundled := f
+	bundled.Output, bundled.Archive, bundled.Bundle = "", "", bundle
+	if err := add("report.md", reportText(bundled, output), 0o644); err != nil {
+		return f, err
+	}
+	if err := zw.Close(); err != nil {
+		return f, err
+	}
+	if err := out.Close(); err != nil {
+		return f, err
+	}
+
+	addArtifact(bundle)
+	removeArtifact(f.Output)
+	if f.Archive != "" {
+		removeArtifact(f.Archive)
+	}
+	return bundled, nil
+}
+
+// bundleScript returns a shell script that runs cmd with runEnv the way the
+// iteration of f ran, from the work directory on an instance of its type.
+func bundleScript(f failureRecord, runEnv, cmd []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n# The iteration that failed on %s (%s) at %s, with seed %d.\n", f.Instance, f.InstanceType, f.Time.Format(time.RFC3339), f.Seed)
+	if len(steps) > 0 {
+		fmt.Fprintf(&b, "# It ran after the -step commands, listed in failure.json.\n")
+	}
+	if runDir != "" {
+		fmt.Fprintf(&b, "cd %s || exit\n", swarm.ShellQuote(runDir))
+	}
+	b.WriteString("exec env")
+	for _, kv := range redactEnv(runEnv) {
+		fmt.Fprintf(&b, " \\\n\t%s", swarm.ShellQuote(kv))
+	}
+	b.WriteString(" \\\n\t")
+	for i, arg := range redactArgs(cmd) {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(swarm.ShellQuote(arg))
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// bundleArchive adds the archive at tarName to zw. With -bundle-include,
+// only the matching files in the archive are added, under archive/.
+// Otherwise, the whole archive is added as is.
+func bundleArchive(zw *zip.Writer, tarName string) error {
+	in, err := os.Open(tarName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if len(bundleInclude) == 0 {
+		// The archive is already compressed.
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "archive.tar.gz", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, in)
+		return err
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !bundleIncludes(hdr.Name) {
+			continue
+		}
+		fh := &zip.FileHeader{Name: path.Join("archive", hdr.Name), Method: zip.Deflate, Modified: hdr.ModTime}
+		fh.SetMode(hdr.FileInfo().Mode())
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// bundleIncludes reports whether the archive file name matches any of the
+// -bundle-include patterns, either as a whole or by its base name.
+func bundleIncludes(name string) bool {
+	for _, pat := range bundleInclude {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pat, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// subcommand is one of goswarm's subcommands.
+type subcommand struct {
+	name  string
+	args  string // argument synopsis, for usage messages
+	short string // one-line description
+	flags *flag.FlagSet
+	run   func(args []string) error
+}
+
+// subcommands lists goswarm's subcommands, in the order they're documented.
+// The run subcommand uses the default flag set, since it has the most flags,
+// and is the default if no subcommand is named.
+var subcommands = []*subcommand{
+	{
+		name:  "run",
+		args:  "[instance type] [command]",
+		short: "run a command on a pool of gomotes until it fails",
+		flags: flag.CommandLine,
+		run:   runCmd,
+	},
+	{
+		name:  "resume",
+		args:  "[state file]",
+		short: "resume a previous session from its state file",
+		flags: flag.CommandLine,
+		run:   resumeCmd,
+	},
+	{
+		name:  "repro",
+		args:  "[failure]",
+		short: "rerun a recorded failure with the same configuration and seed",
+		flags: flag.CommandLine,
+		run:   reproCmd,
+	},
+	{
+		name:  "clean",
+		args:  "[instance type]",
+		short: "destroy instances of the given type, or of every type",
+		flags: cleanFlags,
+		run:   cleanCmd,
+	},
+	{
+		name:  "types",
+		args:  "[regexp]",
+		short: "list valid instance types",
+		flags: typesFlags,
+		run:   typesCmd,
+	},
+	{
+		name:  "doctor",
+		short: "check that gomote and the Go tree are ready for a session",
+		flags: doctorFlags,
+		run:   doctorCmd,
+	},
+	{
+		name:  "status",
+		short: "report the status of running sessions",
+		flags: flag.NewFlagSet("status", flag.ExitOnError),
+		run:   func(args []string) error { return printStatus() },
+	},
+	{
+		name:  "resize",
+		args:  "[size] [pid|name]",
+		short: "resize the pool of a running session",
+		flags: flag.NewFlagSet("resize", flag.ExitOnError),
+		run:   resizeSession,
+	},
+	{
+		name:  "pause",
+		args:  "[pid|name]",
+		short: "pause a running session after in-flight iterations",
+		flags: flag.NewFlagSet("pause", flag.ExitOnError),
+		run:   func(args []string) error { return sendSession("pause", args) },
+	},
+	{
+		name:  "unpause",
+		args:  "[pid|name]",
+		short: "unpause a paused session",
+		flags: flag.NewFlagSet("unpause", flag.ExitOnError),
+		run:   func(args []string) error { return sendSession("unpause", args) },
+	},
+	{
+		name:  "history",
+		short: "summarize the failures of past sessions",
+		flags: historyFlags,
+		run:   historyCmd,
+	},
+	{
+		name:  "report",
+		args:  "[state file]",
+		short: "render the session history, or one session, as a self-contained HTML report",
+		flags: htmlReportFlags,
+		run:   htmlReportCmd,
+	},
+	{
+		name:  "keepalive",
+		short: "keep instances parked with -keep-alive alive until they're adopted or their time is up",
+		flags: keepAliveFlags,
+		run:   keepAliveCmd,
+	},
+}
+
+func init() {
+	for _, sub := range subcommands {
+		if sub.flags == flag.CommandLine {
+			continue
+		}
+		sub := sub
+		sub.flags.Usage = func() {
+			w := sub.flags.Output()
+			fmt.Fprintf(w, "Usage: %s %s [flags] %s\n\n", os.Args[0], sub.name, sub.args)
+			fmt.Fprintf(w, "%s %s: %s.\n", os.Args[0], sub.name, sub.short)
+			sub.flags.PrintDefaults()
+		}
+	}
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "goswarm creates a pool of gomotes and executes a command on them until one of them fails.\n\n")
+		fmt.Fprintf(w, "Note that goswarm does not tear down gomotes by default.\n\n")
+		fmt.Fprintf(w, "Usage: %s [run] [flags] [instance type] [command]\n", os.Args[0])
+		fmt.Fprintf(w, "       %s [subcommand] [flags] [args]\n\n", os.Args[0])
+		fmt.Fprintf(w, "Subcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(w, "  %-8s %s\n", sub.name, sub.short)
+		}
+		fmt.Fprintf(w, "\nFlags for run, resume, and repro:\n")
+		flag.PrintDefaults()
+	}
+}
+
+// lookupSubcommand returns the subcommand named by the first argument, and
+// the remaining arguments. If the first argument isn't a subcommand, it's the
+// start of the arguments to run.
+func lookupSubcommand(args []string) (*subcommand, []string) {
+	if len(args) > 0 {
+		for _, sub := range subcommands {
+			if args[0] == sub.name {
+				return sub, args[1:]
+			}
+		}
+	}
+	return subcommands[0], args
+}
+
+var (
+	typesFlags = flag.NewFlagSet("types", flag.ExitOnError)
+	typesJSON  bool
+)
+
+func init() {
+	typesFlags.BoolVar(&typesJSON, "json", false, "print the instance types as JSON")
+}
+
+// typeInfo is an instance type, as reported by the types subcommand.
+type typeInfo struct {
+	Type      string `json:"type"`
+	Instances int    `json:"instances"` // number of instances the user has of this type
+}
+
+func typesCmd(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most one regexp")
+	}
+	var filter *regexp.Regexp
+	if len(args) == 1 {
+		r, err := regexp.Compile(args[0])
+		if err != nil {
+			return fmt.Errorf("compiling regexp: %v", err)
+		}
+		filter = r
+	}
+	if err := setUpGomote(); err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	typs, err := gomote.InstanceTypes(ctx)
+	if err != nil {
+		return err
+	}
+	insts, err := backend.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing instances: %v", err)
+	}
+	count := make(map[string]int)
+	for _, inst := range insts {
+		count[inst.Type]++
+	}
+	infos := []typeInfo{}
+	for _, typ := range typs {
+		if filter != nil && !filter.MatchString(typ) {
+			continue
+		}
+		infos = append(infos, typeInfo{Type: typ, Instances: count[typ]})
+	}
+	if typesJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(infos)
+	}
+	for _, info := range infos {
+		switch info.Instances {
+		case 0:
+			fmt.Println(info.Type)
+		case 1:
+			fmt.Printf("%s (1 instance)\n", info.Type)
+		default:
+			fmt.Printf("%s (%d instances)\n", info.Type, info.Instances)
+		}
+	}
+	return nil
+}
+
+var cleanFlags = flag.NewFlagSet("clean", flag.ExitOnError)
+
+func init() {
+	cleanFlags.DurationVar(&cleanOlderThan, "older-than", 0, "only clean up instances goswarm created at least this long ago")
+	cleanFlags.BoolVar(&cleanUnowned, "unowned", false, "also clean up instances that goswarm did not create")
+	cleanFlags.StringVar(&cleanPrefix, "prefix", "", "only clean up instances whose names start with this prefix")
+	cleanFlags.BoolVar(&dryRun, "n", false, "print the instances that would be destroyed, without destroying them")
+	cleanFlags.StringVar(&configFile, "config", defaultConfigFile(), "configuration file defining instance type aliases")
+}
+
+func cleanCmd(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most an instance type")
+	}
+	if err := setUpGomote(); err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if len(args) == 0 {
+		// Every type: the ownership, age, and prefix filters still apply.
+		return cleanUpInstances(ctx, nil)
+	}
+	typs, err := resolveInstanceTypes(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return cleanUpInstances(ctx, typs)
+}
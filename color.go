@@ -0,0 +1,88 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var colorMode string
+
+func init() {
+	flag.StringVar(&colorMode, "color", "auto", "colorize the console log: auto (if it's a terminal), always, or never")
+}
+
+// useColor reports whether the console log should be colorized.
+func useColor() bool {
+	switch colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI escape sequences.
+const (
+	ansiReset     = "\x1b[0m"
+	ansiRed       = "\x1b[31m"
+	ansiYellow    = "\x1b[33m"
+	ansiMatchFail = "\x1b[1;97;41m" // bold white on red
+)
+
+// instanceColors are the colors used for instance prefixes. Red and yellow
+// are left out, since they're used for problems.
+var instanceColors = []string{
+	"\x1b[32m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[92m", "\x1b[94m", "\x1b[95m", "\x1b[96m",
+}
+
+// instancePrefix returns a short, stably colored prefix identifying inst.
+func instancePrefix(inst string) string {
+	h := fnv.New32a()
+	h.Write([]byte(inst))
+	c := instanceColors[h.Sum32()%uint32(len(instanceColors))]
+	id := inst
+	if i := strings.LastIndexByte(inst, '-'); i >= 0 && i < len(inst)-1 {
+		id = inst[i+1:]
+	}
+	return c + "[" + id + "]" + ansiReset + " "
+}
+
+// colorize decorates a console log message according to the record's
+// level and attributes.
+func colorize(r slog.Record, msg string) string {
+	var inst, failure string
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "instance":
+			inst = a.Value.String()
+		case "failure":
+			failure = a.Value.String()
+		}
+		return true
+	})
+	switch {
+	case failure == "matched":
+		msg = ansiMatchFail + msg + ansiReset
+	case failure != "" || r.Level >= slog.LevelError:
+		msg = ansiRed + msg + ansiReset
+	case r.Level >= slog.LevelWarn:
+		msg = ansiYellow + msg + ansiReset
+	}
+	if inst != "" {
+		msg = instancePrefix(inst) + msg
+	}
+	return msg
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var commandsFile string
+
+func init() {
+	flag.StringVar(&commandsFile, "commands", "", "file of shell commands, one per line, to rotate through on each iteration in place of a command")
+}
+
+// commandList is the list of commands from -commands, if any.
+var commandList []string
+
+// nextCommandIndex is the index of the command for the next iteration.
+var nextCommandIndex struct {
+	sync.Mutex
+	n int
+}
+
+// loadCommands reads the commands from path, skipping blank lines and
+// # comments.
+func loadCommands(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cmds []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmds = append(cmds, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("%s: no commands", path)
+	}
+	return cmds, nil
+}
+
+// iterationCommand returns the command to run on an instance of type typ
+// in the next iteration, and its index in -commands, or -1 without it.
+// Iterations rotate through the commands, so that they all see the same
+// conditions over time.
+func iterationCommand(typ string, cmd []string) (int, []string) {
+	if len(commandList) == 0 {
+		return -1, remoteCommand(typ, cmd)
+	}
+	nextCommandIndex.Lock()
+	i := nextCommandIndex.n % len(commandList)
+	nextCommandIndex.n++
+	nextCommandIndex.Unlock()
+	return i, remoteCommand(typ, shellCommand(typ, commandList[i]))
+}
+
+// recordCommand counts an iteration of the command with index i.
+func (s *session) recordCommand(i int, status swarm.Status) {
+	if i < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perCommand == nil {
+		s.perCommand = make([]instanceCounts, len(commandList))
+	}
+	s.perCommand[i].record(status)
+}
+
+// commandCounts are the results of the iterations of one command of
+// -commands.
+type commandCounts struct {
+	Command string `json:"command"`
+	instanceCounts
+}
+
+// writePerCommand writes the results of each command of -commands.
+func (st *sessionStatus) writePerCommand(w io.Writer) {
+	if len(st.PerCommand) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  by command:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "    command\titerations\tmatched\tunmatched\terrors\n")
+	for _, c := range st.PerCommand {
+		fmt.Fprintf(tw, "    %s\t%d\t%d\t%d\t%d\n", c.Command, c.Iterations, c.Matched, c.Unmatched, c.Errors)
+	}
+	tw.Flush()
+}
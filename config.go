@@ -0,0 +1,246 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	configFile string
+	profile    string
+)
+
+func init() {
+	flag.StringVar(&configFile, "config", defaultConfigFile(), "configuration file defining default flags and named profiles")
+	flag.StringVar(&profile, "profile", "", "named profile from the configuration file to use")
+}
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goswarm", "config.toml")
+}
+
+// config is a parsed configuration file.
+//
+// The configuration file uses a small subset of TOML: tables of keys whose
+// values are strings, numbers, booleans, or single-line arrays of those.
+// Every value is kept as a list of strings; a scalar is a list of one.
+//
+//	# Flags applied to every session.
+//	[defaults]
+//	deflake = 3
+//
+//	# Used with -profile runtime-stress.
+//	[profile.runtime-stress]
+//	type = "linux-amd64"
+//	command = ["go/src/run.bash"]
+//	e = ["GOGC=1", "GODEBUG=gcstoptheworld=1"]
+//	match = "fatal error:"
+//
+//	# Instance type aliases.
+//	[aliases]
+//	linux = "linux-amd64"
+type config map[string]map[string][]string
+
+// userConfig is the configuration loaded from the configuration file.
+var userConfig config
+
+// loadConfig reads the configuration file at path. A missing file is
+// treated as an empty configuration.
+func loadConfig(path string) (config, error) {
+	cfg := make(config)
+	if path == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	table := ""
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed table header", path, n)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if k, err := strconv.Unquote(key); err == nil {
+			key = k
+		}
+		vals, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if cfg[table] == nil {
+			cfg[table] = make(map[string][]string)
+		}
+		cfg[table][key] = vals
+	}
+	return cfg, sc.Err()
+}
+
+// stripComment removes a trailing # comment that isn't inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++ // Skip the escaped character.
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("arrays must be on a single line")
+	}
+	var vals []string
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	for s != "" {
+		var elem string
+		if s[0] == '"' || s[0] == '\'' {
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			elem, s = s[:end+1], s[end+1:]
+		} else if i := strings.IndexByte(s, ','); i >= 0 {
+			elem, s = s[:i], s[i:]
+		} else {
+			elem, s = s, ""
+		}
+		v, err := parseConfigScalar(strings.TrimSpace(elem))
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+		s = strings.TrimSpace(s)
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return vals, nil
+}
+
+// closingQuote returns the index of the quote closing the string at the
+// start of s, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if s[0] == '"' {
+				i++
+			}
+		case s[0]:
+			return i
+		}
+	}
+	return -1
+}
+
+func parseConfigScalar(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : len(s)-1], nil
+	}
+	// Numbers and booleans are passed through as written.
+	return s, nil
+}
+
+// applyConfig applies the default flags and the selected profile from the
+// configuration file to flags, without overriding flags set on the command
+// line. It returns the profile's instance type followed by its command,
+// if any, for use when none are given on the command line.
+func applyConfig(flags *flag.FlagSet, cfg config) ([]string, error) {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	apply := func(table string) error {
+		for key, vals := range cfg[table] {
+			if key == "type" || key == "command" {
+				continue
+			}
+			if flags.Lookup(key) == nil {
+				return fmt.Errorf("[%s]: unknown flag %q", table, key)
+			}
+			if set[key] {
+				continue
+			}
+			for _, v := range vals {
+				if err := flags.Set(key, v); err != nil {
+					return fmt.Errorf("[%s]: %s: %v", table, key, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := apply("defaults"); err != nil {
+		return nil, err
+	}
+	if profile == "" {
+		return nil, nil
+	}
+	table := "profile." + profile
+	p, ok := cfg[table]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", profile)
+	}
+	if err := apply(table); err != nil {
+		return nil, err
+	}
+	var args []string
+	if typ := p["type"]; len(typ) > 0 {
+		args = append(args, typ[0])
+		args = append(args, p["command"]...)
+	}
+	return args, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+# Flags applied to every session.
+[defaults]
+deflake = 3
+keep-going = true # a comment
+match = "fatal error: \"x\" # not a comment"
+"quoted key" = 'C:\work # literal'
+
+[profile.runtime-stress]
+type = "linux-amd64"
+command = ["go/src/run.bash", '-k', "a,b"]
+e = ["GOGC=1", "GODEBUG=gcstoptheworld=1",]
+empty = []
+`)
+	got, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := config{
+		"defaults": {
+			"deflake":    {"3"},
+			"keep-going": {"true"},
+			"match":      {`fatal error: "x" # not a comment`},
+			"quoted key": {`C:\work # literal`},
+		},
+		"profile.runtime-stress": {
+			"type":    {"linux-amd64"},
+			"command": {"go/src/run.bash", "-k", "a,b"},
+			"e":       {"GOGC=1", "GODEBUG=gcstoptheworld=1"},
+			"empty":   nil,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadConfig =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	for _, path := range []string{"", filepath.Join(t.TempDir(), "missing.toml")} {
+		cfg, err := loadConfig(path)
+		if err != nil || len(cfg) != 0 {
+			t.Errorf("loadConfig(%q) = %v, %v, want an empty configuration", path, cfg, err)
+		}
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"[defaults", "config.toml:1: malformed table header"},
+		{"[defaults]\ndeflake", "config.toml:2: expected key = value"},
+		{"deflake =", "missing value"},
+		{`match = "fatal`, "invalid syntax"},
+		{`match = 'fatal`, "unterminated string"},
+		{`e = ["GOGC=1",`, "arrays must be on a single line"},
+		{`e = ["GOGC=1]`, "unterminated string"},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeConfig(t, tt.text))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loadConfig of %q = %v, want an error containing %q", tt.text, err, tt.err)
+		}
+	}
+}
+
+// testFlags returns a flag set like the command line's, for applyConfig.
+func testFlags() (*flag.FlagSet, *uint, *string, *stringSetVar) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	deflake := fs.Uint("deflake", 1, "")
+	match := fs.String("match", "", "")
+	var e stringSetVar
+	fs.Var(&e, "e", "")
+	return fs, deflake, match, &e
+}
+
+func TestApplyConfig(t *testing.T) {
+	cfg := config{
+		"defaults": {
+			"deflake": {"3"},
+			"match":   {"fatal error:"},
+			"e":       {"GOGC=1"},
+		},
+		"profile.stress": {
+			"type":    {"linux-amd64"},
+			"command": {"go", "test", "-short"},
+			"deflake": {"5"},
+			"e":       {"GODEBUG=gcstoptheworld=1"},
+		},
+	}
+	defer func(old string) { profile = old }(profile)
+
+	tests := []struct {
+		name    string
+		profile string
+		args    []string
+		deflake uint
+		match   string
+		e       []string
+		typCmd  []string
+	}{
+		{
+			name:    "defaults",
+			deflake: 3,
+			match:   "fatal error:",
+			e:       []string{"GOGC=1"},
+		},
+		{
+			name:    "flags win over defaults",
+			args:    []string{"-deflake=7", "-e", "GOGC=off"},
+			deflake: 7,
+			match:   "fatal error:",
+			e:       []string{"GOGC=off"},
+		},
+		{
+			name:    "profile wins over defaults",
+			profile: "stress",
+			deflake: 5,
+			match:   "fatal error:",
+			e:       []string{"GOGC=1", "GODEBUG=gcstoptheworld=1"},
+			typCmd:  []string{"linux-amd64", "go", "test", "-short"},
+		},
+		{
+			name:    "flags win over the profile",
+			profile: "stress",
+			args:    []string{"-deflake=7", "-match=panic:"},
+			deflake: 7,
+			match:   "panic:",
+			e:       []string{"GOGC=1", "GODEBUG=gcstoptheworld=1"},
+			typCmd:  []string{"linux-amd64", "go", "test", "-short"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, deflake, match, e := testFlags()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			profile = tt.profile
+			typCmd, err := applyConfig(fs, cfg)
+			if err != nil {
+				t.Fatalf("applyConfig: %v", err)
+			}
+			if *deflake != tt.deflake || *match != tt.match || !slices.Equal(*e, tt.e) {
+				t.Errorf("-deflake=%d -match=%q -e=%q, want -deflake=%d -match=%q -e=%q", *deflake, *match, *e, tt.deflake, tt.match, tt.e)
+			}
+			if !slices.Equal(typCmd, tt.typCmd) {
+				t.Errorf("type and command = %q, want %q", typCmd, tt.typCmd)
+			}
+		})
+	}
+}
+
+func TestApplyConfigError(t *testing.T) {
+	defer func(old string) { profile = old }(profile)
+	tests := []struct {
+		name    string
+		cfg     config
+		profile string
+		err     string
+	}{
+		{
+			name: "unknown flag",
+			cfg:  config{"defaults": {"deflakes": {"3"}}},
+			err:  `[defaults]: unknown flag "deflakes"`,
+		},
+		{
+			name:    "unknown flag in profile",
+			cfg:     config{"profile.stress": {"nope": {"1"}}},
+			profile: "stress",
+			err:     `[profile.stress]: unknown flag "nope"`,
+		},
+		{
+			name: "bad value",
+			cfg:  config{"defaults": {"deflake": {"three"}}},
+			err:  "[defaults]: deflake: ",
+		},
+		{
+			name:    "unknown profile",
+			cfg:     config{},
+			profile: "stress",
+			err:     `unknown profile "stress"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _, _, _ := testFlags()
+			profile = tt.profile
+			_, err := applyConfig(fs, tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("applyConfig = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
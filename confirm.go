@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+var (
+	cleanForce       bool
+	cleanConfirmOver uint
+)
+
+func init() {
+	flag.BoolVar(&cleanForce, "clean-force", false, "with -clean=start or -clean=always, clean up without asking for confirmation")
+	flag.UintVar(&cleanConfirmOver, "clean-confirm-over", 10, "with -clean=start or -clean=always, ask for confirmation before destroying more than this many instances")
+	cleanFlags.BoolVar(&cleanForce, "force", false, "destroy instances without asking for confirmation")
+	cleanFlags.UintVar(&cleanConfirmOver, "confirm-over", 10, "ask for confirmation before destroying more than this many instances")
+}
+
+// confirmCleanup asks for confirmation before destroying doomed, if there
+// are more than -confirm-over of them or unowned of them weren't created by
+// goswarm, since they may well be someone's debugging gomotes. Without a
+// terminal to ask on, it refuses unless -force is set.
+func confirmCleanup(doomed []gomote.Instance, unowned int) error {
+	if cleanForce || (len(doomed) <= int(cleanConfirmOver) && unowned == 0) {
+		return nil
+	}
+	what := fmt.Sprintf("%d instances", len(doomed))
+	if unowned > 0 {
+		what += fmt.Sprintf(" (%d not created by goswarm)", unowned)
+	}
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("refusing to destroy %s without confirmation; pass -force, or -clean-force for -clean, to go ahead", what)
+	}
+	for _, inst := range doomed {
+		fmt.Fprintf(os.Stderr, "  %s (%s)\n", inst.Name, inst.Type)
+	}
+	fmt.Fprintf(os.Stderr, "Destroy %s? [y/N] ", what)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not destroying %s", what)
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The control socket lets other goswarm processes (e.g. `goswarm status`)
+// talk to a running session. Every session listens on a Unix socket named
+// after its PID in controlDir. The protocol is a single line containing a
+// command, answered with a single JSON-encoded controlResponse.
+
+type controlResponse struct {
+	Error  string         `json:"error,omitempty"`
+	Status *sessionStatus `json:"status,omitempty"`
+}
+
+func controlDir() string {
+	return filepath.Join(os.TempDir(), "goswarm")
+}
+
+// listenControl starts serving the control socket for the current session.
+// The returned function closes the socket and removes it.
+func listenControl() (func(), error) {
+	dir := controlDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	os.Remove(path) // Left over from a previous process with the same PID.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(c)
+		}
+	}()
+	return func() {
+		l.Close()
+		os.Remove(path)
+	}, nil
+}
+
+func serveControl(c net.Conn) {
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+	var resp controlResponse
+	switch cmd := strings.Fields(line); {
+	case len(cmd) == 0:
+		resp.Error = "empty command"
+	case cmd[0] == "status":
+		resp.Status = sess.status()
+	case cmd[0] == "resize":
+		n := 0
+		if len(cmd) == 2 {
+			n, _ = strconv.Atoi(cmd[1])
+		}
+		if n < 1 {
+			resp.Error = "resize requires a positive pool size"
+			break
+		}
+		p := sess.currentPool()
+		if p == nil {
+			resp.Error = "pool not started yet"
+			break
+		}
+		log.Printf("Resizing pool to %d instances.", n)
+		p.Resize(n)
+	case cmd[0] == "pause":
+		log.Printf("Pausing the swarm after in-flight iterations complete.")
+		sess.gate.pause()
+	case cmd[0] == "unpause":
+		log.Printf("Unpausing the swarm.")
+		sess.gate.resume()
+	default:
+		resp.Error = fmt.Sprintf("unknown command %q", cmd[0])
+	}
+	if err := json.NewEncoder(c).Encode(&resp); err != nil {
+		log.Printf("Error responding to control command: %v", err)
+	}
+}
+
+// sendControl sends cmd to the session listening on the socket at path.
+func sendControl(path, cmd string) (*controlResponse, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if _, err := fmt.Fprintln(c, cmd); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// controlSockets returns the control sockets of all running sessions,
+// removing any stale sockets it finds along the way. A socket is only
+// stale once the process it is named after is gone: a session too busy to
+// answer straight away still owns its socket.
+func controlSockets() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(controlDir(), "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, path := range paths {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			pid, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".sock"))
+			if err == nil && !processAlive(pid) {
+				os.Remove(path)
+			}
+			continue
+		}
+		c.Close()
+		live = append(live, path)
+	}
+	return live, nil
+}
+
+// printStatus reports the status of every running session.
+func printStatus() error {
+	paths, err := controlSockets()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no running goswarm sessions found")
+	}
+	for _, path := range paths {
+		resp, err := sendControl(path, "status")
+		if err != nil {
+			return fmt.Errorf("querying %s: %v", path, err)
+		}
+		resp.Status.write(os.Stdout)
+	}
+	return nil
+}
+
+// resizeSession implements `goswarm resize size [pid|name]`.
+func resizeSession(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: goswarm resize size [pid|name]")
+	}
+	path, err := findSession(args[1:])
+	if err != nil {
+		return err
+	}
+	_, err = sendControl(path, "resize "+args[0])
+	return err
+}
+
+// sendSession implements simple commands of the form `goswarm cmd [pid|name]`.
+func sendSession(cmd string, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: goswarm %s [pid|name]", cmd)
+	}
+	path, err := findSession(args)
+	if err != nil {
+		return err
+	}
+	_, err = sendControl(path, cmd)
+	return err
+}
+
+// findSession returns the control socket of the session identified by args,
+// which is either empty or a single PID or -name. If neither is given, there
+// must be exactly one running session.
+func findSession(args []string) (string, error) {
+	if len(args) == 1 {
+		if _, err := strconv.Atoi(args[0]); err == nil {
+			return filepath.Join(controlDir(), args[0]+".sock"), nil
+		}
+	}
+	paths, err := controlSockets()
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 1 {
+		for _, path := range paths {
+			resp, err := sendControl(path, "status")
+			if err == nil && resp.Status.Name == args[0] {
+				return path, nil
+			}
+		}
+		return "", fmt.Errorf("no running goswarm session named %s", args[0])
+	}
+	switch len(paths) {
+	case 0:
+		return "", fmt.Errorf("no running goswarm sessions found")
+	case 1:
+		return paths[0], nil
+	}
+	return "", fmt.Errorf("found %d running goswarm sessions, please specify a PID or name", len(paths))
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestControlSocketsStale(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	dir := controlDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	// None of these answer, but only the dead session's socket is stale.
+	dead := filepath.Join(dir, strconv.Itoa(deadPID(t))+".sock")
+	busy := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	odd := filepath.Join(dir, "odd.sock")
+	for _, path := range []string{dead, busy, odd} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live, err := controlSockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 0 {
+		t.Errorf("controlSockets = %q, want none", live)
+	}
+	if _, err := os.Stat(dead); !os.IsNotExist(err) {
+		t.Errorf("socket of exited session not removed: %v", err)
+	}
+	for _, path := range []string{busy, odd} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("socket removed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+var (
+	daemon    bool
+	daemonLog string
+)
+
+func init() {
+	flag.BoolVar(&daemon, "daemon", false, "run detached from the terminal; use 'goswarm status' to check on the session")
+	flag.StringVar(&daemonLog, "daemon-log", "goswarm.log", "file to which a detached session writes its log")
+}
+
+// daemonEnv is set in the environment of the detached child process so that
+// it knows not to detach again.
+const daemonEnv = "GOSWARM_DAEMONIZED"
+
+// detach re-executes goswarm in the background with the same arguments,
+// its output redirected to daemonLog.
+func detach() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(daemonLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("goswarm running in the background as PID %d, logging to %s.\n", cmd.Process.Pid, daemonLog)
+	fmt.Printf("Use `%s status` to check on it.\n", os.Args[0])
+	return cmd.Process.Release()
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix && !windows
+
+package main
+
+import "syscall"
+
+func detachAttr() *syscall.SysProcAttr {
+	return nil
+}
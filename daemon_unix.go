@@ -0,0 +1,14 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import "syscall"
+
+func detachAttr() *syscall.SysProcAttr {
+	// Start a new session so the child survives the terminal going away.
+	return &syscall.SysProcAttr{Setsid: true}
+}
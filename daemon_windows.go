@@ -0,0 +1,20 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "syscall"
+
+// detachedProcess is DETACHED_PROCESS, which isn't in package syscall.
+const detachedProcess = 0x00000008
+
+func detachAttr() *syscall.SysProcAttr {
+	// Leave the console, so that closing it doesn't take the session with
+	// it, and start a new process group, so that Ctrl-C and Ctrl-Break in
+	// it don't either.
+	return &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	flakeRate  float64
+	confidence float64
+)
+
+func init() {
+	flag.Float64Var(&flakeRate, "flake-rate", 0, "assumed probability that an iteration reproduces the failure, for estimating the chance of detection (0 measures it from matching failures)")
+	flag.Float64Var(&confidence, "confidence", 0.95, "target probability of detection for the time estimate")
+}
+
+// detection estimates how likely the session is to have observed the failure
+// by now, and how long until it reaches the target confidence. It returns an
+// empty string if there's no flake rate to base the estimate on.
+func (st *sessionStatus) detection() string {
+	n := st.iterations()
+	p, how := flakeRate, "assumed"
+	if p <= 0 {
+		matched := st.Results[swarm.FailMatched.String()]
+		if matched == 0 || n == 0 {
+			return ""
+		}
+		p, how = float64(matched)/float64(n), "measured"
+	}
+	if p >= 1 {
+		return ""
+	}
+	prob := 1 - math.Pow(1-p, float64(n))
+	msg := fmt.Sprintf("%.1f%% chance of detection so far (%s flake rate 1 in %.0f)", 100*prob, how, 1/p)
+	if confidence <= 0 || confidence >= 1 {
+		return msg + "."
+	}
+	target := int(math.Ceil(math.Log(1-confidence) / math.Log(1-p)))
+	if n >= target {
+		return msg + fmt.Sprintf(", past %.0f%% confidence.", 100*confidence)
+	}
+	perIter := time.Since(st.Start) / time.Duration(max(n, 1))
+	eta := time.Duration(target-n) * perIter
+	return msg + fmt.Sprintf(", %.0f%% confidence in about %s (%d more iterations).", 100*confidence, eta.Round(time.Second), target-n)
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"path"
+)
+
+var (
+	runDir  string
+	runArgs stringSetVar
+)
+
+func init() {
+	flag.StringVar(&runDir, "dir", "", "directory to run the command in, relative to the instance's work directory, like go/src")
+	flag.Var(&runArgs, "run-arg", "flag to pass verbatim to every gomote run, like -system or -path=$WORKDIR/go/bin,$PATH, may be specified multiple times")
+}
+
+// inRunDir returns cmd, made to run in -dir on backends that can't do that
+// themselves.
+func inRunDir(cmd []string) []string {
+	if runDir == "" || backendName == "gomote" {
+		return cmd
+	}
+	return append([]string{"/bin/sh", "-c", `cd "$1" && shift && exec "$@"`, "sh", runDir}, cmd...)
+}
+
+// runDirPath returns the path of name in -dir, relative to the instance's
+// work directory.
+func runDirPath(name string) string {
+	if runDir == "" {
+		return name
+	}
+	return path.Join(runDir, name)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	minFreeDisk       uint
+	diskCheckInterval time.Duration
+)
+
+func init() {
+	flag.UintVar(&minFreeDisk, "min-free-disk", 0, "recycle instances whose work directory has less than this many MiB of free disk space (0 disables the check)")
+	flag.DurationVar(&diskCheckInterval, "disk-check-interval", 10*time.Minute, "how often to check free disk space with -min-free-disk")
+}
+
+// diskMonitor periodically checks the free disk space on an instance.
+type diskMonitor struct {
+	inst     string
+	next     time.Time
+	disabled bool
+}
+
+// check returns a recycleError if it's time to check inst's free disk
+// space and there's too little of it left.
+func (d *diskMonitor) check(ctx context.Context) error {
+	if minFreeDisk == 0 || d.disabled || time.Now().Before(d.next) {
+		return nil
+	}
+	d.next = time.Now().Add(diskCheckInterval)
+	dr, ok := backend.(swarm.DiskReporter)
+	if !ok {
+		log.Printf("The %s backend can't check free disk space, disabling the check.", backendName)
+		d.disabled = true
+		return nil
+	}
+	free, err := dr.FreeDisk(ctx, d.inst)
+	if err != nil {
+		// Most likely the instance doesn't have df, so don't bother
+		// trying again.
+		log.Printf("Unable to check free disk space on %s, disabling the check: %v", d.inst, unwrap(err))
+		d.disabled = true
+		return nil
+	}
+	if mib := free >> 20; mib < int64(minFreeDisk) {
+		return &recycleError{d.inst, fmt.Sprintf("%d MiB of disk space left", mib)}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+var doctorFlags = flag.NewFlagSet("doctor", flag.ExitOnError)
+
+func init() {
+	doctorFlags.StringVar(&gorootDir, "goroot", "", "Go tree to check, overriding $GOROOT")
+}
+
+// checkResult is the outcome of one of doctor's checks.
+type checkResult struct {
+	name   string
+	status string // ok, warn, or FAIL
+	detail string
+}
+
+// doctorCmd checks that goswarm's environment is ready for a session, and
+// reports the outcome of every check.
+func doctorCmd(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	if err := setUpGomote(); err != nil {
+		return usageErrorf("%v", err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	results := runDoctor(ctx)
+	failed := writeChecks(os.Stdout, results)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// runDoctor runs each check in turn, skipping those that can't pass once an
+// earlier one has failed.
+func runDoctor(ctx context.Context) []checkResult {
+	var results []checkResult
+	add := func(name, status, format string, args ...any) {
+		results = append(results, checkResult{name, status, fmt.Sprintf(format, args...)})
+	}
+
+	path, err := exec.LookPath("gomote")
+	if err != nil {
+		add("gomote", "FAIL", "not found in $PATH; install it with %s", gomoteInstall)
+	} else {
+		add("gomote", "ok", "%s", path)
+		if v := gomoteVersion(ctx, path); v != "" {
+			add("gomote version", "ok", "%s", v)
+		} else {
+			add("gomote version", "warn", "unknown; if anything fails, update gomote with %s", gomoteInstall)
+		}
+
+		start := time.Now()
+		insts, err := backend.List(ctx)
+		took := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			err = gomoteProblem(err)
+		}
+		switch {
+		case err == nil:
+			add("connectivity", "ok", "gomote list took %s", took)
+			add("authentication", "ok", "gomote list succeeded")
+			add("instances", "ok", "%d in use", len(insts))
+		case errors.Is(err, errGomoteAuth):
+			add("connectivity", "ok", "reached the coordinator")
+			add("authentication", "FAIL", "%v", err)
+		default:
+			add("connectivity", "FAIL", "%v", err)
+		}
+	}
+
+	goroot, err := pushRoot()
+	switch {
+	case err != nil:
+		add("GOROOT", "FAIL", "-goroot: %v", err)
+	case goroot == "":
+		add("GOROOT", "warn", "neither -goroot nor $GOROOT is set, so there's no Go tree to push")
+	default:
+		if err := checkGOROOT(ctx, goroot); err != nil {
+			add("GOROOT", "FAIL", "%v", err)
+		} else {
+			add("GOROOT", "ok", "%s", goroot)
+		}
+	}
+	return results
+}
+
+// gomoteVersion returns the version of the golang.org/x/build module the
+// gomote binary at path was built from, or "" if it can't tell.
+func gomoteVersion(ctx context.Context, path string) string {
+	out, err := exec.CommandContext(ctx, "go", "version", "-m", path).Output()
+	if err != nil {
+		return ""
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		// Lines look like "\tmod\tgolang.org/x/build\tv0.0.0-...\th1:...".
+		f := strings.Fields(sc.Text())
+		if len(f) >= 3 && f[0] == "mod" && f[1] == "golang.org/x/build" {
+			return f[2]
+		}
+	}
+	return ""
+}
+
+// writeChecks writes results as a checklist, and returns the number of
+// failed checks.
+func writeChecks(w io.Writer, results []checkResult) int {
+	failed := 0
+	for _, r := range results {
+		detail := strings.ReplaceAll(r.detail, "\n", "\n      ")
+		fmt.Fprintf(w, "%-5s %s: %s\n", r.status, r.name, detail)
+		if r.status == "FAIL" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var dryRun bool
+
+func init() {
+	flag.BoolVar(&dryRun, "n", false, "print the gomote operations that would be performed, without performing them")
+}
+
+// printPlan describes the gomote operations a session would perform.
+func printPlan(w io.Writer, typs []string, cmd []string, adoptable int) {
+	if precheck != "" {
+		fmt.Fprintf(w, "# check locally first\n%s\n", precheck)
+	}
+	if len(gomoteFlags) > 0 || len(gomoteEnv) > 0 {
+		var args []string
+		for _, v := range gomoteEnv {
+			args = append(args, swarm.ShellQuote(v))
+		}
+		args = append(args, "gomote")
+		for _, f := range gomoteFlags {
+			args = append(args, swarm.ShellQuote(f))
+		}
+		fmt.Fprintf(w, "# every gomote below runs as: %s\n", strings.Join(args, " "))
+	}
+	creates := int(instances) - adoptable
+	if creates < 0 {
+		creates = 0
+	}
+	if adoptable > 0 {
+		fmt.Fprintf(w, "# adopt up to %d existing instances of %s\n", adoptable, strings.Join(typs, ", "))
+	}
+	switch {
+	case len(typs) == 1:
+		fmt.Fprintf(w, "# create %d instances\n", creates)
+	case len(typeWeights) > 0:
+		fmt.Fprintf(w, "# create %d instances, spread across types by weight\n", creates)
+		writeTypeWeight(w, typs)
+		writeTypeMax(w, typs)
+	default:
+		fmt.Fprintf(w, "# create %d instances, spread evenly across types\n", creates)
+		writeTypeMax(w, typs)
+	}
+	createArgs := typeCreateArgs()
+	for _, typ := range typs {
+		args := []string{"gomote", "create"}
+		for _, a := range createArgs[typ] {
+			args = append(args, swarm.ShellQuote(a))
+		}
+		args = append(args, swarm.ShellQuote(typ))
+		fmt.Fprintln(w, strings.Join(args, " "))
+	}
+	goroot, _ := pushRoot()
+	if goroot == "" {
+		goroot = "(unset)"
+	}
+	fmt.Fprintf(w, "# push GOROOT=%s to each instance\n", goroot)
+	fmt.Fprintf(w, "gomote push $INSTANCE\n")
+	for _, typ := range typs {
+		if !typePush(typ) {
+			fmt.Fprintf(w, "# but not to %s instances\n", typ)
+		}
+	}
+	for _, typ := range typs {
+		if typeBootstrap(typ) {
+			fmt.Fprintf(w, "# push a bootstrap toolchain to each %s instance\n", typ)
+			fmt.Fprintf(w, "gomote putbootstrap $INSTANCE\n")
+		}
+	}
+	for _, up := range uploads() {
+		fmt.Fprintf(w, "gomote put -mode=%o $INSTANCE %s %s\n", up.mode, swarm.ShellQuote(up.src), swarm.ShellQuote(up.dst))
+	}
+	for _, typ := range typs {
+		if setup := typeSetup(typ); len(setup) > 0 {
+			fmt.Fprintf(w, "# set up each %s instance\n", typ)
+			for _, s := range setup {
+				printRun(w, nil, inRunDir(shellCommand(typ, s)))
+			}
+		}
+	}
+	if makeGo {
+		fmt.Fprintf(w, "# build Go on each instance\n")
+		printRun(w, append(typeEnv(typs[0]), env...), inRunDir(makeCommand(typs[0])))
+	}
+	cmds := [][]string{remoteCommand(typs[0], cmd)}
+	if len(commandList) > 0 {
+		fmt.Fprintf(w, "# run on each instance in a loop, rotating through the commands\n")
+		cmds = nil
+		for _, c := range commandList {
+			cmds = append(cmds, remoteCommand(typs[0], shellCommand(typs[0], c)))
+		}
+	} else {
+		fmt.Fprintf(w, "# run on each instance in a loop\n")
+	}
+	var stepCmds [][]string
+	for _, step := range steps {
+		stepCmds = append(stepCmds, shellCommand(typs[0], step))
+	}
+	cmds = append(stepCmds, cmds...)
+	for _, cmd := range cmds {
+		printRun(w, append(typeEnv(typs[0]), env...), cmd)
+	}
+	switch {
+	case errMatch != "" && matchExit != "":
+		fmt.Fprintf(w, "# on failures matching %s with exit code %s:\n", swarm.ShellQuote(errMatch), matchExit)
+	case errMatch != "":
+		fmt.Fprintf(w, "# on failures matching %s:\n", swarm.ShellQuote(errMatch))
+	case matchExit != "":
+		fmt.Fprintf(w, "# on failures with exit code %s:\n", matchExit)
+	default:
+		fmt.Fprintf(w, "# on any failure:\n")
+	}
+	switch {
+	case noArchive:
+		fmt.Fprintf(w, "# save the output, without an archive (-no-archive)\n")
+	case fetchReferenced:
+		fmt.Fprintf(w, "# archive each directory in the work directory that the output mentions\n")
+		fmt.Fprintf(w, "gomote gettar -dir=$DIR $INSTANCE > $INSTANCE.tar.gz\n")
+	default:
+		fmt.Fprintf(w, "gomote gettar $INSTANCE > $INSTANCE.tar.gz\n")
+	}
+	if clean.AtExit() {
+		fmt.Fprintf(w, "# on exit\n")
+		fmt.Fprintf(w, "gomote destroy $INSTANCE\n")
+	}
+}
+
+// printRun prints the gomote run of cmd on each instance, with env.
+func printRun(w io.Writer, env, cmd []string) {
+	args := []string{"gomote", "run"}
+	for _, v := range redactEnv(env) {
+		args = append(args, "-e", swarm.ShellQuote(v))
+	}
+	if runDir != "" {
+		args = append(args, "-dir", swarm.ShellQuote(runDir))
+	}
+	for _, a := range runArgs {
+		args = append(args, swarm.ShellQuote(a))
+	}
+	args = append(args, "$INSTANCE")
+	for _, c := range cmd {
+		args = append(args, swarm.ShellQuote(c))
+	}
+	fmt.Fprintln(w, strings.Join(args, " "))
+}
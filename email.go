@@ -0,0 +1,71 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	notifyEmail stringSetVar
+	smtpServer  string
+	smtpFrom    string
+	smtpUser    string
+)
+
+func init() {
+	flag.Var(&notifyEmail, "notify-email", "an email address to notify when a matching failure is found and when the session ends, may be specified multiple times")
+	flag.StringVar(&smtpServer, "smtp-server", "localhost:25", "SMTP server (host:port) through which to send -notify-email notifications")
+	flag.StringVar(&smtpFrom, "smtp-from", "", "sender address for -notify-email notifications (default the first recipient)")
+	flag.StringVar(&smtpUser, "smtp-user", "", "user name for SMTP authentication; the password is read from $GOSWARM_SMTP_PASSWORD")
+}
+
+// sendEmail emails n to the -notify-email recipients.
+func sendEmail(n notification) error {
+	from := smtpFrom
+	if from == "" {
+		from = notifyEmail[0]
+	}
+	subject := fmt.Sprintf("goswarm: session on %s ended", n.Type)
+	if n.Event == "failure" {
+		subject = fmt.Sprintf("goswarm: matching failure on %s", n.Instance)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(notifyEmail, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Command: %s\r\n", strings.Join(n.Command, " "))
+	if n.Match != "" {
+		fmt.Fprintf(&msg, "Match: %s\r\n", n.Match)
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	if len(n.Artifacts) > 0 {
+		fmt.Fprintf(&msg, "\r\nArtifacts:\r\n")
+		for _, a := range n.Artifacts {
+			fmt.Fprintf(&msg, "  %s\r\n", a)
+		}
+	}
+
+	var auth smtp.Auth
+	if smtpUser != "" {
+		host, _, err := net.SplitHostPort(smtpServer)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", smtpUser, os.Getenv("GOSWARM_SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(smtpServer, auth, from, notifyEmail, msg.Bytes())
+}
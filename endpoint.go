@@ -0,0 +1,43 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+var (
+	gomoteFlags stringSetVar
+	gomoteEnv   stringSetVar
+)
+
+func init() {
+	// Every subcommand that runs gomote needs to reach the same
+	// coordinator or swarming instance.
+	for _, fs := range []*flag.FlagSet{flag.CommandLine, cleanFlags, typesFlags, doctorFlags, keepAliveFlags} {
+		fs.Var(&gomoteFlags, "gomote-flag", "flag to pass to every gomote invocation, before the subcommand, like one selecting a non-default coordinator or swarming instance, may be specified multiple times")
+		fs.Var(&gomoteEnv, "gomote-env", "environment variable to set, as KEY=VALUE, for every gomote invocation, may be specified multiple times")
+	}
+}
+
+// setUpGomote forwards -gomote-flag and -gomote-env to every gomote
+// invocation, and traces them with -x.
+func setUpGomote() error {
+	for _, v := range gomoteEnv {
+		if !strings.Contains(v, "=") {
+			return fmt.Errorf("-gomote-env: %q is not of the form KEY=VALUE", v)
+		}
+	}
+	gomote.GlobalFlags = gomoteFlags
+	gomote.Env = gomoteEnv
+	if traceGomote {
+		gomote.Trace = printGomoteCommand
+	}
+	return nil
+}
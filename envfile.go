@@ -0,0 +1,72 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var envFile string
+
+func init() {
+	flag.StringVar(&envFile, "env-file", "", "file of VAR=value lines to add to the environment of every run, as if passed with -e, which overrides them, as does -e-passthrough; blank lines and # comments are skipped")
+}
+
+// loadEnvFile reads the variables from path, a .env file: VAR=value lines,
+// optionally preceded by export, with the value optionally quoted, skipping
+// blank lines and # comments.
+func loadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vars []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected VAR=value", path, n)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			value = v
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, name+"="+value)
+	}
+	return vars, sc.Err()
+}
+
+// applyEnvFile adds the variables of -env-file to the start of env, so
+// that -e and -e-passthrough override them.
+func applyEnvFile() error {
+	if envFile == "" {
+		return nil
+	}
+	vars, err := loadEnvFile(envFile)
+	if err != nil {
+		return err
+	}
+	env = append(vars, env...)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Exit codes, so that goswarm can be scripted.
+const (
+	exitFound    = 0 // a matching failure was found (or a subcommand succeeded)
+	exitNotFound = 1 // no matching failure was found within the session's limits
+	exitUsage    = 2 // bad flags or arguments
+	exitInfra    = 3 // goswarm couldn't do its job, for example due to gomote errors
+)
+
+var quietArtifacts bool
+
+func init() {
+	flag.BoolVar(&quietArtifacts, "q", false, "log nothing, and print only the paths of the artifacts of matching failures to stdout")
+}
+
+// exitError is an error with a specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// usageErrorf returns an error for a mistake on the command line.
+func usageErrorf(format string, args ...interface{}) error {
+	return &exitError{exitUsage, fmt.Errorf(format, args...)}
+}
+
+// notFoundErrorf returns an error for a session that didn't find a
+// matching failure.
+func notFoundErrorf(format string, args ...interface{}) error {
+	return &exitError{exitNotFound, fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit code for err, returned by a subcommand.
+// Errors without a specific exit code are assumed to be problems talking
+// to gomote, or with the local system.
+func exitCode(err error) int {
+	if err == nil {
+		return exitFound
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return exitInfra
+}
+
+// printArtifacts prints the paths of the artifacts of every matching
+// failure in the session, one per line, for -q.
+func printArtifacts(w io.Writer) {
+	for _, f := range sess.status().Failures {
+		for _, path := range f.artifacts() {
+			fmt.Fprintln(w, path)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var exportFile string
+
+func init() {
+	flag.StringVar(&exportFile, "export", "", "append a row for every iteration to this file, as newline-delimited JSON ready to load into BigQuery (see the README for the schema)")
+}
+
+// exportRow is a row of -export: an iteration. Its schema is documented in
+// the README.
+type exportRow struct {
+	Session      string    `json:"session"`
+	SessionName  string    `json:"session_name,omitempty"`
+	SessionStart time.Time `json:"session_start"`
+	Host         string    `json:"host"`
+	Command      string    `json:"command"`
+	Commit       string    `json:"goroot_commit,omitempty"`
+	Instance     string    `json:"instance"`
+	InstanceType string    `json:"instance_type"`
+	Iteration    int       `json:"iteration"`
+	Seed         int64     `json:"seed"`
+	Start        time.Time `json:"start"`
+	Duration     float64   `json:"duration_seconds"`
+	Outcome      string    `json:"outcome"` // pass, unmatched, matched, or error
+	Signature    string    `json:"signature,omitempty"`
+	Shuffle      int64     `json:"shuffle_seed,omitempty"` // with -shuffle
+	GODEBUG      string    `json:"godebug,omitempty"`      // with -godebug-fuzz
+}
+
+// exportSchema is the BigQuery schema of exportRow, in the inline form bq
+// load accepts.
+const exportSchema = "session:STRING,session_name:STRING,session_start:TIMESTAMP,host:STRING,command:STRING,goroot_commit:STRING,instance:STRING,instance_type:STRING,iteration:INTEGER,seed:INTEGER,start:TIMESTAMP,duration_seconds:FLOAT,outcome:STRING,signature:STRING,shuffle_seed:INTEGER,godebug:STRING"
+
+// exportOut is the open -export file, if any, and what every row of the
+// session shares.
+var exportOut struct {
+	sync.Mutex
+	f    *os.File
+	base exportRow
+
+	// sigs are the signatures of the failing iterations still running on
+	// each instance.
+	sigs map[string]string
+}
+
+// openExport starts exporting iterations with -export. The returned
+// function stops.
+func openExport(cmd []string) (stop func(), err error) {
+	if exportFile == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(exportFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	start := time.Now()
+	exportOut.f = f
+	exportOut.sigs = make(map[string]string)
+	exportOut.base = exportRow{
+		Session:      fmt.Sprintf("%s-%d-%s", host, os.Getpid(), start.UTC().Format("20060102T150405")),
+		SessionName:  sessionName,
+		SessionStart: start,
+		Host:         host,
+		Command:      redactString(strings.Join(cmd, " ")),
+	}
+	if goroot, _ := pushRoot(); goroot != "" {
+		exportOut.base.Commit, _ = gorootCommit(goroot)
+	}
+	log.Printf("Exporting iterations to %s; load them into BigQuery with\n\tbq load --source_format=NEWLINE_DELIMITED_JSON DATASET.TABLE %s %s", exportFile, exportFile, exportSchema)
+	return func() {
+		exportOut.Lock()
+		defer exportOut.Unlock()
+		if err := exportOut.f.Close(); err != nil {
+			log.Printf("Failed to write %s: %v", exportFile, err)
+		}
+		exportOut.f = nil
+	}, nil
+}
+
+// noteSignature notes the output of the failing iteration running on inst,
+// whose signature its row is to have.
+func noteSignature(inst string, output []byte) {
+	if exportFile == "" {
+		return
+	}
+	exportOut.Lock()
+	defer exportOut.Unlock()
+	if exportOut.sigs != nil {
+		exportOut.sigs[inst] = signatureString(failureSignature(inst, output))
+	}
+}
+
+// exportIteration exports the iteration of data, which started at start
+// and ended with status.
+func exportIteration(data templateData, start time.Time, status swarm.Status) {
+	if exportFile == "" {
+		return
+	}
+	exportOut.Lock()
+	defer exportOut.Unlock()
+	if exportOut.f == nil {
+		return
+	}
+	row := exportOut.base
+	row.Instance = data.Instance
+	row.InstanceType = data.Type
+	row.Iteration = data.Iteration
+	row.Seed = data.Seed
+	row.Start = start
+	row.Duration = time.Since(start).Seconds()
+	row.Outcome = status.String()
+	row.Signature = exportOut.sigs[data.Instance]
+	row.Shuffle = shuffleSeed(data.Seed)
+	row.GODEBUG = godebugFor(data.Seed)
+	delete(exportOut.sigs, data.Instance)
+	b, err := json.Marshal(row)
+	if err != nil {
+		log.Printf("Failed to export iteration: %v", err)
+		return
+	}
+	exportOut.f.Write(append(b, '\n'))
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var fetchReferenced bool
+
+func init() {
+	flag.BoolVar(&fetchReferenced, "fetch-referenced", false, "on matching failures, rather than archive the instance's whole work directory, archive just the directories of the paths in it that the failure's output mentions, like test temporary directories and profiles")
+}
+
+// maxFetchDirs is how many directories -fetch-referenced archives.
+const maxFetchDirs = 20
+
+// outputPathRe matches absolute paths, Unix or Windows, in a command's
+// output.
+var outputPathRe = regexp.MustCompile("(?:[A-Za-z]:)?[/\\\\][^\\s\"'`,;:()<>\\[\\]=]+")
+
+// referencedDirs returns the directories, relative to the work directory of
+// the instance that produced output, of the paths in it output mentions,
+// leaving out those in the pushed GOROOT, goroot. The work directory is
+// recognized by paths into the pushed GOROOT, as in stack traces. It
+// returns nil if there are none.
+func referencedDirs(output []byte, goroot string) []string {
+	var paths []string
+	workDir := ""
+	for _, m := range outputPathRe.FindAll(output, -1) {
+		p := strings.TrimRight(strings.ReplaceAll(string(m), `\`, "/"), ".")
+		paths = append(paths, p)
+		if i := strings.Index(p, remoteGOROOTSrc); i >= 0 && workDir == "" {
+			workDir = p[:i]
+		}
+	}
+	if workDir == "" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, p := range paths {
+		rel, ok := strings.CutPrefix(p, workDir+"/")
+		if !ok {
+			continue
+		}
+		rel = path.Clean(rel)
+		if r, ok := strings.CutPrefix(rel, "go/"); ok {
+			if _, err := os.Stat(filepath.Join(goroot, filepath.FromSlash(r))); err == nil {
+				// Pushed, not written by the command.
+				continue
+			}
+		}
+		// The path may be a file, which can't be archived by itself.
+		dir := path.Dir(rel)
+		if dir == "." || dir == "go" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	// Leave out directories within others.
+	sort.Strings(dirs)
+	var outer []string
+	for _, d := range dirs {
+		if len(outer) > 0 && strings.HasPrefix(d, outer[len(outer)-1]+"/") {
+			continue
+		}
+		outer = append(outer, d)
+	}
+	return outer[:min(len(outer), maxFetchDirs)]
+}
+
+// downloadReferenced is downloadArchive for just the directories of inst's
+// work directory that output, from a matching failure, refers to.
+func downloadReferenced(ctx context.Context, inst, name string, output []byte) (path, note string, err error) {
+	goroot, _ := pushRoot()
+	dirs := referencedDirs(output, goroot)
+	if len(dirs) == 0 {
+		note = "no paths in the work directory in the output, with -fetch-referenced"
+		instLogf(inst, "Not downloading archive of %s: %s.", inst, note)
+		return "", note, nil
+	}
+	instLogf(inst, "Downloading archive of just %s on %s.", strings.Join(dirs, ", "), inst)
+	return fetchArchive(ctx, inst, name, dirs)
+}
+
+// getDirs writes a gzipped tar archive of dirs, relative to inst's work
+// directory, to w, with paths relative to the work directory, as if the
+// whole work directory had been archived. Directories that can't be
+// archived, for example because they're actually files, are skipped.
+func getDirs(ctx context.Context, archiver swarm.DirArchiver, inst string, dirs []string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var errs []error
+	for _, dir := range dirs {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func(dir string) {
+			err := archiver.GetDir(ctx, inst, dir, pw)
+			pw.CloseWithError(err)
+			done <- err
+		}(dir)
+		err := appendTar(tw, pr, dir)
+		pr.CloseWithError(err)
+		if getErr := <-done; getErr != nil {
+			err = getErr
+		}
+		if errors.Is(err, errArchiveTooLarge) || ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			instDetailf(inst, "Failed to archive %s of %s: %v", dir, inst, err)
+			errs = append(errs, fmt.Errorf("%s: %v", dir, err))
+		}
+	}
+	if len(errs) == len(dirs) {
+		return errors.Join(errs...)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// appendTar appends the files of r, a gzipped tar archive of dir, to tw,
+// under dir.
+func appendTar(tw *tar.Writer, r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
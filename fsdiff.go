@@ -0,0 +1,144 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var fsDiff bool
+
+func init() {
+	flag.BoolVar(&fsDiff, "fs-diff", false, "on a matching failure, compare the archive of the instance's work directory with the GOROOT pushed to it, and list the new and modified files, like leaked temporary files and core dumps, in the failure's record and report")
+}
+
+// fsDiffIgnore are the parts of an instance's work directory that differ
+// from the pushed GOROOT on every instance: what's built there, and the
+// bootstrap toolchain.
+var fsDiffIgnore = []string{"go/bin/", "go/pkg/", "go1.4/"}
+
+// maxFSChanges is how many new and modified files a failure records.
+const maxFSChanges = 100
+
+// fsChange is a file in an instance's work directory that's new or
+// modified since GOROOT was pushed to it.
+type fsChange struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	New  bool   `json:"new,omitempty"`
+}
+
+func (c fsChange) String() string {
+	mark := "M"
+	if c.New {
+		mark = "+"
+	}
+	return fmt.Sprintf("%s %s (%d bytes)", mark, c.Path, c.Size)
+}
+
+// localSums caches the hashes of the files of the local GOROOT, which don't
+// change during a session unless -watch re-pushes it.
+var localSums struct {
+	sync.Mutex
+	m map[string][sha256.Size]byte
+}
+
+// localSum returns the hash of the local file at path, and false if it
+// doesn't exist or can't be read.
+func localSum(path string) ([sha256.Size]byte, bool) {
+	localSums.Lock()
+	sum, ok := localSums.m[path]
+	localSums.Unlock()
+	if ok {
+		return sum, true
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return sum, false
+	}
+	sum = sha256.Sum256(b)
+	localSums.Lock()
+	defer localSums.Unlock()
+	if localSums.m == nil {
+		localSums.m = make(map[string][sha256.Size]byte)
+	}
+	localSums.m[path] = sum
+	return sum, true
+}
+
+// diffArchive returns the files in the archive at tarName, of an instance's
+// work directory, that are new or modified since the local GOROOT, goroot,
+// was pushed to it, largest first, and how many there are in all.
+func diffArchive(tarName, goroot string) ([]fsChange, int, error) {
+	in, err := os.Open(tarName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	var uploaded []string
+	for _, up := range uploads() {
+		uploaded = append(uploaded, path.Clean(filepath.ToSlash(up.dst)))
+	}
+	var changes []fsChange
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if slices.Contains(uploaded, name) || slices.ContainsFunc(fsDiffIgnore, func(p string) bool { return strings.HasPrefix(name, p) }) {
+			continue
+		}
+		rel, ok := strings.CutPrefix(name, "go/")
+		if !ok {
+			changes = append(changes, fsChange{name, hdr.Size, true})
+			continue
+		}
+		local := filepath.Join(goroot, filepath.FromSlash(rel))
+		info, err := os.Stat(local)
+		if err != nil {
+			changes = append(changes, fsChange{name, hdr.Size, true})
+			continue
+		}
+		if info.Size() != hdr.Size {
+			changes = append(changes, fsChange{name, hdr.Size, false})
+			continue
+		}
+		sum, ok := localSum(local)
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, 0, err
+		}
+		if !ok || !bytes.Equal(h.Sum(nil), sum[:]) {
+			changes = append(changes, fsChange{name, hdr.Size, false})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Size > changes[j].Size })
+	return changes[:min(len(changes), maxFSChanges)], len(changes), nil
+}
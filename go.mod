@@ -1,5 +1,5 @@
 module github.com/mknyszek/goswarm
 
-go 1.16
+go 1.21
 
-require golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+require golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
@@ -0,0 +1,188 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var godebugFuzz stringSetVar
+
+func init() {
+	flag.Var(&godebugFuzz, "godebug-fuzz", "GODEBUG setting to set to a random one of its values in each iteration, of the form name=value,value... or just name for 0 or 1, or runtime for a set of runtime settings that shake out scheduler and garbage collector bugs; may be specified multiple times, and the summary reports the values matching failures are concentrated in")
+}
+
+// godebugRuntime are the settings of -godebug-fuzz=runtime.
+var godebugRuntime = []string{
+	"gcstoptheworld=0,1,2",
+	"asyncpreemptoff",
+	"madvdontneed",
+	"clobberfree",
+	"gcshrinkstackoff",
+}
+
+// godebugSetting is a GODEBUG setting of -godebug-fuzz, and the values it
+// takes.
+type godebugSetting struct {
+	name   string
+	values []string
+}
+
+// godebugSettings are the settings of -godebug-fuzz, in order.
+var godebugSettings []godebugSetting
+
+// godebugFixed is the GODEBUG settings of every iteration instead, when
+// rerunning a failure.
+var godebugFixed string
+
+// setUpGODEBUG parses the -godebug-fuzz settings.
+func setUpGODEBUG() error {
+	var specs []string
+	for _, s := range godebugFuzz {
+		if s == "runtime" {
+			specs = append(specs, godebugRuntime...)
+		} else {
+			specs = append(specs, s)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		name, values, ok := strings.Cut(spec, "=")
+		s := godebugSetting{name: strings.TrimSpace(name), values: []string{"0", "1"}}
+		if ok {
+			s.values = strings.Split(values, ",")
+		}
+		if s.name == "" || strings.ContainsAny(s.name, ", ") {
+			return fmt.Errorf("-godebug-fuzz: malformed setting %q", spec)
+		}
+		for _, v := range s.values {
+			if v == "" || strings.Contains(v, " ") {
+				return fmt.Errorf("-godebug-fuzz: malformed values of %s in %q", s.name, spec)
+			}
+		}
+		if seen[s.name] {
+			return fmt.Errorf("-godebug-fuzz: %s is specified more than once", s.name)
+		}
+		seen[s.name] = true
+		godebugSettings = append(godebugSettings, s)
+	}
+	return nil
+}
+
+// godebugFor returns the GODEBUG settings of -godebug-fuzz of the iteration
+// with the given seed, like "asyncpreemptoff=1,madvdontneed=0", or "" without
+// -godebug-fuzz. The iteration's seed picks the values, so that rerunning
+// it with its seed sets them the same way.
+func godebugFor(seed int64) string {
+	if godebugFixed != "" || len(godebugSettings) == 0 {
+		return godebugFixed
+	}
+	r := rand.New(rand.NewSource(seed))
+	var kvs []string
+	for _, s := range godebugSettings {
+		kvs = append(kvs, s.name+"="+s.values[r.Intn(len(s.values))])
+	}
+	return strings.Join(kvs, ",")
+}
+
+// godebugEnv returns env with settings added to GODEBUG, after any it
+// already has, or env itself if settings is "".
+func godebugEnv(env []string, settings string) []string {
+	if settings == "" {
+		return env
+	}
+	prev := ""
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "GODEBUG="); ok && v != "" {
+			prev = v + ","
+		}
+	}
+	return append(env[:len(env):len(env)], "GODEBUG="+prev+settings)
+}
+
+// recordGODEBUG counts an iteration, with the given seed, under each of its
+// -godebug-fuzz settings.
+func (s *session) recordGODEBUG(seed int64, status swarm.Status) {
+	settings := godebugFor(seed)
+	if settings == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perGODEBUG == nil {
+		s.perGODEBUG = make(map[string]*instanceCounts)
+	}
+	for _, kv := range strings.Split(settings, ",") {
+		c, ok := s.perGODEBUG[kv]
+		if !ok {
+			c = new(instanceCounts)
+			s.perGODEBUG[kv] = c
+		}
+		c.record(status)
+	}
+}
+
+// godebugCounts are the results of the iterations with one value of a
+// setting of -godebug-fuzz.
+type godebugCounts struct {
+	Setting string `json:"setting"` // like asyncpreemptoff=1
+	instanceCounts
+}
+
+// godebugAlpha is the significance level at which a value of a setting is
+// reported to fail more often than its other values.
+const godebugAlpha = 0.01
+
+// writePerGODEBUG writes the results with each value of each setting of
+// -godebug-fuzz, and which values matching failures occurred significantly
+// more often with.
+func (st *sessionStatus) writePerGODEBUG(w io.Writer) {
+	if len(st.PerGODEBUG) == 0 {
+		return
+	}
+	// Group the values by setting.
+	counts := slices.Clone(st.PerGODEBUG)
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Setting < counts[j].Setting })
+	totals := make(map[string]instanceCounts)
+	for _, c := range counts {
+		name, _, _ := strings.Cut(c.Setting, "=")
+		t := totals[name]
+		t.Iterations += c.Iterations
+		t.Matched += c.Matched
+		totals[name] = t
+	}
+	fmt.Fprintf(w, "  by GODEBUG setting (-godebug-fuzz):\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "    setting\titerations\tmatched\tunmatched\terrors\n")
+	var suspects []string
+	for _, c := range counts {
+		name, _, _ := strings.Cut(c.Setting, "=")
+		total := totals[name]
+		fmt.Fprintf(tw, "    %s\t%d\t%d\t%d\t%d", c.Setting, c.Iterations, c.Matched, c.Unmatched, c.Errors)
+		// Compare with the rate with the other values, with half a failure
+		// so that a value can stand out when the others never failed.
+		if rest := total.Iterations - c.Iterations; c.Matched > 1 && rest > 0 {
+			rate := (float64(total.Matched-c.Matched) + 0.5) / float64(rest)
+			if p := poissonTail(c.Matched, rate*float64(c.Iterations)); p < godebugAlpha {
+				fmt.Fprintf(tw, "\tmore than with %s's other values (p=%.2g)", name, p)
+				suspects = append(suspects, c.Setting)
+			}
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+	tw.Flush()
+	if len(suspects) > 0 {
+		fmt.Fprintf(w, "    matching failures depend on GODEBUG=%s\n", strings.Join(suspects, ","))
+	}
+}
@@ -8,24 +8,257 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func Create(ctx context.Context, typ string) (string, error) {
-	result, err := exec.CommandContext(ctx, "gomote", "create", typ).Output()
+// Settings for every gomote invocation, like those pointing gomote at a
+// non-default coordinator or swarming instance.
+var (
+	GlobalFlags []string // passed before the subcommand
+	Env         []string // added to the environment, as KEY=VALUE
+)
+
+// An Invocation is a completed invocation of gomote.
+type Invocation struct {
+	Args     []string // not including "gomote"
+	Start    time.Time
+	Duration time.Duration
+	Err      error  // nil if gomote succeeded
+	Output   []byte // what gomote wrote, unless it was written elsewhere
+}
+
+// Observe, if set, is called with every invocation of gomote once it
+// completes, possibly concurrently.
+var Observe func(Invocation)
+
+// Trace, if set, is called with the arguments of every invocation of gomote,
+// not including "gomote", and the variables it adds to the environment, as
+// KEY=VALUE, as it starts, possibly concurrently.
+var Trace func(env, args []string)
+
+// invocation is an invocation of gomote, reported to Trace and Observe.
+type invocation struct {
+	*exec.Cmd
+}
+
+func (c invocation) trace() {
+	if Trace == nil {
+		return
+	}
+	var env []string
+	if c.Env != nil {
+		local := make(map[string]bool)
+		for _, kv := range os.Environ() {
+			local[kv] = true
+		}
+		for _, kv := range c.Env {
+			if !local[kv] {
+				env = append(env, kv)
+			}
+		}
+	}
+	Trace(env, c.Args[1:])
+}
+
+func (c invocation) observe(start time.Time, err error, out []byte) {
+	if Observe != nil {
+		Observe(Invocation{Args: c.Args[1:], Start: start, Duration: time.Since(start), Err: err, Output: out})
+	}
+}
+
+func (c invocation) Run() error {
+	var stderr bytes.Buffer
+	if Observe != nil && c.Stderr == nil {
+		c.Stderr = &stderr
+	}
+	c.trace()
+	start := time.Now()
+	err := c.Cmd.Run()
+	c.observe(start, err, stderr.Bytes())
+	return err
+}
+
+func (c invocation) Output() ([]byte, error) {
+	c.trace()
+	start := time.Now()
+	out, err := c.Cmd.Output()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		c.observe(start, err, append(out, ee.Stderr...))
+	} else {
+		c.observe(start, err, out)
+	}
+	return out, err
+}
+
+func (c invocation) CombinedOutput() ([]byte, error) {
+	c.trace()
+	start := time.Now()
+	out, err := c.Cmd.CombinedOutput()
+	c.observe(start, err, out)
+	return out, err
+}
+
+// command returns a gomote invocation of args, with GlobalFlags and Env.
+func command(ctx context.Context, args ...string) invocation {
+	args = append(GlobalFlags[:len(GlobalFlags):len(GlobalFlags)], args...)
+	cmd := exec.CommandContext(ctx, "gomote", args...)
+	if len(Env) > 0 {
+		cmd.Env = append(os.Environ(), Env...)
+	}
+	return invocation{cmd}
+}
+
+// Timeouts for individual gomote invocations, so that a wedged gomote can't
+// stall its caller for the rest of a session. Zero means no limit.
+var (
+	CreateTimeout  = 30 * time.Minute
+	PushTimeout    = 90 * time.Minute
+	DestroyTimeout = 5 * time.Minute
+	GetTimeout     = 30 * time.Minute
+)
+
+// withTimeout returns a context for a gomote invocation limited to d.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timedOut replaces err, returned by the gomote invocation op run with ctx,
+// with a clearer error if the invocation timed out after d.
+func timedOut(ctx context.Context, op string, d time.Duration, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("gomote %s timed out after %s: %w", op, d, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// Create creates an instance of type typ, passing flags to gomote create.
+func Create(ctx context.Context, typ string, flags ...string) (string, error) {
+	ctx, cancel := withTimeout(ctx, CreateTimeout)
+	defer cancel()
+	args := append(append([]string{"create"}, flags...), typ)
+	result, err := command(ctx, args...).Output()
 	if err != nil {
-		return "", err
+		return "", timedOut(ctx, "create", CreateTimeout, err)
 	}
 	return strings.TrimSpace(string(result)), nil
 }
 
-func Push(ctx context.Context, inst string) error {
-	err := exec.CommandContext(ctx, "gomote", "push", inst).Run()
+// ErrNoBatch is returned by CreateBatch when gomote is too old to create
+// several instances at once.
+var ErrNoBatch = errors.New("gomote create does not support -count")
+
+// CreateBatch creates n instances of type typ with a single gomote create,
+// passing it flags, and returns their names. If it fails partway, it
+// returns the names of the instances it did create along with the error.
+func CreateBatch(ctx context.Context, typ string, n int, flags ...string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, CreateTimeout)
+	defer cancel()
+	args := append(append([]string{"create", fmt.Sprintf("-count=%d", n)}, flags...), typ)
+	result, err := command(ctx, args...).Output()
+	err = timedOut(ctx, "create", CreateTimeout, err)
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && bytes.Contains(ee.Stderr, []byte("flag provided but not defined: -count")) {
+		return nil, ErrNoBatch
+	}
+	insts := strings.Fields(string(result))
+	if err == nil && len(insts) != n {
+		err = fmt.Errorf("gomote create -count=%d created %d instances", n, len(insts))
+	}
+	return insts, err
+}
+
+// capacityErrors are substrings of gomote's error output indicating that
+// an instance couldn't be created because the instance type is at capacity.
+var capacityErrors = []string{
+	"capacity",
+	"resource exhausted",
+	"resource_exhausted",
+	"no available",
+}
+
+// IsCapacityError reports whether err, returned by Create, indicates that
+// the instance type is at capacity, so creation may succeed later.
+func IsCapacityError(err error) bool {
+	return !IsQuotaError(err) && stderrContains(err, capacityErrors)
+}
+
+// quotaErrors are substrings of gomote's error output indicating that an
+// instance couldn't be created because the user already has as many
+// instances as they may.
+var quotaErrors = []string{
+	"quota",
+	"too many instances",
+	"instance limit",
+	"maximum number of instances",
+}
+
+// IsQuotaError reports whether err, returned by Create, indicates that the
+// user already has as many instances as they may, so creation won't
+// succeed until one is destroyed.
+func IsQuotaError(err error) bool {
+	return stderrContains(err, quotaErrors)
+}
+
+// stderrContains reports whether err is from a gomote invocation whose
+// error output contains any of substrs, in lower case.
+func stderrContains(err error, substrs []string) bool {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	msg := strings.ToLower(string(ee.Stderr))
+	for _, s := range substrs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Push pushes goroot to inst. If goroot is empty, gomote pushes $GOROOT.
+func Push(ctx context.Context, inst, goroot string) error {
+	ctx, cancel := withTimeout(ctx, PushTimeout)
+	defer cancel()
+	cmd := command(ctx, "push", inst)
+	if goroot != "" {
+		cmd.Env = append(cmd.Environ(), "GOROOT="+goroot)
+	}
+	err := cmd.Run()
+	if err != nil {
+		return timedOut(ctx, "push", PushTimeout, err)
+	}
+	return nil
+}
+
+// PutBootstrap pushes a bootstrap toolchain, for building Go, to inst.
+func PutBootstrap(ctx context.Context, inst string) error {
+	out, err := command(ctx, "putbootstrap", inst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gomote putbootstrap: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Put copies the local file src to dst, relative to the instance's work
+// directory, on inst, with permissions mode.
+func Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	out, err := command(ctx, "put", fmt.Sprintf("-mode=%o", mode.Perm()), inst, src, dst).CombinedOutput()
 	if err != nil {
-		return err
+		return fmt.Errorf("gomote put: %v: %s", err, bytes.TrimSpace(out))
 	}
 	return nil
 }
@@ -34,88 +267,360 @@ type Instance struct {
 	Name, Type string
 }
 
+// noJSONList is set once gomote list turns out not to support -json.
+var noJSONList atomic.Bool
+
+// List lists the user's instances. It prefers gomote list's JSON output,
+// falling back to parsing its text output with older versions of gomote.
 func List(ctx context.Context) ([]Instance, error) {
-	result, err := exec.CommandContext(ctx, "gomote", "list").CombinedOutput()
+	if !noJSONList.Load() {
+		result, err := command(ctx, "list", "-json").Output()
+		var ee *exec.ExitError
+		switch {
+		case err == nil:
+			return parseJSONList(result)
+		case errors.As(err, &ee) && bytes.Contains(ee.Stderr, []byte("flag provided but not defined")):
+			noJSONList.Store(true)
+		default:
+			return nil, err
+		}
+	}
+	result, err := command(ctx, "list").CombinedOutput()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("gomote list: %w: %s", err, bytes.TrimSpace(result))
+	}
+	return parseList(result)
+}
+
+// parseJSONList parses the output of gomote list -json: either an array of
+// instances or one instance per line, each an object naming the instance
+// and its type, under the keys of any version of gomote.
+func parseJSONList(b []byte) ([]Instance, error) {
+	var objs []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("unexpected `gomote list -json` format: %v", err)
+		}
+		switch v := v.(type) {
+		case []any:
+			for _, e := range v {
+				if obj, ok := e.(map[string]any); ok {
+					objs = append(objs, obj)
+				}
+			}
+		case map[string]any:
+			objs = append(objs, v)
+		}
 	}
-	rd := bytes.NewReader(result)
-	sc := bufio.NewScanner(rd)
+	var insts []Instance
+	for _, obj := range objs {
+		name := jsonField(obj, "name", "gomote_id", "gomoteId", "GomoteID", "Name")
+		if name == "" {
+			return nil, fmt.Errorf("unexpected `gomote list -json` format: instance without a name: %v", obj)
+		}
+		typ := jsonField(obj, "type", "builder_type", "builderType", "BuilderType", "host_type", "hostType", "HostType", "Type")
+		insts = append(insts, Instance{name, typ})
+	}
+	return insts, nil
+}
+
+// jsonField returns the first of keys that's a string in obj.
+func jsonField(obj map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if s, ok := obj[k].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// parseList parses the text output of gomote list, which has been a line
+// per instance of tab-separated columns, the name and type first, like
+//
+//	user-gopher-linux-amd64-0	linux-amd64	host-linux-bullseye	expires in 29m
+//
+// though columns have come and gone over time, and swarming-era gomotes
+// separate them with spaces instead. Blank lines, comments, headers, and
+// messages are skipped.
+func parseList(b []byte) ([]Instance, error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
 	var insts []Instance
 	for sc.Scan() {
-		line := sc.Text()
-		details := strings.Split(line, "\t")
-		if len(details) < 2 {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasSuffix(line, ".") {
+			continue // Not an instance, but maybe a message like "No instances."
+		}
+		var fields []string
+		if strings.Contains(line, "\t") {
+			for _, f := range strings.Split(line, "\t") {
+				fields = append(fields, strings.TrimSpace(f))
+			}
+		} else {
+			fields = strings.Fields(line)
+		}
+		name := fields[0]
+		if strings.EqualFold(name, "name") || strings.EqualFold(name, "instance") || strings.HasSuffix(name, ":") {
+			continue // A header.
+		}
+		if strings.ContainsAny(name, " /") {
 			return nil, fmt.Errorf("unexpected `gomote list` format: %q", line)
 		}
-		name := strings.TrimSpace(details[0])
-		typ := strings.TrimSpace(details[1])
+		var typ string
+		if len(fields) > 1 && !strings.HasPrefix(fields[1], "expires") {
+			typ = fields[1]
+		}
 		insts = append(insts, Instance{name, typ})
 	}
-	if sc.Err() != nil {
+	if err := sc.Err(); err != nil {
 		return nil, err
 	}
 	return insts, nil
 }
 
+func Ping(ctx context.Context, inst string) error {
+	return command(ctx, "ping", inst).Run()
+}
+
+// Rm removes paths, relative to the instance's work directory, on inst.
+func Rm(ctx context.Context, inst string, paths ...string) error {
+	args := append([]string{"rm", inst}, paths...)
+	return command(ctx, args...).Run()
+}
+
+// DiskUsage returns the disk space, in bytes, used by inst's work directory.
+// It requires a POSIX du on the instance.
+func DiskUsage(ctx context.Context, inst string) (int64, error) {
+	out, err := command(ctx, "run", "-system", inst, "du", "-sk", ".").Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 1 {
+		return 0, fmt.Errorf("unexpected du output: %q", lines[len(lines)-1])
+	}
+	kb, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected du output: %q", lines[len(lines)-1])
+	}
+	return kb << 10, nil
+}
+
+// FreeDisk returns the free disk space, in bytes, in inst's work directory.
+// It requires a POSIX df on the instance.
+func FreeDisk(ctx context.Context, inst string) (int64, error) {
+	out, err := command(ctx, "run", "-system", inst, "df", "-Pk", ".").Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", lines[len(lines)-1])
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", lines[len(lines)-1])
+	}
+	return kb << 10, nil
+}
+
 func Destroy(ctx context.Context, inst string) error {
-	err := exec.CommandContext(ctx, "gomote", "destroy", inst).Run()
+	ctx, cancel := withTimeout(ctx, DestroyTimeout)
+	defer cancel()
+	err := command(ctx, "destroy", inst).Run()
 	if err != nil {
-		return err
+		return timedOut(ctx, "destroy", DestroyTimeout, err)
 	}
 	return nil
 }
 
-func Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+// Run runs cmd on inst with the additional environment variables env,
+// passing flags to gomote run, and returns its combined output. If ctx is
+// done before the command finishes, the error wraps ctx.Err().
+func Run(ctx context.Context, inst string, env, flags []string, cmd ...string) ([]byte, error) {
 	args := []string{"run"}
 	for _, v := range env {
 		args = append(args, "-e", v)
 	}
+	args = append(args, flags...)
 	args = append(args, inst)
 	args = append(args, cmd...)
-	return exec.CommandContext(ctx, "gomote", args...).CombinedOutput()
+	out, err := command(ctx, args...).CombinedOutput()
+	if err != nil && ctx.Err() != nil {
+		// gomote was killed, so its exit status says nothing about
+		// the command.
+		return out, fmt.Errorf("gomote run on %s: %w", inst, ctx.Err())
+	}
+	return out, err
+}
+
+// infraErrors are substrings of gomote's error output indicating that it
+// had trouble talking to the coordinator or the instance.
+var infraErrors = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"deadline exceeded",
+	"deadlineexceeded",
+	"tls handshake timeout",
+	"unexpected eof",
+	"unavailable",
+	"quota",
+	"resourceexhausted",
+}
+
+// infraErrorLines is how many lines at the end of Run's output are checked
+// for infrastructure errors. gomote reports its own errors last, and looking
+// any further risks mistaking the command's output for an error.
+const infraErrorLines = 3
+
+// isGomoteError reports whether line, in lower case, is an error reported
+// by gomote itself rather than output of the command: gomote prefixes its
+// errors with its name or the subcommand, and passes along the
+// coordinator's RPC errors.
+func isGomoteError(line string) bool {
+	return strings.HasPrefix(line, "gomote:") ||
+		strings.HasPrefix(line, "gomote ") ||
+		strings.HasPrefix(line, "error running ") ||
+		strings.Contains(line, "rpc error: code =")
+}
+
+// isTestFailure reports whether line, trimmed, reports a failed test or
+// package, after which anything is the command's own output.
+func isTestFailure(line string) bool {
+	return strings.HasPrefix(line, "FAIL") || strings.HasPrefix(line, "--- FAIL")
+}
+
+// IsInfraError reports whether output, returned by a failed Run, indicates
+// a problem communicating with the instance rather than a failure of the
+// command itself. Only gomote's own errors count, and never once a test has
+// failed, since tests that time out talking to the network are exactly the
+// flakes being looked for.
+func IsInfraError(output []byte) bool {
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	for _, line := range lines {
+		if isTestFailure(string(bytes.TrimSpace(line))) {
+			return false
+		}
+	}
+	if len(lines) > infraErrorLines {
+		lines = lines[len(lines)-infraErrorLines:]
+	}
+	for _, line := range lines {
+		msg := strings.ToLower(string(bytes.TrimSpace(line)))
+		if !isGomoteError(msg) {
+			continue
+		}
+		for _, s := range infraErrors {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func Get(ctx context.Context, inst string, out io.Writer) error {
+	return GetDir(ctx, inst, "", out)
+}
+
+// GetDir writes a gzipped tar archive of dir, relative to inst's work
+// directory, to out, or of the whole work directory if dir is empty.
+func GetDir(ctx context.Context, inst, dir string, out io.Writer) error {
+	ctx, cancel := withTimeout(ctx, GetTimeout)
+	defer cancel()
 	args := []string{"gettar"}
+	if dir != "" {
+		args = append(args, "-dir="+dir)
+	}
 	args = append(args, inst)
-	cmd := exec.CommandContext(ctx, "gomote", args...)
+	cmd := command(ctx, args...)
 	cmd.Stdout = out
-	return cmd.Run()
+	return timedOut(ctx, "gettar", GetTimeout, cmd.Run())
 }
 
+// RDP forwards remote desktop connections from the local address listen,
+// like localhost:7777, to inst, a Windows instance, until ctx is done.
+func RDP(ctx context.Context, inst, listen string) error {
+	err := command(ctx, "rdp", "-listen="+listen, inst).Run()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// noTypeList is set once gomote create turns out not to support -list.
+var noTypeList atomic.Bool
+
+// InstanceTypes lists the valid instance types. It prefers gomote create
+// -list, one type per line, falling back to the usage message of gomote
+// create with older versions of gomote.
 func InstanceTypes(ctx context.Context) ([]string, error) {
-	result, err := exec.CommandContext(ctx, "gomote", "create").CombinedOutput()
+	if !noTypeList.Load() {
+		result, err := command(ctx, "create", "-list").Output()
+		var ee *exec.ExitError
+		switch {
+		case err == nil:
+			return strings.Fields(string(result)), nil
+		case errors.As(err, &ee) && bytes.Contains(ee.Stderr, []byte("flag provided but not defined")):
+			noTypeList.Store(true)
+		default:
+			return nil, err
+		}
+	}
+	result, err := command(ctx, "create").CombinedOutput()
 	if err != nil {
 		if _, ok := err.(*exec.Error); ok {
 			return nil, err
 		}
 		// Ignore error otherwise because gomote exits with a non-zero exit code.
 	}
-	rd := bytes.NewReader(result)
-	sc := bufio.NewScanner(rd)
+	return parseTypes(result)
+}
+
+// parseTypes parses the types listed by gomote create's usage message. The
+// coordinator-era gomote lists them under "Valid types:", like
+//
+//	Valid types:
+//	  * linux-amd64
+//	  * windows-arm64-11 [limited capacity]
+//
+// while the swarming-era gomote lists builder types under a heading of its
+// own, with or without bullets. Either way, the list is the block of lines
+// after a heading ending in "types:".
+func parseTypes(b []byte) ([]string, error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
 	start := false
 	var typs []string
 	for sc.Scan() {
-		line := sc.Text()
+		line := strings.TrimSpace(sc.Text())
 		if !start {
-			if strings.HasPrefix(line, "Valid types:") {
+			if strings.HasSuffix(strings.ToLower(line), "types:") {
 				start = true
 			}
 			continue
 		}
-		cutl := strings.IndexRune(line, '*')
-		if cutl < 0 || cutl == len(line)-1 {
-			return nil, fmt.Errorf("unexpected `gomote create` format: %q", line)
+		if line == "" {
+			if len(typs) > 0 {
+				break
+			}
+			continue
 		}
-		cutr := strings.IndexRune(line, '[')
-		if cutr < 0 {
-			cutr = len(line)
+		fields := strings.Fields(strings.TrimLeft(line, "*- "))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("unexpected `gomote create` format: %q", line)
 		}
-		typs = append(typs, strings.TrimSpace(line[cutl+1:cutr]))
+		typs = append(typs, fields[0])
 	}
-	if sc.Err() != nil {
+	if err := sc.Err(); err != nil {
 		return nil, err
 	}
+	if !start {
+		return nil, fmt.Errorf("unexpected `gomote create` format: no list of types")
+	}
 	return typs, nil
 }
@@ -0,0 +1,236 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gomote
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIsInfraError(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{
+			name:   "rpc unavailable",
+			output: "ok  \tfmt\t0.1s\nError running run: rpc error: code = Unavailable desc = connection closed before server preface received\n",
+			want:   true,
+		},
+		{
+			name:   "rpc deadline",
+			output: "rpc error: code = DeadlineExceeded desc = context deadline exceeded\n",
+			want:   true,
+		},
+		{
+			name:   "gomote prefix",
+			output: "gomote: write tcp 10.0.0.1:4242: connection reset by peer\n",
+			want:   true,
+		},
+		{
+			name:   "quota",
+			output: "Error running create: rpc error: code = ResourceExhausted desc = quota exceeded\n",
+			want:   true,
+		},
+		{
+			name:   "net/http flake",
+			output: "--- FAIL: TestTransportTimeout (5.00s)\n    transport_test.go:123: Get \"http://127.0.0.1:1234\": context deadline exceeded\nFAIL\nFAIL\tnet/http\t1.2s\n",
+			want:   false,
+		},
+		{
+			name:   "test output without FAIL",
+			output: "panic: read tcp 127.0.0.1:1234: i/o timeout\n\ngoroutine 1 [running]:\nexit status 2\n",
+			want:   false,
+		},
+		{
+			name:   "gomote error after a failure",
+			output: "--- FAIL: TestFoo (0.00s)\nFAIL\nError running run: rpc error: code = Unavailable desc = unexpected EOF\n",
+			want:   false,
+		},
+		{
+			name:   "plain failure",
+			output: "FAIL\tfmt\t0.1s\n",
+			want:   false,
+		},
+		{
+			name:   "gomote error too far back",
+			output: "gomote: connection refused\nretrying\nok\nok\nexit status 1\n",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsInfraError([]byte(tt.output)); got != tt.want {
+				t.Errorf("IsInfraError(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Instance
+	}{
+		{
+			name:   "tab-separated",
+			output: "user-gopher-linux-amd64-0\tlinux-amd64\thost-linux-bullseye\texpires in 29m\nuser-gopher-windows-amd64-2016-1\twindows-amd64-2016\thost-windows-amd64-2016\texpires in 1h2m\n",
+			want: []Instance{
+				{"user-gopher-linux-amd64-0", "linux-amd64"},
+				{"user-gopher-windows-amd64-2016-1", "windows-amd64-2016"},
+			},
+		},
+		{
+			name:   "tab-separated without type",
+			output: "user-gopher-linux-amd64-0\texpires in 29m\n",
+			want:   []Instance{{"user-gopher-linux-amd64-0", ""}},
+		},
+		{
+			name:   "space-separated",
+			output: "user-gopher-gotip-linux-amd64-0   gotip-linux-amd64   expires in 29m\nuser-gopher-gotip-darwin-arm64-1 gotip-darwin-arm64 expires in 1h\n",
+			want: []Instance{
+				{"user-gopher-gotip-linux-amd64-0", "gotip-linux-amd64"},
+				{"user-gopher-gotip-darwin-arm64-1", "gotip-darwin-arm64"},
+			},
+		},
+		{
+			name:   "no instances",
+			output: "No instances.\n",
+		},
+		{
+			name:   "empty",
+			output: "",
+		},
+		{
+			name:   "headers",
+			output: "# gomote instances\nNAME\tTYPE\tHOST\tEXPIRES\nuser-gopher-linux-amd64-0\tlinux-amd64\thost-linux-bullseye\texpires in 29m\n",
+			want:   []Instance{{"user-gopher-linux-amd64-0", "linux-amd64"}},
+		},
+		{
+			name:   "header with colon",
+			output: "Instances:\n\nuser-gopher-linux-amd64-0 linux-amd64 expires in 29m\n",
+			want:   []Instance{{"user-gopher-linux-amd64-0", "linux-amd64"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseList([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("parseList: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseList(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseListError(t *testing.T) {
+	if insts, err := parseList([]byte("some/path linux-amd64\n")); err == nil {
+		t.Errorf("parseList of a path = %v, want an error", insts)
+	}
+}
+
+func TestParseJSONList(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Instance
+	}{
+		{
+			name:   "array",
+			output: `[{"name": "user-gopher-linux-amd64-0", "type": "linux-amd64"}, {"name": "user-gopher-linux-arm64-1", "type": "linux-arm64"}]`,
+			want: []Instance{
+				{"user-gopher-linux-amd64-0", "linux-amd64"},
+				{"user-gopher-linux-arm64-1", "linux-arm64"},
+			},
+		},
+		{
+			name:   "lines",
+			output: "{\"name\": \"user-gopher-linux-amd64-0\", \"type\": \"linux-amd64\"}\n{\"name\": \"user-gopher-linux-arm64-1\", \"type\": \"linux-arm64\"}\n",
+			want: []Instance{
+				{"user-gopher-linux-amd64-0", "linux-amd64"},
+				{"user-gopher-linux-arm64-1", "linux-arm64"},
+			},
+		},
+		{
+			name:   "empty array",
+			output: "[]\n",
+		},
+		{
+			name:   "empty",
+			output: "",
+		},
+		{
+			name:   "gomote_id and builder_type",
+			output: `[{"gomote_id": "user-a-0", "builder_type": "gotip-linux-amd64"}]`,
+			want:   []Instance{{"user-a-0", "gotip-linux-amd64"}},
+		},
+		{
+			name:   "gomoteId and builderType",
+			output: `{"gomoteId": "user-a-0", "builderType": "gotip-linux-amd64", "expires": "2024-01-01T00:00:00Z"}`,
+			want:   []Instance{{"user-a-0", "gotip-linux-amd64"}},
+		},
+		{
+			name:   "GomoteID and BuilderType",
+			output: `[{"GomoteID": "user-a-0", "BuilderType": "linux-amd64"}]`,
+			want:   []Instance{{"user-a-0", "linux-amd64"}},
+		},
+		{
+			name:   "host_type",
+			output: `[{"name": "user-a-0", "host_type": "host-linux-bullseye"}]`,
+			want:   []Instance{{"user-a-0", "host-linux-bullseye"}},
+		},
+		{
+			name:   "hostType",
+			output: `[{"name": "user-a-0", "hostType": "host-linux-bullseye"}]`,
+			want:   []Instance{{"user-a-0", "host-linux-bullseye"}},
+		},
+		{
+			name:   "HostType",
+			output: `[{"name": "user-a-0", "HostType": "host-linux-bullseye"}]`,
+			want:   []Instance{{"user-a-0", "host-linux-bullseye"}},
+		},
+		{
+			name:   "Name and Type",
+			output: `[{"Name": "user-a-0", "Type": "linux-amd64"}]`,
+			want:   []Instance{{"user-a-0", "linux-amd64"}},
+		},
+		{
+			name:   "type preferred over host type",
+			output: `[{"name": "user-a-0", "type": "linux-amd64", "host_type": "host-linux-bullseye"}]`,
+			want:   []Instance{{"user-a-0", "linux-amd64"}},
+		},
+		{
+			name:   "no type",
+			output: `[{"name": "user-a-0"}]`,
+			want:   []Instance{{"user-a-0", ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJSONList([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("parseJSONList: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseJSONList(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONListError(t *testing.T) {
+	for _, output := range []string{
+		`[{"type": "linux-amd64"}]`,
+		`{"name": "user-a-0"`,
+	} {
+		if insts, err := parseJSONList([]byte(output)); err == nil {
+			t.Errorf("parseJSONList(%q) = %v, want an error", output, insts)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var gorootDir string
+
+func init() {
+	flag.StringVar(&gorootDir, "goroot", "", "Go tree to push to each instance, overriding $GOROOT")
+}
+
+// pushRoot returns the absolute path of the Go tree to push: -goroot if
+// set, or $GOROOT.
+func pushRoot() (string, error) {
+	if gorootDir == "" {
+		return os.Getenv("GOROOT"), nil
+	}
+	dir, err := filepath.Abs(gorootDir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// checkGOROOT checks that goroot, about to be pushed to every instance,
+// looks like a Go tree, and warns if it has uncommitted changes, which
+// are pushed along with it.
+func checkGOROOT(ctx context.Context, goroot string) error {
+	if goroot == "" {
+		return nil
+	}
+	looksLikeGo := false
+	for _, name := range []string{"src/make.bash", "VERSION", ".git"} {
+		if _, err := os.Stat(filepath.Join(goroot, name)); err == nil {
+			looksLikeGo = true
+			break
+		}
+	}
+	if !looksLikeGo {
+		return fmt.Errorf("%s doesn't look like a Go tree: it has no src/make.bash, VERSION, or .git", goroot)
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", goroot, "status", "--porcelain", "--untracked-files=no").Output()
+	if err != nil {
+		// Not a git checkout, or no git. Nothing to check.
+		return nil
+	}
+	if n := bytes.Count(out, []byte("\n")); n > 0 {
+		slog.Warn(fmt.Sprintf("%s has uncommitted changes to %d files, which will be pushed too:\n%s", goroot, n, bytes.TrimRight(out, "\n")))
+	}
+	return nil
+}
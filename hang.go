@@ -0,0 +1,208 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hangMarkers are substrings of failure outputs that dump every goroutine
+// because the command hung.
+var hangMarkers = []string{
+	"panic: test timed out after",
+	"SIGQUIT: quit",
+	"fatal error: all goroutines are asleep - deadlock!",
+}
+
+// goroutineHeaderRe matches the line starting each goroutine of a dump,
+// capturing its state, like "chan receive, 5 minutes".
+var goroutineHeaderRe = regexp.MustCompile(`^goroutine \d+(?: [^\[]*)? \[([^\]]*)\]:$`)
+
+// idlePackages are packages whose goroutines are present in every dump of a
+// hung test, whatever hung, so they say nothing about the hang.
+var idlePackages = map[string]bool{"runtime": true, "testing": true, "os/signal": true, "main": true}
+
+// maxHangFrames bounds the frames of each goroutine that make up a hang's
+// signature, since the bottom of deep stacks rarely tells hangs apart.
+const maxHangFrames = 20
+
+// goroutineStack is a goroutine of a dump, canonicalized: its state
+// without how long it's been in it, and the functions of its frames.
+type goroutineStack struct {
+	state string
+	funcs []string
+	files []string // file:line of each frame, as far as known
+}
+
+// parseGoroutines parses the goroutines dumped in output.
+func parseGoroutines(output []byte) []goroutineStack {
+	var gs []goroutineStack
+	var g *goroutineStack
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := goroutineHeaderRe.FindStringSubmatch(line); m != nil {
+			state, _, _ := strings.Cut(m[1], ",")
+			gs = append(gs, goroutineStack{state: state})
+			g = &gs[len(gs)-1]
+			continue
+		}
+		switch {
+		case g == nil:
+		case line == "":
+			g = nil
+		case strings.HasPrefix(line, "\t"):
+			if len(g.files) < len(g.funcs) {
+				// Drop the PC offset.
+				file, _, _ := strings.Cut(strings.TrimSpace(line), " +0x")
+				g.files = append(g.files, file)
+			}
+		case strings.HasPrefix(line, "created by "), strings.HasPrefix(line, "..."):
+			// The creator's or elided frames.
+		default:
+			// Drop the arguments.
+			if i := strings.LastIndex(line, "("); i > 0 && strings.HasSuffix(line, ")") {
+				line = line[:i]
+			}
+			g.funcs = append(g.funcs, line)
+		}
+	}
+	return gs
+}
+
+// funcPackage returns the import path of the package of the function fn,
+// as it appears in a stack trace. Builtins like panic are in the runtime.
+func funcPackage(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+	if i := strings.Index(fn[slash+1:], "."); i >= 0 {
+		return fn[:slash+1+i]
+	}
+	return "runtime"
+}
+
+// idle reports whether every frame of g is in one of idlePackages.
+func (g *goroutineStack) idle() bool {
+	for _, fn := range g.funcs {
+		if !idlePackages[funcPackage(fn)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *goroutineStack) key() string {
+	funcs := g.funcs
+	if len(funcs) > maxHangFrames {
+		funcs = funcs[:maxHangFrames]
+	}
+	return g.state + "\n" + strings.Join(funcs, "\n")
+}
+
+// describe returns a one-line description of g: its state, and the first
+// few of its frames outside the runtime.
+func (g *goroutineStack) describe() string {
+	var funcs []string
+	for _, fn := range g.funcs {
+		if funcPackage(fn) != "runtime" && len(funcs) < 3 {
+			funcs = append(funcs, fn)
+		}
+	}
+	return fmt.Sprintf("[%s] %s", g.state, strings.Join(funcs, " < "))
+}
+
+// hangSignature returns a signature of the hang whose goroutines are
+// dumped in output, made of its distinctive goroutines: those that aren't
+// idle, or all of them if they all are. Two dumps of the same hang have the
+// same signature, whatever their goroutine IDs, argument values, and wait
+// times. It also returns a description of the first distinctive goroutine,
+// or "" if output isn't a dump of a hang.
+func hangSignature(output []byte) (sig [sha256.Size]byte, desc string) {
+	hung := false
+	for _, m := range hangMarkers {
+		hung = hung || bytes.Contains(output, []byte(m))
+	}
+	if !hung {
+		return sig, ""
+	}
+	gs := parseGoroutines(output)
+	var distinct []goroutineStack
+	for _, g := range gs {
+		if !g.idle() {
+			distinct = append(distinct, g)
+		}
+	}
+	if len(distinct) == 0 {
+		distinct = gs
+	}
+	if len(distinct) == 0 {
+		return sig, ""
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, g := range distinct {
+		if k := g.key(); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return sha256.Sum256([]byte(strings.Join(keys, "\n\n"))), distinct[0].describe()
+}
+
+// hangCluster is a distinct hang, standing in for every failure whose
+// goroutine dump has the same signature.
+type hangCluster struct {
+	ID          string `json:"id"`
+	Count       int    `json:"count"`       // number of failures with this hang
+	Example     string `json:"example"`     // output of the first of them
+	Description string `json:"description"` // of its first distinctive goroutine
+}
+
+// recordHang clusters the failure with the given output, saved to path, by
+// the hang it dumps the goroutines of, if any, and returns the ID of its
+// cluster.
+func (s *session) recordHang(output []byte, path string) string {
+	sig, desc := hangSignature(output)
+	if desc == "" {
+		return ""
+	}
+	id := fmt.Sprintf("%x", sig[:4])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.hangs {
+		if c.ID == id {
+			c.Count++
+			return id
+		}
+	}
+	s.hangs = append(s.hangs, &hangCluster{ID: id, Count: 1, Example: path, Description: desc})
+	return id
+}
+
+// writeHangs writes the distinct hangs among the session's failures, most
+// frequent first.
+func (st *sessionStatus) writeHangs(w io.Writer) {
+	if len(st.Hangs) == 0 {
+		return
+	}
+	hangs := append([]hangCluster(nil), st.Hangs...)
+	total := 0
+	for _, c := range hangs {
+		total += c.Count
+	}
+	sort.SliceStable(hangs, func(i, j int) bool { return hangs[i].Count > hangs[j].Count })
+	fmt.Fprintf(w, "  %d distinct hangs among %d failures with goroutine dumps:\n", len(hangs), total)
+	for _, c := range hangs {
+		fmt.Fprintf(w, "    %s (%d times, like %s): %s\n", c.ID, c.Count, c.Example, c.Description)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var heartbeatPeriod time.Duration
+
+func init() {
+	flag.DurationVar(&heartbeatPeriod, "heartbeat", time.Minute, "how often to log a line summarizing the session's progress (0 disables it)")
+}
+
+// heartbeat periodically logs a summary of the session's progress until ctx
+// is done, so that long, quiet sessions visibly make progress.
+func heartbeat(ctx context.Context) {
+	if heartbeatPeriod <= 0 {
+		return
+	}
+	t := time.NewTicker(heartbeatPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		st := sess.status()
+		log.Print(st.progress())
+		if d := st.detection(); d != "" {
+			log.Printf("Estimated %s", d)
+		}
+	}
+}
+
+// progress returns a one-line summary of the session's progress.
+func (st *sessionStatus) progress() string {
+	elapsed := time.Since(st.Start)
+	n := st.iterations()
+	rate := float64(n) / elapsed.Minutes()
+	active := 0
+	for _, is := range st.Instances {
+		if is.State == "running" {
+			active++
+		}
+	}
+	return fmt.Sprintf("Progress after %s: %d iterations (%.1f/min), %d matching failures, %d unmatched, %d active instances.",
+		elapsed.Round(time.Second), n, rate, st.Results[swarm.FailMatched.String()], st.Results[swarm.FailUnmatched.String()], active)
+}
@@ -0,0 +1,377 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// The session history is a file of JSON lines, one per session, kept in the
+// user cache directory, so that goswarm history can answer questions like
+// how often a failure has reproduced across the past month of sessions.
+
+var historyFile string
+
+var (
+	historySince    time.Duration
+	historySig      string
+	historySessions bool
+	historyJSON     bool
+)
+
+var historyFlags = flag.NewFlagSet("history", flag.ExitOnError)
+
+func init() {
+	flag.StringVar(&historyFile, "history", defaultHistoryFile(), "file to record the session in when it ends, for goswarm history (\"\" records nothing)")
+	historyFlags.StringVar(&historyFile, "history", defaultHistoryFile(), "file the sessions are recorded in")
+	historyFlags.DurationVar(&historySince, "since", 30*24*time.Hour, "only consider sessions that started at most this long ago (0 considers all of them)")
+	historyFlags.StringVar(&historySig, "sig", "", "list every failure whose signature starts with this prefix, rather than a summary of the signatures")
+	historyFlags.BoolVar(&historySessions, "sessions", false, "list the sessions, rather than a summary of the signatures")
+	historyFlags.BoolVar(&historyJSON, "json", false, "print the sessions as recorded, one JSON object per line")
+}
+
+func defaultHistoryFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goswarm", "history.jsonl")
+}
+
+// historyRecord is a session in the history.
+type historyRecord struct {
+	PID        int              `json:"pid"`
+	Name       string           `json:"name,omitempty"`
+	Host       string           `json:"host"`
+	Dir        string           `json:"dir"` // working directory
+	Start      time.Time        `json:"start"`
+	End        time.Time        `json:"end"`
+	Types      []string         `json:"types"`
+	Command    []string         `json:"command"`
+	Env        []string         `json:"env,omitempty"`
+	Iterations int              `json:"iterations"`
+	Results    map[string]int   `json:"results"`
+	Failures   []historyFailure `json:"failures,omitempty"`
+	Unmatched  []historyFailure `json:"unmatched,omitempty"`
+	Error      string           `json:"error,omitempty"`  // why the session ended early
+	Commit     string           `json:"commit,omitempty"` // of the GOROOT pushed
+	CommitTime *time.Time       `json:"commit_time,omitempty"`
+}
+
+// historyFailure is a failure, or with Count, an unmatched output
+// recurring Count times, in the history.
+type historyFailure struct {
+	Time      time.Time `json:"time,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Signature string    `json:"signature"`
+	Tests     []string  `json:"tests,omitempty"`
+	Known     string    `json:"known,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	Artifacts []string  `json:"artifacts"` // absolute paths
+}
+
+// signatureString returns the form of a failure signature recorded in the
+// history: short, but still unlikely to collide.
+func signatureString(sig [32]byte) string {
+	return hex.EncodeToString(sig[:8])
+}
+
+// absPaths returns paths made absolute, so that they're meaningful in the
+// history regardless of where goswarm history runs.
+func absPaths(paths []string) []string {
+	abs := make([]string, len(paths))
+	for i, p := range paths {
+		abs[i], _ = filepath.Abs(p)
+	}
+	return abs
+}
+
+// recordHistory appends the session, which ended with err, to -history.
+func recordHistory(err error) {
+	if historyFile == "" || dryRun {
+		return
+	}
+	st := sess.status()
+	host, _ := os.Hostname()
+	dir, _ := os.Getwd()
+	r := historyRecord{
+		PID:        st.PID,
+		Name:       st.Name,
+		Host:       host,
+		Dir:        dir,
+		Start:      st.Start,
+		End:        time.Now(),
+		Types:      st.Types,
+		Command:    redactArgs(st.Command),
+		Env:        redactEnv(env),
+		Iterations: st.iterations(),
+		Results:    st.Results,
+	}
+	if len(r.Types) == 0 {
+		r.Types = []string{st.Type}
+	}
+	if err != nil && err != errStop {
+		r.Error = redactString(err.Error())
+	}
+	if goroot, _ := pushRoot(); goroot != "" {
+		r.Commit, r.CommitTime = gorootCommit(goroot)
+	}
+	for _, f := range st.Failures {
+		r.Failures = append(r.Failures, historyFailure{
+			Time:      f.Time,
+			Instance:  f.Instance,
+			Type:      f.InstanceType,
+			Signature: f.Signature,
+			Tests:     f.Tests,
+			Known:     f.Known,
+			Artifacts: absPaths(f.artifacts()),
+		})
+	}
+	for _, u := range st.Unmatched {
+		r.Unmatched = append(r.Unmatched, historyFailure{
+			Signature: signatureString(u.sig),
+			Count:     u.Count,
+			Artifacts: absPaths([]string{u.Path}),
+		})
+	}
+	if trendAlpha > 0 {
+		// Before recording the session, so it's only compared to others.
+		warnTrends(r)
+	}
+	b, jerr := json.Marshal(r)
+	if jerr != nil {
+		log.Printf("Failed to record the session in %s: %v", historyFile, jerr)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(historyFile), 0o755); err != nil {
+		log.Printf("Failed to record the session in %s: %v", historyFile, err)
+		return
+	}
+	f, ferr := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if ferr != nil {
+		log.Printf("Failed to record the session in %s: %v", historyFile, ferr)
+		return
+	}
+	defer f.Close()
+	// A single write, so that concurrent sessions don't interleave.
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("Failed to record the session in %s: %v", historyFile, err)
+	}
+}
+
+// loadHistory returns the sessions in -history that started at most
+// -since ago, oldest first.
+func loadHistory() ([]historyRecord, error) {
+	f, err := os.Open(historyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []historyRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		var r historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			log.Printf("Skipping malformed session at %s:%d: %v", historyFile, line, err)
+			continue
+		}
+		if historySince > 0 && time.Since(r.Start) > historySince {
+			continue
+		}
+		recs = append(recs, r)
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+	return recs, sc.Err()
+}
+
+// historyCmd implements the history subcommand.
+func historyCmd(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if historyFile == "" {
+		return usageErrorf("no history file")
+	}
+	recs, err := loadHistory()
+	if err != nil {
+		return fmt.Errorf("reading session history: %v", err)
+	}
+	switch {
+	case historyJSON:
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range recs {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	case historySessions:
+		printHistorySessions(recs)
+	case historySig != "":
+		printSignatureHistory(recs, historySig)
+	default:
+		printSignatureSummary(recs)
+	}
+	return nil
+}
+
+// printHistorySessions lists the sessions recs.
+func printHistorySessions(recs []historyRecord) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "START\tDURATION\tTYPES\tITERATIONS\tMATCHED\tUNMATCHED\tCOMMAND\n")
+	for _, r := range recs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			r.Start.Local().Format("2006-01-02 15:04"),
+			r.End.Sub(r.Start).Round(time.Second),
+			strings.Join(r.Types, ","),
+			r.Iterations,
+			r.Results[swarm.FailMatched.String()],
+			r.Results[swarm.FailUnmatched.String()],
+			strings.Join(r.Command, " "))
+	}
+	tw.Flush()
+}
+
+// signatureStats summarizes the failures with one signature.
+type signatureStats struct {
+	sig         string
+	failures    int
+	sessions    int
+	first, last time.Time
+	desc        string
+	artifacts   [][]string // of each of the latest failures
+}
+
+// maxClusterArtifacts is how many failures' artifacts signatureStats keeps.
+const maxClusterArtifacts = 5
+
+// summarizeSignatures returns how many times, and in how many sessions,
+// each failure signature occurred in recs, most frequent first.
+func summarizeSignatures(recs []historyRecord) []*signatureStats {
+	stats := make(map[string]*signatureStats)
+	for _, r := range recs {
+		seen := make(map[string]bool)
+		for _, f := range append(r.Failures[:len(r.Failures):len(r.Failures)], r.Unmatched...) {
+			if f.Signature == "" {
+				continue
+			}
+			s := stats[f.Signature]
+			if s == nil {
+				s = &signatureStats{sig: f.Signature}
+				stats[f.Signature] = s
+			}
+			s.failures += max(f.Count, 1)
+			if !seen[f.Signature] {
+				seen[f.Signature] = true
+				s.sessions++
+			}
+			if r.End.After(s.last) {
+				s.last = r.End
+			}
+			if s.first.IsZero() || r.Start.Before(s.first) {
+				s.first = r.Start
+			}
+			s.artifacts = append(s.artifacts, f.Artifacts)
+			if len(s.artifacts) > maxClusterArtifacts {
+				s.artifacts = s.artifacts[1:]
+			}
+			switch {
+			case f.Known != "":
+				s.desc = f.Known
+			case len(f.Tests) > 0:
+				s.desc = strings.Join(f.Tests, " ")
+			case s.desc == "" && len(f.Artifacts) > 0:
+				s.desc = f.Artifacts[0]
+			}
+		}
+	}
+	var list []*signatureStats
+	for _, s := range stats {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].failures != list[j].failures {
+			return list[i].failures > list[j].failures
+		}
+		return list[i].sig < list[j].sig
+	})
+	return list
+}
+
+// printSignatureSummary lists the failure signatures in recs, with how
+// many times and in how many sessions each occurred, most frequent first.
+func printSignatureSummary(recs []historyRecord) {
+	list := summarizeSignatures(recs)
+	fmt.Printf("%d sessions", len(recs))
+	if historySince > 0 {
+		fmt.Printf(" in the last %s", historySince)
+	}
+	fmt.Printf(".\n")
+	if len(list) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "SIGNATURE\tFAILURES\tSESSIONS\tLAST\tDESCRIPTION\n")
+	for _, s := range list {
+		fmt.Fprintf(tw, "%s\t%d\t%d of %d\t%s\t%s\n", s.sig, s.failures, s.sessions, len(recs), s.last.Local().Format("2006-01-02 15:04"), s.desc)
+	}
+	tw.Flush()
+}
+
+// printSignatureHistory lists every failure in recs whose signature starts
+// with prefix.
+func printSignatureHistory(recs []historyRecord, prefix string) {
+	failures, sessions := 0, 0
+	for _, r := range recs {
+		found := false
+		for _, f := range append(r.Failures[:len(r.Failures):len(r.Failures)], r.Unmatched...) {
+			if !strings.HasPrefix(f.Signature, prefix) {
+				continue
+			}
+			found = true
+			failures += max(f.Count, 1)
+			when := f.Time
+			if when.IsZero() {
+				when = r.End
+			}
+			fmt.Printf("%s %s", when.Local().Format("2006-01-02 15:04"), f.Signature)
+			if f.Count > 1 {
+				fmt.Printf(" (%d times, unmatched)", f.Count)
+			} else if f.Count == 1 {
+				fmt.Printf(" (unmatched)")
+			}
+			if f.Instance != "" {
+				fmt.Printf(" on %s", f.Instance)
+			}
+			fmt.Printf(" in %s\n", strings.Join(r.Command, " "))
+			for _, a := range f.Artifacts {
+				fmt.Printf("    %s\n", a)
+			}
+		}
+		if found {
+			sessions++
+		}
+	}
+	fmt.Printf("%d failures in %d of %d sessions.\n", failures, sessions, len(recs))
+}
@@ -0,0 +1,302 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var htmlReportOut string
+
+var htmlReportFlags = flag.NewFlagSet("report", flag.ExitOnError)
+
+func init() {
+	htmlReportFlags.StringVar(&historyFile, "history", defaultHistoryFile(), "file the sessions are recorded in")
+	htmlReportFlags.DurationVar(&historySince, "since", 30*24*time.Hour, "only report on sessions that started at most this long ago (0 reports on all of them)")
+	htmlReportFlags.StringVar(&htmlReportOut, "o", "goswarm-report.html", "file to write the report to (- for standard output)")
+}
+
+// reportDay is a day's worth of sessions in an HTML report.
+type reportDay struct {
+	Day        string
+	Sessions   int
+	Iterations int
+	Failures   int
+	Rate       float64 // failures per iteration
+}
+
+// reportCluster is the failures with one signature in an HTML report.
+type reportCluster struct {
+	Signature   string
+	Failures    int
+	Sessions    int
+	Rate        float64 // failures per iteration, over the whole report
+	First, Last time.Time
+	Description string
+	Artifacts   [][]string
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"link": htmlReportLink,
+	"pct": func(f float64) string {
+		return fmt.Sprintf("%.2f%%", 100*f)
+	},
+	"bar": func(f, top float64) string {
+		if top == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%.1f", 100*f/top)
+	},
+	"duration": func(from, to time.Time) time.Duration {
+		return to.Sub(from).Round(time.Second)
+	},
+	"date": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04")
+	},
+	"base": filepath.Base,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>goswarm report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; vertical-align: top; }
+td.num { text-align: right; }
+code { font-size: 90%; }
+.bar { background: #c33; height: 0.8em; }
+.barbox { width: 10em; background: #eee; }
+</style>
+</head>
+<body>
+<h1>goswarm report</h1>
+<p>{{.Sessions}} sessions{{with .Since}} in the last {{.}}{{end}}, from {{date .From}} to {{date .To}}:
+{{.Iterations}} iterations, {{.Failures}} failures ({{pct .Rate}}).</p>
+
+<h2>Failure clusters</h2>
+{{if .Clusters}}<table>
+<tr><th>Signature</th><th>Failures</th><th>Sessions</th><th>Rate</th><th>First seen</th><th>Last seen</th><th>Description</th></tr>
+{{range .Clusters}}<tr>
+<td><code>{{.Signature}}</code></td>
+<td class="num">{{.Failures}}</td>
+<td class="num">{{.Sessions}} of {{$.Sessions}}</td>
+<td class="num">{{pct .Rate}}</td>
+<td>{{date .First}}</td>
+<td>{{date .Last}}</td>
+<td>{{.Description}}
+{{with .Artifacts}}<details><summary>Latest artifacts</summary><ul>
+{{range .}}<li>{{range .}}<a href="{{link .}}">{{base .}}</a> {{end}}</li>
+{{end}}</ul></details>{{end}}</td>
+</tr>
+{{end}}</table>{{else}}<p>No failures.</p>{{end}}
+
+<h2>Failure rate over time</h2>
+<table>
+<tr><th>Day</th><th>Sessions</th><th>Iterations</th><th>Failures</th><th colspan="2">Rate</th></tr>
+{{range .Days}}<tr>
+<td>{{.Day}}</td>
+<td class="num">{{.Sessions}}</td>
+<td class="num">{{.Iterations}}</td>
+<td class="num">{{.Failures}}</td>
+<td class="num">{{pct .Rate}}</td>
+<td><div class="barbox"><div class="bar" style="width: {{bar .Rate $.MaxRate}}%"></div></div></td>
+</tr>
+{{end}}</table>
+
+<h2>Sessions</h2>
+<table>
+<tr><th>Start</th><th>Duration</th><th>Types</th><th>Iterations</th><th>Matched</th><th>Unmatched</th><th>Command</th></tr>
+{{range .Records}}<tr>
+<td>{{date .Start}}</td>
+<td>{{duration .Start .End}}</td>
+<td>{{join .Types ", "}}</td>
+<td class="num">{{.Iterations}}</td>
+<td class="num">{{index .Results "matched"}}</td>
+<td class="num">{{index .Results "unmatched"}}</td>
+<td><code>{{join .Command " "}}</code>{{with .Error}}<br>{{.}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// htmlLinkBase is the directory the artifact links of an HTML report
+// are relative to: the report's own.
+var htmlLinkBase string
+
+// htmlReportLink returns a link to the artifact at path from the HTML report:
+// relative if it's under the report's directory, so that the report can be
+// moved along with its artifacts, and a file URL otherwise.
+func htmlReportLink(path string) string {
+	if rel, err := filepath.Rel(htmlLinkBase, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// stateRecord returns the session saved in the state file at path in the
+// form of a session in the history.
+func stateRecord(path string) (historyRecord, error) {
+	st, err := loadState(path)
+	if err != nil {
+		return historyRecord{}, err
+	}
+	r := historyRecord{
+		Start:   st.Start,
+		Types:   strings.Split(st.Type, ","),
+		Command: redactArgs(st.Command),
+		Results: st.Results,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		r.End = fi.ModTime()
+	}
+	for _, n := range st.Results {
+		r.Iterations += n
+	}
+	r.Iterations -= st.Results[swarm.ExecutionError.String()]
+	// Artifact paths are relative to where the session ran, which the
+	// state file is usually saved in.
+	dir := filepath.Dir(path)
+	for _, f := range st.Failures {
+		var paths []string
+		for _, p := range f.artifacts() {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			paths = append(paths, p)
+		}
+		r.Failures = append(r.Failures, historyFailure{
+			Time:      f.Time,
+			Instance:  f.Instance,
+			Type:      f.InstanceType,
+			Signature: f.Signature,
+			Tests:     f.Tests,
+			Known:     f.Known,
+			Artifacts: absPaths(paths),
+		})
+	}
+	return r, nil
+}
+
+// htmlReportCmd implements the report subcommand.
+func htmlReportCmd(args []string) error {
+	var recs []historyRecord
+	switch len(args) {
+	case 0:
+		if historyFile == "" {
+			return usageErrorf("no history file")
+		}
+		var err error
+		recs, err = loadHistory()
+		if err != nil {
+			return fmt.Errorf("reading session history: %v", err)
+		}
+	case 1:
+		r, err := stateRecord(args[0])
+		if err != nil {
+			return err
+		}
+		recs = []historyRecord{r}
+		historySince = 0
+	default:
+		return usageErrorf("expected at most a state file")
+	}
+	if len(recs) == 0 {
+		return fmt.Errorf("no sessions to report on")
+	}
+
+	htmlLinkBase = "."
+	if htmlReportOut != "-" {
+		htmlLinkBase = filepath.Dir(htmlReportOut)
+	}
+	htmlLinkBase, _ = filepath.Abs(htmlLinkBase)
+
+	data := struct {
+		Sessions      int
+		Since         time.Duration
+		From, To      time.Time
+		Iterations    int
+		Failures      int
+		Rate, MaxRate float64
+		Clusters      []reportCluster
+		Days          []reportDay
+		Records       []historyRecord
+	}{
+		Sessions: len(recs),
+		Since:    historySince,
+		From:     recs[0].Start,
+		To:       recs[len(recs)-1].End,
+		Records:  recs,
+	}
+	var days []*reportDay
+	for _, r := range recs {
+		day := r.Start.Local().Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Day != day {
+			days = append(days, &reportDay{Day: day})
+		}
+		d := days[len(days)-1]
+		failures := r.Results[swarm.FailMatched.String()] + r.Results[swarm.FailUnmatched.String()]
+		d.Sessions++
+		d.Iterations += r.Iterations
+		d.Failures += failures
+		data.Iterations += r.Iterations
+		data.Failures += failures
+		if r.End.After(data.To) {
+			data.To = r.End
+		}
+	}
+	for _, d := range days {
+		if d.Iterations > 0 {
+			d.Rate = float64(d.Failures) / float64(d.Iterations)
+		}
+		data.MaxRate = max(data.MaxRate, d.Rate)
+		data.Days = append(data.Days, *d)
+	}
+	if data.Iterations > 0 {
+		data.Rate = float64(data.Failures) / float64(data.Iterations)
+	}
+	for _, s := range summarizeSignatures(recs) {
+		c := reportCluster{
+			Signature:   s.sig,
+			Failures:    s.failures,
+			Sessions:    s.sessions,
+			First:       s.first,
+			Last:        s.last,
+			Description: s.desc,
+			Artifacts:   s.artifacts,
+		}
+		if data.Iterations > 0 {
+			c.Rate = float64(c.Failures) / float64(data.Iterations)
+		}
+		data.Clusters = append(data.Clusters, c)
+	}
+
+	var b bytes.Buffer
+	if err := htmlReportTemplate.Execute(&b, data); err != nil {
+		return err
+	}
+	if htmlReportOut == "-" {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+	if err := os.WriteFile(htmlReportOut, b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	log.Printf("Wrote report on %d sessions to %s.", len(recs), htmlReportOut)
+	return nil
+}
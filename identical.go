@@ -0,0 +1,128 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var skipIdentical bool
+
+func init() {
+	flag.BoolVar(&skipIdentical, "skip-identical", false, "treat the command as deterministic: skip iterations identical to one that already passed on the same instance, with the same command, environment, -step commands, and pushed tree, and the same seed as far as templates use {{.Seed}}, and count the skipped iterations in the summary")
+}
+
+// errIdentical is returned for an iteration skipped with -skip-identical.
+var errIdentical = errors.New("identical to an iteration that passed")
+
+// maxIdenticalSkips is how many iterations in a row an instance skips with
+// -skip-identical before it stops, having nothing different left to run.
+const maxIdenticalSkips = 100
+
+// identical is the iterations that passed on each instance, with
+// -skip-identical.
+var identical struct {
+	sync.Mutex
+	passed map[string]map[string]bool // keys of iterations, by instance
+}
+
+// identicalKey returns the key of an iteration running cmd with runEnv,
+// after the -step commands steps, all expanded. Two iterations with the
+// same key on an instance are the same as far as goswarm can tell: the seed
+// is only part of the key through the templates using it, since
+// $GOSWARM_SEED differs every time.
+func identicalKey(cmd, runEnv, steps []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", pushGen.Load(), currentStamp())
+	for _, ss := range [][]string{cmd, runEnv, steps} {
+		for _, s := range ss {
+			if strings.HasPrefix(s, "GOSWARM_SEED=") {
+				continue
+			}
+			fmt.Fprintf(h, "%s\x00", s)
+		}
+		fmt.Fprintf(h, "\x01")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// identicalPassed reports whether an iteration with key passed on inst.
+func identicalPassed(inst, key string) bool {
+	identical.Lock()
+	defer identical.Unlock()
+	return identical.passed[inst][key]
+}
+
+// recordIdenticalPass records that an iteration with key passed on inst.
+func recordIdenticalPass(inst, key string) {
+	identical.Lock()
+	defer identical.Unlock()
+	if identical.passed == nil {
+		identical.passed = make(map[string]map[string]bool)
+	}
+	if identical.passed[inst] == nil {
+		identical.passed[inst] = make(map[string]bool)
+	}
+	identical.passed[inst][key] = true
+}
+
+// skippedCell is the iterations of one command on one instance type that
+// -skip-identical skipped.
+type skippedCell struct {
+	Type    string `json:"type"`
+	Command string `json:"command,omitempty"` // of -commands
+	Skipped int    `json:"skipped"`
+}
+
+// recordSkip counts an iteration skipped with -skip-identical on an
+// instance of type typ, running the command of -commands with index i, or
+// -1.
+func (s *session) recordSkip(typ string, i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cell := skippedCell{Type: typ}
+	if i >= 0 {
+		cell.Command = commandList[i]
+	}
+	if s.skipped == nil {
+		s.skipped = make(map[skippedCell]int)
+	}
+	s.skipped[cell]++
+}
+
+// writeSkipped writes the iterations skipped with -skip-identical, by
+// instance type and command.
+func (st *sessionStatus) writeSkipped(w io.Writer) {
+	if len(st.Skipped) == 0 {
+		return
+	}
+	total := 0
+	for _, c := range st.Skipped {
+		total += c.Skipped
+	}
+	fmt.Fprintf(w, "  skipped %d iterations identical to ones that passed (-skip-identical):\n", total)
+	cells := append([]skippedCell(nil), st.Skipped...)
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Type != cells[j].Type {
+			return cells[i].Type < cells[j].Type
+		}
+		return cells[i].Command < cells[j].Command
+	})
+	for _, c := range cells {
+		if c.Command != "" {
+			fmt.Fprintf(w, "    %s, %s: %d\n", c.Type, c.Command, c.Skipped)
+		} else {
+			fmt.Fprintf(w, "    %s: %d\n", c.Type, c.Skipped)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// interrupts tracks how many times the session has been interrupted.
+var interrupts struct {
+	sync.Mutex
+	n      int
+	cancel context.CancelFunc
+	pool   *swarm.Pool
+	hold   context.CancelFunc // ends a hold after the pool is done
+}
+
+// handleInterrupts handles Ctrl-C for a session. The first interrupt stops
+// the pool from starting new iterations, letting in-flight iterations and
+// cleanup finish, or cancels the session outright if the pool hasn't started
+// yet. The second interrupt exits immediately. Signals that the process is
+// about to be killed, like the console window closing on Windows, cancel
+// the session outright, so that instances are cleaned up in the time left.
+// The returned function stops handling interrupts.
+func handleInterrupts(cancel context.CancelFunc) (stop func()) {
+	interrupts.Lock()
+	interrupts.cancel = cancel
+	interrupts.Unlock()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	term := make(chan os.Signal, 1)
+	if sigs := terminateSignals(); len(sigs) > 0 {
+		signal.Notify(term, sigs...)
+	}
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+			case sig := <-term:
+				interrupts.Lock()
+				interrupts.n++
+				p := interrupts.pool
+				interrupts.Unlock()
+				log.Printf("Received %v, stopping and cleaning up without waiting for in-flight iterations.", sig)
+				if p != nil {
+					p.DrainAll()
+				}
+				cancel()
+				continue
+			case <-quit:
+				return
+			}
+			interrupts.Lock()
+			interrupts.n++
+			n, p, hold := interrupts.n, interrupts.pool, interrupts.hold
+			interrupts.Unlock()
+			if n > 1 {
+				log.Printf("Interrupted again, exiting immediately.")
+				printSummary(os.Stderr)
+				os.Exit(exitNotFound)
+			}
+			if hold != nil {
+				log.Printf("Interrupted, stopping.")
+				hold()
+				continue
+			}
+			if p == nil {
+				log.Printf("Interrupted, stopping. Interrupt again to exit immediately.")
+				cancel()
+				continue
+			}
+			log.Printf("Interrupted, waiting for in-flight iterations to finish. Interrupt again to exit immediately.")
+			p.DrainAll()
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		signal.Stop(term)
+		close(quit)
+	}
+}
+
+// drainOnInterrupt arranges for an interrupt to drain p.
+func drainOnInterrupt(p *swarm.Pool) {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.pool = p
+}
+
+// holdOnInterrupt arranges for an interrupt to call stop rather than drain
+// the pool, which is done.
+func holdOnInterrupt(stop context.CancelFunc) {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.hold = stop
+}
+
+// interrupted reports whether the session has been interrupted.
+func interrupted() bool {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	return interrupts.n > 0
+}
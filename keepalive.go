@@ -0,0 +1,201 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// Parking keeps a session's instances alive after it exits, so that the
+// next session can adopt them rather than wait for new instances to be
+// created and pushed to. Parked instances are marked in the registry, and a
+// background goswarm keepalive process pings them until they're adopted, or
+// destroys them once they've been parked for -keep-alive.
+
+var keepAlive time.Duration
+
+// parkedAny is whether the session has parked any instances.
+var parkedAny atomic.Bool
+
+var keepAliveFlags = flag.NewFlagSet("keepalive", flag.ExitOnError)
+
+func init() {
+	flag.DurationVar(&keepAlive, "keep-alive", 0, "on exit, rather than destroy instances or leave them to expire, park them for this long, keeping them alive in the background, so that the next session of the same instance type adopts them right away, without a push if the tree hasn't changed")
+}
+
+// parkInstance parks inst, of type typ, for -keep-alive.
+func parkInstance(inst, typ string) {
+	updateRegistry(func(reg map[string]registryEntry) {
+		e, ok := reg[inst]
+		if !ok {
+			host, _ := os.Hostname()
+			e = registryEntry{Type: typ, Created: time.Now(), Owner: os.Getpid(), Host: host, Session: sessionName}
+		}
+		until := time.Now().Add(keepAlive)
+		e.Parked = &until
+		reg[inst] = e
+	})
+}
+
+// adoptParked queues up the parked instances of the types typs for
+// adoption by the pool.
+func (s *session) adoptParked(typs []string) error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return fmt.Errorf("reading instance registry: %v", err)
+	}
+	var names []string
+	for name, e := range reg {
+		if e.Parked != nil && time.Now().Before(*e.Parked) && slices.Contains(typs, e.Type) && !ownedByOtherSession(e) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		log.Printf("Adopting parked instance %s.", name)
+		s.adopt = append(s.adopt, adoption{instanceState: instanceState{Name: name, Type: reg[name].Type}, push: true})
+	}
+	return nil
+}
+
+// keeperLog returns the path of the log of the keepalive process.
+func keeperLog() (string, error) {
+	path, err := registryPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "keepalive.log"), nil
+}
+
+// startKeeper starts a goswarm keepalive process in the background to keep
+// the parked instances alive, unless one is already running.
+func startKeeper() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logPath, err := keeperLog()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := []string{"keepalive"}
+	for _, v := range gomoteFlags {
+		args = append(args, "-gomote-flag="+v)
+	}
+	for _, v := range gomoteEnv {
+		args = append(args, "-gomote-env="+v)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Keeping parked instances alive in the background, logging to %s.", logPath)
+	return cmd.Process.Release()
+}
+
+// claimKeeper makes this process the only keepalive process, reporting
+// false if another one is already running. The returned function gives up
+// the claim.
+func claimKeeper() (release func(), ok bool, err error) {
+	path, err := registryPath()
+	if err != nil {
+		return nil, false, err
+	}
+	path = filepath.Join(filepath.Dir(path), "keepalive.pid")
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, true, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, false, err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && processAlive(pid) {
+			return nil, false, nil
+		}
+		os.Remove(path)
+	}
+}
+
+// keepAliveCmd implements the keepalive subcommand.
+func keepAliveCmd(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("unexpected arguments: %v", args)
+	}
+	if err := setUpGomote(); err != nil {
+		return usageErrorf("%v", err)
+	}
+	backendName, backend = "gomote", swarm.Gomote
+	release, ok, err := claimKeeper()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer release()
+	ctx := context.Background()
+	pinger := backend.(swarm.Pinger)
+	for {
+		reg, err := loadRegistry()
+		if err != nil {
+			return fmt.Errorf("reading instance registry: %v", err)
+		}
+		parked := 0
+		for name, e := range reg {
+			if e.Parked == nil || ownedByOtherSession(e) {
+				continue
+			}
+			if time.Now().After(*e.Parked) {
+				log.Printf("Destroying %s, parked for longer than -keep-alive.", name)
+				if err := backend.Destroy(ctx, name); err != nil {
+					log.Printf("Error destroying instance %s: %v", name, err)
+				}
+				unregisterInstance(name)
+				continue
+			}
+			parked++
+			if err := pinger.Ping(ctx, name); err != nil {
+				log.Printf("Error pinging parked instance %s: %v", name, unwrap(err))
+			}
+		}
+		if parked == 0 {
+			log.Printf("No parked instances left.")
+			return nil
+		}
+		time.Sleep(keepalivePeriod)
+	}
+}
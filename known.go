@@ -0,0 +1,71 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	knownIssuesFile string
+	skipKnown       bool
+)
+
+func init() {
+	flag.StringVar(&knownIssuesFile, "known-issues", "", "JSON file of known failure signatures, each a regexp 'pattern' mapped to an 'issue', with which to label failures")
+	flag.BoolVar(&skipKnown, "skip-known", false, "treat failures matching a known issue as unmatched")
+}
+
+// knownIssue is a known failure signature.
+//
+// A known issues file is a JSON array of them, typically shared by a team:
+//
+//	[
+//		{"pattern": "fatal error: found bad pointer in Go heap", "issue": "golang/go#12345"}
+//	]
+type knownIssue struct {
+	Pattern string `json:"pattern"`
+	Issue   string `json:"issue"`
+
+	re *regexp.Regexp
+}
+
+// knownIssues are the known issues loaded from -known-issues.
+var knownIssues []knownIssue
+
+// loadKnownIssues loads the known issues file at path.
+func loadKnownIssues(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var issues []knownIssue
+	if err := json.Unmarshal(b, &issues); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range issues {
+		re, err := regexp.Compile(issues[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: issue %s: %v", path, issues[i].Issue, err)
+		}
+		issues[i].re = re
+	}
+	knownIssues = issues
+	return nil
+}
+
+// knownIssueFor returns the known issue that output matches, or "".
+func knownIssueFor(output []byte) string {
+	for _, k := range knownIssues {
+		if k.re.Match(output) {
+			return k.Issue
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	createConcurrency uint
+	createInterval    time.Duration
+	opConcurrency     uint
+	pushConcurrency   uint
+)
+
+func init() {
+	flag.UintVar(&createConcurrency, "create-concurrency", 0, "maximum number of instances to create at once; 0 means no limit")
+	flag.DurationVar(&createInterval, "create-interval", 0, "minimum time between starting instance creations")
+	flag.UintVar(&pushConcurrency, "push-concurrency", 4, "maximum number of pushes to run at once, so that a few finish, and their instances start running, while the rest of the pool is still being created and pushed to, rather than every push sharing the bandwidth and finishing at about the same time; 0 means no limit")
+	flag.UintVar(&opConcurrency, "op-concurrency", 0, "maximum number of gomote operations, like creates, pushes, and archive downloads, to run at once, whatever the size of the pool; runs of the command aren't limited; 0 means no limit")
+}
+
+// createLimiter staggers instance creation.
+var createLimiter = new(limiter)
+
+// opLimiter bounds the gomote operations in flight, other than runs.
+var opLimiter = new(limiter)
+
+// pushLimiter bounds the pushes in flight, pipelining the pool's startup.
+var pushLimiter = new(limiter)
+
+// limitOp calls f, a gomote operation, once opLimiter allows it.
+func limitOp(ctx context.Context, f func() error) error {
+	if err := opLimiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer opLimiter.release()
+	return f()
+}
+
+// limitedBackend is a backend whose operations are limited by limitOp, for
+// the swarm's own use. With the session's hooks, the swarm only ever
+// destroys the instances it replaces itself.
+type limitedBackend struct {
+	swarm.Backend
+}
+
+func (b limitedBackend) Destroy(ctx context.Context, inst string) error {
+	return limitOp(ctx, func() error { return b.Backend.Destroy(ctx, inst) })
+}
+
+// limiter bounds the concurrency and rate of some operation.
+// The zero value imposes no limits.
+type limiter struct {
+	sem      chan struct{} // nil for unlimited concurrency
+	interval time.Duration // minimum time between operations starting
+
+	mu   sync.Mutex
+	next time.Time // earliest time the next operation may start
+}
+
+func newLimiter(concurrency uint, interval time.Duration) *limiter {
+	l := &limiter{interval: interval}
+	if concurrency > 0 {
+		l.sem = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// acquire waits until an operation may start. If it returns nil, the caller
+// must call release when the operation is done.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if l.interval > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+		l.mu.Unlock()
+		select {
+		case <-time.After(time.Until(start)):
+		case <-ctx.Done():
+			l.release()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (l *limiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFile acquires an exclusive lock on path across processes, returning
+// a function that releases it. Locks held by processes that no longer
+// exist are broken.
+func lockFile(path string) (unlock func(), err error) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if b, err := os.ReadFile(path); err == nil {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err == nil && !processAlive(pid) && breakLock(path, pid) {
+				continue
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// staleBreak is how long breaking a lock may take before the breaker is
+// assumed to have died doing it.
+const staleBreak = 10 * time.Second
+
+// breakLock breaks the lock on path held by pid, which no longer exists,
+// and reports whether it did. Processes take turns breaking locks, holding
+// path.break while they do, so that one that saw the same stale lock as
+// another can't go on to remove the lock the other took in its place.
+func breakLock(path string, pid int) bool {
+	brk := path + ".break"
+	f, err := os.OpenFile(brk, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		if fi, err := os.Stat(brk); err == nil && time.Since(fi.ModTime()) > staleBreak {
+			os.Remove(brk)
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(brk)
+	// Check again, now that no other process can break the lock.
+	b, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(pid) {
+		return false
+	}
+	log.Printf("Breaking stale lock %s held by PID %d.", path, pid)
+	os.Remove(path)
+	return true
+}
+
+// ownedByOtherSession reports whether the instance described by e belongs
+// to another goswarm session that is still running on this machine.
+func ownedByOtherSession(e registryEntry) bool {
+	if e.Owner == 0 || e.Owner == os.Getpid() {
+		return false
+	}
+	host, _ := os.Hostname()
+	return e.Host == host && processAlive(e.Owner)
+}
+
+// warnConcurrentSessions logs a warning about other running sessions using
+// the same instance type, since they compete for the same quota.
+func warnConcurrentSessions(typ string) {
+	paths, err := controlSockets()
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		resp, err := sendControl(path, "status")
+		if err != nil || resp.Status.PID == os.Getpid() || resp.Status.Type != typ {
+			continue
+		}
+		log.Printf("Warning: goswarm session %d is also using %d instances of %s; "+
+			"both sessions share your instance quota, and neither will clean up the other's instances.",
+			resp.Status.PID, len(resp.Status.Instances), typ)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deadPID returns the PID of a process that has exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command(exe, "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestLockFileStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(deadPID(t))+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Every locker sees the stale lock at once, and only one may hold the
+	// lock at a time.
+	var held atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockFile(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n := held.Add(1); n > 1 {
+				t.Errorf("%d holders of the lock", n)
+			}
+			time.Sleep(time.Millisecond)
+			held.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if _, err := os.Stat(path + ".break"); !os.IsNotExist(err) {
+		t.Errorf("break lock left behind: %v", err)
+	}
+}
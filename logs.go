@@ -0,0 +1,296 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	artifactsDir string
+	instanceLogs bool
+	logFormat    string
+	logFile      string
+)
+
+func init() {
+	flag.StringVar(&artifactsDir, "artifacts", ".", "directory in which to write failure outputs, archives, and logs")
+	flag.BoolVar(&instanceLogs, "instance-logs", false, "write each instance's log, including the output of every run, to its own file in the artifacts directory's logs subdirectory, keeping the console log condensed")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the console log: text, or json for one structured record per line")
+	flag.StringVar(&logFile, "log-file", "", "also append the log to this file, in the format of -log-format, at full verbosity whatever -v is")
+}
+
+// logFileOut is the open -log-file, if any.
+var logFileOut *os.File
+
+// logLevel is the minimum level of messages logged to the console.
+var logLevel = new(slog.LevelVar)
+
+// logStart is when the session started, in Unix nanoseconds, from which
+// every log line counts the time elapsed. A resumed session counts from
+// the start of the session it resumes.
+var logStart atomic.Int64
+
+// sinceStart returns the time elapsed in the session.
+func sinceStart() time.Duration {
+	return time.Duration(time.Now().UnixNano() - logStart.Load())
+}
+
+// formatElapsed formats d, a time elapsed in the session, for the log, as
+// hours, minutes, and seconds.
+func formatElapsed(d time.Duration) string {
+	s := int64(d / time.Second)
+	return fmt.Sprintf("+%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// logPrefix returns the prefix of a log line written at t: the time, and
+// the time elapsed in the session.
+func logPrefix(t time.Time) string {
+	return t.Format("2006/01/02 15:04:05") + " " + formatElapsed(time.Duration(t.UnixNano()-logStart.Load()))
+}
+
+// setUpLogging directs the log, and the log package, to a slog handler
+// according to -log-format and -v, and to -log-file.
+func setUpLogging() error {
+	logStart.CompareAndSwap(0, time.Now().UnixNano())
+	switch verbosity {
+	case 0:
+		// Quiet mode.
+		logLevel.Set(slog.LevelError + 1)
+	case 1:
+		logLevel.Set(slog.LevelInfo)
+	default:
+		logLevel.Set(slog.LevelDebug)
+	}
+	h, err := newLogHandler(os.Stderr, logLevel, useColor())
+	if err != nil {
+		return err
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening -log-file: %v", err)
+		}
+		fh, err := newLogHandler(f, slog.LevelDebug, false)
+		if err != nil {
+			return err
+		}
+		h = teeHandler{h, fh}
+		logFileOut = f
+	}
+	slog.SetDefault(slog.New(redactHandler{h}))
+	return nil
+}
+
+// newLogHandler returns a handler writing records of at least level to w,
+// in the format of -log-format.
+func newLogHandler(w io.Writer, level slog.Leveler, color bool) (slog.Handler, error) {
+	switch logFormat {
+	case "text":
+		return &textHandler{w: w, level: level, color: color}, nil
+	case "json":
+		return elapsedHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", logFormat)
+}
+
+// textHandler is a slog.Handler that writes messages in the style of the
+// log package, leaving out attributes. Messages name the instance they're
+// about already, and the attributes are meant for the JSON format, though
+// they're used to pick colors.
+type textHandler struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	color bool
+}
+
+func (h *textHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := r.Message
+	if r.Level >= slog.LevelWarn {
+		msg = r.Level.String() + ": " + msg
+	}
+	if h.color {
+		msg = colorize(r, msg)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintf(h.w, "%s %s\n", logPrefix(r.Time), msg)
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *textHandler) WithGroup(string) slog.Handler      { return h }
+
+// teeHandler is a slog.Handler that passes each record on to every one of
+// its handlers that's enabled for it.
+type teeHandler []slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range h {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range h {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	t := make(teeHandler, len(h))
+	for i, h := range h {
+		t[i] = h.WithAttrs(attrs)
+	}
+	return t
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	t := make(teeHandler, len(h))
+	for i, h := range h {
+		t[i] = h.WithGroup(name)
+	}
+	return t
+}
+
+// elapsedHandler is a slog.Handler that adds the time elapsed in the
+// session, in seconds, to each record.
+type elapsedHandler struct {
+	slog.Handler
+}
+
+func (h elapsedHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.Float64("elapsed", time.Duration(r.Time.UnixNano()-logStart.Load()).Seconds()))
+	return h.Handler.Handle(ctx, r)
+}
+
+// instanceLogDir returns the directory holding per-instance logs.
+func instanceLogDir() string {
+	return filepath.Join(artifactsDir, "logs")
+}
+
+// instanceLogFiles holds the open per-instance log files, by instance name.
+var instanceLogFiles struct {
+	sync.Mutex
+	m map[string]*os.File
+}
+
+// instanceLog returns the log file for inst, opening it if necessary, or nil
+// if per-instance logs are disabled or the file can't be opened.
+func instanceLog(inst string) *os.File {
+	if !instanceLogs || inst == "" {
+		return nil
+	}
+	instanceLogFiles.Lock()
+	defer instanceLogFiles.Unlock()
+	if f, ok := instanceLogFiles.m[inst]; ok {
+		return f
+	}
+	if instanceLogFiles.m == nil {
+		instanceLogFiles.m = make(map[string]*os.File)
+	}
+	var f *os.File
+	path := filepath.Join(instanceLogDir(), inst+".log")
+	err := os.MkdirAll(instanceLogDir(), 0o755)
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+	if err == nil {
+		recordArtifact(path)
+	} else {
+		log.Printf("Failed to open log file for %s, logging to the console only: %v", inst, err)
+	}
+	// Remember failures too, so they're only reported once.
+	instanceLogFiles.m[inst] = f
+	return f
+}
+
+// closeInstanceLog closes inst's log file, once inst is no longer in use.
+func closeInstanceLog(inst string) {
+	instanceLogFiles.Lock()
+	defer instanceLogFiles.Unlock()
+	if f := instanceLogFiles.m[inst]; f != nil {
+		f.Close()
+	}
+	delete(instanceLogFiles.m, inst)
+}
+
+// writeInstanceLog writes a timestamped message to inst's log file, and
+// reports whether it did.
+func writeInstanceLog(inst, msg string) bool {
+	f := instanceLog(inst)
+	if f == nil {
+		return false
+	}
+	fmt.Fprintf(f, "%s %s\n", logPrefix(time.Now()), redactString(msg))
+	return true
+}
+
+// instLogf logs a message about inst, both to the console and to inst's log.
+func instLogf(inst, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	writeInstanceLog(inst, msg)
+	slog.Info(msg, "instance", inst)
+}
+
+// instWarnf is like instLogf, for problems with inst.
+func instWarnf(inst, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	writeInstanceLog(inst, msg)
+	slog.Warn(msg, "instance", inst)
+}
+
+// instFailuref is like instLogf, for failures of the command on inst.
+func instFailuref(inst string, matched bool, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	writeInstanceLog(inst, msg)
+	failure := "unmatched"
+	if matched {
+		failure = "matched"
+	}
+	slog.Info(msg, "instance", inst, "failure", failure)
+}
+
+// instDetailf logs a routine message about inst, which is left out of the
+// console log if inst has its own log.
+func instDetailf(inst, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !writeInstanceLog(inst, msg) {
+		slog.Debug(msg, "instance", inst)
+	}
+}
+
+// instOutput writes the output of a run on inst to inst's log.
+func instOutput(inst string, out []byte) {
+	if f := instanceLog(inst); f != nil {
+		f.Write(out)
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			f.Write([]byte("\n"))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	crossRef     bool
+	luciAnalysis string
+)
+
+func init() {
+	flag.BoolVar(&crossRef, "crossref", false, "look up matching failures in LUCI Analysis, to find out whether they're known flakes on the build dashboard (requires luci-auth)")
+	flag.StringVar(&luciAnalysis, "luci-analysis", "https://analysis.api.luci.app", "base URL of the LUCI Analysis API used by -crossref")
+}
+
+// luciProject is the LUCI project of the Go build dashboard.
+const luciProject = "golang"
+
+// pRPC JSON responses start with this prefix, to prevent XSSI.
+const prpcPrefix = ")]}'\n"
+
+// lookUpFailure asks LUCI Analysis which clusters of failures on the build
+// dashboard the failure with the given reason belongs to, and returns links
+// describing them: the associated bug, if any, and otherwise the cluster.
+func lookUpFailure(ctx context.Context, reason string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	token, err := exec.CommandContext(ctx, "luci-auth", "token").Output()
+	if err != nil {
+		return nil, fmt.Errorf("getting a token with luci-auth: %v", unwrap(err))
+	}
+
+	type failureReason struct {
+		PrimaryErrorMessage string `json:"primaryErrorMessage"`
+	}
+	type testResult struct {
+		RequestTag    string        `json:"requestTag"`
+		TestID        string        `json:"testId"`
+		FailureReason failureReason `json:"failureReason"`
+	}
+	req := struct {
+		Project     string       `json:"project"`
+		TestResults []testResult `json:"testResults"`
+	}{luciProject, []testResult{{RequestTag: "goswarm", FailureReason: failureReason{reason}}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(luciAnalysis, "/") + "/prpc/luci.analysis.v1.Clusters/Cluster"
+	hreq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Accept", "application/json")
+	hreq.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("LUCI Analysis returned %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	var result struct {
+		ClusteredTestResults []struct {
+			Clusters []struct {
+				ClusterID struct {
+					Algorithm string `json:"algorithm"`
+					ID        string `json:"id"`
+				} `json:"clusterId"`
+				Bug *struct {
+					LinkText string `json:"linkText"`
+					URL      string `json:"url"`
+				} `json:"bug"`
+			} `json:"clusters"`
+		} `json:"clusteredTestResults"`
+	}
+	if err := json.Unmarshal(bytes.TrimPrefix(b, []byte(prpcPrefix)), &result); err != nil {
+		return nil, fmt.Errorf("decoding LUCI Analysis response: %v", err)
+	}
+	var links []string
+	for _, r := range result.ClusteredTestResults {
+		for _, c := range r.Clusters {
+			if c.Bug != nil && c.Bug.URL != "" {
+				links = append(links, fmt.Sprintf("[%s](%s)", c.Bug.LinkText, c.Bug.URL))
+				continue
+			}
+			links = append(links, fmt.Sprintf("[%s cluster](https://luci-analysis.appspot.com/p/%s/clusters/%s/%s)",
+				c.ClusterID.Algorithm, luciProject, c.ClusterID.Algorithm, c.ClusterID.ID))
+		}
+	}
+	return links, nil
+}
+
+// failureReason returns the line of output that best describes a failure,
+// for looking it up: the first line matching re, or the last line.
+func failureReason(re *regexp.Regexp, output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if re != nil {
+		for _, line := range lines {
+			if re.MatchString(line) {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
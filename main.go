@@ -5,47 +5,57 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
+	"math/rand"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/mknyszek/goswarm/gomote"
-	"golang.org/x/sync/errgroup"
+	"github.com/mknyszek/goswarm/swarm"
 )
 
 var (
-	instances uint
-	clean     cleanMode = cleanOff
+	instances uint = 10
+	clean          = swarm.CleanOff
 	verbosity uint
 	deflakes  uint
 	env       stringSetVar
 	errMatch  string
 	keepGoing bool
+	reuse     bool
+	reusePush bool
+
+	// backend provides the instances.
+	backend = swarm.Gomote
+
+	cleanOlderThan time.Duration
+	cleanUnowned   bool
+	cleanPrefix    string
 )
 
 func init() {
-	flag.UintVar(&instances, "i", 10, "number of instances to run in parallel")
+	flag.Var(&poolSizeVar{&instances, &instancesAuto}, "i", "number of instances to run in parallel, or auto to size the pool from the capacity available: what's left of -quota for gomote, the hosts for ssh, or the CPUs for local")
 	flag.Var(&env, "e", "an environment variable to use on the gomote of the form VAR=value, may be specified multiple times")
 	flag.StringVar(&errMatch, "match", "", "stop only if a failure's output matches this regexp")
-	flag.Var(&clean, "clean", "off=do not clean up instances, start=clean up existing gomotes of the provided instance type at startup, exit=clean up instances created by goswarm on exit")
+	flag.Var(&clean, "clean", "off=do not clean up instances, start=clean up existing gomotes of the provided instance type at startup, exit=clean up instances created by goswarm on exit, always=both start and exit")
+	flag.DurationVar(&cleanOlderThan, "clean-older-than", 0, "with -clean=start or -clean=always, only clean up instances goswarm created at least this long ago")
+	flag.BoolVar(&cleanUnowned, "clean-unowned", false, "also clean up instances of the instance type that goswarm did not create")
+	flag.StringVar(&cleanPrefix, "clean-prefix", "", "with -clean=start or -clean=always, only clean up instances whose names start with this prefix")
 	flag.UintVar(&verbosity, "v", 2, "verbosity level: 0 is quiet, 2 is the maximum")
-	flag.UintVar(&deflakes, "deflake", 5, "number of times to retry basic gomote operations")
+	flag.UintVar(&deflakes, "deflake", 5, "maximum number of attempts at basic gomote operations, with exponential backoff between them")
 	flag.BoolVar(&keepGoing, "keep-going", false, "keep testing on remaining instances after finding a matching failure")
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "goswarm creates a pool of gomotes and executes a command on them until one of them fails.\n\n")
-		fmt.Fprintf(flag.CommandLine.Output(), "Note that goswarm does not tear down gomotes.\n\n")
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [instance type] [command]\n", os.Args[0])
-		flag.PrintDefaults()
-	}
+	flag.BoolVar(&reuse, "reuse", false, "adopt existing instances of the instance type before creating new ones")
+	flag.BoolVar(&reusePush, "reuse-push", true, "push GOROOT to instances adopted with -reuse")
 }
 
 type stringSetVar []string
@@ -59,194 +69,1089 @@ func (s *stringSetVar) Set(c string) error {
 	return nil
 }
 
-type cleanMode string
-
-const (
-	cleanOff   cleanMode = "off" // do not clean up.
-	cleanStart cleanMode = "start" // clean up old instances before starting.
-	cleanExit  cleanMode = "exit" // clean up instances created by goswarm on exit.
-)
-
-func (c *cleanMode) String() string {
-	if c == nil {
-		return ""
+func main() {
+	sub, args := lookupSubcommand(os.Args[1:])
+	sub.flags.Parse(args)
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: reading configuration: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	userConfig = cfg
+	if err := sub.run(sub.flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitCode(err))
 	}
-	return string(*c)
 }
 
-func (c *cleanMode) Set(s string) error {
-	switch cleanMode(s) {
-	case cleanOff:
-		*c = cleanOff
-	case cleanStart:
-		*c = cleanStart
-	case cleanExit:
-		*c = cleanExit
-	default:
-		return fmt.Errorf("unknown clean mode %q", s)
+// resolveInstanceType validates typ, returning the full name of the
+// instance type it refers to.
+func resolveInstanceType(ctx context.Context, typ string) (string, error) {
+	if alias, ok := userConfig["aliases"][typ]; ok && len(alias) > 0 {
+		log.Printf("Instance type %s is an alias for %s.", typ, alias[0])
+		typ = alias[0]
 	}
-	return nil
+	typer, ok := backend.(swarm.Typer)
+	if !ok {
+		// Any instance type goes.
+		return typ, nil
+	}
+	typs, err := typer.InstanceTypes(ctx)
+	if err != nil {
+		if backendName == "gomote" {
+			return "", gomoteProblem(err)
+		}
+		return "", err
+	}
+	t, err := matchInstanceType(typ, typs)
+	if err != nil {
+		return "", &exitError{exitUsage, err}
+	}
+	if t != typ {
+		log.Printf("Using instance type %s.", t)
+	}
+	return t, nil
 }
 
-func main() {
-	flag.Parse()
-	if err := run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// resolveInstanceTypes resolves a comma-separated list of instance types,
+// for sessions that spread their instances across several types.
+func resolveInstanceTypes(ctx context.Context, list string) ([]string, error) {
+	var typs []string
+	for _, typ := range strings.Split(list, ",") {
+		if typ == "" {
+			continue
+		}
+		t, err := resolveInstanceType(ctx, typ)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(typs, t) {
+			typs = append(typs, t)
+		}
+	}
+	if len(typs) == 0 {
+		return nil, usageErrorf("expected an instance type")
 	}
+	return typs, nil
 }
 
-func validateInstanceType(ctx context.Context, typ string) error {
-	typs, err := gomote.InstanceTypes(ctx)
+// cleanUpInstances destroys the existing instances of the types typs, or
+// of every type if typs is nil, that pass the -clean filters.
+func cleanUpInstances(ctx context.Context, typs []string) error {
+	insts, err := backend.List(ctx)
 	if err != nil {
 		return err
 	}
-	for _, it := range typs {
-		if typ == it {
-			return nil
+	if !dryRun {
+		pruneRegistry(insts)
+	}
+	reg, err := loadRegistry()
+	if err != nil {
+		return fmt.Errorf("reading instance registry: %v", err)
+	}
+	if dryRun {
+		fmt.Printf("# clean up existing instances\n")
+	}
+	var doomed []gomote.Instance
+	unowned := 0
+	for _, inst := range insts {
+		if typs != nil && !slices.Contains(typs, inst.Type) {
+			continue
+		}
+		if !strings.HasPrefix(inst.Name, cleanPrefix) {
+			continue
+		}
+		e, owned := reg[inst.Name]
+		if !owned && !cleanUnowned {
+			log.Printf("Skipping instance %s not created by goswarm.", inst.Name)
+			continue
+		}
+		if ownedByOtherSession(e) {
+			log.Printf("Skipping instance %s in use by goswarm session %d.", inst.Name, e.Owner)
+			continue
+		}
+		if cleanOlderThan > 0 {
+			if !owned {
+				log.Printf("Skipping instance %s of unknown age.", inst.Name)
+				continue
+			}
+			if age := time.Since(e.Created); age < cleanOlderThan {
+				log.Printf("Skipping instance %s, only %s old.", inst.Name, age.Round(time.Second))
+				continue
+			}
+		}
+		if dryRun {
+			fmt.Printf("gomote destroy %s  # %s\n", swarm.ShellQuote(inst.Name), describeInstance(inst.Type, e, owned))
+		}
+		doomed = append(doomed, inst)
+		if !owned {
+			unowned++
 		}
 	}
-	return fmt.Errorf("invalid instance type: %s", typ)
+	if dryRun {
+		fmt.Printf("# %d instances would be destroyed\n", len(doomed))
+		return nil
+	}
+	if err := confirmCleanup(doomed, unowned); err != nil {
+		return err
+	}
+	for _, inst := range doomed {
+		log.Printf("Destroying instance %s...", inst.Name)
+		if err := backend.Destroy(ctx, inst.Name); err != nil {
+			return err
+		}
+		unregisterInstance(inst.Name)
+	}
+	return nil
+}
+
+// describeInstance describes an instance of type typ for a dry run of
+// cleanup, from its registry entry e if goswarm created it.
+func describeInstance(typ string, e registryEntry, owned bool) string {
+	switch {
+	case !owned:
+		return typ + ", not created by goswarm"
+	case e.Parked != nil:
+		return fmt.Sprintf("%s, created %s ago, parked", typ, time.Since(e.Created).Round(time.Second))
+	}
+	return fmt.Sprintf("%s, created %s ago", typ, time.Since(e.Created).Round(time.Second))
 }
 
-func cleanUpInstances(ctx context.Context, typ string) error {
-	insts, err := gomote.List(ctx)
+// reuseInstances queues up all existing instances of the types typs for
+// adoption by the pool.
+func (s *session) reuseInstances(ctx context.Context, typs []string) error {
+	insts, err := backend.List(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("listing instances: %v", err)
+	}
+	reg, err := loadRegistry()
+	if err != nil {
+		return fmt.Errorf("reading instance registry: %v", err)
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, inst := range insts {
-		if inst.Type != typ {
+		if !slices.Contains(typs, inst.Type) {
 			continue
 		}
-		log.Printf("Destroying instance %s...", inst.Name)
-		if err := gomote.Destroy(ctx, inst.Name); err != nil {
-			return err
+		if e, ok := reg[inst.Name]; ok && ownedByOtherSession(e) {
+			log.Printf("Not reusing instance %s in use by goswarm session %d.", inst.Name, e.Owner)
+			continue
 		}
+		log.Printf("Reusing instance %s.", inst.Name)
+		s.adopt = append(s.adopt, adoption{instanceState: instanceState{Name: inst.Name, Type: inst.Type}, push: reusePush})
 	}
 	return nil
 }
 
-var errStop = errors.New("stop execution due to matching failure")
+// errStop stops the session after a matching failure.
+var errStop = swarm.ErrStop
 
-func run() error {
+// runCmd implements the run subcommand.
+func runCmd(args []string) error {
+	profileArgs, err := applyConfig(flag.CommandLine, userConfig)
+	if err != nil {
+		return usageErrorf("%s: %v", configFile, err)
+	}
+	if backendName == "local" {
+		// The local backend has no instance types.
+		args = append([]string{"local"}, args...)
+	}
+	if len(args) > 1 {
+		if args[1] == "--" {
+			// Everything after -- is the command, exactly as given.
+			args = append(args[:1:1], args[2:]...)
+		} else if name, ok := goswarmFlag(args[1]); ok {
+			return usageErrorf("-%s after the instance type is passed to the command; move it before the instance type, or pass -- before the command to confirm", name)
+		}
+	}
+	if scriptFile != "" {
+		// The uploaded script is the command, and any arguments are
+		// passed to it.
+		if shScript != "" {
+			return usageErrorf("-script and -sh are mutually exclusive")
+		}
+		if _, err := os.Stat(scriptFile); err != nil {
+			return usageErrorf("-script: %v", err)
+		}
+		if len(args) == 0 && len(profileArgs) > 0 {
+			args = profileArgs[:1]
+		}
+		if len(args) == 0 {
+			return usageErrorf("expected an instance type")
+		}
+		args = append([]string{args[0], scriptCommand()}, args[1:]...)
+	}
+	if commandsFile != "" {
+		// The commands stand in for the command.
+		if shScript != "" || scriptFile != "" {
+			return usageErrorf("-commands, -sh, and -script are mutually exclusive")
+		}
+		if len(args) > 1 {
+			return usageErrorf("-commands and a command are mutually exclusive")
+		}
+		cmds, err := loadCommands(commandsFile)
+		if err != nil {
+			return usageErrorf("-commands: %v", err)
+		}
+		if len(args) == 0 && len(profileArgs) > 0 {
+			args = profileArgs[:1]
+		}
+		if len(args) == 0 {
+			return usageErrorf("expected an instance type")
+		}
+		commandList = cmds
+		args = append(args, cmds...)
+	}
+	if shScript != "" {
+		// The script stands in for the command.
+		if len(args) > 1 {
+			return usageErrorf("-sh and a command are mutually exclusive")
+		}
+		if len(args) == 0 && len(profileArgs) > 0 {
+			args = profileArgs[:1]
+		}
+		if len(args) == 0 {
+			return usageErrorf("expected an instance type")
+		}
+		args = append(args, shScript)
+	}
+	if len(args) == 0 {
+		args = profileArgs
+	} else if len(args) == 1 && len(profileArgs) > 1 {
+		// Just an instance type, so use the profile's command.
+		args = append(args, profileArgs[1:]...)
+	}
 	// No arguments is always wrong.
-	if flag.NArg() == 0 {
-		return fmt.Errorf("expected an instance type, followed by a command")
+	if len(args) == 0 {
+		return usageErrorf("expected an instance type, followed by a command")
+	}
+	return runSession(args, nil)
+}
+
+// goswarmFlag reports whether arg looks like one of goswarm's own flags,
+// returning its name.
+func goswarmFlag(arg string) (string, bool) {
+	name := strings.TrimLeft(arg, "-")
+	if name == arg || name == "" {
+		return "", false
+	}
+	name, _, _ = strings.Cut(name, "=")
+	return name, flag.Lookup(name) != nil
+}
+
+// resumeCmd implements the resume subcommand.
+func resumeCmd(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected a state file")
+	}
+	if _, err := applyConfig(flag.CommandLine, userConfig); err != nil {
+		return usageErrorf("%s: %v", configFile, err)
+	}
+	prev, err := loadState(args[0])
+	if err != nil {
+		return err
+	}
+	return runSession(prev.apply(), prev)
+}
+
+// runSession runs a session with the instance type and command in args.
+// If prev is non-nil, the session continues from it.
+func runSession(args []string, prev *sessionState) (err error) {
+	if quietArtifacts {
+		verbosity = 0
+	}
+	if err := setUpLogging(); err != nil {
+		return &exitError{exitUsage, err}
 	}
-	if verbosity == 0 {
-		// Quiet mode.
-		log.SetOutput(io.Discard)
+	if err := setUpBackend(); err != nil {
+		return &exitError{exitUsage, err}
+	}
+	if err := setUpSessionName(); err != nil {
+		return usageErrorf("-name: %v", err)
+	}
+	if err := checkRetention(); err != nil {
+		return usageErrorf("%v", err)
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	stopInterrupts := handleInterrupts(cancel)
+	defer stopInterrupts()
+
+	if err := checkGomote(ctx); err != nil {
+		return err
+	}
 
 	// We have at least an instance type, so validate that
 	// and clean up instances if asked.
-	typ := flag.Arg(0)
-	if err := validateInstanceType(ctx, typ); err != nil {
+	typs, err := resolveInstanceTypes(ctx, args[0])
+	if err != nil {
 		return err
 	}
-	if clean == cleanStart {
-		if err := cleanUpInstances(ctx, typ); err != nil {
+	typ := strings.Join(typs, ",")
+	if err := setUpTypeMax(ctx, typs); err != nil {
+		return err
+	}
+	if err := setUpTypeWeight(ctx, typs); err != nil {
+		return err
+	}
+	if err := applyMatchFlags(); err != nil {
+		return usageErrorf("-match-flags: %v", err)
+	}
+	if err := parseMatchExit(); err != nil {
+		return usageErrorf("-match-exit: %v", err)
+	}
+	var errRegexp *regexp.Regexp
+	if errMatch != "" {
+		r, err := regexp.Compile(errMatch)
+		if err != nil {
+			return usageErrorf("compiling regexp: %v", err)
+		}
+		errRegexp = r
+	}
+	if err := applyEnvPassthrough(); err != nil {
+		return usageErrorf("-e-passthrough: %v", err)
+	}
+	if err := applyEnvFile(); err != nil {
+		return usageErrorf("-env-file: %v", err)
+	}
+	if err := setUpSecrets(); err != nil {
+		return usageErrorf("-secret: %v", err)
+	}
+	if err := parseTemplates(args[1:], env, steps); err != nil {
+		return usageErrorf("%v", err)
+	}
+	if err := setUpBench(); err != nil {
+		return &exitError{exitUsage, err}
+	}
+	if err := setUpGODEBUG(); err != nil {
+		return usageErrorf("%v", err)
+	}
+	if knownIssuesFile != "" {
+		if err := loadKnownIssues(knownIssuesFile); err != nil {
+			return usageErrorf("loading known issues: %v", err)
+		}
+	}
+	if err := setUpAnnotate(); err != nil {
+		return usageErrorf("%v", err)
+	}
+	if _, ok := backend.(swarm.Remover); len(wipePaths) > 0 && !ok {
+		return usageErrorf("-wipe is not supported by the %s backend", backendName)
+	}
+	if goroot, _ := pushRoot(); len(args) > 1 {
+		if err := checkGOROOT(ctx, goroot); err != nil {
+			return usageErrorf("GOROOT: %v", err)
+		}
+		if watchTree && goroot == "" {
+			return usageErrorf("-watch needs a Go tree to watch, from -goroot or $GOROOT")
+		}
+		if precheck != "" && !dryRun {
+			if err := runPrecheck(ctx, goroot); err != nil {
+				return usageErrorf("-precheck failed: %v", err)
+			}
+		}
+	}
+	if err := checkTypeOptions(); err != nil {
+		return usageErrorf("%s: %v", configFile, err)
+	}
+	if err := loadRetryPolicies(); err != nil {
+		return usageErrorf("%s: %v", configFile, err)
+	}
+	if err := setUpStopWhen(); err != nil {
+		return usageErrorf("-stop-when: %v", err)
+	}
+	if err := setUpBootstrap(args[1:]); err != nil {
+		return usageErrorf("-bootstrap: %v", err)
+	}
+	if measureRepro > 0 && (soak || keepGoing || untilSuccess || verifyIters > 0) {
+		return usageErrorf("-measure-repro is mutually exclusive with -soak, -keep-going, -until-success, and -verify")
+	}
+	if verifyIters > 0 && (soak || keepGoing) {
+		return usageErrorf("-verify is mutually exclusive with -soak and -keep-going")
+	}
+	if untilSuccess && (soak || keepGoing || verifyIters > 0) {
+		return usageErrorf("-until-success is mutually exclusive with -soak, -keep-going, and -verify")
+	}
+	if len(runArgs) > 0 && backendName != "gomote" {
+		return usageErrorf("-run-arg is only supported by the gomote backend")
+	}
+	if _, ok := backend.(swarm.Putter); scriptFile != "" && !ok {
+		return usageErrorf("-script is not supported by the %s backend", backendName)
+	}
+	if stdinFile != "" {
+		if _, ok := backend.(swarm.Putter); !ok {
+			return usageErrorf("-stdin is not supported by the %s backend", backendName)
+		}
+		if stdinFile == "-" && daemon {
+			return usageErrorf("-stdin=- and -daemon are mutually exclusive")
+		}
+		for _, t := range typs {
+			if isWindowsType(t) {
+				return usageErrorf("-stdin is not supported on Windows instance types")
+			}
+		}
+		cleanup, err := setUpStdin()
+		if err != nil {
+			return usageErrorf("-stdin: %v", err)
+		}
+		defer cleanup()
+	}
+	if clean.AtStart() && reuse {
+		return usageErrorf("-reuse and -clean=%s are mutually exclusive", clean)
+	}
+	if keepAlive > 0 && backendName != "gomote" {
+		return usageErrorf("-keep-alive requires the gomote backend")
+	}
+	if pairDebug && backendName != "gomote" {
+		return usageErrorf("-pair requires the gomote backend")
+	}
+	// A detached session cleans up before detaching, while there's still a
+	// terminal on which to confirm it.
+	if clean.AtStart() && prev == nil && os.Getenv(daemonEnv) == "" {
+		if err := cleanUpInstances(ctx, typs); err != nil {
 			return fmt.Errorf("cleaning up instances: %v", err)
 		}
 	}
-	if flag.NArg() == 1 {
+	if len(args) == 1 {
 		// No command, so nothing more to do.
 		// Surface an error if -clean was not passed.
-		if clean != cleanStart {
-			return fmt.Errorf("expected a command")
+		if !clean.AtStart() {
+			return usageErrorf("expected a command")
 		}
 		return nil
 	}
+	if daemon && !dryRun && os.Getenv(daemonEnv) == "" {
+		return detach()
+	}
 
-	var errRegexp *regexp.Regexp
-	if errMatch != "" {
-		r, err := regexp.Compile(errMatch)
-		if err != nil {
-			return fmt.Errorf("compiling regexp: %v", err)
+	if dryRun {
+		adoptable := 0
+		if reuse {
+			insts, err := backend.List(ctx)
+			if err != nil {
+				return fmt.Errorf("listing instances: %v", err)
+			}
+			for _, inst := range insts {
+				if slices.Contains(typs, inst.Type) {
+					adoptable++
+				}
+			}
 		}
-		errRegexp = r
+		if err := sizePool(ctx, typs); err != nil {
+			return err
+		}
+		capToTypeMax(typs)
+		printPlan(os.Stdout, typs, args[1:], adoptable)
+		return nil
+	}
+	pruneArtifacts()
+	if err := os.MkdirAll(artifactsDir, 0o755); err != nil {
+		return fmt.Errorf("creating artifacts directory: %v", err)
+	}
+	if stop, err := openTranscript(); err != nil {
+		log.Printf("Failed to create gomote transcript: %v", err)
+	} else {
+		defer stop()
 	}
 
-	eg, ctx := errgroup.WithContext(ctx)
-	for i := 0; i < int(instances); i++ {
-		eg.Go(func() error {
-			return runOneInstance(ctx, typ, errRegexp)
-		})
+	sess = newSession(typs, args[1:])
+	stopExport, err := openExport(sess.cmd)
+	if err != nil {
+		return fmt.Errorf("opening -export file: %v", err)
+	}
+	defer stopExport()
+	if prev != nil {
+		if err := sess.restore(ctx, prev); err != nil {
+			return err
+		}
+	} else if reuse {
+		if err := sess.reuseInstances(ctx, typs); err != nil {
+			return err
+		}
+	} else if backendName == "gomote" {
+		if err := sess.adoptParked(typs); err != nil {
+			log.Printf("Not adopting parked instances: %v", err)
+		}
+	}
+	if stateFile != "" {
+		persistCtx, stopPersisting := context.WithCancel(ctx)
+		saved := sess.persist(persistCtx, stateFile)
+		defer func() {
+			stopPersisting()
+			<-saved
+		}()
+	}
+	if stop, err := listenControl(); err != nil {
+		log.Printf("Failed to create control socket, `goswarm status` will not work: %v", err)
+	} else {
+		defer stop()
+	}
+	warnConcurrentSessions(typ)
+	createLimiter = newLimiter(createConcurrency, createInterval)
+	opLimiter = newLimiter(opConcurrency, 0)
+	pushLimiter = newLimiter(pushConcurrency, 0)
+	transferLimiter = newLimiter(transferConcurrency, 0)
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+	if serveAddr != "" {
+		serveArtifacts(serveAddr)
+	}
+	stopTraces := exportTraces()
+	defer stopTraces()
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+	go heartbeat(ctx)
+	if watchTree {
+		goroot, _ := pushRoot()
+		go watchGOROOT(ctx, goroot)
+	}
+	if err := sizePool(ctx, typs); err != nil {
+		return err
+	}
+	capToTypeMax(typs)
+	if err := capToQuota(ctx); err != nil {
+		return err
+	}
+	ctx, sp := startSpan(ctx, "session", "instance.type", typ)
+
+	stopStopWhen := startStopWhen()
+	defer stopStopWhen()
+	stopDeadline := func() {}
+	defer func() { stopDeadline() }()
+	cfg := swarmConfig(args[1:], errRegexp, func(p *swarm.Pool) {
+		sess.setPool(p)
+		drainOnInterrupt(p)
+		stopDeadline = startDeadline(p)
+		watchResizeSignals(ctx, p)
+		if preflight {
+			startPreflight(p, int(instances))
+		} else {
+			growPool(p, int(instances))
+		}
+	})
+	_, err = cfg.Run(ctx)
+	sp.End(err)
+	if parkedAny.Load() {
+		if err := startKeeper(); err != nil {
+			log.Printf("Failed to start keeping parked instances alive: %v", err)
+		}
+	}
+	printSummary(os.Stderr)
+	recordHistory(err)
+	notifyEnd()
+	annotateIssuesAtEnd()
+	if quietArtifacts {
+		printArtifacts(os.Stdout)
 	}
-	err := eg.Wait()
-	if err == errStop {
-		err = nil
+	if benchIters > 0 {
+		writeBenchSummary(os.Stdout)
 	}
-	return err
+	if reproducing() {
+		writeReproSummary(os.Stdout)
+	}
+	if verifyIters > 0 {
+		writeVerifySummary(os.Stdout)
+	}
+	waitRDP(ctx)
+	waitPair(ctx)
+	switch {
+	case err != nil && err != errStop && ctx.Err() == nil:
+		return err
+	case verifyIters > 0 && len(sess.status().Failures) > 0:
+		return notFoundErrorf("verification failed")
+	case verified():
+		return nil
+	case verifyIters > 0 && (ctx.Err() != nil || interrupted()):
+		return notFoundErrorf("interrupted before verifying")
+	case untilSuccess && sess.status().Pass != nil:
+		return nil
+	case untilSuccess:
+		return notFoundErrorf("no run passed")
+	case reproducing() && !measuring() && !reproduced():
+		return notFoundErrorf("the failure did not reproduce")
+	case len(sess.status().Failures) > 0:
+		return nil
+	case benchmarkDone():
+		return nil
+	case ctx.Err() != nil || interrupted():
+		return notFoundErrorf("interrupted without finding a matching failure")
+	case deadlineReached.Load():
+		return notFoundErrorf("no matching failure within -max-duration")
+	case stopWhenHeld.Load():
+		return notFoundErrorf("no matching failure before -stop-when held")
+	}
+	return &exitError{exitInfra, errors.New("every instance stopped without finding a matching failure")}
 }
 
-type testStatus int
+// swarmConfig returns the configuration of the session's swarm, running cmd
+// and matching failures with errRegexp. start is called with the pool to
+// start it.
+func swarmConfig(cmd []string, errRegexp *regexp.Regexp, start func(p *swarm.Pool)) *swarm.Config {
+	return &swarm.Config{
+		Type:      sess.types[0],
+		Command:   cmd,
+		KeepGoing: keepGoing,
+		Retry:     retryPolicy("run").RetryPolicy,
+		Backend:   limitedBackend{backend},
+		Logf:      instLogf,
+		Warnf:     instWarnf,
+		Hooks: swarm.Hooks{
+			Destroyed: unregisterInstance,
+			Start:     start,
+			NewSlot:   newSlot,
+			SetUp:     setUpSlot,
+			Iterate: func(ctx context.Context, s *swarm.Slot) (swarm.Status, []byte, error) {
+				return runIteration(ctx, s, cmd, errRegexp)
+			},
+			InfraError: slotInfraError,
+			Passed:     slotPassed,
+			Failure:    slotFailure,
+			Ended:      slotEnded,
+			Release:    releaseSlot,
+			SlotDone:   slotDone,
+		},
+	}
+}
 
-const (
-	testExecutionError testStatus = iota // tests did not run due to external error
-	testPass // tests passed
-	testFailUnmatched // tests failed but did not match regexp
-	testFailMatched // test failed and match regexp
-)
+// slotState is the session's state of a slot of the swarm's pool.
+type slotState struct {
+	is       *instanceState
+	setup    instanceSetup // how the slot's instance is to be set up
+	parkable bool          // whether the instance is in good shape to be parked on exit
+	span     *span
 
-// Run testing in a single instance.
-//
-// Returns errStop to halt all testing.
-func runOneInstance(ctx context.Context, typ string, errRegexp *regexp.Regexp) error {
-	// Create instance.
-	var inst string
-	err := retry(func() error {
-		i, err := gomote.Create(ctx, typ)
-		inst = i
+	// State of the iterations on the slot's instance since it was set up.
+	gen   int64 // pushGen when it was pushed to
+	disk  *diskMonitor
+	skips int // in a row, with -skip-identical
+	n     int // iterations that passed or failed without matching
+
+	// The latest iteration.
+	seed     int64
+	cmdIndex int
+	run      bool // whether it's a run of a failure
+}
+
+// newSlot adds an instance to the session for a new slot of the pool.
+func newSlot(ctx context.Context, s *swarm.Slot) (context.Context, bool) {
+	is, setup := sess.addInstance()
+	if is == nil {
+		log.Printf("Not adding an instance, every instance type is at its -type-max.")
+		return ctx, false
+	}
+	ctx, sp := startSpan(ctx, "instance", "instance.type", is.Type)
+	s.Type = is.Type
+	s.Instance = is.Name
+	s.Data = &slotState{is: is, setup: setup, span: sp}
+	return ctx, true
+}
+
+// slotDone records that the slot s exited with err.
+func slotDone(s *swarm.Slot, err error) {
+	st := s.Data.(*slotState)
+	st.span.End(err)
+	sess.setState(st.is, "stopped")
+	closeInstanceLog(st.is.Name)
+}
+
+// setUpSlot sets up the instance of the slot s, creating it if it has none.
+func setUpSlot(ctx context.Context, s *swarm.Slot) bool {
+	st := s.Data.(*slotState)
+	setup := st.setup
+	if s.Instance == "" {
+		setup = setupCreate
+	}
+	ok := setUpInstance(ctx, s.Type, st.is, setup, &s.Instance)
+	st.parkable = ok
+	if !ok {
+		return false
+	}
+	st.gen = pushGen.Load()
+	st.disk = &diskMonitor{inst: s.Instance}
+	st.skips, st.n = 0, 0
+	activeInstances.Add(1)
+	return true
+}
+
+// releaseSlot keeps, parks, or destroys the instance of the slot s as it
+// exits.
+func releaseSlot(s *swarm.Slot) {
+	st := s.Data.(*slotState)
+	inst, typ := s.Instance, s.Type
+	if !clean.AtExit() && keepAlive == 0 {
+		return
+	}
+	if rdpInstance(inst) {
+		instLogf(inst, "Keeping %s for remote desktop debugging; destroy it with gomote destroy %s when done.", inst, inst)
+		return
+	}
+	if pairInstance(inst) {
+		instLogf(inst, "Keeping %s for pair debugging; destroy it with gomote destroy %s when done.", inst, inst)
+		return
+	}
+	if keepAlive > 0 && st.parkable {
+		instLogf(inst, "Parking %s for %s.", inst, keepAlive)
+		sess.releaseInstance(inst)
+		parkInstance(inst, typ)
+		parkedAny.Store(true)
+		return
+	}
+	if !clean.AtExit() {
+		return
+	}
+	instLogf(inst, "Destroying instance %s...", inst)
+	ctx := context.Background()
+	defer sess.releaseInstance(inst)
+	if err := limitOp(ctx, func() error { return backend.Destroy(ctx, inst) }); err != nil {
+		instWarnf(inst, "Error destroying instance %s: %v", inst, err)
+		return
+	}
+	unregisterInstance(inst)
+}
+
+// slotEnded decides what the slot s does once the iterations on its
+// instance end with err.
+func slotEnded(s *swarm.Slot, err error) (swarm.Next, error) {
+	st := s.Data.(*slotState)
+	inst := s.Instance
+	activeInstances.Add(-1)
+	var lost *swarm.LostBuilderError
+	var recycle *recycleError
+	var quarantine *quarantineError
+	var retype *retypeError
+	switch {
+	case errors.As(err, &lost):
+		// Replace the lost builder with a fresh instance,
+		// rather than shrinking the pool.
+		instWarnf(inst, "Lost builder %s, replacing it.", inst)
+	case errors.As(err, &recycle):
+		instLogf(inst, "Recycling %s: %s.", inst, recycle.reason)
+	case errors.As(err, &retype):
+		instLogf(inst, "Replacing %s with an instance of %s, to focus on the types producing matching failures.", inst, retype.typ)
+		s.Type = retype.typ
+		sess.setType(st.is, s.Type)
+	case errors.Is(err, errTreeChanged):
+		// Keep the instance, just push to it again.
+		sess.setState(st.is, "pushing")
+		st.setup = setupPush
+		return swarm.Refresh, nil
+	case errors.As(err, &quarantine):
+		sess.recordQuarantine(inst, quarantine.reason)
+		st.parkable = false
+		if !quarantineReplace {
+			instWarnf(inst, "Quarantining %s: %s.", inst, quarantine.reason)
+			return swarm.Exit, nil
+		}
+		instWarnf(inst, "Quarantining %s: %s; replacing it.", inst, quarantine.reason)
+	default:
+		return swarm.Exit, err
+	}
+	// The swarm destroys the instance, and unregisters it once it's gone.
+	sess.releaseInstance(inst)
+	closeInstanceLog(inst)
+	sess.setState(st.is, "creating")
+	return swarm.Replace, nil
+}
+
+// runIteration runs an iteration of cmd on the instance of the slot s,
+// recording its results.
+func runIteration(ctx context.Context, s *swarm.Slot, cmd []string, errRegexp *regexp.Regexp) (swarm.Status, []byte, error) {
+	st := s.Data.(*slotState)
+	inst, is := s.Instance, st.is
+	if pushGen.Load() != st.gen {
+		return swarm.ExecutionError, nil, errTreeChanged
+	}
+	if sess.gate.isPaused() {
+		sess.setState(is, "paused")
+		sess.gate.wait(ctx, inst, s.Drain())
+		sess.setState(is, "running")
+		return swarm.ExecutionError, nil, swarm.ErrSkip
+	}
+	if err := st.disk.check(ctx); err != nil {
+		return swarm.ExecutionError, nil, err
+	}
+	start := time.Now()
+	seed := rand.Int63()
+	run := reproducing()
+	if run {
+		if typ := reproType(is.Type); typ != "" {
+			return swarm.ExecutionError, nil, &retypeError{inst, typ}
+		}
+		if !startRepro() {
+			instLogf(inst, "Every run is underway, stopping %s.", inst)
+			return swarm.ExecutionError, nil, swarm.ErrDone
+		}
+		seed = repro.seed
+	}
+	var cmdIndex int
+	var runCmd []string
+	if run {
+		cmdIndex, runCmd = reproCommand(is.Type, cmd)
+	} else {
+		cmdIndex, runCmd = iterationCommand(is.Type, cmd)
+	}
+	st.seed, st.cmdIndex, st.run = seed, cmdIndex, run
+	data := templateData{Instance: inst, Type: is.Type, Iteration: is.Iterations, Shard: is.Shard, Shards: sess.shards(), Seed: seed, Command: cmdIndex}
+	status, err := runOneTest(ctx, inst, runCmd, errRegexp, data)
+	if errors.Is(err, errIdentical) {
+		sess.recordSkip(is.Type, cmdIndex)
+		if st.skips++; st.skips >= maxIdenticalSkips {
+			instLogf(inst, "Every iteration on %s would be identical to one that passed, stopping it.", inst)
+			return status, nil, swarm.ErrDone
+		}
+		return status, nil, swarm.ErrSkip
+	}
+	st.skips = 0
+	sess.recordCommand(cmdIndex, status)
+	sess.recordShuffle(seed, status)
+	sess.recordGODEBUG(seed, status)
+	if run {
+		finishRepro(status == swarm.FailMatched, status != swarm.ExecutionError)
+	}
+	iterationsTotal.Inc(status.String())
+	sess.recordIteration(is, status)
+	exportIteration(data, start, status)
+	if err := sess.checkBroken(); err != nil {
+		return status, nil, err
+	}
+	checkStopWhen()
+	if benchmarkDone() || verifyIters > 0 && sess.cleanIterations() >= int(verifyIters) {
+		sess.currentPool().DrainAll()
+	}
+	slog.Debug(fmt.Sprintf("Iteration %d on %s: %s.", is.Iterations, inst, status), "instance", inst, "iteration", is.Iterations, "result", status.String(), "duration", time.Since(start), "seed", data.Seed)
+	var ie *swarm.InfraError
+	if errors.As(err, &ie) {
+		if outage.failed(inst, err) {
+			sess.setState(is, "paused")
+			waitCtx, cancel := swarm.WithDrain(ctx, s.Drain())
+			outage.wait(waitCtx)
+			cancel()
+			sess.setState(is, "running")
+			return status, nil, swarm.ErrSkip
+		}
+		return status, nil, err
+	}
+	outage.succeeded()
+	if err == nil && status == swarm.FailMatched && !run {
+		startMeasuring(seed, is.Type, cmdIndex)
+	}
+	return status, nil, err
+}
+
+// slotInfraError checks whether the instance of the slot s is to be
+// quarantined after an infrastructure error running the command.
+func slotInfraError(ctx context.Context, s *swarm.Slot, err error) error {
+	if err := checkQuarantine(s.Instance, s.TotalInfraErrors); err != nil {
 		return err
-	}, deflakes)
-	if err != nil {
-		log.Printf("Aborting instance creation due to too many errors: %v", unwrap(err))
-		return nil
 	}
-	log.Printf("Created instance %s...", inst)
+	if s.InfraErrors < retryPolicy("run").Attempts {
+		retriesTotal.Inc("run")
+	}
+	return nil
+}
 
-	if clean == cleanExit {
-		defer func() {
-			log.Printf("Destroying instance %s...", inst)
-			if err := gomote.Destroy(context.Background(), inst); err != nil {
-				log.Printf("Error destroying instance %s: %v", inst, err)
+// slotPassed readies the instance of the slot s for the next iteration,
+// after one that passed or failed without matching, unless it's time to
+// stop or replace it.
+func slotPassed(ctx context.Context, s *swarm.Slot, status swarm.Status) error {
+	st := s.Data.(*slotState)
+	inst := s.Instance
+	if status == swarm.Pass && untilSuccess {
+		return errStop
+	}
+	if status == swarm.FailUnmatched {
+		if err := checkQuarantine(inst, s.TotalInfraErrors); err != nil {
+			return err
+		}
+	}
+	if st.n++; recycleAfter > 0 && st.n >= int(recycleAfter) {
+		return &recycleError{inst, fmt.Sprintf("ran %d iterations", st.n)}
+	}
+	if err := sess.retype(inst, s.Type); err != nil {
+		return err
+	}
+	wipeWorkspace(ctx, inst)
+	return nil
+}
+
+// slotFailure decides whether to keep testing on an instance after a
+// matching failure.
+func slotFailure(ctx context.Context, f *swarm.Failure) error {
+	if reproducing() || soak || untilSuccess {
+		// Every run counts, so keep going.
+		wipeWorkspace(ctx, f.Instance)
+		return swarm.ErrContinue
+	}
+	return nil
+}
+
+// setUpInstance creates the instance, if needed, and pushes GOROOT to it,
+// storing its name in *inst. It reports whether the instance is ready.
+func setUpInstance(ctx context.Context, typ string, is *instanceState, setup instanceSetup, inst *string) bool {
+	// Create instance.
+	if setup == setupCreate {
+		start := time.Now()
+		var quotaErr, capacityErr error
+		err := retry(ctx, "create", "", func(ctx context.Context) error {
+			i, err := createInstance(ctx, typ, is)
+			switch {
+			case gomote.IsQuotaError(err):
+				// Retrying won't help.
+				quotaErr = err
+				return nil
+			case gomote.IsCapacityError(err):
+				// With -i auto, shrink the pool instead.
+				capacityErr = err
+				return nil
 			}
-		}()
+			*inst = i
+			return err
+		})
+		if err == nil && quotaErr != nil {
+			sess.hitQuota(quotaErr)
+			return false
+		}
+		if err == nil && capacityErr != nil {
+			log.Printf("No capacity for %s, shrinking the pool to %d instances.", typ, poolSize()-1)
+			return false
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Aborting instance creation due to too many errors: %v", unwrap(err))
+			}
+			return false
+		}
+		sess.recordSetup("create", time.Since(start))
+		sess.holdInstance(*inst, start)
+		instLogf(*inst, "Created instance %s...", *inst)
+		registerInstance(*inst, typ)
+		sess.setName(is, *inst)
+		sess.setState(is, "pushing")
+	} else {
+		claimInstance(*inst)
+		sess.holdInstance(*inst, time.Now())
 	}
 
-	// Push GOROOT to instance.
-	// N.B. GOROOT is implicitly passed to gomote via the environment.
-	err = retry(func() error { return gomote.Push(ctx, inst) }, deflakes)
-	if err != nil {
-		log.Printf("Giving up on %s due to too many errors while pushing: %v", inst, unwrap(err))
-		return nil
+	// Push GOROOT, or -goroot, to instance.
+	if stamp := currentStamp(); setup == setupPush && stamp != "" && pushedStamp(*inst) == stamp {
+		instDetailf(*inst, "Skipping push to %s, which already has this tree.", *inst)
+	} else if setup != setupNone && !typePush(typ) {
+		instDetailf(*inst, "Skipping push to %s, since %s instances aren't pushed to.", *inst, typ)
+	} else if setup != setupNone {
+		// Time the pushes themselves, not the wait for other pushes.
+		var took time.Duration
+		err := retry(ctx, "push", *inst, func(ctx context.Context) error {
+			if err := pushLimiter.acquire(ctx); err != nil {
+				return err
+			}
+			defer pushLimiter.release()
+			return limitTransfer(ctx, func() error {
+				start := time.Now()
+				defer func() { took += time.Since(start) }()
+				return limitOp(ctx, func() error { return backend.Push(ctx, *inst) })
+			})
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				instWarnf(*inst, "Giving up on %s due to too many errors while pushing: %v", *inst, unwrap(err))
+			}
+			return false
+		}
+		recordPush(*inst, stamp)
+		sess.recordSetup("push", took)
+		instDetailf(*inst, "Pushed to %s.", *inst)
+	}
+	if setup != setupNone && typeBootstrap(typ) {
+		b := backend.(swarm.Bootstrapper)
+		err := retry(ctx, "putbootstrap", *inst, func(ctx context.Context) error {
+			return limitOp(ctx, func() error { return b.PutBootstrap(ctx, *inst) })
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				instWarnf(*inst, "Giving up on %s due to too many errors while pushing the bootstrap toolchain: %v", *inst, unwrap(err))
+			}
+			return false
+		}
+		instDetailf(*inst, "Pushed the bootstrap toolchain to %s.", *inst)
+	}
+	for _, up := range uploads() {
+		up := up
+		err := retry(ctx, "put", *inst, func(ctx context.Context) error {
+			return limitOp(ctx, func() error { return put(ctx, *inst, up) })
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				instWarnf(*inst, "Giving up on %s due to too many errors while uploading %s: %v", *inst, up.src, err)
+			}
+			return false
+		}
+	}
+	if setup != setupNone {
+		if err := runTypeSetup(ctx, *inst, typ); err != nil {
+			if ctx.Err() == nil {
+				instWarnf(*inst, "Giving up on %s: setting it up: %v", *inst, unwrap(err))
+			}
+			return false
+		}
 	}
-	log.Printf("Pushed to %s.", inst)
+	if setup != setupNone && makeGo {
+		sess.setState(is, "building")
+		if err := buildGo(ctx, *inst, is); err != nil {
+			if ctx.Err() == nil {
+				instWarnf(*inst, "Giving up on %s: building Go: %v", *inst, unwrap(err))
+			}
+			return false
+		}
+		instDetailf(*inst, "Built Go on %s.", *inst)
+	}
+	sess.setState(is, "running")
+	return true
+}
 
-	// Run command in a loop.
-	cmd := flag.Args()[1:]
+// Bounds on the backoff between attempts to create an instance of a
+// type that's at capacity.
+const (
+	capacityBackoffMin = 15 * time.Second
+	capacityBackoffMax = 5 * time.Minute
+)
+
+// createInstance creates an instance of type typ. If the type is at capacity,
+// it keeps trying with exponential backoff until ctx is done, since capacity
+// usually frees up eventually. Instances requested at about the same time
+// are created in a batch, if the backend can.
+func createInstance(ctx context.Context, typ string, is *instanceState) (string, error) {
+	if inst, ok := batchCreate(ctx, typ); ok {
+		return inst, nil
+	}
+	backoff := capacityBackoffMin
 	for {
-		status, err := runOneTest(ctx, inst, cmd, errRegexp)
-		if err != nil {
+		if err := createLimiter.acquire(ctx); err != nil {
+			return "", err
+		}
+		var inst string
+		err := limitOp(ctx, func() (err error) {
+			inst, err = backend.Create(ctx, typ)
 			return err
+		})
+		createLimiter.release()
+		if !gomote.IsCapacityError(err) || shrinkForCapacity() {
+			return inst, err
 		}
-		switch status {
-		case testPass, testFailUnmatched:
-			continue
-		case testFailMatched:
-			if keepGoing {
-				// Stop testing on this instance, but return
-				// nil so others keep testing.
-				return nil
-			}
-			// Abort all testing and exit.
-			return errStop
-		default:
-			panic(fmt.Sprintf("unexpected status %s", status))
+		log.Printf("No capacity for %s, retrying in %s...", typ, backoff)
+		sess.setState(is, "waiting")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		sess.setState(is, "creating")
+		if backoff *= 2; backoff > capacityBackoffMax {
+			backoff = capacityBackoffMax
 		}
 	}
 }
@@ -255,81 +1160,226 @@ func runOneInstance(ctx context.Context, typ string, errRegexp *regexp.Regexp) e
 // failure (or there is an internal gomote issue).
 //
 // If the test runs, the test status and a nil error are returned. Otherwise
-// testExecutionError is returned with the error.
-func runOneTest(ctx context.Context, inst string, cmd []string, errRegexp *regexp.Regexp) (testStatus, error) {
-	log.Printf("Running command on %s.", inst)
-	results, err := gomote.Run(ctx, inst, env, cmd...)
-	select {
-	case <-ctx.Done():
-		// Context canceled. Return nil.
-		return testExecutionError, context.Canceled
-	default:
+// swarm.ExecutionError is returned with the error. An iteration skipped with
+// -skip-identical returns swarm.Pass and errIdentical.
+func runOneTest(ctx context.Context, inst string, cmd []string, errRegexp *regexp.Regexp, data templateData) (swarm.Status, error) {
+	cmd, err := expandTemplates(cmd, data)
+	if err != nil {
+		return swarm.ExecutionError, err
 	}
-	if err == nil {
-		return testPass, nil
+	runEnv, err := expandTemplates(env, data)
+	if err != nil {
+		return swarm.ExecutionError, err
 	}
-
-	_, ok := err.(*exec.ExitError)
-	if !ok {
-		// Failed in some other way.
-		return testExecutionError, err
+	// Come first, so that -e can override them.
+	runEnv = append(append(iterationEnv(data), typeEnv(data.Type)...), runEnv...)
+	runEnv = shuffleEnv(runEnv, shuffleSeed(data.Seed))
+	runEnv = godebugEnv(runEnv, godebugFor(data.Seed))
+	var key string
+	if skipIdentical && benchIters == 0 && !reproducing() {
+		expanded, err := expandTemplates(steps, data)
+		if err != nil {
+			return swarm.ExecutionError, err
+		}
+		key = identicalKey(cmd, runEnv, expanded)
+		if identicalPassed(inst, key) {
+			instDetailf(inst, "Skipping iteration on %s, identical to one that passed.", inst)
+			return swarm.Pass, errIdentical
+		}
+	}
+	instDetailf(inst, "Running command on %s with seed %d.", inst, data.Seed)
+	_, sp := startSpan(ctx, "run", "instance", inst)
+	arm := nextBenchArm()
+	if arm != nil {
+		runEnv = append(runEnv[:len(runEnv):len(runEnv)], arm.env...)
+	}
+	if err := runSteps(ctx, inst, runEnv, data); err != nil {
+		sp.End(err)
+		if ctx.Err() != nil {
+			return swarm.ExecutionError, context.Canceled
+		}
+		return swarm.ExecutionError, err
+	}
+	start := time.Now()
+	runCtx := ctx
+	if failSlower > 0 {
+		// Stop the iteration once it's too slow, rather than waiting
+		// out what may be a hang.
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, failSlower)
+		defer cancel()
+	}
+	results, err := backend.Run(runCtx, inst, runEnv, cmd...)
+	runTime := time.Since(start)
+	results = redact(results)
+	runDuration.Observe(runTime)
+	sp.End(err)
+	instOutput(inst, results)
+	if errors.Is(err, context.Canceled) {
+		return swarm.ExecutionError, context.Canceled
+	}
+	// The backend reports a canceled run by wrapping the context's error.
+	slow := errors.Is(err, context.DeadlineExceeded) && runCtx.Err() != nil
+	code, exit := swarm.ExitCode(err), swarm.ExitStatus(err)
+	status, err := swarm.Classify(inst, results, err)
+	if slow {
+		results = append(results, slowNote(runTime)...)
+		status, err = swarm.FailUnmatched, nil
 	}
-	if bytes.Contains(results, []byte(inst)) {
-		return testExecutionError, fmt.Errorf("lost builder %q", inst)
+	if status == swarm.FailUnmatched {
+		noteSignature(inst, results)
 	}
-	if errRegexp != nil && !errRegexp.Match(results) {
+	if status != swarm.ExecutionError {
+		sess.recordDuration(runTime)
+		if arm != nil {
+			if err := recordBench(arm, results); err != nil {
+				instWarnf(inst, "Failed to record benchmark results from %s: %v", inst, err)
+			}
+		}
+	}
+	if status == swarm.Pass && key != "" {
+		recordIdenticalPass(inst, key)
+	}
+	if status == swarm.Pass && untilSuccess {
+		instLogf(inst, "Run on %s passed with seed %d.", inst, data.Seed)
+		if err := recordPass(ctx, inst, results, data.Seed); err != nil {
+			return swarm.ExecutionError, err
+		}
+	}
+	if status != swarm.FailUnmatched {
+		return status, err
+	}
+	matched := slow || (errRegexp == nil || errRegexp.Match(results)) && matchesExit(code)
+	var known string
+	if !slow {
+		known = knownIssueFor(results)
+	}
+	if known != "" {
+		instLogf(inst, "Failure on %s matches known issue %s.", inst, known)
+		if skipKnown {
+			matched = false
+		}
+	}
+	if !matched {
 		// Only consider failures that match the regexp
 		// "real" failures. But if our verbosity level
 		// is high enough, dump the failure anyway.
-		f, err := os.CreateTemp("", inst)
+		path, dup, err := sess.saveUnmatched(inst, results)
 		if err != nil {
-			return testExecutionError, fmt.Errorf("failed to write output from %s to temp file: %w", inst, err)
+			return swarm.ExecutionError, fmt.Errorf("failed to write output from %s: %w", inst, err)
 		}
-		defer f.Close()
-		if _, err := f.Write(results); err != nil {
-			return testExecutionError, fmt.Errorf("Failed to write output from %s to %s: %w", inst, f.Name(), err)
+		if verbosity < 2 || instanceLog(inst) != nil {
+			instFailuref(inst, false, "Unmatched failure on %s with seed %d (%s).", inst, data.Seed, exit)
+		} else {
+			slog.Info(fmt.Sprintf("Unmatched failure on %s with seed %d (%s):\n%s", inst, data.Seed, exit, tailLines(results, int(consoleLines))), "instance", inst, "failure", "unmatched", "seed", data.Seed, "exit", exit)
 		}
-		f.Close()
-		if verbosity < 2 {
-			log.Printf("Unmatched failure on %s.", inst)
+		if dup {
+			instLogf(inst, "Output of %s is identical to %s.", inst, path)
 		} else {
-			log.Printf("Unmatched failure on %s:\n%s", inst, string(results))
+			instLogf(inst, "Wrote output of %s to %s.", inst, path)
 		}
-		log.Printf("Wrote output of %s to %s.", inst, f.Name())
-		return testFailUnmatched, nil
+		sess.recordHang(results, path)
+		return swarm.FailUnmatched, nil
 	}
-	log.Printf("Discovered failure on %s.", inst)
-	outName := inst + ".out"
+	if slow {
+		instFailuref(inst, true, "Discovered slow iteration on %s with seed %d, stopped after %s.", inst, data.Seed, runTime.Round(time.Millisecond))
+	} else {
+		instFailuref(inst, true, "Discovered failure on %s with seed %d (%s).", inst, data.Seed, exit)
+	}
+	var matchCtx string
+	if errRegexp != nil && !slow {
+		matchCtx = matchContext(errRegexp, results, int(matchContextLines))
+		instLogf(inst, "Matched on %s:\n%s", inst, matchCtx)
+	}
+	name := sess.failureName(inst)
+	outName := filepath.Join(artifactsDir, name+".out")
 	if err := os.WriteFile(outName, results, 0o644); err != nil {
 		log.Printf("Dumping output from %s:\n%s", inst, string(results))
-		return testExecutionError, fmt.Errorf("failed to write output: %v\n", err)
+		return swarm.ExecutionError, fmt.Errorf("failed to write output: %v\n", err)
+	}
+	addArtifact(outName)
+	instLogf(inst, "Wrote output of %s to %s.", inst, outName)
+	var tarName, tarNote string
+	if fetchReferenced {
+		tarName, tarNote, err = downloadReferenced(ctx, inst, name, results)
+	} else {
+		tarName, tarNote, err = downloadArchive(ctx, inst, name)
 	}
-	log.Printf("Wrote output of %s to %s.", inst, outName)
-	tarName := inst + ".tar.gz"
-	f, err := os.Create(tarName)
 	if err != nil {
-		return testExecutionError, fmt.Errorf("failed to create archive for %s: %v", inst, err)
+		return swarm.ExecutionError, err
 	}
-	defer f.Close()
-	if err := gomote.Get(ctx, inst, f); err != nil {
-		return testExecutionError, fmt.Errorf("failed to download archive for %s: %v", inst, err)
+	f := failureRecord{Instance: inst, Time: time.Now(), Elapsed: sinceStart(), Output: outName, Archive: tarName, ArchiveNote: tarNote, Context: matchCtx, Known: known, Slow: slow, Seed: data.Seed, InstanceType: data.Type, ExitCode: code, ExitStatus: exit}
+	f.Signature = signatureString(failureSignature(inst, results))
+	f.Shuffle = shuffleSeed(data.Seed)
+	f.GODEBUG = godebugFor(data.Seed)
+	f.Hang = sess.recordHang(results, outName)
+	f.Tests = failedTests(results)
+	if rerunCount > 0 && len(f.Tests) > 0 && !slow {
+		// Only now, so that the reruns don't disturb the archive.
+		f.Rerun = f.Tests[0]
+		f.Reruns, f.RerunFailures = rerunTest(ctx, inst, runEnv, cmd, f.Rerun)
 	}
-	log.Printf("Downloaded archive of %s to %s.", inst, tarName)
-	return testFailMatched, nil
-}
-
-func retry(f func() error, retries uint) error {
-	i := 0
-loop:
-	err := f()
-	if err == nil {
-		return nil
+	if data.Command >= 0 {
+		f.Command = commandList[data.Command]
+	}
+	if fsDiff && tarName != "" {
+		// Before bundling, which removes the archive.
+		if goroot, _ := pushRoot(); goroot != "" {
+			var err error
+			if f.FSChanges, f.FSChanged, err = diffArchive(tarName, goroot); err != nil {
+				instWarnf(inst, "Failed to compare the work directory of %s with GOROOT: %v", inst, err)
+			}
+		}
+	}
+	if crossRef {
+		links, err := lookUpFailure(ctx, failureReason(errRegexp, results))
+		if err != nil {
+			instWarnf(inst, "Failed to look up failure on %s in LUCI Analysis: %v", inst, err)
+		} else {
+			f.Dashboard = links
+		}
+	}
+	script := reproScript(f, data, runEnv, cmd)
+	if bundleFailures {
+		// After the lookup, so that the bundled report has its links.
+		b, err := bundleFailure(f, results, runEnv, cmd, script)
+		if err != nil {
+			// The loose artifacts are still there.
+			instWarnf(inst, "Failed to bundle artifacts of %s: %v", inst, err)
+		} else {
+			f = b
+			instLogf(inst, "Bundled artifacts of %s into %s.", inst, f.Bundle)
+		}
+	}
+	if f.Bundle == "" {
+		if path, err := writeFailureMetadata(f); err != nil {
+			instWarnf(inst, "Failed to write metadata of failure on %s: %v", inst, err)
+		} else {
+			addArtifact(path)
+			f.Metadata = path
+		}
+		if script != nil {
+			path := uniquePath(filepath.Join(artifactsDir, fmt.Sprintf("repro-%s-%s.sh", f.Time.Format("20060102T150405"), f.Instance)))
+			if err := os.WriteFile(path, script, 0o755); err != nil {
+				instWarnf(inst, "Failed to write repro script of failure on %s: %v", inst, err)
+			} else {
+				addArtifact(path)
+				f.Repro = path
+			}
+		}
 	}
-	i++
-	if i < int(retries) {
-		goto loop
+	if report, err := writeReport(f, results); err != nil {
+		instWarnf(inst, "Failed to write report for %s: %v", inst, err)
+	} else {
+		addArtifact(report)
+		f.Report = report
+		instLogf(inst, "Wrote report for %s to %s.", inst, report)
 	}
-	return err
+	sess.recordFailure(f)
+	notifyFailure(f, results)
+	startRDP(inst, data.Type)
+	startPair(inst, f, results)
+	return swarm.FailMatched, nil
 }
 
 func unwrap(err error) error {
@@ -0,0 +1,101 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var makeGo bool
+
+func init() {
+	flag.BoolVar(&makeGo, "make", false, "build Go with make.bash (make.bat on Windows) once on each instance after pushing GOROOT, before running the command; an instance whose build fails is reported as a build failure, not a failure of the command, and stops")
+}
+
+// buildFailure is an instance on which make.bash failed.
+type buildFailure struct {
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+	Output   string    `json:"output"`
+}
+
+// recordBuildFailure records that make.bash failed on inst, with its
+// output written to out.
+func (s *session) recordBuildFailure(inst, out string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buildFailures = append(s.buildFailures, buildFailure{Instance: inst, Time: time.Now(), Output: out})
+}
+
+// makeCommand returns the command that builds Go on an instance of type
+// typ, from the directory commands run in.
+func makeCommand(typ string) []string {
+	dir := "go/src"
+	if runDir != "" {
+		// Commands run in -dir, so find go/src from there.
+		dir = strings.Repeat("../", strings.Count(path.Clean(runDir), "/")+1) + dir
+	}
+	if isWindowsType(typ) {
+		return shellCommand(typ, fmt.Sprintf(`cd %s && make.bat`, strings.ReplaceAll(dir, "/", `\`)))
+	}
+	return shellCommand(typ, fmt.Sprintf("cd %s && ./%s", dir, typeScript(typ, "make.bash")))
+}
+
+// buildGo runs make.bash on inst, retrying infrastructure errors. If the
+// build itself fails, it writes the output to the artifacts directory,
+// records a build failure, and returns an error.
+func buildGo(ctx context.Context, inst string, is *instanceState) error {
+	data := templateData{Instance: inst, Type: is.Type, Shard: is.Shard, Shards: sess.shards(), Command: -1}
+	runEnv, err := expandTemplates(env, data)
+	if err != nil {
+		return err
+	}
+	runEnv = append(typeEnv(is.Type), runEnv...)
+	var out []byte
+	var status swarm.Status
+	err = retry(ctx, "make", inst, func(ctx context.Context) error {
+		var err error
+		out, err = backend.Run(ctx, inst, runEnv, inRunDir(makeCommand(is.Type))...)
+		out = redact(out)
+		status, err = swarm.Classify(inst, out, err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if status == swarm.Pass {
+		return nil
+	}
+	outName := filepath.Join(artifactsDir, inst+".make.out")
+	if err := os.WriteFile(outName, out, 0o644); err != nil {
+		return fmt.Errorf("failed to write build output: %v", err)
+	}
+	addArtifact(outName)
+	sess.recordBuildFailure(inst, outName)
+	instWarnf(inst, "Building Go failed on %s, wrote its output to %s:\n%s", inst, outName, tailLines(out, int(consoleLines)))
+	return fmt.Errorf("make.bash failed on %s", inst)
+}
+
+// writeBuildFailures writes the instances on which make.bash failed, if
+// any.
+func (st *sessionStatus) writeBuildFailures(w io.Writer) {
+	if len(st.BuildFailures) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  build failures:\n")
+	for _, b := range st.BuildFailures {
+		fmt.Fprintf(w, "    %s: %s\n", b.Instance, b.Output)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+)
+
+var (
+	matchContextLines uint
+	consoleLines      uint
+)
+
+func init() {
+	flag.UintVar(&matchContextLines, "match-context", 5, "number of lines of context around a -match match to log and record with the failure")
+	flag.UintVar(&consoleLines, "console-lines", 100, "number of trailing lines of an unmatched failure's output to log at -v=2 (0 logs all of it)")
+}
+
+// tailLines returns the last n lines of output, noting how many were left
+// out. If n is 0, it returns all of output.
+func tailLines(output []byte, n int) string {
+	output = bytes.TrimRight(output, "\n")
+	if n <= 0 {
+		return string(output)
+	}
+	start := len(output)
+	for i := 0; i < n; i++ {
+		j := bytes.LastIndexByte(output[:start], '\n')
+		if j < 0 {
+			return string(output)
+		}
+		start = j
+	}
+	skipped := bytes.Count(output[:start], []byte("\n")) + 1
+	return fmt.Sprintf("[%d earlier lines omitted]%s", skipped, output[start:])
+}
+
+// matchContext returns the lines of output around the first match of re,
+// with n lines of context on either side, or "" if there's no match.
+func matchContext(re *regexp.Regexp, output []byte, n int) string {
+	loc := re.FindIndex(output)
+	if loc == nil {
+		return ""
+	}
+	// Extend the match to whole lines, then by n lines in each direction.
+	start := bytes.LastIndexByte(output[:loc[0]], '\n') + 1
+	for i := 0; i < n && start > 0; i++ {
+		start = bytes.LastIndexByte(output[:start-1], '\n') + 1
+	}
+	end := loc[1]
+	for i := 0; i <= n && end < len(output); i++ {
+		j := bytes.IndexByte(output[end:], '\n')
+		if j < 0 {
+			end = len(output)
+			break
+		}
+		end += j + 1
+	}
+	return string(bytes.TrimRight(output[start:end], "\n"))
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var matchExit string
+
+func init() {
+	flag.StringVar(&matchExit, "match-exit", "", "comma-separated list of exit codes of the command that make a failure match, like 2 for panics, alone or along with -match")
+}
+
+// matchExitCodes are the exit codes of -match-exit.
+var matchExitCodes []int
+
+// parseMatchExit parses -match-exit.
+func parseMatchExit() error {
+	matchExitCodes = nil
+	if matchExit == "" {
+		return nil
+	}
+	for _, s := range strings.Split(matchExit, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || code < 0 {
+			return fmt.Errorf("%q is not an exit code", s)
+		}
+		matchExitCodes = append(matchExitCodes, code)
+	}
+	return nil
+}
+
+// matchesExit reports whether a failure with the exit code code matches
+// -match-exit, if any.
+func matchesExit(code int) bool {
+	return len(matchExitCodes) == 0 || slices.Contains(matchExitCodes, code)
+}
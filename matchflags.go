@@ -0,0 +1,34 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var matchFlags string
+
+func init() {
+	flag.StringVar(&matchFlags, "match-flags", "", "regexp flags for -match: any of i (case-insensitive), m (^ and $ match at the start and end of every line), s (. matches newlines), and U (ungreedy), like -match-flags=ms")
+}
+
+// applyMatchFlags adds -match-flags to -match, in the inline syntax,
+// (?flags), which -match may also use directly. Since they're part of
+// -match itself, they're recorded and carried over along with it.
+func applyMatchFlags() error {
+	if matchFlags == "" || errMatch == "" {
+		return nil
+	}
+	if i := strings.IndexFunc(matchFlags, func(r rune) bool { return !strings.ContainsRune("imsU", r) }); i >= 0 {
+		return fmt.Errorf("unknown flag %q, expected i, m, s, or U", matchFlags[i])
+	}
+	prefix := "(?" + matchFlags + ")"
+	if !strings.HasPrefix(errMatch, prefix) {
+		errMatch = prefix + errMatch
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricsAddr string
+
+func init() {
+	flag.StringVar(&metricsAddr, "metrics", "", "address (e.g. localhost:9090) on which to serve Prometheus metrics at /metrics")
+}
+
+// Metrics exported by goswarm.
+var (
+	iterationsTotal = newCounter("goswarm_iterations_total",
+		"Number of command iterations, by result.", "result")
+	retriesTotal = newCounter("goswarm_gomote_retries_total",
+		"Number of retried gomote operations.", "op")
+	activeInstances = newGauge("goswarm_active_instances",
+		"Number of instances currently running the command.")
+	runDuration = newHistogram("goswarm_run_duration_seconds",
+		"Duration of command iterations.")
+	gomoteOpDuration = newHistogram("goswarm_gomote_op_duration_seconds",
+		"Latency of individual gomote operations.", "op")
+)
+
+// durationBuckets are the histogram buckets, in seconds, used for all
+// histograms. They span quick gomote operations through long all.bash runs.
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1200, 2400, 3600}
+
+// metric is a single Prometheus metric family.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+}
+
+// serveMetrics serves all registered metrics in the Prometheus text
+// exposition format on addr. It runs until the process exits.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+}
+
+// labeled is the shared bookkeeping for metrics with labels.
+type labeled struct {
+	name, help string
+	labels     []string
+}
+
+func (l *labeled) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, l.help, l.name, typ)
+}
+
+// key returns a map key for the label values vals.
+func (l *labeled) key(vals []string) string {
+	if len(vals) != len(l.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", l.name, len(vals), len(l.labels)))
+	}
+	return strings.Join(vals, "\xff")
+}
+
+// labelEscaper escapes label values as the text exposition format does,
+// which, unlike Go, leaves everything but \, ", and newlines as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// format formats the labels for key, plus any extra label pairs.
+func (l *labeled) format(key string, extra ...string) string {
+	var pairs []string
+	if len(l.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, l.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counter struct {
+	labeled
+	mu   sync.Mutex
+	vals map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{labeled: labeled{name, help, labels}, vals: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *counter) Inc(labels ...string) {
+	k := c.key(labels)
+	c.mu.Lock()
+	c.vals[k]++
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.vals) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(k), formatFloat(c.vals[k]))
+	}
+}
+
+type gauge struct {
+	labeled
+	mu  sync.Mutex
+	val float64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{labeled: labeled{name: name, help: help}}
+	register(g)
+	return g
+}
+
+func (g *gauge) Add(d float64) {
+	g.mu.Lock()
+	g.val += d
+	g.mu.Unlock()
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.val))
+}
+
+type histogram struct {
+	labeled
+	mu   sync.Mutex
+	vals map[string]*histogramData
+}
+
+type histogramData struct {
+	counts []uint64 // one per bucket, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	h := &histogram{labeled: labeled{name, help, labels}, vals: make(map[string]*histogramData)}
+	register(h)
+	return h
+}
+
+func (h *histogram) Observe(d time.Duration, labels ...string) {
+	k := h.key(labels)
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	data, ok := h.vals[k]
+	if !ok {
+		data = &histogramData{counts: make([]uint64, len(durationBuckets))}
+		h.vals[k] = data
+	}
+	for i, b := range durationBuckets {
+		if s <= b {
+			data.counts[i]++
+			break
+		}
+	}
+	data.count++
+	data.sum += s
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		data := h.vals[k]
+		var cum uint64
+		for i, b := range durationBuckets {
+			cum += data.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(k, "le", formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(k, "le", "+Inf"), data.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(k), formatFloat(data.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(k), data.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
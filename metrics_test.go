@@ -0,0 +1,30 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestLabelFormat(t *testing.T) {
+	l := &labeled{name: "goswarm_test", labels: []string{"op", "type"}}
+	tests := []struct {
+		vals  []string
+		extra []string
+		want  string
+	}{
+		{[]string{"create", "linux-amd64"}, nil, `{op="create",type="linux-amd64"}`},
+		{[]string{"create", "linux-amd64"}, []string{"le", "+Inf"}, `{op="create",type="linux-amd64",le="+Inf"}`},
+		{[]string{`C:\go "x"`, "a\nb"}, nil, `{op="C:\\go \"x\"",type="a\nb"}`},
+		// Unlike %q, the format leaves everything else alone.
+		{[]string{"héllo\t", "\x01"}, nil, "{op=\"héllo\t\",type=\"\x01\"}"},
+	}
+	for _, tt := range tests {
+		if got := l.format(l.key(tt.vals), tt.extra...); got != tt.want {
+			t.Errorf("format(%q, %q) = %s, want %s", tt.vals, tt.extra, got, tt.want)
+		}
+	}
+	if got := (&labeled{name: "goswarm_test"}).format(""); got != "" {
+		t.Errorf("format without labels = %q, want none", got)
+	}
+}
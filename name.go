@@ -0,0 +1,42 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+var sessionName string
+
+func init() {
+	flag.StringVar(&sessionName, "name", "", "name of the session, to keep concurrent sessions apart: its artifacts go in a subdirectory of -artifacts by that name, its default state file and daemon log carry it, and goswarm status, pause, unpause, and resize accept it in place of a PID")
+}
+
+// sessionNameRe matches valid session names, which must be usable as file
+// names.
+var sessionNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// setUpSessionName namespaces the session's files by -name.
+func setUpSessionName() error {
+	if sessionName == "" {
+		return nil
+	}
+	if !sessionNameRe.MatchString(sessionName) {
+		return fmt.Errorf("%q must be letters, digits, '.', '-', and '_'", sessionName)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	artifactsDir = filepath.Join(artifactsDir, sessionName)
+	if !set["state"] {
+		stateFile = "goswarm-state-" + sessionName + ".json"
+	}
+	if !set["daemon-log"] {
+		daemonLog = "goswarm-" + sessionName + ".log"
+	}
+	return nil
+}
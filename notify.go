@@ -0,0 +1,111 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var notifyURL string
+
+func init() {
+	flag.StringVar(&notifyURL, "notify-url", "", "webhook URL (e.g. a Slack incoming webhook) to POST a JSON notification to when a matching failure is found and when the session ends")
+}
+
+// notification describes a matching failure, or the end of a session.
+type notification struct {
+	Event     string         `json:"event"` // "failure" or "end"
+	Text      string         `json:"text"`  // human-readable summary, as expected by Slack
+	Type      string         `json:"type"`
+	Command   []string       `json:"command"`
+	Match     string         `json:"match,omitempty"`
+	Instance  string         `json:"instance,omitempty"`
+	Artifacts []string       `json:"artifacts,omitempty"`
+	Snippet   string         `json:"snippet,omitempty"`
+	Results   map[string]int `json:"results,omitempty"`
+}
+
+// notifySnippetLines is the number of lines of output included in a failure
+// notification, if there's no match context.
+const notifySnippetLines = 20
+
+// notifyFailure sends a notification about the matching failure f, with
+// the given output.
+func notifyFailure(f failureRecord, output []byte) {
+	snippet := f.Context
+	if snippet == "" {
+		snippet = tailLines(output, notifySnippetLines)
+	}
+	notify(notification{
+		Event:     "failure",
+		Text:      fmt.Sprintf("goswarm found a matching failure on %s (%s):\n```\n%s\n```", f.Instance, sess.typ, snippet),
+		Type:      sess.typ,
+		Command:   sess.cmd,
+		Match:     errMatch,
+		Instance:  f.Instance,
+		Artifacts: f.artifacts(),
+		Snippet:   snippet,
+	})
+}
+
+// notifyEnd sends a notification summarizing the session, once it ends.
+func notifyEnd() {
+	st := sess.status()
+	var summary strings.Builder
+	st.writeSummary(&summary)
+	var artifacts []string
+	for _, f := range st.Failures {
+		artifacts = append(artifacts, f.artifacts()...)
+	}
+	notify(notification{
+		Event:     "end",
+		Text:      fmt.Sprintf("goswarm session on %s ended.\n```\n%s```", st.Type, summary.String()),
+		Type:      st.Type,
+		Command:   st.Command,
+		Match:     errMatch,
+		Artifacts: artifacts,
+		Results:   st.Results,
+	})
+}
+
+// notify sends n to every configured notification channel.
+func notify(n notification) {
+	if notifyURL != "" {
+		if err := postNotification(notifyURL, n); err != nil {
+			log.Printf("Failed to send notification: %v", err)
+		}
+	}
+	if len(notifyEmail) > 0 {
+		if err := sendEmail(n); err != nil {
+			log.Printf("Failed to send email notification: %v", err)
+		}
+	}
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// postNotification POSTs n as JSON to url.
+func postNotification(url string, n notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var outageBackoff time.Duration
+
+func init() {
+	flag.DurationVar(&outageBackoff, "outage-backoff", 30*time.Second, "when every instance is failing gomote operations at once, pause the whole session for this long, doubling it while the outage lasts (0 disables)")
+}
+
+// outageMaxBackoff bounds the pause during a long outage.
+const outageMaxBackoff = 10 * time.Minute
+
+// outageDetector notices when gomote operations are failing on every
+// instance at once, as when the coordinator restarts, and pauses the
+// session until it's likely to be back, rather than letting every
+// instance exhaust its retries independently.
+type outageDetector struct {
+	mu      sync.Mutex
+	failing map[string]bool // instances that failed an operation since the last success anywhere
+	over    chan struct{}   // non-nil during an outage; closed when it's over
+	backoff time.Duration   // of the current or last outage, until an operation succeeds
+}
+
+var outage outageDetector
+
+// succeeded records that an operation succeeded, so there's no outage.
+func (o *outageDetector) succeeded() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.backoff > 0 && o.over == nil {
+		log.Printf("Gomote operations are succeeding again.")
+		o.backoff = 0
+	}
+	clear(o.failing)
+}
+
+// failed records that an operation on inst failed with err. It reports
+// whether there's an outage, in which case the failure shouldn't count
+// against the operation, which should be retried once wait returns.
+func (o *outageDetector) failed(inst string, err error) bool {
+	if outageBackoff <= 0 {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.over != nil {
+		return true
+	}
+	if o.failing == nil {
+		o.failing = make(map[string]bool)
+	}
+	o.failing[inst] = true
+	// Once an outage starts, it isn't over until something succeeds.
+	if o.backoff == 0 && len(o.failing) < max(poolSize(), 2) {
+		return false
+	}
+	o.backoff = min(max(2*o.backoff, outageBackoff), outageMaxBackoff)
+	over := make(chan struct{})
+	o.over = over
+	slog.Warn(fmt.Sprintf("Gomote operations are failing on every instance, pausing the session for %s: %v", o.backoff, unwrap(err)))
+	time.AfterFunc(o.backoff, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.over = nil
+		close(over)
+		log.Printf("Resuming the session after the outage.")
+	})
+	return true
+}
+
+// wait blocks until the current outage, if any, is over or ctx is done.
+func (o *outageDetector) wait(ctx context.Context) {
+	o.mu.Lock()
+	over := o.over
+	o.mu.Unlock()
+	if over == nil {
+		return
+	}
+	select {
+	case <-over:
+	case <-ctx.Done():
+	}
+}
+
+// poolSize returns the size of the session's pool, or 0 outside of
+// a session.
+func poolSize() int {
+	if sess == nil {
+		return 0
+	}
+	p := sess.currentPool()
+	if p == nil {
+		return 0
+	}
+	return p.Size()
+}
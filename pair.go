@@ -0,0 +1,181 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var pairDebug bool
+
+func init() {
+	flag.BoolVar(&pairDebug, "pair", false, "on the first matching failure, pause the rest of the swarm, keep the failing instance alive until the session is interrupted, and write instructions for someone else to connect to it and look at the failure live to pair-INSTANCE.txt in the artifacts directory")
+}
+
+// pairTailLines is how many lines of the failure's output the pair
+// debugging handoff includes, if there's no match context.
+const pairTailLines = 30
+
+// pair is the instance handed off for pair debugging, with -pair.
+var pair struct {
+	sync.Mutex
+	inst string
+	path string // of the handoff
+}
+
+// gomoteCommandLine returns the gomote invocation of args as a shell
+// command, with -gomote-env and -gomote-flag.
+func gomoteCommandLine(args ...string) string {
+	words := gomoteWords()
+	for _, a := range args {
+		words = append(words, swarm.ShellQuote(a))
+	}
+	return redactString(strings.Join(words, " "))
+}
+
+// gomoteWords returns the start of a gomote invocation as shell words,
+// with -gomote-env and -gomote-flag.
+func gomoteWords() []string {
+	var words []string
+	for _, kv := range gomoteEnv {
+		k, v, _ := strings.Cut(kv, "=")
+		words = append(words, k+"="+swarm.ShellQuote(v))
+	}
+	words = append(words, "gomote")
+	for _, f := range gomoteFlags {
+		words = append(words, swarm.ShellQuote(f))
+	}
+	return words
+}
+
+// startPair hands inst off for pair debugging of the matching failure f,
+// with the given output, if -pair is set and no other instance has been
+// handed off yet: it pauses the swarm, keeps inst, and writes the handoff.
+func startPair(inst string, f failureRecord, output []byte) {
+	if !pairDebug {
+		return
+	}
+	pair.Lock()
+	defer pair.Unlock()
+	if pair.inst != "" {
+		return
+	}
+	pair.inst = inst
+	sess.gate.pause()
+
+	var b strings.Builder
+	host, _ := os.Hostname()
+	fmt.Fprintf(&b, "Matching failure on %s (%s) at %s, kept alive for pair debugging\n", inst, f.InstanceType, f.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "by goswarm session %d on %s.\n\n", os.Getpid(), host)
+	fmt.Fprintf(&b, "Command: %s\n", redactString(strings.Join(sess.cmd, " ")))
+	fmt.Fprintf(&b, "Seed: %d\n", f.Seed)
+	if f.ExitStatus != "" {
+		fmt.Fprintf(&b, "Exit: %s\n", f.ExitStatus)
+	}
+	if len(f.Tests) > 0 {
+		fmt.Fprintf(&b, "Failed tests: %s\n", strings.Join(f.Tests, " "))
+	}
+	if f.Known != "" {
+		fmt.Fprintf(&b, "Known issue: %s\n", f.Known)
+	}
+	snippet := f.Context
+	if snippet == "" {
+		snippet = tailLines(output, pairTailLines)
+	}
+	fmt.Fprintf(&b, "\nOutput:\n")
+	for _, line := range strings.Split(strings.TrimRight(snippet, "\n"), "\n") {
+		fmt.Fprintf(&b, "\t%s\n", line)
+	}
+	fmt.Fprintf(&b, "\nConnect to the instance:\n")
+	fmt.Fprintf(&b, "\t%s\n", gomoteCommandLine("ssh", inst))
+	if isWindowsType(f.InstanceType) {
+		fmt.Fprintf(&b, "\t%s  # then connect a remote desktop client to localhost:7777\n", gomoteCommandLine("rdp", "-listen=localhost:7777", inst))
+	}
+	fmt.Fprintf(&b, "Run commands on it, in the work directory the failure ran in:\n")
+	run := []string{"run"}
+	if runDir != "" {
+		run = append(run, "-dir", runDir)
+	}
+	run = append(append(run, runArgs...), inst, "go/bin/go", "env")
+	fmt.Fprintf(&b, "\t%s\n", gomoteCommandLine(run...))
+	fmt.Fprintf(&b, "\nArtifacts, on %s:\n", host)
+	for _, a := range f.artifacts() {
+		abs, _ := filepath.Abs(a)
+		fmt.Fprintf(&b, "\t%s\n", abs)
+	}
+	if f.Metadata != "" {
+		fmt.Fprintf(&b, "Reproduce elsewhere with:\n\tgoswarm repro %s\n", filepath.Base(f.Metadata))
+	}
+	if keepGoing {
+		fmt.Fprintf(&b, "\nThe rest of the swarm is paused: resume it with goswarm unpause %d.\n", os.Getpid())
+	} else {
+		fmt.Fprintf(&b, "\nThe rest of the swarm has stopped.\n")
+	}
+	fmt.Fprintf(&b, "The instance stays alive until the session is interrupted; then destroy it with\n\t%s\n", gomoteCommandLine("destroy", inst))
+	text := redactString(b.String())
+
+	pair.path = filepath.Join(artifactsDir, "pair-"+inst+".txt")
+	if err := os.WriteFile(pair.path, []byte(text), 0o644); err != nil {
+		instWarnf(inst, "Failed to write pair debugging handoff: %v", err)
+		pair.path = ""
+	} else {
+		addArtifact(pair.path)
+	}
+	instLogf(inst, "Handing %s off for pair debugging:\n%s", inst, text)
+	if pair.path != "" {
+		instLogf(inst, "Wrote the handoff to %s; share it with whoever is to look at the failure.", pair.path)
+	}
+}
+
+// pairInstance reports whether inst is handed off for pair debugging, and
+// must be kept.
+func pairInstance(inst string) bool {
+	pair.Lock()
+	defer pair.Unlock()
+	return inst != "" && inst == pair.inst
+}
+
+// waitPair keeps the instance handed off for pair debugging, if any, alive
+// once the session is otherwise done, until it's interrupted or ctx is
+// done.
+func waitPair(ctx context.Context) {
+	pair.Lock()
+	inst := pair.inst
+	pair.Unlock()
+	if inst == "" || interrupted() {
+		return
+	}
+	hold, stop := context.WithCancel(ctx)
+	defer stop()
+	holdOnInterrupt(stop)
+	log.Printf("Keeping %s alive for pair debugging. Interrupt to stop.", inst)
+	pinger, _ := backend.(swarm.Pinger)
+	t := time.NewTicker(keepalivePeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-hold.Done():
+			log.Printf("No longer keeping %s alive; destroy it with %s when done.", inst, gomoteCommandLine("destroy", inst))
+			return
+		case <-t.C:
+			if pinger == nil {
+				continue
+			}
+			if err := pinger.Ping(hold, inst); err != nil && hold.Err() == nil {
+				instWarnf(inst, "Error pinging %s: %v", inst, unwrap(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var envPassthrough string
+
+func init() {
+	flag.StringVar(&envPassthrough, "e-passthrough", "", "comma-separated names of local environment variables, like GOFLAGS,GODEBUG, to copy into the environment of every run, as if passed with -e, which overrides them")
+}
+
+// applyEnvPassthrough adds the -e-passthrough variables that are set
+// locally to the start of env, so that -e overrides them.
+func applyEnvPassthrough() error {
+	if envPassthrough == "" {
+		return nil
+	}
+	var vars []string
+	for _, name := range strings.Split(envPassthrough, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, "=") {
+			return fmt.Errorf("%q is not a variable name; use -e to set a variable", name)
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("Not passing %s through, since it isn't set locally.", name)
+			continue
+		}
+		vars = append(vars, name+"="+v)
+	}
+	env = append(vars, env...)
+	return nil
+}
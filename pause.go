@@ -0,0 +1,79 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// keepalivePeriod is how often paused instances are pinged so that
+// they don't expire.
+const keepalivePeriod = time.Minute
+
+// pauseGate lets the whole swarm be paused between iterations.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused chan struct{} // non-nil while paused; closed on resume
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused == nil {
+		g.paused = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused != nil
+}
+
+// wait blocks while the swarm is paused, pinging inst periodically to keep
+// it alive. It returns early if ctx is done or drain is closed.
+func (g *pauseGate) wait(ctx context.Context, inst string, drain <-chan struct{}) {
+	g.mu.Lock()
+	resumed := g.paused
+	g.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	instLogf(inst, "Pausing %s.", inst)
+	pinger, _ := backend.(swarm.Pinger)
+	t := time.NewTicker(keepalivePeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-resumed:
+			instLogf(inst, "Resuming %s.", inst)
+			return
+		case <-ctx.Done():
+			return
+		case <-drain:
+			return
+		case <-t.C:
+			if pinger == nil {
+				continue
+			}
+			if err := pinger.Ping(ctx, inst); err != nil {
+				instWarnf(inst, "Error pinging paused instance %s: %v", inst, unwrap(err))
+			}
+		}
+	}
+}
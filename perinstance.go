@@ -0,0 +1,82 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// instanceCounts are the results of the iterations on one instance.
+type instanceCounts struct {
+	Type       string `json:"type,omitempty"`
+	Iterations int    `json:"iterations"`
+	Matched    int    `json:"matched,omitempty"`
+	Unmatched  int    `json:"unmatched,omitempty"`
+	Errors     int    `json:"errors,omitempty"`
+}
+
+func (c *instanceCounts) failures() int {
+	return c.Matched + c.Unmatched
+}
+
+// record counts an iteration with the given status.
+func (c *instanceCounts) record(status swarm.Status) {
+	switch status {
+	case swarm.ExecutionError:
+		c.Errors++
+		return
+	case swarm.FailMatched:
+		c.Matched++
+	case swarm.FailUnmatched:
+		c.Unmatched++
+	}
+	c.Iterations++
+}
+
+// maxInstancesListed is the most instances the summary lists by failure
+// count.
+const maxInstancesListed = 10
+
+// writePerInstance writes the failure counts of the instances that failed,
+// most failures first, and calls out an instance responsible for most of
+// them, which suggests the problem is specific to that host.
+func (st *sessionStatus) writePerInstance(w io.Writer) {
+	var names []string
+	total := 0
+	for name, c := range st.PerInstance {
+		if c.failures() > 0 {
+			names = append(names, name)
+			total += c.failures()
+		}
+	}
+	if len(names) == 0 || len(st.PerInstance) < 2 {
+		return
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := st.PerInstance[names[i]], st.PerInstance[names[j]]
+		if ci.failures() != cj.failures() {
+			return ci.failures() > cj.failures()
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(w, "  failures by instance (of %d instances):\n", len(st.PerInstance))
+	for i, name := range names {
+		if i == maxInstancesListed {
+			fmt.Fprintf(w, "    (and %d more)\n", len(names)-i)
+			break
+		}
+		c := st.PerInstance[name]
+		fmt.Fprintf(w, "    %-30s %d of %d iterations failed (matched %d, unmatched %d)\n",
+			name, c.failures(), c.Iterations, c.Matched, c.Unmatched)
+	}
+	if top := st.PerInstance[names[0]]; total >= 3 && 2*top.failures() > total {
+		fmt.Fprintf(w, "  %d of %d failures were on %s, so the problem may be specific to that host\n",
+			top.failures(), total, names[0])
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// typeCounts are the results of the iterations on all the instances of
+// one type.
+type typeCounts struct {
+	instanceCounts
+	Instances int
+}
+
+// perType totals the per-instance counts by instance type, in the order of
+// the session's types.
+func (st *sessionStatus) perType() []typeCounts {
+	counts := make([]typeCounts, len(st.Types))
+	index := make(map[string]int)
+	for i, typ := range st.Types {
+		counts[i].Type = typ
+		index[typ] = i
+	}
+	for _, c := range st.PerInstance {
+		i, ok := index[c.Type]
+		if !ok {
+			continue
+		}
+		tc := &counts[i]
+		tc.Instances++
+		tc.Iterations += c.Iterations
+		tc.Matched += c.Matched
+		tc.Unmatched += c.Unmatched
+		tc.Errors += c.Errors
+	}
+	return counts
+}
+
+// writePerType writes a table comparing the results on each instance type,
+// for sessions spread across several types, to show which platforms
+// actually exhibit the failure.
+func (st *sessionStatus) writePerType(w io.Writer) {
+	if len(st.Types) < 2 {
+		return
+	}
+	fmt.Fprintf(w, "  by instance type:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "    type\tinstances\titerations\tmatched\tunmatched\terrors\tmatch rate\n")
+	for _, c := range st.perType() {
+		rate := "-"
+		if c.Iterations > 0 {
+			rate = fmt.Sprintf("%.2f%%", 100*float64(c.Matched)/float64(c.Iterations))
+		}
+		fmt.Fprintf(tw, "    %s\t%d\t%d\t%d\t%d\t%d\t%s\n", c.Type, c.Instances, c.Iterations, c.Matched, c.Unmatched, c.Errors, rate)
+	}
+	tw.Flush()
+}
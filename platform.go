@@ -0,0 +1,82 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// knownGOOS are the GOOS values that may appear in instance types.
+var knownGOOS = []string{"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js", "linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows"}
+
+// typePlatform returns the GOOS and GOARCH of instances of type typ, like
+// windows and amd64 for windows-amd64-2016, or "" for those it can't tell.
+func typePlatform(typ string) (goos, goarch string) {
+	if backendName == "local" {
+		return runtime.GOOS, runtime.GOARCH
+	}
+	parts := strings.Split(typ, "-")
+	for i, p := range parts {
+		if !slices.Contains(knownGOOS, p) {
+			continue
+		}
+		if i+1 < len(parts) {
+			// Drop details of the machine, as in linux-arm64_c4ah72.
+			goarch, _, _ = strings.Cut(parts[i+1], "_")
+		}
+		return p, goarch
+	}
+	return "", ""
+}
+
+// windowsProgram returns prog, the program of a command written for Unix,
+// adapted to Windows: with backslashes for slashes, and with scripts like
+// race.bash replaced by their batch file counterparts, like race.bat. It
+// also reports whether the result is a batch file, which only cmd.exe can
+// run. Templates are left alone, since they're expanded later.
+func windowsProgram(prog string) (string, bool) {
+	if strings.Contains(prog, "{{") {
+		return prog, false
+	}
+	if p, ok := strings.CutSuffix(prog, ".bash"); ok {
+		prog = p + ".bat"
+	}
+	prog = strings.ReplaceAll(prog, "/", `\`)
+	lower := strings.ToLower(prog)
+	return prog, strings.HasSuffix(lower, ".bat") || strings.HasSuffix(lower, ".cmd")
+}
+
+// windowsCommand returns cmd, a command written for Unix, adapted to run on
+// Windows instances. Only the program is adapted: arguments like package
+// patterns use slashes on every platform.
+func windowsCommand(cmd []string) []string {
+	if len(cmd) == 0 {
+		return cmd
+	}
+	prog, batch := windowsProgram(cmd[0])
+	adapted := append([]string{prog}, cmd[1:]...)
+	if batch {
+		adapted = append([]string{`C:\Windows\System32\cmd.exe`, "/c"}, adapted...)
+	}
+	return adapted
+}
+
+// windowsScript returns script, a shell command written for Unix, with its
+// program adapted to run with cmd /c on Windows instances, as by
+// windowsCommand. Templates are keyed by their text, so a script with any
+// is left alone.
+func windowsScript(script string) string {
+	prog, rest, _ := strings.Cut(script, " ")
+	if prog == "" || strings.Contains(script, "{{") {
+		return script
+	}
+	prog, _ = windowsProgram(prog)
+	if rest == "" {
+		return prog
+	}
+	return prog + " " + rest
+}
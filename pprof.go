@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	rpprof "runtime/pprof"
+	"runtime/trace"
+)
+
+var (
+	pprofAddr  string
+	cpuProfile string
+	execTrace  string
+)
+
+func init() {
+	flag.StringVar(&pprofAddr, "pprof", "", "address, like localhost:6060, on which to serve goswarm's own profiles and goroutine stacks at /debug/pprof/, to diagnose stalls in large sessions")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile of goswarm itself, for the whole session, to this file")
+	flag.StringVar(&execTrace, "exectrace", "", "write an execution trace of goswarm itself, for the whole session, to this file, for go tool trace")
+}
+
+// servePprof serves goswarm's profiles on addr.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Profiling server failed: %v", err)
+		}
+	}()
+}
+
+// startProfiling starts -pprof, -cpuprofile, and -exectrace. The returned
+// function stops profiling and writes the profiles, and should be called
+// before exit.
+func startProfiling() (stop func(), err error) {
+	if pprofAddr != "" {
+		servePprof(pprofAddr)
+	}
+	var stops []func()
+	stop = func() {
+		for _, f := range stops {
+			f()
+		}
+	}
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err == nil {
+			if err = rpprof.StartCPUProfile(f); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-cpuprofile: %v", err)
+		}
+		stops = append(stops, func() {
+			rpprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if execTrace != "" {
+		f, err := os.Create(execTrace)
+		if err == nil {
+			if err = trace.Start(f); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("-exectrace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	return stop, nil
+}
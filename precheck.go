@@ -0,0 +1,43 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var precheck string
+
+func init() {
+	flag.StringVar(&precheck, "precheck", "", "shell command to run locally before creating any instances, like 'go build std' or 'go vet runtime', to fail fast on errors that would fail on every instance alike; it runs with GOROOT set to the tree being pushed, and its bin directory first in PATH")
+}
+
+// runPrecheck runs -precheck locally, returning an error with its output
+// if it fails.
+func runPrecheck(ctx context.Context, goroot string) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", precheck)
+	cmd.Env = os.Environ()
+	if goroot != "" {
+		cmd.Env = append(cmd.Env,
+			"GOROOT="+goroot,
+			"PATH="+filepath.Join(goroot, "bin")+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	}
+	log.Printf("Running %q locally...", precheck)
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, bytes.TrimRight(out, "\n"))
+	}
+	log.Printf("Ran %q locally in %s.", precheck, time.Since(start).Round(time.Millisecond))
+	return nil
+}
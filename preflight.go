@@ -0,0 +1,53 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var preflight bool
+
+func init() {
+	flag.BoolVar(&preflight, "preflight", false, "run the command once on a single instance, and only start the rest of the pool if it passes or fails with a matching failure")
+}
+
+// startPreflight starts the pool with a single instance, growing it to n
+// instances once the first iteration completes sanely. Otherwise, it stops
+// the session.
+func startPreflight(p *swarm.Pool, n int) {
+	log.Printf("Starting preflight run on a single instance.")
+	p.Resize(1)
+	p.Go(func() error {
+		var status swarm.Status
+		select {
+		case status = <-sess.first:
+		case <-p.Done():
+			return nil
+		case <-p.Stopped():
+			return nil
+		case <-p.Exhausted():
+			// It may have finished an iteration before giving up.
+			select {
+			case status = <-sess.first:
+			default:
+				return fmt.Errorf("preflight instance never ran")
+			}
+		}
+		switch status {
+		case swarm.Pass, swarm.FailMatched:
+			log.Printf("Preflight run finished (%s), starting the rest of the pool.", status)
+			growPool(p, n)
+			return nil
+		case swarm.FailUnmatched:
+			return fmt.Errorf("preflight run failed with an unmatched failure, is the command correct?")
+		}
+		return fmt.Errorf("preflight run failed to execute")
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+// Pushes are the slowest part of setting up an instance, so goswarm records
+// a stamp of the tree pushed to each instance in the registry, and skips
+// pushing the same tree to it again, like when it's adopted with -reuse.
+
+var stampCache struct {
+	sync.Mutex
+	gen   int64 // pushGen when stamp was computed
+	stamp string
+}
+
+// currentStamp returns the stamp of the tree being pushed, or "" if there's
+// no tree or it can't be read.
+func currentStamp() string {
+	stampCache.Lock()
+	defer stampCache.Unlock()
+	gen := pushGen.Load()
+	if stampCache.stamp != "" && stampCache.gen == gen {
+		return stampCache.stamp
+	}
+	goroot, _ := pushRoot()
+	if goroot == "" {
+		return ""
+	}
+	sum, err := treeStamp(goroot)
+	if err != nil {
+		log.Printf("Failed to stamp %s, pushing it unconditionally: %v", goroot, err)
+		return ""
+	}
+	stampCache.gen, stampCache.stamp = gen, goroot+"@"+hex.EncodeToString(sum[:])
+	return stampCache.stamp
+}
+
+// pushedStamp returns the stamp of the tree last pushed to inst, if known.
+func pushedStamp(inst string) string {
+	reg, err := loadRegistry()
+	if err != nil {
+		return ""
+	}
+	return reg[inst].Pushed
+}
+
+// recordPush records that the tree with the given stamp was pushed to inst.
+func recordPush(inst, stamp string) {
+	updateRegistry(func(reg map[string]registryEntry) {
+		if e, ok := reg[inst]; ok {
+			e.Pushed = stamp
+			reg[inst] = e
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	quarantineAfter   uint
+	quarantineReplace bool
+)
+
+func init() {
+	flag.UintVar(&quarantineAfter, "quarantine", 0, "stop using an instance after this many infrastructure errors, or this many unmatched failures that no other instance has seen (0 means never)")
+	flag.BoolVar(&quarantineReplace, "quarantine-replace", false, "replace quarantined instances with fresh ones, rather than shrinking the pool")
+}
+
+// quarantineError indicates that an instance misbehaved and should no
+// longer be used, for the given reason.
+type quarantineError struct {
+	inst   string
+	reason string
+}
+
+func (e *quarantineError) Error() string {
+	return fmt.Sprintf("quarantining %s: %s", e.inst, e.reason)
+}
+
+// quarantineRecord is an instance that was quarantined.
+type quarantineRecord struct {
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+}
+
+// recordQuarantine records that inst was quarantined.
+func (s *session) recordQuarantine(inst, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quarantined = append(s.quarantined, quarantineRecord{Instance: inst, Time: time.Now(), Reason: reason})
+}
+
+// exclusiveUnmatched returns the number of unmatched failures on inst
+// whose signatures no other instance has produced. Until the other
+// instances have together run at least as many iterations as inst, they
+// may just not have hit its failures yet, so it's 0.
+func (s *session) exclusiveUnmatched(inst string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	others := 0
+	for name, c := range s.perInstance {
+		if name != inst {
+			others += c.Iterations
+		}
+	}
+	if c := s.perInstance[inst]; c == nil || others < c.Iterations {
+		return 0
+	}
+	n := 0
+	for _, u := range s.unmatched {
+		if len(u.insts) == 1 && u.insts[inst] {
+			n += u.Count
+		}
+	}
+	return n
+}
+
+// checkQuarantine returns a quarantineError if inst, having seen infraErrs
+// infrastructure errors in total, should be quarantined.
+func checkQuarantine(inst string, infraErrs int) error {
+	if quarantineAfter == 0 {
+		return nil
+	}
+	if infraErrs >= int(quarantineAfter) {
+		return &quarantineError{inst, fmt.Sprintf("%d infrastructure errors", infraErrs)}
+	}
+	if n := sess.exclusiveUnmatched(inst); n >= int(quarantineAfter) {
+		return &quarantineError{inst, fmt.Sprintf("%d unmatched failures not seen on other instances", n)}
+	}
+	return nil
+}
+
+// writeQuarantined writes the instances that were quarantined, if any.
+func (st *sessionStatus) writeQuarantined(w io.Writer) {
+	if len(st.Quarantined) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  quarantined instances:\n")
+	for _, q := range st.Quarantined {
+		fmt.Fprintf(w, "    %s: %s\n", q.Instance, q.Reason)
+	}
+}
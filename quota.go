@@ -0,0 +1,94 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var quota uint
+
+func init() {
+	flag.UintVar(&quota, "quota", 0, "the most gomote instances you may have at once, to cap the pool at what's left of it up front (0 means to find out when creating an instance fails because of it)")
+}
+
+// capToQuota caps the size of the pool at what's left of -quota, given the
+// instances the user already has, and warns if it does.
+func capToQuota(ctx context.Context) error {
+	if quota == 0 || backendName != "gomote" {
+		return nil
+	}
+	room, err := quotaRoom(ctx)
+	if err != nil {
+		return err
+	}
+	if int(instances) <= room {
+		return nil
+	}
+	slog.Warn(fmt.Sprintf("Only %d of the %d instances of -quota are left, capping the pool at %d instances.", room, quota, room))
+	sess.capPool(room)
+	instances = uint(room)
+	return nil
+}
+
+// quotaRoom returns how many more instances the session may have, given
+// -quota and the instances the user already has.
+func quotaRoom(ctx context.Context) (int, error) {
+	insts, err := backend.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing instances: %v", err)
+	}
+	room := int(quota) - len(insts)
+	if sess != nil {
+		// Instances the session adopts already count against the quota.
+		sess.mu.Lock()
+		room += len(sess.adopt)
+		sess.mu.Unlock()
+	}
+	if room <= 0 {
+		return 0, &exitError{exitInfra, fmt.Errorf("all %d instances of -quota are in use", quota)}
+	}
+	return room, nil
+}
+
+// hitQuota records that creating an instance failed because the user
+// already has as many instances as they may. Since none will be created
+// until one is destroyed, the pool is capped at the instances it has.
+func (s *session) hitQuota(err error) {
+	s.mu.Lock()
+	n := 0
+	for _, is := range s.instances {
+		if is.Name != "" && is.State != "stopped" {
+			n++
+		}
+	}
+	first := s.quotaCap == 0
+	if first {
+		s.quotaCap = n
+	}
+	s.mu.Unlock()
+	if first {
+		slog.Warn(fmt.Sprintf("Reached the gomote instance quota, capping the pool at the %d instances it has: %s", n, strings.TrimSpace(unwrap(err).Error())))
+	}
+}
+
+// capPool records that the pool was capped at n instances.
+func (s *session) capPool(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotaCap = n
+}
+
+// writeQuotaCap writes the size the pool was capped at, if it was.
+func (st *sessionStatus) writeQuotaCap(w io.Writer) {
+	if st.QuotaCap > 0 {
+		fmt.Fprintf(w, "  pool capped at %d instances by the gomote instance quota\n", st.QuotaCap)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var rampStart uint
+
+func init() {
+	flag.UintVar(&rampStart, "ramp", 0, "start with this many instances, doubling the pool up to -i as iterations succeed (0 starts the whole pool at once)")
+}
+
+// growPool grows the pool to n instances, ramping up if requested.
+func growPool(p *swarm.Pool, n int) {
+	if rampStart == 0 || int(rampStart) >= n {
+		p.Resize(n)
+		return
+	}
+	size := int(rampStart)
+	if cur := p.Size(); cur > size {
+		size = cur
+	}
+	log.Printf("Ramping up, starting with %d instances.", size)
+	p.Resize(size)
+	p.Go(func() error {
+		for size < n {
+			select {
+			case <-sess.progress:
+			case <-p.Done():
+				return nil
+			case <-p.Stopped():
+				return nil
+			case <-p.Exhausted():
+				// Every instance gave up, so there's nothing to ramp up.
+				return nil
+			}
+			if sess.succeeded() < size {
+				continue
+			}
+			if cur := p.Size(); cur > size {
+				// The pool was resized by hand, so respect that.
+				size = cur
+			}
+			size *= 2
+			if size > n {
+				size = n
+			}
+			log.Printf("Ramping up pool to %d instances.", size)
+			p.Resize(size)
+		}
+		return nil
+	})
+}
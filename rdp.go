@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var rdpAddr string
+
+func init() {
+	flag.StringVar(&rdpAddr, "rdp", "", "on the first matching failure on a Windows instance, forward remote desktop connections from this local address, like localhost:7777, to the instance, and keep it, and the session, around until interrupted, to debug the failure in its desktop")
+}
+
+// rdp is the remote desktop forwarding of the first Windows instance with a
+// matching failure, with -rdp.
+var rdp struct {
+	sync.Mutex
+	inst   string
+	done   chan struct{} // closed when forwarding stops
+	cancel context.CancelFunc
+}
+
+// startRDP starts forwarding remote desktop connections to inst, of type
+// typ, which just had a matching failure, if -rdp is set, inst runs
+// Windows, and no other instance's are forwarded yet.
+func startRDP(inst, typ string) {
+	if rdpAddr == "" || !isWindowsType(typ) {
+		return
+	}
+	rd, ok := backend.(swarm.RemoteDesktop)
+	if !ok {
+		instWarnf(inst, "Not forwarding remote desktop connections to %s: not supported by the %s backend.", inst, backendName)
+		return
+	}
+	rdp.Lock()
+	defer rdp.Unlock()
+	if rdp.inst != "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rdp.inst, rdp.done, rdp.cancel = inst, make(chan struct{}), cancel
+	go func() {
+		defer close(rdp.done)
+		if err := rd.RDP(ctx, inst, rdpAddr); err != nil {
+			instWarnf(inst, "Remote desktop forwarding to %s stopped: %v", inst, err)
+		}
+	}()
+	instLogf(inst, "Forwarding remote desktop connections from %s to %s; connect a remote desktop client to %s to debug the failure.", rdpAddr, inst, rdpAddr)
+}
+
+// rdpInstance reports whether remote desktop connections are forwarded to
+// inst, which must then be kept.
+func rdpInstance(inst string) bool {
+	rdp.Lock()
+	defer rdp.Unlock()
+	return inst != "" && inst == rdp.inst
+}
+
+// waitRDP keeps forwarding remote desktop connections, if any, once the
+// session is otherwise done, until it's interrupted or ctx is done. If the
+// session was already interrupted, it stops forwarding right away.
+func waitRDP(ctx context.Context) {
+	rdp.Lock()
+	inst, done, cancel := rdp.inst, rdp.done, rdp.cancel
+	rdp.Unlock()
+	if inst == "" {
+		return
+	}
+	defer func() { <-done }()
+	defer cancel()
+	if interrupted() {
+		return
+	}
+	hold, stop := context.WithCancel(ctx)
+	defer stop()
+	holdOnInterrupt(stop)
+	log.Printf("Still forwarding remote desktop connections from %s to %s. Interrupt to stop.", rdpAddr, inst)
+	select {
+	case <-hold.Done():
+	case <-done:
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var recycleAfter uint
+
+func init() {
+	flag.UintVar(&recycleAfter, "recycle", 0, "destroy and recreate each instance after this many iterations, to shed accumulated remote state (0 means never)")
+}
+
+// recycleError indicates that an instance should be replaced with a fresh
+// one, for the given reason.
+type recycleError struct {
+	inst   string
+	reason string
+}
+
+func (e *recycleError) Error() string {
+	return fmt.Sprintf("recycling %s: %s", e.inst, e.reason)
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// The registry is a local record of the instances goswarm has created, and
+// by which session, so that cleanup can be limited to instances goswarm owns.
+// It's shared by all goswarm processes, and guarded by a lock file.
+
+// registryEntry describes an instance created by goswarm.
+type registryEntry struct {
+	Type    string     `json:"type"`
+	Created time.Time  `json:"created"`
+	Owner   int        `json:"owner"`             // PID of the session that created it
+	Host    string     `json:"host"`              // host on which Owner runs
+	Pushed  string     `json:"pushed,omitempty"`  // stamp of the tree last pushed to it
+	Session string     `json:"session,omitempty"` // -name of Owner
+	Parked  *time.Time `json:"parked,omitempty"`  // until when it's parked, with -keep-alive
+}
+
+var registryMu sync.Mutex
+
+func registryPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name := "instances.json"
+	if backendName != "gomote" {
+		// Keep instance names from different backends apart.
+		name = "instances-" + backendName + ".json"
+	}
+	return filepath.Join(dir, "goswarm", name), nil
+}
+
+// loadRegistry returns the registry, keyed by instance name.
+func loadRegistry() (map[string]registryEntry, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return readRegistry()
+}
+
+func readRegistry() (map[string]registryEntry, error) {
+	path, err := registryPath()
+	if err != nil {
+		return nil, err
+	}
+	reg := make(map[string]registryEntry)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return reg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &reg); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+func writeRegistry(reg map[string]registryEntry) error {
+	path, err := registryPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(reg, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// updateRegistry applies f to the registry and writes it back. Errors are
+// logged rather than returned, since the registry is best-effort.
+func updateRegistry(f func(reg map[string]registryEntry)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	path, err := registryPath()
+	if err != nil {
+		log.Printf("Failed to update instance registry: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Failed to update instance registry: %v", err)
+		return
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		log.Printf("Failed to lock instance registry: %v", err)
+		return
+	}
+	defer unlock()
+	reg, err := readRegistry()
+	if err != nil {
+		log.Printf("Failed to read instance registry: %v", err)
+		return
+	}
+	f(reg)
+	if err := writeRegistry(reg); err != nil {
+		log.Printf("Failed to update instance registry: %v", err)
+	}
+}
+
+func registerInstance(name, typ string) {
+	updateRegistry(func(reg map[string]registryEntry) {
+		host, _ := os.Hostname()
+		reg[name] = registryEntry{Type: typ, Created: time.Now(), Owner: os.Getpid(), Host: host, Session: sessionName}
+	})
+}
+
+// claimInstance marks an instance goswarm created as owned by this session.
+func claimInstance(name string) {
+	updateRegistry(func(reg map[string]registryEntry) {
+		if e, ok := reg[name]; ok {
+			e.Owner = os.Getpid()
+			e.Host, _ = os.Hostname()
+			e.Session = sessionName
+			e.Parked = nil
+			reg[name] = e
+		}
+	})
+}
+
+func unregisterInstance(name string) {
+	updateRegistry(func(reg map[string]registryEntry) {
+		delete(reg, name)
+	})
+}
+
+// pruneRegistry removes instances that no longer exist from the registry,
+// given the complete list of live instances.
+func pruneRegistry(live []gomote.Instance) {
+	alive := make(map[string]bool)
+	for _, inst := range live {
+		alive[inst.Name] = true
+	}
+	updateRegistry(func(reg map[string]registryEntry) {
+		for name := range reg {
+			if !alive[name] {
+				delete(reg, name)
+			}
+		}
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// reportSnippetLines is the number of lines of output included in a report,
+// if there's no match context.
+const reportSnippetLines = 50
+
+// writeReport writes a Markdown report of the matching failure f, with the
+// given output, ready to paste into an issue or a code review comment. It
+// returns the report's path.
+func writeReport(f failureRecord, output []byte) (string, error) {
+	path := uniquePath(filepath.Join(artifactsDir, fmt.Sprintf("report-%s-%s.md", f.Time.Format("20060102T150405"), f.Instance)))
+	if err := os.WriteFile(path, reportText(f, output), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// reportText returns the Markdown report of the matching failure f, with the
+// given output.
+func reportText(f failureRecord, output []byte) []byte {
+	st := sess.status()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "### goswarm: failure on %s\n\n", st.Type)
+	fmt.Fprintf(&b, "Command:\n\n```\n%s\n```\n\n", redactString(strings.Join(st.Command, " ")))
+	if len(env) > 0 {
+		fmt.Fprintf(&b, "Environment:\n\n```\n%s\n```\n\n", strings.Join(redactEnv(env), "\n"))
+	}
+	if errMatch != "" {
+		fmt.Fprintf(&b, "Match: `%s`\n\n", errMatch)
+	}
+	if matchExit != "" {
+		fmt.Fprintf(&b, "Matching exit codes: %s\n\n", matchExit)
+	}
+	// This failure's iteration isn't recorded yet.
+	n, matched := st.iterations()+1, st.Results[swarm.FailMatched.String()]+1
+	fmt.Fprintf(&b, "Failed on instance `%s` at %s (%s into the session), after %d iterations ", f.Instance, f.Time.Format("2006-01-02 15:04:05 MST"), f.Elapsed.Round(time.Second), n)
+	fmt.Fprintf(&b, "(observed failure rate: %d/%d, about 1 in %.0f).\n\n", matched, n, float64(n)/float64(matched))
+	fmt.Fprintf(&b, "Seed: `%d` (`GOSWARM_SEED`, `{{.Seed}}`)\n\n", f.Seed)
+	if f.ExitStatus != "" {
+		fmt.Fprintf(&b, "Exit: `%s`\n\n", f.ExitStatus)
+	}
+	if len(f.Tests) > 0 {
+		fmt.Fprintf(&b, "Failed tests: `%s`\n\n", strings.Join(f.Tests, "`, `"))
+	}
+	if f.Reruns > 0 {
+		fmt.Fprintf(&b, "Rerun alone on the same instance, `%s` failed %d of %d times.\n\n", f.Rerun, f.RerunFailures, f.Reruns)
+	}
+	if f.Known != "" {
+		fmt.Fprintf(&b, "This failure matches known issue %s.\n\n", f.Known)
+	}
+	if f.Slow {
+		fmt.Fprintf(&b, "The command was stopped for running longer than %s.\n\n", failSlower)
+	}
+	snippet := f.Context
+	if snippet == "" {
+		snippet = tailLines(output, reportSnippetLines)
+	}
+	fmt.Fprintf(&b, "<details><summary>Failure output</summary>\n\n```\n%s\n```\n</details>\n\n", snippet)
+	if stack := annotateStack(output); stack != "" {
+		fmt.Fprintf(&b, "<details><summary>Stack, in the local GOROOT</summary>\n\n```\n%s```\n</details>\n\n", stack)
+	}
+	if len(f.FSChanges) > 0 {
+		fmt.Fprintf(&b, "<details><summary>New and modified files on the instance (%d)</summary>\n\n```\n", f.FSChanged)
+		for _, c := range f.FSChanges {
+			fmt.Fprintf(&b, "%s\n", c)
+		}
+		if f.FSChanged > len(f.FSChanges) {
+			fmt.Fprintf(&b, "... and %d smaller ones\n", f.FSChanged-len(f.FSChanges))
+		}
+		fmt.Fprintf(&b, "```\n</details>\n\n")
+	}
+	if crossRef {
+		if len(f.Dashboard) == 0 {
+			fmt.Fprintf(&b, "No similar failures found on the build dashboard.\n\n")
+		} else {
+			fmt.Fprintf(&b, "Similar failures on the build dashboard:\n\n")
+			for _, l := range f.Dashboard {
+				fmt.Fprintf(&b, "- %s\n", l)
+			}
+			fmt.Fprintf(&b, "\n")
+		}
+	}
+	fmt.Fprintf(&b, "Artifacts:\n\n")
+	for _, a := range f.artifacts() {
+		fmt.Fprintf(&b, "- %s\n", reportLink(a))
+	}
+	return b.Bytes()
+}
+
+// reportLink returns a Markdown link to the artifact at path, served by
+// -serve if it's enabled, or just the path otherwise.
+func reportLink(path string) string {
+	if serveAddr == "" {
+		return "`" + path + "`"
+	}
+	host, port, err := net.SplitHostPort(serveAddr)
+	if err != nil {
+		return "`" + path + "`"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if h, err := os.Hostname(); err == nil {
+			host = h
+		}
+	}
+	return fmt.Sprintf("[%s](http://%s%s)", filepath.Base(path), net.JoinHostPort(host, port), artifactLink(path))
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	reproRuns    uint
+	measureRepro uint
+)
+
+func init() {
+	flag.UintVar(&reproRuns, "repro-runs", 10, "with the repro subcommand, the number of times to rerun the failure")
+	flag.UintVar(&measureRepro, "measure-repro", 0, "once a matching failure is found, rerun it this many times across the pool, with its seed, command, and instance type, and report how often it reproduces")
+}
+
+// failureMetadata is the metadata of a matching failure, written to its
+// bundle or next to its output, with everything needed to rerun it.
+type failureMetadata struct {
+	failureRecord
+	Backend   string   `json:"backend,omitempty"`
+	Type      string   `json:"type"`
+	Command   []string `json:"command"`
+	Env       []string `json:"env,omitempty"`
+	Match     string   `json:"match,omitempty"`
+	MatchExit string   `json:"match_exit,omitempty"`
+	Sh        string   `json:"sh,omitempty"`
+	Script    string   `json:"script,omitempty"`
+	Stdin     string   `json:"stdin,omitempty"`
+	Steps     []string `json:"steps,omitempty"`
+	Dir       string   `json:"dir,omitempty"`
+	RunArgs   []string `json:"run_args,omitempty"`
+	Make      bool     `json:"make,omitempty"`
+	GOROOT    string   `json:"goroot,omitempty"`
+}
+
+func newFailureMetadata(f failureRecord) failureMetadata {
+	meta := failureMetadata{
+		failureRecord: f,
+		Backend:       backendName,
+		Type:          f.InstanceType,
+		Command:       redactArgs(sess.cmd),
+		Env:           redactEnv(env),
+		Match:         errMatch,
+		MatchExit:     matchExit,
+		Sh:            shScript,
+		Script:        scriptFile,
+		Stdin:         stdinFile,
+		Steps:         steps,
+		Dir:           runDir,
+		RunArgs:       runArgs,
+		Make:          makeGo,
+	}
+	meta.GOROOT, _ = pushRoot()
+	if f.Command != "" {
+		// Just the command of -commands that failed.
+		meta.Command, meta.Sh = redactArgs([]string{f.Command}), redactString(f.Command)
+	}
+	return meta
+}
+
+// writeFailureMetadata writes the metadata of f next to its output, and
+// returns its path.
+func writeFailureMetadata(f failureRecord) (string, error) {
+	b, err := json.MarshalIndent(newFailureMetadata(f), "", "\t")
+	if err != nil {
+		return "", err
+	}
+	path := strings.TrimSuffix(f.Output, ".out") + ".json"
+	return path, os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// loadFailureMetadata reads the metadata of a failure from path, which is
+// either the metadata itself or a failure bundle.
+func loadFailureMetadata(path string) (*failureMetadata, error) {
+	var r io.Reader
+	if filepath.Ext(path) == ".zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		f, err := zr.Open("failure.json")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		defer f.Close()
+		r = f
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	meta := new(failureMetadata)
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	if meta.Type == "" || len(meta.Command) == 0 {
+		return nil, fmt.Errorf("%s: missing instance type or command", path)
+	}
+	return meta, nil
+}
+
+// repro tracks the runs of the repro subcommand.
+var repro struct {
+	mu      sync.Mutex
+	active  bool
+	measure bool // rerunning a failure found this session, for -measure-repro
+	seed    int64
+	typ     string // instance type of the runs, or "" for any
+	command int    // index in commandList of the command of the runs, or -1 for any
+	started int    // runs started, and not abandoned
+	done    int    // runs completed
+	matched int    // runs that reproduced the failure
+}
+
+// reproducing reports whether the session is rerunning a failure.
+func reproducing() bool {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	return repro.active
+}
+
+// measuring reports whether the session is rerunning a failure it found, for
+// -measure-repro.
+func measuring() bool {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	return repro.measure
+}
+
+// startMeasuring dedicates the pool to rerunning the matching failure with
+// the given seed, on an instance of type typ running the command of
+// -commands with index cmdIndex, -measure-repro times. It does nothing
+// without -measure-repro or if the pool is already rerunning a failure.
+func startMeasuring(seed int64, typ string, cmdIndex int) {
+	if measureRepro == 0 {
+		return
+	}
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	if repro.active {
+		return
+	}
+	repro.active, repro.measure = true, true
+	repro.seed, repro.typ, repro.command = seed, typ, cmdIndex
+	reproRuns = measureRepro
+	log.Printf("Rerunning the failure with seed %d on %s %d times, to measure how often it reproduces.", seed, typ, measureRepro)
+}
+
+// reproType returns the instance type that an instance of type typ must be
+// replaced with to run the failure, or "" if it needn't be, or every run is
+// claimed anyway.
+func reproType(typ string) string {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	if repro.typ == "" || repro.typ == typ || repro.started >= int(reproRuns) {
+		return ""
+	}
+	return repro.typ
+}
+
+// reproCommand is iterationCommand for a run of the failure, which always
+// runs the command of -commands that failed.
+func reproCommand(typ string, cmd []string) (int, []string) {
+	repro.mu.Lock()
+	i := repro.command
+	repro.mu.Unlock()
+	if i < 0 {
+		return iterationCommand(typ, cmd)
+	}
+	return i, remoteCommand(typ, shellCommand(typ, commandList[i]))
+}
+
+// reproduced reports whether any run reproduced the failure.
+func reproduced() bool {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	return repro.matched > 0
+}
+
+// startRepro claims a run, reporting false if every run is claimed.
+func startRepro() bool {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	if repro.started >= int(reproRuns) {
+		return false
+	}
+	repro.started++
+	return true
+}
+
+// finishRepro records the result of a run. A run that couldn't execute the
+// command is given back, to be retried.
+func finishRepro(matched, ran bool) {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	if !ran {
+		repro.started--
+		return
+	}
+	repro.done++
+	if matched {
+		repro.matched++
+	}
+}
+
+// writeReproSummary writes how often the failure reproduced.
+func writeReproSummary(w io.Writer) {
+	repro.mu.Lock()
+	defer repro.mu.Unlock()
+	if repro.done == 0 {
+		fmt.Fprintf(w, "No runs completed.\n")
+		return
+	}
+	fmt.Fprintf(w, "Reproduced %d of %d runs (%.1f%%) with seed %d.\n", repro.matched, repro.done, 100*float64(repro.matched)/float64(repro.done), repro.seed)
+}
+
+// reproCmd implements the repro subcommand.
+func reproCmd(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected a failure's metadata or bundle")
+	}
+	if _, err := applyConfig(flag.CommandLine, userConfig); err != nil {
+		return usageErrorf("%s: %v", configFile, err)
+	}
+	if reproRuns == 0 {
+		return usageErrorf("-repro-runs must be positive")
+	}
+	meta, err := loadFailureMetadata(args[0])
+	if err != nil {
+		return err
+	}
+	if meta.Backend != "" {
+		backendName = meta.Backend
+	}
+	// Flags on the command line take precedence, to try variations.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["e"] {
+		// Secrets are left to -e-passthrough and -env-file.
+		env = unredactedEnv(meta.Env)
+	}
+	if !set["match"] {
+		errMatch = meta.Match
+	}
+	if !set["match-exit"] {
+		matchExit = meta.MatchExit
+	}
+	shScript, scriptFile, stdinFile, steps, runDir = meta.Sh, meta.Script, meta.Stdin, meta.Steps, meta.Dir
+	makeGo = makeGo || meta.Make
+	if !set["goroot"] {
+		gorootDir = meta.GOROOT
+	}
+	if !set["run-arg"] {
+		runArgs = meta.RunArgs
+	}
+	if meta.Shuffle != 0 && !set["shuffle"] {
+		// The same test order, whatever the seed picks.
+		shuffleOrders, shuffleSeeds.seeds = 1, []int64{meta.Shuffle}
+	}
+	if meta.GODEBUG != "" && !set["godebug-fuzz"] {
+		godebugFixed = meta.GODEBUG
+	}
+	instances = min(instances, reproRuns)
+	repro.active, repro.seed, repro.command = true, meta.Seed, -1
+	return runSession(append([]string{meta.Type}, meta.Command...), nil)
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// maxEmbeddedUpload is the size of the largest upload, like the -script or
+// -stdin file, that a repro script embeds. Larger ones are referred to by
+// their local path instead.
+const maxEmbeddedUpload = 1 << 20
+
+// reproScript returns a standalone shell script that reproduces the matching
+// failure f on a fresh gomote instance, with nothing but gomote: it creates
+// an instance of the same type, sets it up the way the session did, and runs
+// cmd, the exact command of the iteration, with runEnv, its exact
+// environment, seed included. data is the iteration's template data. It
+// returns nil for backends other than gomote.
+func reproScript(f failureRecord, data templateData, runEnv, cmd []string) []byte {
+	if backendName != "gomote" {
+		return nil
+	}
+	typ := f.InstanceType
+	// gomote returns the gomote invocation of words, which are shell
+	// words already, with the instance in $inst.
+	gomote := func(words ...string) string {
+		return redactString(strings.Join(append(gomoteWords(), words...), " "))
+	}
+	run := func(env, cmd []string) string {
+		words := []string{"run"}
+		for _, kv := range redactEnv(env) {
+			words = append(words, "-e", swarm.ShellQuote(kv))
+		}
+		if runDir != "" {
+			words = append(words, "-dir", swarm.ShellQuote(runDir))
+		}
+		words = append(append(words, shellWords(runArgs)...), `"$inst"`)
+		return gomote(append(words, shellWords(redactArgs(cmd))...)...)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Reproduces the failure goswarm found on %s (%s) at %s, with seed %d,\n", f.Instance, typ, f.Time.Format(time.RFC3339), f.Seed)
+	fmt.Fprintf(&b, "# on a fresh gomote instance. It needs only gomote:\n")
+	fmt.Fprintf(&b, "#\tgo install golang.org/x/build/cmd/gomote@latest\n")
+	if f.ExitStatus != "" {
+		fmt.Fprintf(&b, "# The command failed with %s", f.ExitStatus)
+		if len(f.Tests) > 0 {
+			fmt.Fprintf(&b, " in %s", strings.Join(f.Tests, " "))
+		}
+		fmt.Fprintf(&b, ".\n")
+	}
+	if errMatch != "" {
+		fmt.Fprintf(&b, "# Its output matched %q.\n", errMatch)
+	}
+	fmt.Fprintf(&b, "set -e\n\n")
+
+	if typePush(typ) {
+		goroot, _ := pushRoot()
+		var commit string
+		if goroot != "" {
+			commit, _ = gorootCommit(goroot)
+		}
+		fmt.Fprintf(&b, "# The Go tree in $GOROOT is pushed to the instance.\n")
+		if goroot != "" {
+			fmt.Fprintf(&b, ": \"${GOROOT:=%s}\"\n", redactString(goroot))
+		} else {
+			fmt.Fprintf(&b, ": \"${GOROOT:?set GOROOT to the Go tree to push}\"\n")
+		}
+		fmt.Fprintf(&b, "export GOROOT\n")
+		if commit != "" {
+			fmt.Fprintf(&b, "if [ \"$(git -C \"$GOROOT\" rev-parse HEAD 2>/dev/null)\" != %s ]; then\n", commit)
+			fmt.Fprintf(&b, "\techo \"warning: $GOROOT is not at %s, the commit the failure occurred at\" >&2\n", commit)
+			fmt.Fprintf(&b, "fi\n")
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	fmt.Fprintf(&b, "inst=$(%s)\n", gomote(append([]string{"create"}, shellWords(append(typeCreateArgs()[typ], typ))...)...))
+	fmt.Fprintf(&b, "echo \"Created $inst; destroy it with: gomote destroy $inst\" >&2\n")
+	if typePush(typ) {
+		fmt.Fprintf(&b, "%s\n", gomote("push", `"$inst"`))
+	}
+	if typeBootstrap(typ) {
+		fmt.Fprintf(&b, "%s\n", gomote("putbootstrap", `"$inst"`))
+	}
+	for _, up := range uploads() {
+		writeReproUpload(&b, up, gomote)
+	}
+	for _, s := range typeSetup(typ) {
+		fmt.Fprintf(&b, "%s\n", run(nil, inRunDir(shellCommand(typ, s))))
+	}
+	if makeGo {
+		makeEnv, _ := expandTemplates(env, templateData{Instance: data.Instance, Type: typ, Shard: data.Shard, Shards: data.Shards, Command: -1})
+		fmt.Fprintf(&b, "%s\n", run(append(typeEnv(typ), makeEnv...), inRunDir(makeCommand(typ))))
+	}
+	expanded, _ := expandTemplates(steps, data)
+	for _, s := range expanded {
+		fmt.Fprintf(&b, "%s\n", run(runEnv, inRunDir(shellCommand(typ, s))))
+	}
+	fmt.Fprintf(&b, "\n# The iteration that failed.\n")
+	fmt.Fprintf(&b, "%s\n", run(runEnv, cmd))
+	return b.Bytes()
+}
+
+// shellWords returns args quoted as shell words.
+func shellWords(args []string) []string {
+	words := make([]string, len(args))
+	for i, a := range args {
+		words[i] = swarm.ShellQuote(a)
+	}
+	return words
+}
+
+// writeReproUpload writes the commands of a repro script uploading up to
+// the instance, with the contents of the file embedded if it isn't too
+// large, so that the script stands alone.
+func writeReproUpload(b *bytes.Buffer, up upload, gomote func(...string) string) {
+	mode := fmt.Sprintf("-mode=%o", up.mode.Perm())
+	data, err := os.ReadFile(up.src)
+	if err != nil || len(data) > maxEmbeddedUpload {
+		src, _ := filepath.Abs(up.src)
+		fmt.Fprintf(b, "# %s is on the machine the failure occurred on.\n", src)
+		fmt.Fprintf(b, "%s\n", gomote("put", mode, `"$inst"`, swarm.ShellQuote(src), swarm.ShellQuote(up.dst)))
+		return
+	}
+	tmp := `"$tmp"/` + swarm.ShellQuote(filepath.Base(up.dst))
+	fmt.Fprintf(b, "tmp=$(mktemp -d)\n")
+	fmt.Fprintf(b, "base64 --decode >%s <<'EOF'\n", tmp)
+	enc := base64.StdEncoding.EncodeToString(redact(data))
+	for len(enc) > 76 {
+		fmt.Fprintf(b, "%s\n", enc[:76])
+		enc = enc[76:]
+	}
+	fmt.Fprintf(b, "%s\nEOF\n", enc)
+	fmt.Fprintf(b, "%s\n", gomote("put", mode, `"$inst"`, tmp, swarm.ShellQuote(up.dst)))
+	fmt.Fprintf(b, "rm -r \"$tmp\"\n")
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var rerunCount uint
+
+func init() {
+	flag.UintVar(&rerunCount, "rerun", 0, "after each matching failure of go test, rerun just the test that failed this many times on the same instance, recording how many of the reruns it fails too; the reruns come after the failure's archive is downloaded, so as not to disturb it, and before the failure is reported")
+}
+
+// rerunFlags are the go test flags that select what it runs, and how many
+// times, which rerunCommand replaces.
+var rerunFlags = []string{"run", "bench", "count"}
+
+// rerunFlag reports whether arg is one of rerunFlags, and if so, whether
+// its value is in the next argument.
+func rerunFlag(arg string) (ok, split bool) {
+	if !strings.HasPrefix(arg, "-") {
+		return false, false
+	}
+	name := strings.TrimPrefix(strings.TrimLeft(arg, "-"), "test.")
+	name, _, hasValue := strings.Cut(name, "=")
+	return slices.Contains(rerunFlags, name), !hasValue
+}
+
+// testPattern returns a -run or -bench pattern matching just test, as
+// named in go test's output, and none of its siblings.
+func testPattern(test string) string {
+	parts := strings.Split(test, "/")
+	for i, p := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(p) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+// rerunCommand returns cmd, a go test command, changed to run just test
+// once. It returns nil if cmd doesn't run go test.
+func rerunCommand(cmd []string, test string) []string {
+	i := slices.IndexFunc(cmd, func(arg string) bool {
+		base := path.Base(strings.ReplaceAll(arg, `\`, "/"))
+		return base == "go" || base == "go.exe"
+	})
+	if i < 0 || i+1 == len(cmd) || cmd[i+1] != "test" {
+		return nil
+	}
+	rerun := append([]string(nil), cmd[:i+2]...)
+	if strings.HasPrefix(test, "Benchmark") {
+		rerun = append(rerun, "-run=^$", "-bench="+testPattern(test))
+	} else {
+		rerun = append(rerun, "-run="+testPattern(test))
+	}
+	rerun = append(rerun, "-count=1")
+	for j := i + 2; j < len(cmd); j++ {
+		if ok, split := rerunFlag(cmd[j]); ok {
+			if split {
+				j++
+			}
+			continue
+		}
+		rerun = append(rerun, cmd[j])
+	}
+	return rerun
+}
+
+// rerunTest reruns test, which failed when inst ran cmd in env, alone
+// -rerun times on inst. It returns how many reruns completed, and how many
+// of them test failed.
+func rerunTest(ctx context.Context, inst string, env, cmd []string, test string) (runs, failed int) {
+	rerun := rerunCommand(cmd, test)
+	if rerun == nil {
+		instLogf(inst, "Not rerunning %s on %s, since the command doesn't run go test.", test, inst)
+		return 0, 0
+	}
+	instLogf(inst, "Rerunning %s alone %d times on %s.", test, rerunCount, inst)
+	for i := uint(0); i < rerunCount && ctx.Err() == nil; i++ {
+		out, err := backend.Run(ctx, inst, env, rerun...)
+		if ctx.Err() != nil {
+			break
+		}
+		status, err := swarm.Classify(inst, out, err)
+		if status == swarm.ExecutionError {
+			// The instance is likely in no shape for more.
+			instWarnf(inst, "Failed to rerun %s on %s: %v", test, inst, err)
+			break
+		}
+		runs++
+		if status == swarm.FailUnmatched && slices.Contains(failedTests(out), test) {
+			failed++
+		}
+	}
+	instLogf(inst, "%s failed %d of %d reruns on %s.", test, failed, runs, inst)
+	return runs, failed
+}
@@ -0,0 +1,17 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import (
+	"context"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// watchResizeSignals does nothing on platforms without SIGUSR1 and SIGUSR2.
+// Use `goswarm resize` instead.
+func watchResizeSignals(ctx context.Context, p *swarm.Pool) {}
@@ -0,0 +1,49 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// watchResizeSignals grows the pool by one instance on SIGUSR1 and
+// shrinks it by one on SIGUSR2, until ctx is done.
+func watchResizeSignals(ctx context.Context, p *swarm.Pool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-c:
+				if sig == syscall.SIGUSR1 {
+					resizePoolBy(p, 1)
+				} else {
+					resizePoolBy(p, -1)
+				}
+			}
+		}
+	}()
+}
+
+// resizePoolBy changes the size of p by delta, never shrinking it below 1.
+func resizePoolBy(p *swarm.Pool, delta int) {
+	n := p.Size() + delta
+	if n < 1 {
+		n = 1
+	}
+	log.Printf("Resizing pool to %d instances.", n)
+	p.Resize(n)
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	retainAge  time.Duration
+	retainSize uint
+)
+
+func init() {
+	flag.DurationVar(&retainAge, "retain-age", 0, "at the start of the session, delete artifacts of previous sessions older than this from the artifacts directory (0 keeps them)")
+	flag.UintVar(&retainSize, "retain-size", 0, "at the start of the session, delete the oldest artifacts of previous sessions from the artifacts directory until they total at most this many MiB (0 means no limit)")
+}
+
+// artifactsRoot returns the artifacts directory shared by every session,
+// which holds the artifacts of named sessions in subdirectories.
+func artifactsRoot() string {
+	if sessionName != "" {
+		return filepath.Dir(artifactsDir)
+	}
+	return artifactsDir
+}
+
+// manifestName is the name of the file in the artifacts root listing the
+// artifacts goswarm has written there, one path relative to the root per
+// line. Pruning only ever deletes the files it lists: the artifacts
+// directory is often the current directory, or one shared with other tools.
+const manifestName = ".goswarm-artifacts"
+
+// manifestMu serializes the session's writes to the manifest.
+var manifestMu sync.Mutex
+
+// recordArtifact lists the artifact at path in the manifest, so that later
+// sessions may prune it.
+func recordArtifact(path string) {
+	root := artifactsRoot()
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(root, manifestName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("Failed to record artifact %s for pruning: %v", path, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\n", filepath.ToSlash(rel))
+}
+
+// checkRetention reports an error if -retain-age or -retain-size is set
+// without -artifacts, whose default is the current directory.
+func checkRetention() error {
+	if retainAge == 0 && retainSize == 0 {
+		return nil
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == "artifacts" })
+	if !set {
+		return fmt.Errorf("-retain-age and -retain-size require -artifacts, so as not to prune the current directory by default")
+	}
+	return nil
+}
+
+// metadataOf returns the path of the failure metadata written next to the
+// artifact at path, or "" if there's none.
+func metadataOf(path string) string {
+	stem, ok := strings.CutSuffix(path, ".out")
+	if !ok {
+		stem, ok = strings.CutSuffix(path, ".tar.gz")
+	}
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(stem + ".json"); err != nil {
+		return ""
+	}
+	return stem + ".json"
+}
+
+type artifactFile struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+// findArtifacts returns the artifacts the manifest in root lists that still
+// exist, oldest first.
+func findArtifacts(root string) ([]artifactFile, error) {
+	data, err := os.ReadFile(filepath.Join(root, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var files []artifactFile
+	seen := make(map[string]bool)
+	for _, rel := range strings.Split(string(data), "\n") {
+		rel = filepath.FromSlash(rel)
+		if rel == "" || !filepath.IsLocal(rel) || seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		path := filepath.Join(root, rel)
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, artifactFile{path, info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	return files, nil
+}
+
+// writeManifest replaces the manifest in root with one listing files.
+func writeManifest(root string, files []artifactFile) error {
+	var b strings.Builder
+	for _, f := range files {
+		rel, err := filepath.Rel(root, f.path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\n", filepath.ToSlash(rel))
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	path := filepath.Join(root, manifestName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneArtifacts deletes artifacts of previous sessions from the artifacts
+// root according to -retain-age and -retain-size, along with the failure
+// metadata next to them. Only the artifacts listed in the manifest are
+// considered.
+func pruneArtifacts() {
+	if retainAge == 0 && retainSize == 0 {
+		return
+	}
+	root := artifactsRoot()
+	files, err := findArtifacts(root)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read the list of old artifacts in %s: %v", root, err)
+		}
+		return
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	var pruned int
+	var freed int64
+	var kept []artifactFile
+	for i, f := range files {
+		old := retainAge > 0 && time.Since(f.mod) > retainAge
+		over := retainSize > 0 && total > int64(retainSize)<<20
+		if !old && !over {
+			// The rest are newer still.
+			kept = append(kept, files[i:]...)
+			break
+		}
+		meta := metadataOf(f.path)
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Failed to delete old artifact: %v", err)
+			kept = append(kept, f)
+			continue
+		}
+		if meta != "" {
+			os.Remove(meta)
+		}
+		total -= f.size
+		pruned++
+		freed += f.size
+	}
+	if err := writeManifest(root, kept); err != nil {
+		log.Printf("Failed to update the list of artifacts in %s: %v", root, err)
+	}
+	if pruned > 0 {
+		abs, _ := filepath.Abs(root)
+		log.Printf("Deleted %d old artifacts (%d MiB) from %s.", pruned, freed>>20, abs)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	retryMaxElapsed time.Duration
+)
+
+func init() {
+	flag.DurationVar(&retryBackoff, "retry-backoff", time.Second, "initial backoff between retries of gomote operations, doubled after every attempt")
+	flag.DurationVar(&retryMaxBackoff, "retry-max-backoff", time.Minute, "maximum backoff between retries of gomote operations")
+	flag.DurationVar(&retryMaxElapsed, "retry-max-elapsed", 10*time.Minute, "give up retrying a gomote operation after this long (0 means no limit)")
+}
+
+// defaultRetryPolicy returns the retry policy set by flags.
+func defaultRetryPolicy() swarm.RetryPolicy {
+	return swarm.RetryPolicy{
+		Attempts:   int(deflakes),
+		Backoff:    retryBackoff,
+		MaxBackoff: retryMaxBackoff,
+		MaxElapsed: retryMaxElapsed,
+		Jitter:     0.2,
+	}
+}
+
+// A class of gomote operations, like pushes, can have a retry policy of its
+// own in the configuration file, since what suits a quick create doesn't
+// suit a 40-minute push. Unset keys default to the flags.
+//
+//	[retry.push]
+//	attempts = 2
+//	backoff = "30s"
+//	max-backoff = "5m"
+//	max-elapsed = "2h"
+//	timeout = "45m"   # per attempt
+const retryTablePrefix = "retry."
+
+// opClasses maps each retried operation to its class. The run class covers
+// every command run on an instance; iterations of the command retry
+// infrastructure errors by its policy too, but aren't subject to its
+// timeout (see -fail-if-slower-than).
+var opClasses = map[string]string{
+	"create":       "create",
+	"push":         "push",
+	"putbootstrap": "push",
+	"put":          "push",
+	"run":          "run",
+	"make":         "run",
+	"setup":        "run",
+	"rm":           "run",
+	"gettar":       "gettar",
+}
+
+// classPolicy is how to retry a class of operations.
+type classPolicy struct {
+	swarm.RetryPolicy
+	timeout time.Duration // per attempt; 0 means no limit
+}
+
+// classPolicies holds the policies of the classes configured in the
+// configuration file.
+var classPolicies map[string]classPolicy
+
+// loadRetryPolicies reads the retry tables of the configuration file.
+func loadRetryPolicies() error {
+	classPolicies = make(map[string]classPolicy)
+	for table, opts := range userConfig {
+		class, ok := strings.CutPrefix(table, retryTablePrefix)
+		if !ok {
+			continue
+		}
+		if opClasses[class] != class {
+			return fmt.Errorf("[%s]: unknown operation class %q, expected create, push, run, or gettar", table, class)
+		}
+		cp := classPolicy{RetryPolicy: defaultRetryPolicy()}
+		for key, vals := range opts {
+			if len(vals) != 1 {
+				return fmt.Errorf("[%s]: %s must be a single value", table, key)
+			}
+			var err error
+			switch key {
+			case "attempts":
+				cp.Attempts, err = strconv.Atoi(vals[0])
+				if err == nil && cp.Attempts < 1 {
+					err = fmt.Errorf("must be at least 1")
+				}
+			case "backoff":
+				cp.Backoff, err = time.ParseDuration(vals[0])
+			case "max-backoff":
+				cp.MaxBackoff, err = time.ParseDuration(vals[0])
+			case "max-elapsed":
+				cp.MaxElapsed, err = time.ParseDuration(vals[0])
+			case "timeout":
+				cp.timeout, err = time.ParseDuration(vals[0])
+			default:
+				err = fmt.Errorf("unknown option, expected attempts, backoff, max-backoff, max-elapsed, or timeout")
+			}
+			if err != nil {
+				return fmt.Errorf("[%s]: %s: %v", table, key, err)
+			}
+		}
+		classPolicies[class] = cp
+	}
+	return nil
+}
+
+// retryPolicy returns the policy for retrying op.
+func retryPolicy(op string) classPolicy {
+	if cp, ok := classPolicies[opClasses[op]]; ok {
+		return cp
+	}
+	return classPolicy{RetryPolicy: defaultRetryPolicy()}
+}
+
+// retry calls f, a gomote operation named op on inst, until it succeeds or
+// op's retry policy gives up. Every attempt is traced and timed, and
+// limited to the policy's timeout. Attempts that fail during an outage
+// don't count.
+func retry(ctx context.Context, op, inst string, f func(ctx context.Context) error) error {
+	cp := retryPolicy(op)
+	attempt := 0
+	return cp.Do(ctx, func() error {
+		for {
+			outage.wait(ctx)
+			if attempt++; attempt > 1 {
+				retriesTotal.Inc(op)
+			}
+			actx, sp := startSpan(ctx, op, "attempt", strconv.Itoa(attempt))
+			t := time.Now()
+			err := cp.attempt(actx, f)
+			gomoteOpDuration.Observe(time.Since(t), op)
+			sp.End(err)
+			if err == nil {
+				outage.succeeded()
+				return nil
+			}
+			if ctx.Err() != nil || !outage.failed(inst, err) {
+				return err
+			}
+		}
+	})
+}
+
+// attempt calls f once, limited to the policy's timeout.
+func (cp classPolicy) attempt(ctx context.Context, f func(ctx context.Context) error) error {
+	if cp.timeout <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cp.timeout)
+	defer cancel()
+	err := f(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %v", cp.timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var scriptFile string
+
+func init() {
+	flag.StringVar(&scriptFile, "script", "", "local script to upload to each instance and run, with the command's arguments, in place of a command")
+}
+
+// scriptCommand returns the command that runs the uploaded script, which
+// keeps its name on the instance, and is uploaded to -dir.
+func scriptCommand() string {
+	return "./" + filepath.Base(scriptFile)
+}
+
+// upload is a local file that's copied to each instance's work directory
+// during setup.
+type upload struct {
+	src, dst string
+	mode     fs.FileMode
+}
+
+// uploads returns the files the command needs on each instance.
+func uploads() []upload {
+	var ups []upload
+	if scriptFile != "" {
+		ups = append(ups, upload{scriptFile, runDirPath(filepath.Base(scriptFile)), 0o755})
+	}
+	if stdinFile != "" {
+		ups = append(ups, upload{stdinPath, runDirPath(stdinName), 0o644})
+	}
+	return ups
+}
+
+// put copies up to inst.
+func put(ctx context.Context, inst string, up upload) error {
+	putter, ok := backend.(swarm.Putter)
+	if !ok {
+		return fmt.Errorf("uploading files is not supported by the %s backend", backendName)
+	}
+	return putter.Put(ctx, inst, up.src, up.dst, up.mode)
+}
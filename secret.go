@@ -0,0 +1,164 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	secretVars  stringSetVar
+	secretMatch stringSetVar
+)
+
+func init() {
+	flag.Var(&secretVars, "secret", "name of an environment variable of the runs, from -e, -e-passthrough, or -env-file, whose value is a secret to redact from logs, outputs, reports, and failure metadata; may be repeated")
+	flag.Var(&secretMatch, "secret-match", "regexp matching secrets to redact from logs, outputs, reports, and failure metadata, like 'ghp_[A-Za-z0-9]+'; may be repeated")
+}
+
+// redactedText stands in for secrets.
+const redactedText = "[REDACTED]"
+
+// redactor redacts secrets: the values of -secret variables, and matches
+// of -secret-match.
+type redactor struct {
+	values [][]byte
+	res    []*regexp.Regexp
+}
+
+// secrets is the session's redactor, or nil if there are no secrets.
+var secrets atomic.Pointer[redactor]
+
+// setUpSecrets sets up redaction of the secrets in env, once it's
+// complete.
+func setUpSecrets() error {
+	r := new(redactor)
+	for _, name := range secretVars {
+		found := false
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			if k == name && v != "" {
+				r.values = append(r.values, []byte(v))
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not set with -e, -e-passthrough, or -env-file", name)
+		}
+	}
+	// Longest first, in case one secret contains another.
+	slices.SortFunc(r.values, func(a, b []byte) int { return len(b) - len(a) })
+	for _, s := range secretMatch {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		r.res = append(r.res, re)
+	}
+	if len(r.values) > 0 || len(r.res) > 0 {
+		secrets.Store(r)
+	}
+	return nil
+}
+
+// redact returns b with any secrets in it replaced.
+func redact(b []byte) []byte {
+	r := secrets.Load()
+	if r == nil {
+		return b
+	}
+	for _, v := range r.values {
+		b = bytes.ReplaceAll(b, v, []byte(redactedText))
+	}
+	for _, re := range r.res {
+		b = re.ReplaceAllLiteral(b, []byte(redactedText))
+	}
+	return b
+}
+
+// redactString is redact for strings.
+func redactString(s string) string {
+	if secrets.Load() == nil {
+		return s
+	}
+	return string(redact([]byte(s)))
+}
+
+// redactEnv returns env, a list of VAR=value, with the values of -secret
+// variables, and any other secrets, redacted.
+func redactEnv(env []string) []string {
+	if secrets.Load() == nil {
+		return env
+	}
+	var out []string
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); slices.Contains(secretVars, k) {
+			kv = k + "=" + redactedText
+		}
+		out = append(out, redactString(kv))
+	}
+	return out
+}
+
+// redactArgs returns args with any secrets in them redacted.
+func redactArgs(args []string) []string {
+	if secrets.Load() == nil {
+		return args
+	}
+	var out []string
+	for _, a := range args {
+		out = append(out, redactString(a))
+	}
+	return out
+}
+
+// unredactedEnv returns env, recorded with redactEnv, without the
+// variables whose values were redacted.
+func unredactedEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		if _, v, _ := strings.Cut(kv, "="); v != redactedText {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// redactHandler is a slog.Handler that redacts secrets from messages and
+// string attributes.
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	if secrets.Load() == nil {
+		return h.Handler.Handle(ctx, r)
+	}
+	out := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Value.Kind() == slog.KindString {
+			a.Value = slog.StringValue(redactString(a.Value.String()))
+		}
+		out.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return redactHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var serveAddr string
+
+func init() {
+	flag.StringVar(&serveAddr, "serve", "", "address (e.g. :8080) on which to serve the artifacts directory over HTTP, with an index of the session's failures")
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"link": artifactLink,
+	"join": strings.Join,
+	"ago": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>goswarm: {{.Type}}</title></head>
+<body>
+<h1>goswarm session {{.PID}} ({{.Type}})</h1>
+<p>Command: <code>{{join .Command " "}}</code>, running for {{ago .Start}}.</p>
+<p>{{.Iterations}} iterations:
+pass {{index .Results "pass"}}, unmatched {{index .Results "unmatched"}},
+matched {{index .Results "matched"}}, errors {{index .Results "error"}}.</p>
+<h2>Matching failures</h2>
+{{with .Failures}}<ul>
+{{range .}}<li>{{.Instance}} at {{.Time.Format "15:04:05"}}:
+{{range .Artifacts}}<a href="{{link .}}">{{.}}</a> {{end}}
+{{with .Context}}<pre>{{.}}</pre>{{end}}</li>
+{{end}}</ul>{{else}}<p>None yet.</p>{{end}}
+{{with .Unmatched}}<h2>Unmatched failures</h2>
+<ul>
+{{range .}}<li><a href="{{link .Path}}">{{.Path}}</a> ({{.Count}} times)</li>
+{{end}}</ul>{{end}}
+<p><a href="/files/">Browse all artifacts</a></p>
+</body>
+</html>
+`))
+
+// artifactLink returns the URL at which the artifact at path is served.
+func artifactLink(path string) string {
+	rel, err := filepath.Rel(artifactsDir, path)
+	if err != nil {
+		rel = path
+	}
+	return "/files/" + filepath.ToSlash(rel)
+}
+
+// serveArtifacts serves the artifacts directory, and an index of the
+// session's failures, on addr.
+func serveArtifacts(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(artifactsDir))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		st := sess.status()
+		type failure struct {
+			failureRecord
+			Artifacts []string
+		}
+		var failures []failure
+		for _, f := range st.Failures {
+			failures = append(failures, failure{f, f.artifacts()})
+		}
+		data := struct {
+			*sessionStatus
+			Iterations int
+			Failures   []failure
+		}{st, st.iterations(), failures}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := indexTemplate.Execute(w, data); err != nil {
+			log.Printf("Rendering artifact index: %v", err)
+		}
+	})
+	log.Printf("Serving artifacts at http://%s/.", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Artifact server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,461 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// session tracks the state of a running swarm, for reporting.
+type session struct {
+	mu        sync.Mutex
+	start     time.Time
+	typ       string   // comma-separated list of types
+	types     []string // instance types to spread the pool across
+	cmd       []string
+	instances []*instanceState
+	results   map[string]int // swarm.Status.String() -> count
+	failures  []failureRecord
+	unmatched []*unmatchedOutput // oldest first
+	durations []time.Duration    // of every iteration that ran the command
+
+	createDurations []time.Duration // of every instance creation, including retries
+	pushDurations   []time.Duration // of every push, including retries
+
+	perInstance map[string]*instanceCounts // by instance name
+	perCommand  []instanceCounts           // by index in -commands
+	perShuffle  map[int64]*instanceCounts  // by -shuffle seed
+	perGODEBUG  map[string]*instanceCounts // by -godebug-fuzz setting, like asyncpreemptoff=1
+	skipped     map[skippedCell]int        // by instance type and command, with -skip-identical
+	quarantined []quarantineRecord
+
+	buildFailures []buildFailure
+	pass          *passRecord // with -until-success
+	brokenChecked bool        // whether -broken-rate has been checked
+	quotaCap      int         // size the pool was capped at by the instance quota
+	builders      builderTime
+	hangs         []*hangCluster                         // in the order first seen
+	unmatchedSeen map[[sha256.Size]byte]*unmatchedOutput // by signature
+	pool          *swarm.Pool
+	gate          pauseGate
+	adopt         []adoption // live instances to reuse before creating new ones
+
+	// first receives the result of the first iteration of the session.
+	first chan swarm.Status
+
+	// progress is signaled whenever an iteration completes.
+	progress chan struct{}
+}
+
+// adoption is an existing instance that the session may take over.
+type adoption struct {
+	instanceState
+	push bool // whether the instance still needs GOROOT pushed to it
+}
+
+// instanceSetup describes the steps needed to set up an instance for
+// the pool.
+type instanceSetup int
+
+const (
+	setupCreate instanceSetup = iota // create the instance and push to it
+	setupPush                        // push to an existing instance
+	setupNone                        // the instance is ready to go
+)
+
+// instanceState is the state of a single instance in the pool.
+type instanceState struct {
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Shard      int    `json:"shard"`
+	State      string `json:"state"`
+	Iterations int    `json:"iterations"`
+}
+
+// failureRecord describes a matching failure and where its artifacts live.
+type failureRecord struct {
+	Instance      string        `json:"instance"`
+	InstanceType  string        `json:"instance_type,omitempty"`
+	Time          time.Time     `json:"time"`
+	Elapsed       time.Duration `json:"elapsed"` // since the session started
+	Output        string        `json:"output"`
+	Archive       string        `json:"archive,omitempty"`
+	ArchiveNote   string        `json:"archive_note,omitempty"`   // why there's no archive
+	Context       string        `json:"context,omitempty"`        // lines around the -match match
+	Bundle        string        `json:"bundle,omitempty"`         // bundle replacing Output and Archive
+	Report        string        `json:"report,omitempty"`         // Markdown report
+	Metadata      string        `json:"metadata,omitempty"`       // for goswarm repro, unless bundled
+	Seed          int64         `json:"seed"`                     // random seed of the iteration
+	Dashboard     []string      `json:"dashboard,omitempty"`      // links to similar failures on the build dashboard
+	Known         string        `json:"known,omitempty"`          // known issue the failure matches
+	Slow          bool          `json:"slow,omitempty"`           // stopped by -fail-if-slower-than
+	Command       string        `json:"command,omitempty"`        // the command from -commands that failed
+	ExitCode      int           `json:"exit_code"`                // of the command, or -1 if it didn't exit on its own
+	ExitStatus    string        `json:"exit_status,omitempty"`    // how the command exited, like "exit status 2" or "signal: killed"
+	Hang          string        `json:"hang,omitempty"`           // ID of the hang the failure dumps the goroutines of
+	Tests         []string      `json:"tests,omitempty"`          // tests and benchmarks that failed
+	Rerun         string        `json:"rerun,omitempty"`          // test rerun alone by -rerun
+	Reruns        int           `json:"reruns,omitempty"`         // number of reruns that completed
+	RerunFailures int           `json:"rerun_failures,omitempty"` // number of them the test failed
+	FSChanges     []fsChange    `json:"fs_changes,omitempty"`     // the largest new and modified files on the instance, with -fs-diff
+	FSChanged     int           `json:"fs_changed,omitempty"`     // number of new and modified files
+	Signature     string        `json:"signature,omitempty"`      // of the output, to recognize the failure in other sessions
+	Repro         string        `json:"repro,omitempty"`          // script reproducing the failure with just gomote, unless bundled
+	Shuffle       int64         `json:"shuffle,omitempty"`        // go test -shuffle seed of the test order, with -shuffle
+	GODEBUG       string        `json:"godebug,omitempty"`        // GODEBUG settings of -godebug-fuzz
+}
+
+// artifacts returns the paths of the failure's artifacts.
+func (f *failureRecord) artifacts() []string {
+	var paths []string
+	if f.Bundle != "" {
+		paths = append(paths, f.Bundle)
+	} else {
+		paths = append(paths, f.Output)
+		if f.Archive != "" {
+			paths = append(paths, f.Archive)
+		}
+		if f.Metadata != "" {
+			paths = append(paths, f.Metadata)
+		}
+		if f.Repro != "" {
+			paths = append(paths, f.Repro)
+		}
+	}
+	if f.Report != "" {
+		paths = append(paths, f.Report)
+	}
+	return paths
+}
+
+// sess is the current session.
+var sess *session
+
+func newSession(typs []string, cmd []string) *session {
+	return &session{
+		start:       time.Now(),
+		typ:         strings.Join(typs, ","),
+		types:       typs,
+		cmd:         cmd,
+		results:     make(map[string]int),
+		perInstance: make(map[string]*instanceCounts),
+		first:       make(chan swarm.Status, 1),
+		progress:    make(chan struct{}, 1),
+	}
+}
+
+// addInstance adds a new instance to the pool, preferring to adopt an
+// existing one, and returns the steps needed to set it up. New instances
+// are of whichever of the session's types has the fewest live instances
+// for its weight, short of its -type-max. If every type is at its
+// -type-max, addInstance returns nil.
+func (s *session) addInstance() (*instanceState, instanceSetup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	is := &instanceState{Type: s.leastUsedType(), State: "creating"}
+	setup := setupCreate
+	if is.Type == "" && len(s.adopt) == 0 {
+		return nil, setup
+	}
+	if len(s.adopt) > 0 {
+		a := s.adopt[0]
+		s.adopt = s.adopt[1:]
+		is = &instanceState{Name: a.Name, Type: a.Type, State: "running", Iterations: a.Iterations}
+		if is.Type == "" {
+			// From a state file that predates multiple types.
+			is.Type = s.types[0]
+		}
+		setup = setupNone
+		if a.push {
+			is.State = "pushing"
+			setup = setupPush
+		}
+	}
+	is.Shard = s.freeShard()
+	s.instances = append(s.instances, is)
+	return is, setup
+}
+
+// leastUsedType returns the session's instance type with the fewest live
+// instances for its weight, preferring earlier types on ties, and skipping
+// types at their -type-max. It returns "" if every type is at its
+// -type-max. s.mu must be held.
+func (s *session) leastUsedType() string {
+	live := s.liveByType()
+	best := ""
+	for _, typ := range s.types {
+		if atTypeMax(typ, live[typ]) {
+			continue
+		}
+		if best == "" || float64(live[typ])/s.typeWeight(typ) < float64(live[best])/s.typeWeight(best) {
+			best = typ
+		}
+	}
+	return best
+}
+
+// liveByType returns the number of live instances of each type. s.mu must
+// be held.
+func (s *session) liveByType() map[string]int {
+	live := make(map[string]int)
+	for _, is := range s.instances {
+		if is.State != "stopped" {
+			live[is.Type]++
+		}
+	}
+	return live
+}
+
+// shards returns the total number of shards the work is split into: the
+// pool size, or more if the pool grew past it.
+func (s *session) shards() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int(instances)
+	for _, is := range s.instances {
+		if is.State != "stopped" {
+			n = max(n, is.Shard+1)
+		}
+	}
+	return n
+}
+
+// freeShard returns the lowest shard no live instance has. s.mu must be
+// held.
+func (s *session) freeShard() int {
+	used := make(map[int]bool)
+	for _, is := range s.instances {
+		if is.State != "stopped" {
+			used[is.Shard] = true
+		}
+	}
+	n := 0
+	for used[n] {
+		n++
+	}
+	return n
+}
+
+func (s *session) setName(is *instanceState, name string) {
+	s.mu.Lock()
+	is.Name = name
+	s.mu.Unlock()
+}
+
+func (s *session) setType(is *instanceState, typ string) {
+	s.mu.Lock()
+	is.Type = typ
+	s.mu.Unlock()
+}
+
+// setPool records the session's pool, once it has started.
+func (s *session) setPool(p *swarm.Pool) {
+	s.mu.Lock()
+	s.pool = p
+	s.mu.Unlock()
+}
+
+// currentPool returns the session's pool, or nil if it hasn't started yet.
+// The control socket is up before the pool is, so callers that may run
+// before the session starts must check.
+func (s *session) currentPool() *swarm.Pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pool
+}
+
+func (s *session) setState(is *instanceState, state string) {
+	s.mu.Lock()
+	is.State = state
+	s.mu.Unlock()
+}
+
+func (s *session) recordIteration(is *instanceState, status swarm.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[status.String()]++
+	if status != swarm.ExecutionError {
+		is.Iterations++
+	}
+	c, ok := s.perInstance[is.Name]
+	if !ok {
+		c = &instanceCounts{Type: is.Type}
+		s.perInstance[is.Name] = c
+	}
+	c.record(status)
+	select {
+	case s.first <- status:
+	default:
+	}
+	select {
+	case s.progress <- struct{}{}:
+	default:
+	}
+}
+
+// succeeded returns the number of iterations that ran the command to
+// completion and either passed or failed as expected.
+func (s *session) succeeded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results[swarm.Pass.String()] + s.results[swarm.FailMatched.String()]
+}
+
+func (s *session) recordFailure(f failureRecord) {
+	s.mu.Lock()
+	s.failures = append(s.failures, f)
+	s.mu.Unlock()
+}
+
+// sessionStatus is a snapshot of a session, as reported by `goswarm status`.
+type sessionStatus struct {
+	PID       int               `json:"pid"`
+	Name      string            `json:"name,omitempty"`
+	Start     time.Time         `json:"start"`
+	Type      string            `json:"type"`
+	Types     []string          `json:"types,omitempty"`
+	Command   []string          `json:"command"`
+	Paused    bool              `json:"paused"`
+	Results   map[string]int    `json:"results"`
+	Instances []instanceState   `json:"instances"`
+	Failures  []failureRecord   `json:"failures"`
+	Unmatched []unmatchedOutput `json:"unmatched,omitempty"`
+	Timing    *timingStats      `json:"timing,omitempty"`
+
+	CreateTiming *timingStats `json:"create_timing,omitempty"`
+	PushTiming   *timingStats `json:"push_timing,omitempty"`
+
+	PerInstance map[string]instanceCounts `json:"per_instance,omitempty"`
+	Quarantined []quarantineRecord        `json:"quarantined,omitempty"`
+	PerCommand  []commandCounts           `json:"per_command,omitempty"`
+	PerShuffle  []shuffleCounts           `json:"per_shuffle,omitempty"`
+	PerGODEBUG  []godebugCounts           `json:"per_godebug,omitempty"`
+	Skipped     []skippedCell             `json:"skipped,omitempty"`
+
+	BuildFailures []buildFailure `json:"build_failures,omitempty"`
+	Pass          *passRecord    `json:"pass,omitempty"`
+	QuotaCap      int            `json:"quota_cap,omitempty"`
+
+	Hangs []hangCluster `json:"hangs,omitempty"`
+
+	BuilderTime      time.Duration `json:"builder_time"`
+	BuilderInstances int           `json:"builder_instances"`
+
+	ArtifactBytes int64 `json:"artifact_bytes"`
+}
+
+func (s *session) status() *sessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &sessionStatus{
+		PID:      os.Getpid(),
+		Name:     sessionName,
+		Start:    s.start,
+		Type:     s.typ,
+		Types:    s.types,
+		Command:  s.cmd,
+		Paused:   s.gate.isPaused(),
+		Results:  make(map[string]int),
+		Failures: append([]failureRecord(nil), s.failures...),
+	}
+	for k, v := range s.results {
+		st.Results[k] = v
+	}
+	for _, is := range s.instances {
+		st.Instances = append(st.Instances, *is)
+	}
+	for _, u := range s.unmatched {
+		st.Unmatched = append(st.Unmatched, *u)
+	}
+	st.Timing = newTimingStats(s.durations)
+	st.CreateTiming = newTimingStats(s.createDurations)
+	st.PushTiming = newTimingStats(s.pushDurations)
+	st.PerInstance = make(map[string]instanceCounts)
+	for name, c := range s.perInstance {
+		st.PerInstance[name] = *c
+	}
+	st.Quarantined = append([]quarantineRecord(nil), s.quarantined...)
+	st.BuildFailures = append([]buildFailure(nil), s.buildFailures...)
+	st.Pass = s.pass
+	st.QuotaCap = s.quotaCap
+	for _, c := range s.hangs {
+		st.Hangs = append(st.Hangs, *c)
+	}
+	st.BuilderTime = s.builders.total()
+	st.BuilderInstances = s.builders.instances
+	st.ArtifactBytes = artifactBytes.Load()
+	for i, c := range s.perCommand {
+		st.PerCommand = append(st.PerCommand, commandCounts{Command: commandList[i], instanceCounts: c})
+	}
+	for seed, c := range s.perShuffle {
+		st.PerShuffle = append(st.PerShuffle, shuffleCounts{Shuffle: seed, instanceCounts: *c})
+	}
+	for kv, c := range s.perGODEBUG {
+		st.PerGODEBUG = append(st.PerGODEBUG, godebugCounts{Setting: kv, instanceCounts: *c})
+	}
+	for cell, n := range s.skipped {
+		cell.Skipped = n
+		st.Skipped = append(st.Skipped, cell)
+	}
+	return st
+}
+
+// iterations returns the total number of completed iterations.
+func (st *sessionStatus) iterations() int {
+	n := 0
+	for k, v := range st.Results {
+		if k != swarm.ExecutionError.String() {
+			n += v
+		}
+	}
+	return n
+}
+
+func (st *sessionStatus) write(w io.Writer) {
+	state := "running"
+	if st.Paused {
+		state = "paused"
+	}
+	id := strconv.Itoa(st.PID)
+	if st.Name != "" {
+		id = fmt.Sprintf("%s, PID %d,", st.Name, st.PID)
+	}
+	fmt.Fprintf(w, "Session %s (%s): %s for %s\n", id, st.Type, state, time.Since(st.Start).Round(time.Second))
+	fmt.Fprintf(w, "  command: %s\n", strings.Join(st.Command, " "))
+	fmt.Fprintf(w, "  iterations: %d (pass %d, unmatched %d, matched %d, errors %d)\n",
+		st.iterations(),
+		st.Results[swarm.Pass.String()],
+		st.Results[swarm.FailUnmatched.String()],
+		st.Results[swarm.FailMatched.String()],
+		st.Results[swarm.ExecutionError.String()])
+	if d := st.detection(); d != "" {
+		fmt.Fprintf(w, "  detection: %s\n", d)
+	}
+	st.writeBuilderTime(w)
+	st.writeArtifactBudget(w)
+	fmt.Fprintf(w, "  instances:\n")
+	for _, is := range st.Instances {
+		name := is.Name
+		if name == "" {
+			name = "(pending)"
+		}
+		fmt.Fprintf(w, "    %-30s %-10s %d iterations\n", name, is.State, is.Iterations)
+	}
+	if len(st.Failures) > 0 {
+		fmt.Fprintf(w, "  failures:\n")
+		for _, f := range st.Failures {
+			fmt.Fprintf(w, "    %s at %s: %s\n", f.Instance, f.Time.Format(time.Kitchen), strings.Join(f.artifacts(), ", "))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "flag"
+
+var shScript string
+
+func init() {
+	flag.StringVar(&shScript, "sh", "", "shell script to run on each instance in place of a command, with sh -c, or cmd /c on Windows, so that pipes, cd, and variable expansion work")
+}
+
+// isWindowsType reports whether instances of type typ run Windows.
+func isWindowsType(typ string) bool {
+	goos, _ := typePlatform(typ)
+	return goos == "windows"
+}
+
+// remoteCommand returns cmd as it's run on instances of type typ, with -sh,
+// -stdin, and -dir applied, and adapted to the type's scripts and to Windows
+// instances.
+func remoteCommand(typ string, cmd []string) []string {
+	if shScript != "" {
+		cmd = shellCommand(typ, shScript)
+	} else {
+		cmd = typeScriptCommand(typ, cmd)
+		if isWindowsType(typ) {
+			cmd = windowsCommand(cmd)
+		}
+	}
+	if stdinFile != "" {
+		cmd = stdinCommand(cmd)
+	}
+	return inRunDir(cmd)
+}
+
+// shellCommand returns the command that runs script in the shell of
+// instances of type typ.
+func shellCommand(typ, script string) []string {
+	if isWindowsType(typ) {
+		return []string{`C:\Windows\System32\cmd.exe`, "/c", windowsScript(script)}
+	}
+	return []string{"/bin/sh", "-c", script}
+}
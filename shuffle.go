@@ -0,0 +1,160 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var shuffleOrders uint
+
+func init() {
+	flag.UintVar(&shuffleOrders, "shuffle", 0, "run go test with -shuffle, in one of this many test orders chosen at random each iteration, and report the orders failures are concentrated in, a sign of tests that depend on each other")
+}
+
+// shuffleAlpha is the significance level at which a test order is reported
+// to fail more often than the others.
+const shuffleAlpha = 0.01
+
+// shuffleSeeds are the -shuffle seeds of the test orders, chosen when the
+// first iteration starts.
+var shuffleSeeds struct {
+	sync.Mutex
+	seeds []int64
+}
+
+// shuffleSeed returns the -shuffle seed of the test order of the iteration
+// with the given seed, or 0 without -shuffle. The iteration's seed picks the
+// order, so that rerunning it with its seed runs the tests in the same order.
+func shuffleSeed(seed int64) int64 {
+	if shuffleOrders == 0 {
+		return 0
+	}
+	shuffleSeeds.Lock()
+	defer shuffleSeeds.Unlock()
+	if shuffleSeeds.seeds == nil {
+		for i := uint(0); i < shuffleOrders; i++ {
+			// Zero would mean no shuffling.
+			shuffleSeeds.seeds = append(shuffleSeeds.seeds, rand.Int63n(1<<62)+1)
+		}
+	}
+	return shuffleSeeds.seeds[uint64(seed)%uint64(len(shuffleSeeds.seeds))]
+}
+
+// shuffleEnv returns env with go test's -shuffle flag set to shuffle in
+// GOFLAGS, so that it applies wherever the command runs go test, or env
+// itself if shuffle is 0.
+func shuffleEnv(env []string, shuffle int64) []string {
+	if shuffle == 0 {
+		return env
+	}
+	flags := ""
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "GOFLAGS="); ok {
+			flags = v + " "
+		}
+	}
+	return append(env[:len(env):len(env)], fmt.Sprintf("GOFLAGS=%s-shuffle=%d", flags, shuffle))
+}
+
+// recordShuffle counts an iteration, with the given seed, in its test order.
+func (s *session) recordShuffle(seed int64, status swarm.Status) {
+	shuffle := shuffleSeed(seed)
+	if shuffle == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perShuffle == nil {
+		s.perShuffle = make(map[int64]*instanceCounts)
+	}
+	c, ok := s.perShuffle[shuffle]
+	if !ok {
+		c = new(instanceCounts)
+		s.perShuffle[shuffle] = c
+	}
+	c.record(status)
+}
+
+// shuffleCounts are the results of the iterations in one test order of
+// -shuffle.
+type shuffleCounts struct {
+	Shuffle int64 `json:"shuffle"`
+	instanceCounts
+}
+
+// maxShuffleOrders is the most test orders the summary lists.
+const maxShuffleOrders = 10
+
+// writePerShuffle writes the results of the test orders of -shuffle that
+// failed, most failures first, and which of them failed significantly more
+// often than the others.
+func (st *sessionStatus) writePerShuffle(w io.Writer) {
+	if len(st.PerShuffle) == 0 {
+		return
+	}
+	var total instanceCounts
+	var failed []shuffleCounts
+	for _, c := range st.PerShuffle {
+		total.Iterations += c.Iterations
+		total.Matched += c.Matched
+		if c.failures() > 0 {
+			failed = append(failed, c)
+		}
+	}
+	fmt.Fprintf(w, "  by test order (-shuffle):\n")
+	if len(failed) == 0 {
+		fmt.Fprintf(w, "    no failures in %d orders\n", len(st.PerShuffle))
+		return
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		if failed[i].Matched != failed[j].Matched {
+			return failed[i].Matched > failed[j].Matched
+		}
+		return failed[i].failures() > failed[j].failures()
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "    shuffle\titerations\tmatched\tunmatched\terrors\n")
+	var suspects []string
+	for i, c := range failed {
+		note := ""
+		// Compare with the rate in the other orders, with half a failure
+		// so that an order can stand out when the others never failed.
+		rest := total.Iterations - c.Iterations
+		if c.Matched > 1 && rest > 0 {
+			rate := (float64(total.Matched-c.Matched) + 0.5) / float64(rest)
+			if p := poissonTail(c.Matched, rate*float64(c.Iterations)); p < shuffleAlpha {
+				note = fmt.Sprintf("more than the other orders (p=%.2g)", p)
+				suspects = append(suspects, fmt.Sprintf("-shuffle=%d", c.Shuffle))
+			}
+		}
+		if i < maxShuffleOrders {
+			fmt.Fprintf(tw, "    %d\t%d\t%d\t%d\t%d", c.Shuffle, c.Iterations, c.Matched, c.Unmatched, c.Errors)
+			if note != "" {
+				fmt.Fprintf(tw, "\t%s", note)
+			}
+			fmt.Fprintf(tw, "\n")
+		}
+	}
+	tw.Flush()
+	if len(failed) > maxShuffleOrders {
+		fmt.Fprintf(w, "    and %d more orders with failures\n", len(failed)-maxShuffleOrders)
+	}
+	if n := len(st.PerShuffle) - len(failed); n > 0 {
+		fmt.Fprintf(w, "    %d other orders had no failures\n", n)
+	}
+	if len(suspects) > 0 {
+		fmt.Fprintf(w, "    failures depend on the test order: try go test %s, and look for tests that leave state behind\n", suspects[0])
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var failSlower time.Duration
+
+func init() {
+	flag.DurationVar(&failSlower, "fail-if-slower-than", 0, "stop any iteration that runs longer than this, and treat it as a matching failure (0 means no limit)")
+}
+
+// slowNote is appended to the output of an iteration stopped for running
+// longer than -fail-if-slower-than, so it's clear why it ended.
+func slowNote(took time.Duration) []byte {
+	return []byte(fmt.Sprintf("\ngoswarm: stopped after %s, exceeding -fail-if-slower-than=%s\n", took.Round(time.Millisecond), failSlower))
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var (
+	soak        bool
+	maxDuration time.Duration
+)
+
+func init() {
+	flag.BoolVar(&soak, "soak", false, "never stop on matching failures: record every one and keep the whole pool running until -max-duration or an interrupt, to characterize how flaky the command is rather than catch one bug")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "stop the session once it has run this long, after in-flight iterations finish (0 means no limit)")
+}
+
+// deadlineReached is set once the session has run for -max-duration.
+var deadlineReached atomic.Bool
+
+// startDeadline drains p once the session has run for -max-duration. It
+// returns a function that cancels the deadline.
+func startDeadline(p *swarm.Pool) (stop func()) {
+	if maxDuration <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(time.Until(sess.start.Add(maxDuration)), func() {
+		deadlineReached.Store(true)
+		log.Printf("Ran for -max-duration of %s, stopping after in-flight iterations.", maxDuration)
+		p.DrainAll()
+	})
+	return func() { t.Stop() }
+}
+
+// uniquePath returns path, or if it already exists, path with -2, -3, and
+// so on added before its extension, for the artifacts of failures that
+// happen within the same second.
+func uniquePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// failureName returns the name of the artifacts of the next failure on
+// inst: inst itself for its first failure, then inst-2, inst-3, and so on,
+// since with -soak an instance can fail many times.
+func (s *session) failureName(inst string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 1
+	for _, f := range s.failures {
+		if f.Instance == inst {
+			n++
+		}
+	}
+	if n == 1 {
+		return inst
+	}
+	return fmt.Sprintf("%s-%d", inst, n)
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var stateFile string
+
+func init() {
+	flag.StringVar(&stateFile, "state", "goswarm-state.json", "file to which session state is periodically saved, for use with 'goswarm resume'; empty to disable")
+}
+
+// statePeriod is how often the session state is saved.
+const statePeriod = 30 * time.Second
+
+// sessionState is the persisted form of a session.
+type sessionState struct {
+	Backend      string            `json:"backend,omitempty"`
+	Type         string            `json:"type"`
+	Command      []string          `json:"command"`
+	Sh           string            `json:"sh,omitempty"`     // -sh script, in place of Command
+	Script       string            `json:"script,omitempty"` // -script to upload and run
+	Stdin        string            `json:"stdin,omitempty"`
+	Commands     bool              `json:"commands,omitempty"` // whether Command is the list of -commands
+	Steps        []string          `json:"steps,omitempty"`
+	Dir          string            `json:"dir,omitempty"`
+	RunArgs      []string          `json:"runArgs,omitempty"`
+	GomoteFlags  []string          `json:"gomoteFlags,omitempty"`
+	GomoteEnv    []string          `json:"gomoteEnv,omitempty"`
+	Bootstrap    string            `json:"bootstrap,omitempty"`
+	Make         bool              `json:"make,omitempty"`
+	GOROOT       string            `json:"goroot,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	Secrets      []string          `json:"secrets,omitempty"`     // -secret names
+	SecretMatch  []string          `json:"secretMatch,omitempty"` // -secret-match patterns
+	Match        string            `json:"match,omitempty"`
+	MatchFlags   string            `json:"matchFlags,omitempty"`
+	MatchExit    string            `json:"matchExit,omitempty"`
+	KnownIssues  string            `json:"knownIssues,omitempty"`
+	SkipKnown    bool              `json:"skipKnown,omitempty"`
+	Identical    bool              `json:"skipIdentical,omitempty"` // -skip-identical
+	Shuffle      uint              `json:"shuffle,omitempty"`
+	GODEBUGFuzz  []string          `json:"godebugFuzz,omitempty"`
+	Rerun        uint              `json:"rerun,omitempty"`
+	Wipe         []string          `json:"wipe,omitempty"`
+	Recycle      uint              `json:"recycle,omitempty"`
+	Quarantine   uint              `json:"quarantine,omitempty"`
+	Replace      bool              `json:"quarantineReplace,omitempty"` // -quarantine-replace
+	Adapt        bool              `json:"adapt,omitempty"`
+	TypeMax      []string          `json:"typeMax,omitempty"`
+	TypeWeight   []string          `json:"typeWeight,omitempty"`
+	FailSlower   time.Duration     `json:"failIfSlowerThan,omitempty"`
+	Bench        uint              `json:"bench,omitempty"`
+	BenchArms    []string          `json:"benchArms,omitempty"` // as passed to -bench-arm
+	KeepGoing    bool              `json:"keepGoing,omitempty"`
+	Soak         bool              `json:"soak,omitempty"`
+	Verify       uint              `json:"verify,omitempty"`
+	UntilSuccess bool              `json:"untilSuccess,omitempty"`
+	StopWhen     string            `json:"stopWhen,omitempty"`
+	MaxDuration  time.Duration     `json:"maxDuration,omitempty"`
+	Clean        swarm.CleanPolicy `json:"clean"`
+	Size         uint              `json:"size"`
+	Start        time.Time         `json:"start"`
+	Results      map[string]int    `json:"results"`
+	Instances    []instanceState   `json:"instances"`
+	Failures     []failureRecord   `json:"failures,omitempty"`
+}
+
+func (s *session) state() *sessionState {
+	st := s.status()
+	var arms []string
+	for _, a := range benchArms {
+		arms = append(arms, a.String())
+	}
+	return &sessionState{
+		Backend:      backendName,
+		Type:         st.Type,
+		Command:      st.Command,
+		Sh:           shScript,
+		Script:       scriptFile,
+		Stdin:        stdinFile,
+		Commands:     len(commandList) > 0,
+		Steps:        steps,
+		Dir:          runDir,
+		RunArgs:      runArgs,
+		GomoteFlags:  gomoteFlags,
+		GomoteEnv:    gomoteEnv,
+		Bootstrap:    bootstrapMode,
+		Make:         makeGo,
+		GOROOT:       gorootDir,
+		Env:          env,
+		Secrets:      secretVars,
+		SecretMatch:  secretMatch,
+		Match:        errMatch,
+		MatchFlags:   matchFlags,
+		MatchExit:    matchExit,
+		KnownIssues:  knownIssuesFile,
+		SkipKnown:    skipKnown,
+		Identical:    skipIdentical,
+		Shuffle:      shuffleOrders,
+		GODEBUGFuzz:  godebugFuzz,
+		Rerun:        rerunCount,
+		Wipe:         wipePaths,
+		Recycle:      recycleAfter,
+		Quarantine:   quarantineAfter,
+		Replace:      quarantineReplace,
+		Adapt:        adapt,
+		TypeMax:      typeMax,
+		TypeWeight:   typeWeight,
+		FailSlower:   failSlower,
+		Bench:        benchIters,
+		BenchArms:    arms,
+		KeepGoing:    keepGoing,
+		Soak:         soak,
+		Verify:       verifyIters,
+		UntilSuccess: untilSuccess,
+		StopWhen:     stopWhen,
+		MaxDuration:  maxDuration,
+		Clean:        clean,
+		Size:         instances,
+		Start:        st.Start,
+		Results:      st.Results,
+		Instances:    st.Instances,
+		Failures:     st.Failures,
+	}
+}
+
+// persist saves the session state to path every statePeriod, and once more
+// when ctx is done. The returned channel is closed after the final save.
+func (s *session) persist(ctx context.Context, path string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(statePeriod)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.save(path)
+				return
+			case <-t.C:
+				s.save(path)
+			}
+		}
+	}()
+	return done
+}
+
+func (s *session) save(path string) {
+	b, err := json.MarshalIndent(s.state(), "", "\t")
+	if err != nil {
+		log.Printf("Failed to encode session state: %v", err)
+		return
+	}
+	// Write to a temporary file first so a crash mid-write can't
+	// clobber the previous state. Only the user may read it, since
+	// it has the values of -e, secrets included. Remove any left over
+	// temporary file, since WriteFile keeps an existing file's mode.
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		log.Printf("Failed to save session state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Failed to save session state: %v", err)
+	}
+}
+
+func loadState(path string) (*sessionState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	st := new(sessionState)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return st, nil
+}
+
+// apply restores the session configuration from st into the flags,
+// and returns the instance type followed by the command, as they would
+// have been passed on the command line.
+func (st *sessionState) apply() []string {
+	if st.Backend != "" {
+		backendName = st.Backend
+	}
+	env = st.Env
+	// Before setUpSecrets, so that the resumed session redacts the
+	// same secrets.
+	secretVars = st.Secrets
+	secretMatch = st.SecretMatch
+	shScript = st.Sh
+	scriptFile = st.Script
+	stdinFile = st.Stdin
+	steps = st.Steps
+	runDir = st.Dir
+	runArgs = st.RunArgs
+	gomoteFlags = st.GomoteFlags
+	gomoteEnv = st.GomoteEnv
+	makeGo = st.Make
+	gorootDir = st.GOROOT
+	if st.Bootstrap != "" {
+		bootstrapMode = st.Bootstrap
+	}
+	if st.Commands {
+		commandList = st.Command
+	}
+	errMatch = st.Match
+	matchFlags = st.MatchFlags
+	matchExit = st.MatchExit
+	knownIssuesFile = st.KnownIssues
+	skipKnown = st.SkipKnown
+	skipIdentical = st.Identical
+	shuffleOrders = st.Shuffle
+	godebugFuzz = st.GODEBUGFuzz
+	rerunCount = st.Rerun
+	wipePaths = st.Wipe
+	recycleAfter = st.Recycle
+	quarantineAfter = st.Quarantine
+	quarantineReplace = st.Replace
+	adapt = st.Adapt
+	typeMax = st.TypeMax
+	typeWeight = st.TypeWeight
+	failSlower = st.FailSlower
+	benchIters = st.Bench
+	benchArms = nil
+	for _, a := range st.BenchArms {
+		benchArms.Set(a) // Valid, since it was when first set.
+	}
+	keepGoing = st.KeepGoing
+	soak = st.Soak
+	verifyIters = st.Verify
+	untilSuccess = st.UntilSuccess
+	stopWhen = st.StopWhen
+	maxDuration = st.MaxDuration
+	clean = st.Clean
+	instances = st.Size
+	instancesAuto = false
+	return append([]string{st.Type}, st.Command...)
+}
+
+// restore carries over results and failures from a previous session, and
+// arranges for instances from it that are still alive to be adopted
+// rather than recreated.
+func (s *session) restore(ctx context.Context, prev *sessionState) error {
+	live, err := backend.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing instances: %v", err)
+	}
+	alive := make(map[string]bool)
+	for _, inst := range live {
+		alive[inst.Name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = prev.Start
+	logStart.Store(prev.Start.UnixNano())
+	for k, v := range prev.Results {
+		s.results[k] += v
+	}
+	s.failures = append(s.failures, prev.Failures...)
+	for _, is := range prev.Instances {
+		if is.Name == "" || !alive[is.Name] {
+			continue
+		}
+		log.Printf("Adopting instance %s.", is.Name)
+		s.adopt = append(s.adopt, adoption{instanceState: is})
+	}
+	return nil
+}
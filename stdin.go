@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+)
+
+var stdinFile string
+
+func init() {
+	flag.StringVar(&stdinFile, "stdin", "", "file to feed to the command's standard input on every iteration, or - to read it once from goswarm's own standard input")
+}
+
+// stdinName is the name of the uploaded standard input in each instance's
+// work directory.
+const stdinName = ".goswarm-stdin"
+
+// stdinPath is the local file holding the standard input for the command,
+// which is a copy of goswarm's own for -stdin=-.
+var stdinPath string
+
+// setUpStdin prepares the -stdin file for uploading, returning a function
+// that cleans up after it.
+func setUpStdin() (func(), error) {
+	if stdinFile != "-" {
+		stdinPath = stdinFile
+		_, err := os.Stat(stdinPath)
+		return func() {}, err
+	}
+	f, err := os.CreateTemp("", "goswarm-stdin-*")
+	if err != nil {
+		return nil, err
+	}
+	stdinPath = f.Name()
+	cleanup := func() { os.Remove(stdinPath) }
+	_, err = io.Copy(f, os.Stdin)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// stdinCommand wraps cmd to read its standard input from the uploaded file.
+func stdinCommand(cmd []string) []string {
+	return append([]string{"/bin/sh", "-c", `exec "$@" < ` + stdinName, "sh"}, cmd...)
+}
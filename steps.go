@@ -0,0 +1,45 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var steps stringSetVar
+
+func init() {
+	flag.Var(&steps, "step", "shell command to run before the command in every iteration, like cleaning up after the last one, may be specified multiple times; only the command itself is judged, and a failing step is treated as an infrastructure error")
+}
+
+// runSteps runs the -step commands on inst, in order, with environment
+// env. A step that fails is reported as a *swarm.InfraError, since it
+// says nothing about the command.
+func runSteps(ctx context.Context, inst string, env []string, data templateData) error {
+	for _, step := range steps {
+		s, err := expandTemplates([]string{step}, data)
+		if err != nil {
+			return err
+		}
+		instDetailf(inst, "Running step %q on %s.", s[0], inst)
+		out, err := backend.Run(ctx, inst, env, inRunDir(shellCommand(data.Type, s[0]))...)
+		if err == nil {
+			continue
+		}
+		var ie *swarm.InfraError
+		var lost *swarm.LostBuilderError
+		if errors.As(err, &ie) || errors.As(err, &lost) || ctx.Err() != nil {
+			return err
+		}
+		instWarnf(inst, "Step %q failed on %s: %v\n%s", s[0], inst, err, tailLines(out, int(consoleLines)))
+		return &swarm.InfraError{Instance: inst, Output: append([]byte(fmt.Sprintf("step %q: %v\n", s[0], err)), out...)}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var stopWhen string
+
+func init() {
+	flag.StringVar(&stopWhen, "stop-when", "", "stop the session, after in-flight iterations finish, once this condition holds, like 'matched>=3 || runs>=1000 || elapsed>4h', comparing runs, pass, matched, unmatched, errors, or elapsed, and combining comparisons with &&, ||, !, and parentheses")
+}
+
+// stopWhenInterval is how often -stop-when is checked between iterations,
+// for conditions on elapsed.
+const stopWhenInterval = time.Second
+
+// stopCond is a parsed -stop-when condition.
+type stopCond func(vars map[string]float64) bool
+
+// stopVars are the variables a -stop-when condition may compare.
+// elapsed is a duration, and the rest are counts of iterations.
+var stopVars = []string{"runs", "pass", "matched", "unmatched", "errors", "elapsed"}
+
+var (
+	stopWhenCond stopCond
+	stopWhenHeld atomic.Bool // set once -stop-when holds
+)
+
+// setUpStopWhen parses -stop-when.
+func setUpStopWhen() error {
+	if stopWhen == "" {
+		return nil
+	}
+	c, err := parseStopCond(stopWhen)
+	if err != nil {
+		return err
+	}
+	stopWhenCond = c
+	return nil
+}
+
+// parseStopCond parses a -stop-when condition:
+//
+//	expr  = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" expr ")" | var op value
+//	op    = "<" | "<=" | ">" | ">=" | "==" | "!="
+func parseStopCond(s string) (stopCond, error) {
+	toks, err := stopTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &stopParser{toks: toks}
+	c, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return c, nil
+}
+
+// stopOps are the tokens of a condition other than names and values,
+// longest first so that, for example, ">=" isn't read as ">".
+var stopOps = []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"}
+
+// stopTokens splits a condition into tokens.
+func stopTokens(s string) ([]string, error) {
+	var toks []string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		op := ""
+		for _, o := range stopOps {
+			if strings.HasPrefix(s, o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			toks = append(toks, op)
+			s = s[len(op):]
+			continue
+		}
+		n := strings.IndexFunc(s, func(r rune) bool {
+			return !(r == '_' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+		})
+		if n == 0 {
+			return nil, fmt.Errorf("unexpected %q", s[:1])
+		}
+		if n < 0 {
+			n = len(s)
+		}
+		toks = append(toks, s[:n])
+		s = s[n:]
+	}
+	return toks, nil
+}
+
+type stopParser struct {
+	toks []string
+	pos  int
+}
+
+// next returns the next token, or "" at the end of the condition.
+func (p *stopParser) next() string {
+	if p.pos == len(p.toks) {
+		return ""
+	}
+	p.pos++
+	return p.toks[p.pos-1]
+}
+
+// peek returns the next token without consuming it.
+func (p *stopParser) peek() string {
+	if p.pos == len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *stopParser) expr() (stopCond, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x0 := x
+		x = func(vars map[string]float64) bool { return x0(vars) || y(vars) }
+	}
+	return x, nil
+}
+
+func (p *stopParser) and() (stopCond, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x0 := x
+		x = func(vars map[string]float64) bool { return x0(vars) && y(vars) }
+	}
+	return x, nil
+}
+
+func (p *stopParser) unary() (stopCond, error) {
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "!":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(vars map[string]float64) bool { return !x(vars) }, nil
+	case "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok != ")" {
+			return nil, fmt.Errorf("expected ), found %q", tok)
+		}
+		return x, nil
+	default:
+		return p.comparison(tok)
+	}
+}
+
+// comparison parses the rest of a comparison of the variable name.
+func (p *stopParser) comparison(name string) (stopCond, error) {
+	known := false
+	for _, v := range stopVars {
+		known = known || v == name
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown variable %q, expected one of %s", name, strings.Join(stopVars, ", "))
+	}
+	op := p.next()
+	var cmp func(x, y float64) bool
+	switch op {
+	case "<":
+		cmp = func(x, y float64) bool { return x < y }
+	case "<=":
+		cmp = func(x, y float64) bool { return x <= y }
+	case ">":
+		cmp = func(x, y float64) bool { return x > y }
+	case ">=":
+		cmp = func(x, y float64) bool { return x >= y }
+	case "==":
+		cmp = func(x, y float64) bool { return x == y }
+	case "!=":
+		cmp = func(x, y float64) bool { return x != y }
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s, found %q", name, op)
+	}
+	value := p.next()
+	var y float64
+	if name == "elapsed" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("elapsed must be compared to a duration, like 4h, not %q", value)
+		}
+		y = d.Seconds()
+	} else {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be compared to a count, not %q", name, value)
+		}
+		y = float64(n)
+	}
+	return func(vars map[string]float64) bool { return cmp(vars[name], y) }, nil
+}
+
+// stopVarValues returns the current values of stopVars.
+func (s *session) stopVarValues() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vars := map[string]float64{
+		"pass":      float64(s.results[swarm.Pass.String()]),
+		"matched":   float64(s.results[swarm.FailMatched.String()]),
+		"unmatched": float64(s.results[swarm.FailUnmatched.String()]),
+		"errors":    float64(s.results[swarm.ExecutionError.String()]),
+		"elapsed":   time.Since(s.start).Seconds(),
+	}
+	vars["runs"] = vars["pass"] + vars["matched"] + vars["unmatched"]
+	return vars
+}
+
+// checkStopWhen drains the pool, once, if -stop-when holds.
+func checkStopWhen() {
+	if stopWhenCond == nil || stopWhenHeld.Load() || !stopWhenCond(sess.stopVarValues()) {
+		return
+	}
+	if stopWhenHeld.CompareAndSwap(false, true) {
+		log.Printf("Stopping after in-flight iterations, since -stop-when %s holds.", stopWhen)
+		sess.currentPool().DrainAll()
+	}
+}
+
+// startStopWhen checks -stop-when periodically, for conditions that can
+// start to hold between iterations. It returns a function that stops
+// checking.
+func startStopWhen() (stop func()) {
+	if stopWhenCond == nil {
+		return func() {}
+	}
+	t := time.NewTicker(stopWhenInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				checkStopWhen()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStopTokens(t *testing.T) {
+	got, err := stopTokens("!(matched>=3||runs<1000)&&elapsed>1h30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"!", "(", "matched", ">=", "3", "||", "runs", "<", "1000", ")", "&&", "elapsed", ">", "1h30m"}
+	if !slices.Equal(got, want) {
+		t.Errorf("stopTokens = %q, want %q", got, want)
+	}
+}
+
+func TestParseStopCond(t *testing.T) {
+	tests := []struct {
+		cond string
+		vars map[string]float64
+		want bool
+	}{
+		{"matched>=3", map[string]float64{"matched": 3}, true},
+		{"matched>=3", map[string]float64{"matched": 2}, false},
+		{"runs == 10", map[string]float64{"runs": 10}, true},
+		{"runs != 10", map[string]float64{"runs": 10}, false},
+		{"pass < 1", nil, true},
+		{"unmatched <= 1", map[string]float64{"unmatched": 2}, false},
+		{"errors > 0", map[string]float64{"errors": 1}, true},
+		{"elapsed > 4h", map[string]float64{"elapsed": 4*3600 + 1}, true},
+		{"elapsed > 4h", map[string]float64{"elapsed": 3600}, false},
+		{"elapsed >= 90s", map[string]float64{"elapsed": 90}, true},
+
+		// && binds more tightly than ||.
+		{"matched>0 || runs>0 && pass>0", map[string]float64{"matched": 1}, true},
+		{"matched>0 || runs>0 && pass>0", map[string]float64{"runs": 1}, false},
+		{"(matched>0 || runs>0) && pass>0", map[string]float64{"matched": 1}, false},
+		{"runs>0 && pass>0 || matched>0", map[string]float64{"matched": 1}, true},
+
+		// ! binds more tightly than && and ||.
+		{"!matched>0", nil, true},
+		{"!matched>0", map[string]float64{"matched": 1}, false},
+		{"!matched>0 && runs>0", map[string]float64{"runs": 1}, true},
+		{"!(matched>0 || runs>0)", map[string]float64{"runs": 1}, false},
+		{"!!runs>0", map[string]float64{"runs": 1}, true},
+		{"((runs>0))", map[string]float64{"runs": 1}, true},
+	}
+	for _, tt := range tests {
+		c, err := parseStopCond(tt.cond)
+		if err != nil {
+			t.Errorf("parseStopCond(%q): %v", tt.cond, err)
+			continue
+		}
+		if got := c(tt.vars); got != tt.want {
+			t.Errorf("parseStopCond(%q)(%v) = %v, want %v", tt.cond, tt.vars, got, tt.want)
+		}
+	}
+}
+
+func TestParseStopCondError(t *testing.T) {
+	tests := []struct {
+		cond string
+		err  string
+	}{
+		{"", "unexpected end"},
+		{"(runs>1", "expected ), found \"\""},
+		{"runs>1)", "unexpected \")\""},
+		{"((runs>1)", "expected )"},
+		{"runs>1 &&", "unexpected end"},
+		{"runs>1 ||", "unexpected end"},
+		{"!", "unexpected end"},
+		{"runs>", "must be compared to a count"},
+		{"runs 1", "expected a comparison after runs"},
+		{"failures>1", "unknown variable \"failures\""},
+		{"elapsed>3", "elapsed must be compared to a duration"},
+		{"elapsed>soon", "elapsed must be compared to a duration"},
+		{"runs>1h", "runs must be compared to a count"},
+		{"runs>-1", "unexpected \"-\""},
+		{"runs>1 runs>2", "unexpected \"runs\""},
+	}
+	for _, tt := range tests {
+		_, err := parseStopCond(tt.cond)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseStopCond(%q) = %v, want an error containing %q", tt.cond, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// writeSummary writes a summary of the session, and where to find what it
+// collected, for when it ends.
+func (st *sessionStatus) writeSummary(w io.Writer) {
+	fmt.Fprintf(w, "Session summary:\n")
+	fmt.Fprintf(w, "  ran for %s: %d iterations (pass %d, unmatched %d, matched %d, errors %d)\n",
+		time.Since(st.Start).Round(time.Second),
+		st.iterations(),
+		st.Results[swarm.Pass.String()],
+		st.Results[swarm.FailUnmatched.String()],
+		st.Results[swarm.FailMatched.String()],
+		st.Results[swarm.ExecutionError.String()])
+	if d := st.detection(); d != "" {
+		fmt.Fprintf(w, "  detection: %s\n", d)
+	}
+	if st.Timing != nil {
+		st.Timing.write(w)
+	}
+	// When sessions are slow to start, these tell whether the
+	// coordinator or the instances are to blame.
+	st.CreateTiming.writePercentiles(w, "create")
+	st.PushTiming.writePercentiles(w, "push")
+	st.writeQuotaCap(w)
+	st.writeBuilderTime(w)
+	st.writeArtifactBudget(w)
+	st.writePass(w)
+	if len(st.Failures) == 0 {
+		fmt.Fprintf(w, "  no matching failures\n")
+	} else {
+		fmt.Fprintf(w, "  matching failures:\n")
+		for _, f := range st.Failures {
+			fmt.Fprintf(w, "    %s: %s", f.Instance, strings.Join(f.artifacts(), ", "))
+			if f.Archive == "" && f.Bundle == "" && f.ArchiveNote != "" {
+				fmt.Fprintf(w, " (no archive: %s)", f.ArchiveNote)
+			}
+			if f.Known != "" {
+				fmt.Fprintf(w, " [matches %s]", f.Known)
+			}
+			if f.Slow {
+				fmt.Fprintf(w, " [slower than %s]", failSlower)
+			}
+			fmt.Fprintf(w, " [seed %d]", f.Seed)
+			if f.Shuffle != 0 {
+				fmt.Fprintf(w, " [shuffle %d]", f.Shuffle)
+			}
+			if f.GODEBUG != "" {
+				fmt.Fprintf(w, " [GODEBUG %s]", f.GODEBUG)
+			}
+			if f.ExitStatus != "" {
+				fmt.Fprintf(w, " [%s]", f.ExitStatus)
+			}
+			if f.Hang != "" {
+				fmt.Fprintf(w, " [hang %s]", f.Hang)
+			}
+			if len(f.Tests) > 0 {
+				fmt.Fprintf(w, " [failed %s]", strings.Join(f.Tests, ", "))
+			}
+			if f.Reruns > 0 {
+				fmt.Fprintf(w, " [reproduced %d/%d reruns]", f.RerunFailures, f.Reruns)
+			}
+			if f.Command != "" {
+				fmt.Fprintf(w, " [command %s]", f.Command)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	st.writeFailedTests(w)
+	st.writePerType(w)
+	st.writePerCommand(w)
+	st.writePerShuffle(w)
+	st.writePerGODEBUG(w)
+	st.writeSkipped(w)
+	st.writePerInstance(w)
+	st.writeQuarantined(w)
+	st.writeBuildFailures(w)
+	st.writeHangs(w)
+	if len(st.Unmatched) > 0 {
+		fmt.Fprintf(w, "  unmatched failure outputs:\n")
+		for _, u := range st.Unmatched {
+			fmt.Fprintf(w, "    %s (%d times)\n", u.Path, u.Count)
+		}
+	}
+}
+
+// printSummary prints a summary of the session, if there is one, to w
+// unless logging is disabled, and to -log-file.
+func printSummary(w io.Writer) {
+	if sess == nil {
+		return
+	}
+	if logFileOut != nil {
+		// The log file is at full verbosity.
+		sess.status().writeSummary(logFileOut)
+	}
+	if verbosity == 0 {
+		return
+	}
+	sess.status().writeSummary(w)
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Backend provides the instances a swarm runs on.
+type Backend interface {
+	// Create creates an instance of type typ, returning its name.
+	Create(ctx context.Context, typ string) (string, error)
+
+	// Push pushes GOROOT to inst.
+	Push(ctx context.Context, inst string) error
+
+	// Run runs cmd in inst's work directory with the additional environment
+	// variables env, returning its combined output. If the command fails,
+	// the error implements ExitCode() int, like *ExitError. If it can't be
+	// run because of a problem with the instance, the error is an
+	// *InfraError or a *LostBuilderError. If ctx is done before the command
+	// finishes, the error wraps ctx.Err() instead.
+	Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error)
+
+	// Destroy destroys inst.
+	Destroy(ctx context.Context, inst string) error
+
+	// List lists the user's instances.
+	List(ctx context.Context) ([]gomote.Instance, error)
+}
+
+// Backends may implement any of the following interfaces, for features
+// beyond running the command.
+type (
+	// Typer lists the valid instance types.
+	Typer interface {
+		InstanceTypes(ctx context.Context) ([]string, error)
+	}
+
+	// Archiver writes a gzipped tar archive of inst's work directory to w.
+	Archiver interface {
+		Get(ctx context.Context, inst string, w io.Writer) error
+	}
+
+	// DirArchiver writes a gzipped tar archive of dir, relative to inst's
+	// work directory, to w, with paths relative to dir.
+	DirArchiver interface {
+		GetDir(ctx context.Context, inst, dir string, w io.Writer) error
+	}
+
+	// Remover removes paths, relative to inst's work directory.
+	Remover interface {
+		Rm(ctx context.Context, inst string, paths ...string) error
+	}
+
+	// DiskReporter reports the disk space, in bytes, used by and free in
+	// inst's work directory.
+	DiskReporter interface {
+		DiskUsage(ctx context.Context, inst string) (int64, error)
+		FreeDisk(ctx context.Context, inst string) (int64, error)
+	}
+
+	// Putter copies the local file src to dst, relative to inst's work
+	// directory, with permissions mode.
+	Putter interface {
+		Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error
+	}
+
+	// BatchCreator creates n instances of type typ at once, returning
+	// the names of those it created, even if it fails partway.
+	BatchCreator interface {
+		CreateBatch(ctx context.Context, typ string, n int) ([]string, error)
+	}
+
+	// Bootstrapper pushes a bootstrap toolchain, for building Go from
+	// source, to inst.
+	Bootstrapper interface {
+		PutBootstrap(ctx context.Context, inst string) error
+	}
+
+	// Pinger keeps inst alive while it's idle.
+	Pinger interface {
+		Ping(ctx context.Context, inst string) error
+	}
+
+	// RemoteDesktop forwards remote desktop connections from the local
+	// address listen to inst, a Windows instance, until ctx is done.
+	RemoteDesktop interface {
+		RDP(ctx context.Context, inst, listen string) error
+	}
+)
+
+// Gomote is the Backend that uses the gomote command, with the default
+// options.
+var Gomote Backend = GomoteBackend{}
+
+// GomoteBackend is a Backend that uses the gomote command.
+type GomoteBackend struct {
+	// Dir is the directory commands run in, relative to the instance's
+	// work directory. By default, it's the directory of the command.
+	Dir string
+
+	// RunArgs are extra flags passed verbatim to every gomote run.
+	RunArgs []string
+
+	// GOROOT is the Go tree pushed to each instance. If empty, it's
+	// $GOROOT.
+	GOROOT string
+
+	// CreateArgs are extra flags passed to gomote create, by instance type.
+	CreateArgs map[string][]string
+}
+
+func (g GomoteBackend) Create(ctx context.Context, typ string) (string, error) {
+	return gomote.Create(ctx, typ, g.CreateArgs[typ]...)
+}
+
+func (g GomoteBackend) CreateBatch(ctx context.Context, typ string, n int) ([]string, error) {
+	return gomote.CreateBatch(ctx, typ, n, g.CreateArgs[typ]...)
+}
+
+func (g GomoteBackend) Push(ctx context.Context, inst string) error {
+	return gomote.Push(ctx, inst, pushRoot(g.GOROOT))
+}
+
+func (g GomoteBackend) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	var flags []string
+	if g.Dir != "" {
+		flags = append(flags, "-dir", g.Dir)
+	}
+	flags = append(flags, g.RunArgs...)
+	return gomote.Run(ctx, inst, env, flags, cmd...)
+}
+
+func (GomoteBackend) Destroy(ctx context.Context, inst string) error {
+	return gomote.Destroy(ctx, inst)
+}
+
+func (GomoteBackend) List(ctx context.Context) ([]gomote.Instance, error) {
+	return gomote.List(ctx)
+}
+
+func (GomoteBackend) InstanceTypes(ctx context.Context) ([]string, error) {
+	return gomote.InstanceTypes(ctx)
+}
+
+func (GomoteBackend) Get(ctx context.Context, inst string, w io.Writer) error {
+	return gomote.Get(ctx, inst, w)
+}
+
+func (GomoteBackend) GetDir(ctx context.Context, inst, dir string, w io.Writer) error {
+	return gomote.GetDir(ctx, inst, dir, w)
+}
+
+func (GomoteBackend) Rm(ctx context.Context, inst string, paths ...string) error {
+	return gomote.Rm(ctx, inst, paths...)
+}
+
+func (GomoteBackend) DiskUsage(ctx context.Context, inst string) (int64, error) {
+	return gomote.DiskUsage(ctx, inst)
+}
+
+func (GomoteBackend) FreeDisk(ctx context.Context, inst string) (int64, error) {
+	return gomote.FreeDisk(ctx, inst)
+}
+
+func (GomoteBackend) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	return gomote.Put(ctx, inst, src, dst, mode)
+}
+
+func (GomoteBackend) PutBootstrap(ctx context.Context, inst string) error {
+	return gomote.PutBootstrap(ctx, inst)
+}
+
+func (GomoteBackend) Ping(ctx context.Context, inst string) error {
+	return gomote.Ping(ctx, inst)
+}
+
+func (GomoteBackend) RDP(ctx context.Context, inst, listen string) error {
+	return gomote.RDP(ctx, inst, listen)
+}
+
+// pushRoot returns the Go tree to push: goroot, or $GOROOT if it's empty.
+func pushRoot(goroot string) string {
+	if goroot != "" {
+		return goroot
+	}
+	return os.Getenv("GOROOT")
+}
+
+// ExitError is the error returned by a Backend's Run when the command
+// exits with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the command's exit status.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Container is a Backend that runs each instance as a Linux container on
+// this machine, with Docker or Podman, to burn local cores rather than
+// shared builder capacity. An instance type like linux-arm64 selects the
+// container's platform, linux/arm64; running a foreign architecture needs
+// emulation set up for the runtime.
+//
+// As on a gomote, the work directory is /workdir and GOROOT is pushed to
+// /workdir/go. The image needs sleep, rm, and tar.
+type Container struct {
+	Runtime string // docker or podman; if empty, docker
+	Image   string // image to run
+
+	// GOROOT is the Go tree pushed to each instance. If empty, it's
+	// $GOROOT.
+	GOROOT string
+
+	mu   sync.Mutex
+	next int
+}
+
+// containerWorkdir is the work directory in every container.
+const containerWorkdir = "/workdir"
+
+// containerTypeLabel is the label recording a container's instance type.
+const containerTypeLabel = "goswarm.type"
+
+// linuxArches are the architectures of the instance types offered by
+// backends that run linux images, like Container.
+var linuxArches = []string{"386", "amd64", "arm", "arm64", "ppc64le", "riscv64", "s390x"}
+
+// linuxTypes returns the instance types offered by backends that run linux
+// images.
+func linuxTypes() []string {
+	var typs []string
+	for _, arch := range linuxArches {
+		typs = append(typs, "linux-"+arch)
+	}
+	return typs
+}
+
+// linuxArch returns the architecture of a linux instance type, like arm64
+// for linux-arm64 or linux-arm64-longtest.
+func linuxArch(typ string) (string, error) {
+	goos, arch, ok := strings.Cut(typ, "-")
+	if !ok || goos != "linux" {
+		return "", fmt.Errorf("only linux instance types are supported, not %s", typ)
+	}
+	arch, _, _ = strings.Cut(arch, "-")
+	return arch, nil
+}
+
+func (c *Container) runtime() string {
+	if c.Runtime == "" {
+		return "docker"
+	}
+	return c.Runtime
+}
+
+// command runs the container runtime with args, returning its combined
+// output.
+func (c *Container) command(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, c.runtime(), args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %v: %s", c.runtime(), args[0], err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// InstanceTypes implements Typer.
+func (c *Container) InstanceTypes(ctx context.Context) ([]string, error) {
+	return linuxTypes(), nil
+}
+
+func (c *Container) Create(ctx context.Context, typ string) (string, error) {
+	goarch, err := linuxArch(typ)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	name := fmt.Sprintf("goswarm-%d-%d", os.Getpid(), c.next)
+	c.next++
+	c.mu.Unlock()
+	_, err = c.command(ctx, "run", "--detach", "--init",
+		"--name", name,
+		"--label", containerTypeLabel+"="+typ,
+		"--platform", "linux/"+goarch,
+		"--workdir", containerWorkdir,
+		c.Image, "sleep", "infinity")
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *Container) Push(ctx context.Context, inst string) error {
+	goroot := pushRoot(c.GOROOT)
+	if goroot == "" {
+		return errors.New("GOROOT is not set")
+	}
+	if _, err := c.command(ctx, "exec", inst, "rm", "-rf", containerWorkdir+"/go"); err != nil {
+		return err
+	}
+	_, err := c.command(ctx, "cp", goroot, inst+":"+containerWorkdir+"/go")
+	return err
+}
+
+// containerErrors are substrings of the runtime's output indicating that
+// the container is gone.
+var containerErrors = []string{
+	"no such container",
+	"is not running",
+}
+
+func (c *Container) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	args := []string{"exec"}
+	for _, v := range env {
+		args = append(args, "--env", v)
+	}
+	args = append(args, inst)
+	args = append(args, cmd...)
+	out, err := exec.CommandContext(ctx, c.runtime(), args...).CombinedOutput()
+	if err := canceled(ctx, inst, err); err != nil {
+		return out, err
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return out, err
+	}
+	msg := strings.ToLower(string(out))
+	for _, s := range containerErrors {
+		if strings.Contains(msg, s) {
+			return out, &LostBuilderError{inst}
+		}
+	}
+	return out, &ExitError{Code: ee.ExitCode()}
+}
+
+func (c *Container) Destroy(ctx context.Context, inst string) error {
+	_, err := c.command(ctx, "rm", "--force", inst)
+	return err
+}
+
+func (c *Container) List(ctx context.Context) ([]gomote.Instance, error) {
+	out, err := c.command(ctx, "ps", "--filter", "label="+containerTypeLabel,
+		"--format", `{{.Names}}	{{.Label "`+containerTypeLabel+`"}}`)
+	if err != nil {
+		return nil, err
+	}
+	var insts []gomote.Instance
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, typ, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		insts = append(insts, gomote.Instance{Name: name, Type: typ})
+	}
+	return insts, nil
+}
+
+// Get implements Archiver.
+func (c *Container) Get(ctx context.Context, inst string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, c.runtime(), "exec", inst, "tar", "czf", "-", "-C", containerWorkdir, ".")
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s exec: %v: %s", c.runtime(), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// Put implements Putter.
+func (c *Container) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	dst = containerWorkdir + "/" + dst
+	if _, err := c.command(ctx, "cp", src, inst+":"+dst); err != nil {
+		return err
+	}
+	_, err := c.command(ctx, "exec", inst, "chmod", fmt.Sprintf("%o", mode.Perm()), dst)
+	return err
+}
+
+// Rm implements Remover.
+func (c *Container) Rm(ctx context.Context, inst string, paths ...string) error {
+	args := []string{"exec", "--workdir", containerWorkdir, inst, "rm", "-rf", "--"}
+	_, err := c.command(ctx, append(args, paths...)...)
+	return err
+}
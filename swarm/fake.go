@@ -0,0 +1,184 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Fake is a deterministic, in-memory Backend, for testing code that drives
+// a swarm without any real instances. The zero value is ready to use, and
+// every run passes.
+type Fake struct {
+	// Outcome returns the outcome of the nth run, counting from 0, on the
+	// instance with the given name. If nil, every run passes.
+	Outcome func(inst string, n int) FakeOutcome
+
+	// CreateFailures and PushFailures are how many times Create and Push
+	// fail before succeeding.
+	CreateFailures int
+	PushFailures   int
+
+	// Latency, if non-nil, returns how long an operation takes, given its
+	// name: "create", "push", "run", or "destroy".
+	Latency func(op string) time.Duration
+
+	mu    sync.Mutex
+	next  int                      // number of instances created
+	insts map[string]*fakeInstance // live instances
+	calls []string
+}
+
+// FakeOutcome is the outcome of a run on a Fake.
+type FakeOutcome struct {
+	Output   string
+	ExitCode int   // if non-zero, Run returns an *ExitError
+	Err      error // if non-nil, Run returns it, as if the command didn't run
+}
+
+type fakeInstance struct {
+	typ    string
+	pushed bool
+	runs   int
+}
+
+// Calls returns the operations performed on f, in order, such as
+// "create linux-amd64" or "run fake-linux-amd64-0".
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *Fake) record(format string, args ...any) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+// wait waits out the latency of op.
+func (f *Fake) wait(ctx context.Context, op string) error {
+	if f.Latency == nil {
+		return nil
+	}
+	select {
+	case <-time.After(f.Latency(op)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *Fake) Create(ctx context.Context, typ string) (string, error) {
+	if err := f.wait(ctx, "create"); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("create %s", typ)
+	if f.CreateFailures > 0 {
+		f.CreateFailures--
+		return "", fmt.Errorf("fake: failed to create instance of %s", typ)
+	}
+	if f.insts == nil {
+		f.insts = make(map[string]*fakeInstance)
+	}
+	inst := fmt.Sprintf("fake-%s-%d", typ, f.next)
+	f.next++
+	f.insts[inst] = &fakeInstance{typ: typ}
+	return inst, nil
+}
+
+func (f *Fake) Push(ctx context.Context, inst string) error {
+	if err := f.wait(ctx, "push"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("push %s", inst)
+	fi, ok := f.insts[inst]
+	if !ok {
+		return fmt.Errorf("fake: no instance %s", inst)
+	}
+	if f.PushFailures > 0 {
+		f.PushFailures--
+		return fmt.Errorf("fake: failed to push to %s", inst)
+	}
+	fi.pushed = true
+	return nil
+}
+
+// Put implements Putter. The file isn't copied anywhere.
+func (f *Fake) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	if err := f.wait(ctx, "put"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("put %s %s %s", inst, src, dst)
+	if _, ok := f.insts[inst]; !ok {
+		return fmt.Errorf("fake: no instance %s", inst)
+	}
+	return nil
+}
+
+func (f *Fake) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	if err := f.wait(ctx, "run"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.record("run %s %s", inst, strings.Join(cmd, " "))
+	fi, ok := f.insts[inst]
+	if !ok {
+		f.mu.Unlock()
+		return nil, &LostBuilderError{inst}
+	}
+	n := fi.runs
+	fi.runs++
+	f.mu.Unlock()
+
+	if f.Outcome == nil {
+		return nil, nil
+	}
+	o := f.Outcome(inst, n)
+	if o.Err != nil {
+		return []byte(o.Output), o.Err
+	}
+	if o.ExitCode != 0 {
+		return []byte(o.Output), &ExitError{Code: o.ExitCode}
+	}
+	return []byte(o.Output), nil
+}
+
+func (f *Fake) Destroy(ctx context.Context, inst string) error {
+	if err := f.wait(ctx, "destroy"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("destroy %s", inst)
+	if _, ok := f.insts[inst]; !ok {
+		return fmt.Errorf("fake: no instance %s", inst)
+	}
+	delete(f.insts, inst)
+	return nil
+}
+
+func (f *Fake) List(ctx context.Context) ([]gomote.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var insts []gomote.Instance
+	for name, fi := range f.insts {
+		insts = append(insts, gomote.Instance{Name: name, Type: fi.typ})
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i].Name < insts[j].Name })
+	return insts, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Kubernetes is a Backend that runs each instance as a pod on a Kubernetes
+// cluster, with kubectl, for pools far larger than the gomote fleet can
+// provide. An instance type like linux-arm64 schedules the pod on a linux
+// node of that architecture.
+//
+// As on a gomote, the work directory is /workdir and GOROOT is pushed to
+// /workdir/go. The image needs sleep, sh, rm, and tar.
+type Kubernetes struct {
+	Context   string // kubeconfig context; if empty, the current context
+	Namespace string // if empty, the context's namespace
+	Image     string // image to run
+
+	// CPU and Memory, if set, are the resources requested for every pod,
+	// in Kubernetes' quantity format, like "2" or "4Gi".
+	CPU    string
+	Memory string
+
+	// GOROOT is the Go tree pushed to each instance. If empty, it's
+	// $GOROOT.
+	GOROOT string
+
+	mu     sync.Mutex
+	prefix string // prefix of pod names, unique to this Kubernetes
+	next   int
+}
+
+// podTypeLabel is the label recording a pod's instance type.
+const podTypeLabel = "goswarm.type"
+
+// podReadyTimeout is how long to wait for a pod to be scheduled and start.
+const podReadyTimeout = "15m"
+
+// kubectl returns a kubectl command with args, for the configured context
+// and namespace.
+func (k *Kubernetes) kubectl(ctx context.Context, args ...string) *exec.Cmd {
+	var flags []string
+	if k.Context != "" {
+		flags = append(flags, "--context", k.Context)
+	}
+	if k.Namespace != "" {
+		flags = append(flags, "--namespace", k.Namespace)
+	}
+	return exec.CommandContext(ctx, "kubectl", append(flags, args...)...)
+}
+
+// command runs kubectl with args, returning its combined output.
+func (k *Kubernetes) command(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := k.kubectl(ctx, args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("kubectl %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// InstanceTypes implements Typer.
+func (k *Kubernetes) InstanceTypes(ctx context.Context) ([]string, error) {
+	return linuxTypes(), nil
+}
+
+func (k *Kubernetes) Create(ctx context.Context, typ string) (string, error) {
+	goarch, err := linuxArch(typ)
+	if err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	if k.prefix == "" {
+		// Pods from different machines share the cluster, so a PID
+		// isn't unique enough.
+		b := make([]byte, 4)
+		rand.Read(b)
+		k.prefix = "goswarm-" + hex.EncodeToString(b)
+	}
+	name := fmt.Sprintf("%s-%d", k.prefix, k.next)
+	k.next++
+	k.mu.Unlock()
+
+	container := map[string]any{
+		"name":       name,
+		"image":      k.Image,
+		"command":    []string{"sleep", "infinity"},
+		"workingDir": containerWorkdir,
+	}
+	if k.CPU != "" || k.Memory != "" {
+		requests := make(map[string]string)
+		if k.CPU != "" {
+			requests["cpu"] = k.CPU
+		}
+		if k.Memory != "" {
+			requests["memory"] = k.Memory
+		}
+		container["resources"] = map[string]any{"requests": requests}
+	}
+	overrides, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"nodeSelector": map[string]string{
+				"kubernetes.io/os":   "linux",
+				"kubernetes.io/arch": goarch,
+			},
+			"containers": []any{container},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = k.command(ctx, "run", name,
+		"--image", k.Image,
+		"--restart", "Never",
+		"--labels", podTypeLabel+"="+typ,
+		"--overrides", string(overrides))
+	if err != nil {
+		return "", err
+	}
+	if _, err := k.command(ctx, "wait", "--for=condition=Ready", "pod/"+name, "--timeout", podReadyTimeout); err != nil {
+		k.Destroy(context.Background(), name)
+		return "", err
+	}
+	return name, nil
+}
+
+func (k *Kubernetes) Push(ctx context.Context, inst string) error {
+	goroot := pushRoot(k.GOROOT)
+	if goroot == "" {
+		return errors.New("GOROOT is not set")
+	}
+	if _, err := k.command(ctx, "exec", inst, "--", "rm", "-rf", containerWorkdir+"/go"); err != nil {
+		return err
+	}
+	_, err := k.command(ctx, "cp", goroot, inst+":"+containerWorkdir+"/go")
+	return err
+}
+
+// kubectlLostErrors and kubectlInfraErrors are substrings of kubectl's
+// output indicating that the pod is gone, or that kubectl couldn't reach
+// the cluster.
+var (
+	kubectlLostErrors  = []string{"notfound", "not found", "container not found", "pod does not exist"}
+	kubectlInfraErrors = []string{"unable to connect to the server", "connection refused", "i/o timeout", "tls handshake timeout", "error dialing backend"}
+)
+
+func (k *Kubernetes) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	args := []string{"exec", inst, "--", "env"}
+	args = append(args, env...)
+	args = append(args, cmd...)
+	out, err := k.kubectl(ctx, args...).CombinedOutput()
+	if err := canceled(ctx, inst, err); err != nil {
+		return out, err
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return out, err
+	}
+	// kubectl reports its own errors last.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	last := strings.ToLower(lines[len(lines)-1])
+	if !strings.HasPrefix(last, "command terminated with exit code") {
+		for _, s := range kubectlInfraErrors {
+			if strings.Contains(last, s) {
+				return out, &InfraError{Instance: inst, Output: out}
+			}
+		}
+		for _, s := range kubectlLostErrors {
+			if strings.Contains(last, s) {
+				return out, &LostBuilderError{inst}
+			}
+		}
+	}
+	return out, &ExitError{Code: ee.ExitCode()}
+}
+
+func (k *Kubernetes) Destroy(ctx context.Context, inst string) error {
+	_, err := k.command(ctx, "delete", "pod", inst, "--wait=false", "--ignore-not-found")
+	return err
+}
+
+func (k *Kubernetes) List(ctx context.Context) ([]gomote.Instance, error) {
+	out, err := k.command(ctx, "get", "pods", "--selector", podTypeLabel, "--no-headers",
+		"--output", `custom-columns=NAME:.metadata.name,TYPE:.metadata.labels.goswarm\.type`)
+	if err != nil {
+		return nil, err
+	}
+	var insts []gomote.Instance
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		insts = append(insts, gomote.Instance{Name: fields[0], Type: fields[1]})
+	}
+	return insts, nil
+}
+
+// Get implements Archiver.
+func (k *Kubernetes) Get(ctx context.Context, inst string, w io.Writer) error {
+	cmd := k.kubectl(ctx, "exec", inst, "--", "tar", "czf", "-", "-C", containerWorkdir, ".")
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kubectl exec: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// Put implements Putter.
+func (k *Kubernetes) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	dst = containerWorkdir + "/" + dst
+	if _, err := k.command(ctx, "cp", src, inst+":"+dst); err != nil {
+		return err
+	}
+	_, err := k.command(ctx, "exec", inst, "--", "chmod", fmt.Sprintf("%o", mode.Perm()), dst)
+	return err
+}
+
+// Rm implements Remover.
+func (k *Kubernetes) Rm(ctx context.Context, inst string, paths ...string) error {
+	args := []string{"exec", inst, "--", "sh", "-c", `cd ` + containerWorkdir + ` && rm -rf -- "$@"`, "sh"}
+	_, err := k.command(ctx, append(args, paths...)...)
+	return err
+}
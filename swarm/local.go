@@ -0,0 +1,212 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Local is a Backend that runs the command in subprocesses on this machine,
+// each "instance" being a temporary work directory. Pushing to an instance
+// links $GOROOT into its work directory as go, like on a gomote. The
+// instance type is ignored.
+//
+// The zero value is ready to use.
+type Local struct {
+	// GOROOT is the Go tree pushed to each instance. If empty, it's
+	// $GOROOT.
+	GOROOT string
+
+	mu   sync.Mutex
+	next int
+	dirs map[string]string // work directory of each live instance
+}
+
+func (l *Local) dir(inst string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dir, ok := l.dirs[inst]
+	if !ok {
+		return "", &LostBuilderError{inst}
+	}
+	return dir, nil
+}
+
+func (l *Local) Create(ctx context.Context, typ string) (string, error) {
+	dir, err := os.MkdirTemp("", "goswarm-")
+	if err != nil {
+		return "", err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dirs == nil {
+		l.dirs = make(map[string]string)
+	}
+	inst := fmt.Sprintf("local-%d", l.next)
+	l.next++
+	l.dirs[inst] = dir
+	return inst, nil
+}
+
+func (l *Local) Push(ctx context.Context, inst string) error {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return err
+	}
+	goroot := pushRoot(l.GOROOT)
+	if goroot == "" {
+		// Nothing to push. The command may not need a GOROOT.
+		return nil
+	}
+	err = os.Symlink(goroot, filepath.Join(dir, "go"))
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return nil, err
+	}
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Dir = dir // also where a relative cmd[0] is found
+	c.Env = append(os.Environ(), env...)
+	out, err := c.CombinedOutput()
+	if err := canceled(ctx, inst, err); err != nil {
+		return out, err
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return out, &ExitError{Code: ee.ExitCode()}
+	}
+	return out, err
+}
+
+func (l *Local) Destroy(ctx context.Context, inst string) error {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	delete(l.dirs, inst)
+	l.mu.Unlock()
+	return os.RemoveAll(dir)
+}
+
+func (l *Local) List(ctx context.Context) ([]gomote.Instance, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var insts []gomote.Instance
+	for inst := range l.dirs {
+		insts = append(insts, gomote.Instance{Name: inst, Type: "local"})
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i].Name < insts[j].Name })
+	return insts, nil
+}
+
+// Rm implements Remover.
+func (l *Local) Rm(ctx context.Context, inst string, paths ...string) error {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(filepath.Join(dir, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put implements Putter.
+func (l *Local) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	dst = filepath.Join(dir, dst)
+	if err := os.WriteFile(dst, b, mode); err != nil {
+		return err
+	}
+	// WriteFile leaves an existing file's mode alone.
+	return os.Chmod(dst, mode)
+}
+
+// Get implements Archiver. Symbolic links, like the one to GOROOT, are
+// archived as links.
+func (l *Local) Get(ctx context.Context, inst string, w io.Writer) error {
+	dir, err := l.dir(inst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
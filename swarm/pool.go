@@ -0,0 +1,148 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A Pool is a resizable set of goroutines, or slots, each driving one
+// instance at a time.
+type Pool struct {
+	eg  *errgroup.Group
+	ctx context.Context
+	run func(ctx context.Context, drain <-chan struct{}) error
+
+	mu       sync.Mutex
+	slots    []chan struct{} // drain channels of the running slots, oldest first
+	closed   bool
+	stopping chan struct{} // closed by DrainAll
+	empty    chan struct{} // closed once the last running slot exits
+	emptied  bool
+}
+
+// newPool creates a pool whose slots each execute run. run should return
+// promptly, at a convenient point, once its drain channel is closed.
+func newPool(ctx context.Context, run func(ctx context.Context, drain <-chan struct{}) error) *Pool {
+	eg, ctx := errgroup.WithContext(ctx)
+	return &Pool{eg: eg, ctx: ctx, run: run, stopping: make(chan struct{}), empty: make(chan struct{})}
+}
+
+// Size returns the number of running slots.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.slots)
+}
+
+// Resize grows or shrinks the pool to n slots. Shrinking drains the
+// most recently added slots. Once the pool is drained with DrainAll, or
+// every slot has exited on its own, it doesn't grow again.
+func (p *Pool) Resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	for len(p.slots) < n {
+		drain := make(chan struct{})
+		p.slots = append(p.slots, drain)
+		p.eg.Go(func() error {
+			defer p.remove(drain)
+			return p.run(p.ctx, drain)
+		})
+	}
+	for len(p.slots) > n {
+		last := len(p.slots) - 1
+		close(p.slots[last])
+		p.slots = p.slots[:last]
+	}
+}
+
+// remove forgets about a slot that has exited.
+func (p *Pool) remove(drain chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, d := range p.slots {
+		if d == drain {
+			p.slots = append(p.slots[:i], p.slots[i+1:]...)
+			if len(p.slots) == 0 && !p.emptied {
+				// Close the pool in the same step, so that a Resize
+				// can't start a slot once wait may be returning.
+				p.emptied = true
+				p.closed = true
+				close(p.empty)
+			}
+			return
+		}
+	}
+}
+
+// DrainAll drains every slot, and keeps the pool from growing again.
+func (p *Pool) DrainAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stopping)
+	for _, d := range p.slots {
+		close(d)
+	}
+	p.slots = nil
+}
+
+// Stopped returns a channel that's closed once the pool is drained with
+// DrainAll.
+func (p *Pool) Stopped() <-chan struct{} {
+	return p.stopping
+}
+
+// Exhausted returns a channel that's closed once every running slot has
+// exited on its own, such as when their instances all gave up, rather than
+// being drained.
+func (p *Pool) Exhausted() <-chan struct{} {
+	return p.empty
+}
+
+// Done returns a channel that's closed once the pool is stopped by an
+// error, or the context it was created with is done.
+func (p *Pool) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// WithDrain returns a context that's canceled once drain is closed, for
+// work that should be abandoned when a slot is drained.
+func WithDrain(ctx context.Context, drain <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-drain:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Go runs f alongside the pool's slots. The pool isn't done until f
+// returns, and an error from f stops the pool.
+func (p *Pool) Go(f func() error) {
+	p.eg.Go(f)
+}
+
+// wait waits for every slot to exit, returning the first error
+// returned by any of them.
+func (p *Pool) wait() error {
+	err := p.eg.Wait()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy describes how to retry a failing operation.
+type RetryPolicy struct {
+	Attempts   int           // maximum number of attempts
+	Backoff    time.Duration // backoff after the first attempt
+	MaxBackoff time.Duration
+	MaxElapsed time.Duration // 0 means no limit
+	Jitter     float64       // fraction of the backoff to randomize
+}
+
+// DefaultRetryPolicy is the retry policy used when none is given.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   5,
+	Backoff:    time.Second,
+	MaxBackoff: time.Minute,
+	MaxElapsed: 10 * time.Minute,
+	Jitter:     0.2,
+}
+
+// Do calls f until it succeeds, the policy gives up, or ctx is done.
+// It returns the last error from f.
+func (rp RetryPolicy) Do(ctx context.Context, f func() error) error {
+	start := time.Now()
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if i >= rp.Attempts || ctx.Err() != nil {
+			return err
+		}
+		wait := rp.Delay(i)
+		if rp.MaxElapsed > 0 && time.Since(start)+wait > rp.MaxElapsed {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Delay returns how long to wait after the given number of failed attempts.
+func (rp RetryPolicy) Delay(failures int) time.Duration {
+	backoff := rp.Backoff
+	for i := 1; i < failures && backoff < rp.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > rp.MaxBackoff {
+		backoff = rp.MaxBackoff
+	}
+	return rp.jittered(backoff)
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jittered randomizes d by up to the policy's jitter fraction in either
+// direction, so that instances failing together don't retry in lockstep.
+func (rp RetryPolicy) jittered(d time.Duration) time.Duration {
+	if rp.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	jitterMu.Lock()
+	f := jitterRand.Float64()*2 - 1
+	jitterMu.Unlock()
+	return d + time.Duration(f*rp.Jitter*float64(d))
+}
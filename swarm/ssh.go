@@ -0,0 +1,262 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// SSH is a Backend that drives a fixed set of hosts over SSH, for hardware
+// the build farm doesn't have. Each host is one instance, named after the
+// host, and can be in use by one swarm at a time.
+//
+// Pushing copies $GOROOT to the host's work directory with rsync, or scp if
+// rsync isn't installed. Destroying an instance removes its work directory
+// and releases the host. The hosts need a POSIX shell and the usual tools,
+// like tar, du, and df.
+type SSH struct {
+	// Hosts are the hosts of each instance type, as passed to ssh, like
+	// "user@host" or an alias from ~/.ssh/config.
+	Hosts map[string][]string
+
+	// Dir is the work directory on each host, relative to the home
+	// directory. If empty, it's "goswarm".
+	Dir string
+
+	// GOROOT is the Go tree pushed to each instance. If empty, it's
+	// $GOROOT.
+	GOROOT string
+
+	mu    sync.Mutex
+	inUse map[string]string // host -> instance type
+}
+
+// sshOptions are passed to every ssh command, so a host that wants a
+// password fails rather than hanging.
+var sshOptions = []string{"-o", "BatchMode=yes"}
+
+// sshConnectionError is ssh's exit status when it fails to connect.
+const sshConnectionError = 255
+
+func (s *SSH) dir() string {
+	if s.Dir == "" {
+		return "goswarm"
+	}
+	return s.Dir
+}
+
+// ssh runs script on host with sh, returning its combined output.
+func (s *SSH) ssh(ctx context.Context, host, script string) ([]byte, error) {
+	args := append(append([]string(nil), sshOptions...), host, script)
+	out, err := exec.CommandContext(ctx, "ssh", args...).CombinedOutput()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		if ee.ExitCode() == sshConnectionError {
+			return out, &InfraError{Instance: host, Output: out}
+		}
+		return out, &ExitError{Code: ee.ExitCode()}
+	}
+	return out, err
+}
+
+// sshError returns an error for a failed ssh command that isn't the
+// command under test.
+func sshError(op, host string, out []byte, err error) error {
+	if len(bytes.TrimSpace(out)) == 0 {
+		return fmt.Errorf("%s on %s: %v", op, host, err)
+	}
+	return fmt.Errorf("%s on %s: %v: %s", op, host, err, bytes.TrimSpace(out))
+}
+
+// InstanceTypes implements Typer.
+func (s *SSH) InstanceTypes(ctx context.Context) ([]string, error) {
+	var typs []string
+	for typ := range s.Hosts {
+		typs = append(typs, typ)
+	}
+	sort.Strings(typs)
+	return typs, nil
+}
+
+func (s *SSH) Create(ctx context.Context, typ string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inUse == nil {
+		s.inUse = make(map[string]string)
+	}
+	for _, host := range s.Hosts[typ] {
+		if _, ok := s.inUse[host]; !ok {
+			s.inUse[host] = typ
+			return host, nil
+		}
+	}
+	return "", fmt.Errorf("no free hosts of type %s", typ)
+}
+
+func (s *SSH) Push(ctx context.Context, inst string) error {
+	goroot := pushRoot(s.GOROOT)
+	if goroot == "" {
+		return errors.New("GOROOT is not set")
+	}
+	dir := ShellQuote(s.dir())
+	if out, err := s.ssh(ctx, inst, "rm -rf "+dir+"/go && mkdir -p "+dir); err != nil {
+		return sshError("push", inst, out, err)
+	}
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("rsync"); err == nil {
+		cmd = exec.CommandContext(ctx, "rsync", "-a", "--delete", "--exclude=.git",
+			"-e", "ssh "+strings.Join(sshOptions, " "),
+			goroot+"/", inst+":"+s.dir()+"/go/")
+	} else {
+		args := append([]string{"-r", "-q"}, sshOptions...)
+		args = append(args, goroot, inst+":"+s.dir()+"/go")
+		cmd = exec.CommandContext(ctx, "scp", args...)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return sshError("push", inst, out, err)
+	}
+	return nil
+}
+
+func (s *SSH) Run(ctx context.Context, inst string, env []string, cmd ...string) ([]byte, error) {
+	var script strings.Builder
+	fmt.Fprintf(&script, "cd %s && exec env", ShellQuote(s.dir()))
+	for _, v := range env {
+		script.WriteString(" " + ShellQuote(v))
+	}
+	for _, arg := range cmd {
+		script.WriteString(" " + ShellQuote(arg))
+	}
+	out, err := s.ssh(ctx, inst, script.String())
+	if err := canceled(ctx, inst, err); err != nil {
+		return out, err
+	}
+	return out, err
+}
+
+func (s *SSH) Destroy(ctx context.Context, inst string) error {
+	out, err := s.ssh(ctx, inst, "rm -rf "+ShellQuote(s.dir()))
+	s.mu.Lock()
+	delete(s.inUse, inst)
+	s.mu.Unlock()
+	if err != nil {
+		return sshError("destroy", inst, out, err)
+	}
+	return nil
+}
+
+func (s *SSH) List(ctx context.Context) ([]gomote.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var insts []gomote.Instance
+	for host, typ := range s.inUse {
+		insts = append(insts, gomote.Instance{Name: host, Type: typ})
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i].Name < insts[j].Name })
+	return insts, nil
+}
+
+// Get implements Archiver.
+func (s *SSH) Get(ctx context.Context, inst string, w io.Writer) error {
+	args := append(append([]string(nil), sshOptions...), inst, "tar czf - -C "+ShellQuote(s.dir())+" .")
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return sshError("gettar", inst, stderr.Bytes(), err)
+	}
+	return nil
+}
+
+// Rm implements Remover.
+func (s *SSH) Rm(ctx context.Context, inst string, paths ...string) error {
+	script := "cd " + ShellQuote(s.dir()) + " && rm -rf"
+	for _, p := range paths {
+		script += " " + ShellQuote(p)
+	}
+	if out, err := s.ssh(ctx, inst, script); err != nil {
+		return sshError("rm", inst, out, err)
+	}
+	return nil
+}
+
+// Put implements Putter.
+func (s *SSH) Put(ctx context.Context, inst, src, dst string, mode fs.FileMode) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst = ShellQuote(s.dir() + "/" + dst)
+	script := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s", ShellQuote(s.dir()), dst, mode.Perm(), dst)
+	args := append(append([]string(nil), sshOptions...), inst, script)
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = f
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return sshError("put", inst, out, err)
+	}
+	return nil
+}
+
+// DiskUsage implements DiskReporter.
+func (s *SSH) DiskUsage(ctx context.Context, inst string) (int64, error) {
+	return s.kilobytes(ctx, inst, "du -sk "+ShellQuote(s.dir()), 0)
+}
+
+// FreeDisk implements DiskReporter.
+func (s *SSH) FreeDisk(ctx context.Context, inst string) (int64, error) {
+	return s.kilobytes(ctx, inst, "df -Pk "+ShellQuote(s.dir()), 3)
+}
+
+// kilobytes runs script on inst and parses the field of its last line
+// as a number of kilobytes, returning it in bytes.
+func (s *SSH) kilobytes(ctx context.Context, inst, script string, field int) (int64, error) {
+	out, err := s.ssh(ctx, inst, script)
+	if err != nil {
+		return 0, sshError(strings.Fields(script)[0], inst, out, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) <= field {
+		return 0, fmt.Errorf("unexpected output: %q", lines[len(lines)-1])
+	}
+	kb, err := strconv.ParseInt(fields[field], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output: %q", lines[len(lines)-1])
+	}
+	return kb << 10, nil
+}
+
+// Ping implements Pinger.
+func (s *SSH) Ping(ctx context.Context, inst string) error {
+	if out, err := s.ssh(ctx, inst, "true"); err != nil {
+		return sshError("ping", inst, out, err)
+	}
+	return nil
+}
+
+// ShellQuote quotes s for use as a single POSIX shell word, if necessary.
+func ShellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
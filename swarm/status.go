@@ -0,0 +1,178 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/mknyszek/goswarm/gomote"
+)
+
+// Status is the outcome of one iteration of the command.
+type Status int
+
+const (
+	ExecutionError Status = iota // the command did not run due to an external error
+	Pass                         // the command passed
+	FailUnmatched                // the command failed, but not in the way being looked for
+	FailMatched                  // the command failed in the way being looked for
+)
+
+func (s Status) String() string {
+	switch s {
+	case ExecutionError:
+		return "error"
+	case Pass:
+		return "pass"
+	case FailUnmatched:
+		return "unmatched"
+	case FailMatched:
+		return "matched"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// CleanPolicy says when to destroy instances. It implements flag.Value.
+type CleanPolicy string
+
+const (
+	CleanOff    CleanPolicy = "off"    // do not clean up.
+	CleanStart  CleanPolicy = "start"  // clean up old instances before starting.
+	CleanExit   CleanPolicy = "exit"   // clean up instances created by the swarm on exit.
+	CleanAlways CleanPolicy = "always" // both CleanStart and CleanExit.
+)
+
+// AtStart reports whether old instances should be cleaned up at startup.
+func (c CleanPolicy) AtStart() bool {
+	return c == CleanStart || c == CleanAlways
+}
+
+// AtExit reports whether the swarm's instances should be cleaned up on exit.
+func (c CleanPolicy) AtExit() bool {
+	return c == CleanExit || c == CleanAlways
+}
+
+func (c *CleanPolicy) String() string {
+	if c == nil {
+		return ""
+	}
+	return string(*c)
+}
+
+func (c *CleanPolicy) Set(s string) error {
+	switch CleanPolicy(s) {
+	case CleanOff, CleanStart, CleanExit, CleanAlways:
+		*c = CleanPolicy(s)
+	default:
+		return fmt.Errorf("unknown clean mode %q", s)
+	}
+	return nil
+}
+
+// InfraError is a failure to run a command due to a problem communicating
+// with the instance, as opposed to a failure of the command.
+type InfraError struct {
+	Instance string
+	Output   []byte
+}
+
+func (e *InfraError) Error() string {
+	lines := strings.Split(strings.TrimSpace(string(e.Output)), "\n")
+	return fmt.Sprintf("infrastructure error running on %s: %s", e.Instance, lines[len(lines)-1])
+}
+
+// LostBuilderError indicates that an instance is gone, for example because
+// it expired or its buildlet crashed.
+type LostBuilderError struct {
+	Instance string
+}
+
+func (e *LostBuilderError) Error() string {
+	return fmt.Sprintf("lost builder %q", e.Instance)
+}
+
+// canceled returns an error wrapping ctx.Err() if ctx is done and err is
+// from a command run on inst, which was killed because of it, so err says
+// nothing about the command. Otherwise, it returns nil.
+func canceled(ctx context.Context, inst string, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("running on %s: %w", inst, ctx.Err())
+	}
+	return nil
+}
+
+// ExitCode returns the exit code of a command run by a Backend, given the
+// error Run returned, or -1 if the command didn't exit on its own, as when
+// it was killed by a signal or never ran.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ec interface{ ExitCode() int }
+	if errors.As(err, &ec) {
+		return ec.ExitCode()
+	}
+	return -1
+}
+
+// ExitStatus describes how a command run by a Backend exited, given the
+// error Run returned, like "exit status 2" or "signal: killed". It returns
+// "" if the command didn't run to completion.
+func ExitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ProcessState.String()
+	}
+	var ec interface{ ExitCode() int }
+	if errors.As(err, &ec) {
+		return fmt.Sprintf("exit status %d", ec.ExitCode())
+	}
+	return ""
+}
+
+// Classify classifies the outcome of running a command on inst, given the
+// output and error returned by a Backend's Run.
+//
+// A command that ran and failed is reported as FailUnmatched; it's up to the
+// caller to decide whether it matches. If the command didn't run, Classify
+// returns ExecutionError along with an *InfraError, a *LostBuilderError, or
+// the original error, which wraps the context's error if the command was
+// canceled.
+func Classify(inst string, output []byte, err error) (Status, error) {
+	if err == nil {
+		return Pass, nil
+	}
+	var ie *InfraError
+	var lost *LostBuilderError
+	if errors.As(err, &ie) || errors.As(err, &lost) {
+		return ExecutionError, err
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		// gomote exits with the command's status, and reports its own
+		// errors in the output, so tell them apart from the command's.
+		if gomote.IsInfraError(output) {
+			return ExecutionError, &InfraError{Instance: inst, Output: output}
+		}
+		if bytes.Contains(output, []byte(inst)) {
+			return ExecutionError, &LostBuilderError{inst}
+		}
+		return FailUnmatched, nil
+	}
+	var ec interface{ ExitCode() int }
+	if errors.As(err, &ec) {
+		return FailUnmatched, nil
+	}
+	// Failed in some other way.
+	return ExecutionError, err
+}
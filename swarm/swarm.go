@@ -0,0 +1,514 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package swarm runs a command on a pool of gomotes until it fails.
+//
+// It's the orchestration loop behind the goswarm command, for tools such as
+// bisection scripts and CI jobs that would rather embed goswarm than shell
+// out to it:
+//
+//	cfg := &swarm.Config{
+//		Type:      "linux-amd64",
+//		Command:   []string{"go/bin/go", "test", "-run=TestFlaky", "runtime"},
+//		Instances: 10,
+//		Match:     regexp.MustCompile("fatal error:").Match,
+//		Clean:     swarm.CleanExit,
+//	}
+//	res, err := cfg.Run(ctx)
+//
+// As with the goswarm command, GOROOT is pushed to every instance, so it
+// must be set in the environment, unless the Backend is given its own.
+package swarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Config configures a swarm.
+type Config struct {
+	Type      string   // instance type
+	Command   []string // command to run on each instance, relative to its work directory
+	Env       []string // environment variables of the form VAR=value
+	Instances int      // number of instances to run in parallel; 0 means 1
+
+	// Match reports whether a failure's output is the failure being looked
+	// for. If nil, every failure matches.
+	Match func(output []byte) bool
+
+	// KeepGoing keeps testing on the remaining instances after a matching
+	// failure, until every instance has found one or given up.
+	KeepGoing bool
+
+	// Clean says when to destroy instances. Note that CleanStart destroys
+	// every instance of Type, not just ones created by a swarm.
+	Clean CleanPolicy
+
+	// Retry is the policy for retrying gomote operations, and commands that
+	// fail with infrastructure errors. If its Attempts is 0,
+	// DefaultRetryPolicy is used.
+	Retry RetryPolicy
+
+	// Backend provides the instances. If nil, Gomote is used.
+	Backend Backend
+
+	// Hooks are called as the swarm runs.
+	Hooks Hooks
+
+	// Logf, if non-nil, is used to log progress, about the instance inst
+	// unless it's "".
+	Logf func(inst, format string, args ...any)
+
+	// Warnf, if non-nil, is used in place of Logf to log problems.
+	Warnf func(inst, format string, args ...any)
+}
+
+// Hooks are functions called as a swarm runs, each of which may be nil.
+// They may be called concurrently from different slots.
+//
+// Created, Iteration, Failure, and Destroyed observe the swarm. The rest let
+// the caller take over parts of each slot's work, as the goswarm command
+// does, while the swarm still drives the slots, retries infrastructure
+// errors, replaces lost instances, and stops at matching failures.
+type Hooks struct {
+	// Created is called once an instance is created, before GOROOT is
+	// pushed to it.
+	Created func(inst string)
+
+	// Iteration is called after every iteration of the command that ran,
+	// with its status and output.
+	Iteration func(inst string, status Status, output []byte)
+
+	// Failure is called for every matching failure, before the swarm stops.
+	// It may, for example, download artifacts from the instance. If it
+	// returns ErrContinue, the instance keeps testing regardless of
+	// KeepGoing. If it returns another error, the swarm stops with that
+	// error.
+	Failure func(ctx context.Context, f *Failure) error
+
+	// Destroyed is called after an instance is cleaned up.
+	Destroyed func(inst string)
+
+	// Start is called with the pool once it's created, in place of growing
+	// it to Instances, to size it and resize it as the swarm runs.
+	Start func(p *Pool)
+
+	// NewSlot is called as each slot starts, to set up s: to pick its Type,
+	// adopt an existing Instance, or set its Data. It returns the context
+	// for the slot's work, or false to leave the slot unused.
+	NewSlot func(ctx context.Context, s *Slot) (context.Context, bool)
+
+	// SetUp creates s's instance if it has none, and readies it to run the
+	// command, in place of creating it and pushing GOROOT to it. It reports
+	// whether the instance is ready; the slot exits if not.
+	SetUp func(ctx context.Context, s *Slot) bool
+
+	// Iterate runs one iteration on s's instance, in place of running
+	// Command and matching its output with Match. It returns the status of
+	// the iteration and its output, or an error: an *InfraError to retry
+	// according to Retry, ErrSkip to go on without counting the iteration,
+	// ErrDone to stop testing on the instance, or any other error to end
+	// the instance's iterations with.
+	Iterate func(ctx context.Context, s *Slot) (Status, []byte, error)
+
+	// InfraError is called for each infrastructure error running the
+	// command, once s counts it. If it returns an error, the instance's
+	// iterations end with it.
+	InfraError func(ctx context.Context, s *Slot, err error) error
+
+	// Passed is called after each iteration that passed or failed without
+	// matching. If it returns an error, the instance's iterations end with
+	// it.
+	Passed func(ctx context.Context, s *Slot, status Status) error
+
+	// Ended is called once the iterations on s's instance end with err, or
+	// nil if the slot was drained or the instance gave up, to decide what
+	// the slot does next, and with what error it exits. By default, a lost
+	// instance is replaced, and the slot exits otherwise.
+	Ended func(s *Slot, err error) (Next, error)
+
+	// Release is called as a slot with an instance exits, in place of
+	// destroying the instance according to Clean.
+	Release func(s *Slot)
+
+	// SlotDone is called once a slot exits, with the error it exits with.
+	SlotDone func(s *Slot, err error)
+}
+
+// Next is what a slot does once the iterations on its instance end.
+type Next int
+
+const (
+	Exit    Next = iota // exit the slot
+	Replace             // destroy the instance and set up a fresh one
+	Refresh             // set up the same instance again, and keep iterating
+)
+
+// A Slot is a place in the pool, running iterations on one instance at a
+// time.
+type Slot struct {
+	Type     string // instance type
+	Instance string // name of the instance, or "" before it's created
+	Data     any    // for the hooks' own use
+
+	// InfraErrors is the number of infrastructure errors in a row running
+	// the command on the instance, and TotalInfraErrors the number since
+	// it was set up.
+	InfraErrors      int
+	TotalInfraErrors int
+
+	drain <-chan struct{}
+}
+
+// Drain returns a channel that's closed once the slot is drained, and
+// should stop at a convenient point.
+func (s *Slot) Drain() <-chan struct{} {
+	return s.drain
+}
+
+// Failure is a matching failure.
+type Failure struct {
+	Instance string
+	Time     time.Time
+	Output   []byte
+}
+
+// Result summarizes a swarm's run.
+type Result struct {
+	Failures   []Failure      // matching failures, in the order they were found
+	Iterations map[Status]int // number of iterations with each status
+}
+
+var (
+	// ErrStop stops the swarm after a matching failure. Hooks may return
+	// it to stop the swarm as if there had been one.
+	ErrStop = errors.New("stop execution due to matching failure")
+
+	// ErrSkip, returned by Hooks.Iterate, goes on to the next iteration
+	// without counting this one.
+	ErrSkip = errors.New("iteration skipped")
+
+	// ErrDone, returned by Hooks.Iterate, stops testing on the instance.
+	ErrDone = errors.New("done testing on the instance")
+
+	// ErrContinue, returned by Hooks.Failure, keeps testing on the
+	// instance after a matching failure.
+	ErrContinue = errors.New("keep testing after a matching failure")
+)
+
+// Run runs the swarm until it finds a matching failure (or, with KeepGoing,
+// until every instance has), every instance gives up, or ctx is done.
+//
+// Finding no matching failure is not an error; check the Result's Failures.
+// If ctx is done, Run returns the results so far along with ctx's error.
+func (c *Config) Run(ctx context.Context) (*Result, error) {
+	if c.Type == "" && c.Hooks.NewSlot == nil || len(c.Command) == 0 && c.Hooks.Iterate == nil {
+		return nil, errors.New("swarm: Config needs an instance type and a command")
+	}
+	r := &runner{cfg: c, res: &Result{Iterations: make(map[Status]int)}}
+	r.backend = c.Backend
+	if r.backend == nil {
+		r.backend = Gomote
+	}
+	if r.cfg.Retry.Attempts == 0 {
+		r.retry = DefaultRetryPolicy
+	} else {
+		r.retry = r.cfg.Retry
+	}
+	if c.Clean.AtStart() {
+		if err := r.cleanUp(ctx); err != nil {
+			return nil, fmt.Errorf("cleaning up instances: %v", err)
+		}
+	}
+	p := newPool(ctx, r.slot)
+	if c.Hooks.Start != nil {
+		c.Hooks.Start(p)
+	} else {
+		p.Resize(max(c.Instances, 1))
+	}
+	err := p.wait()
+	if err == ErrStop {
+		err = nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return r.res, err
+}
+
+// runner is the state of a running swarm.
+type runner struct {
+	cfg     *Config
+	backend Backend
+	retry   RetryPolicy
+
+	mu  sync.Mutex
+	res *Result
+}
+
+func (r *runner) logf(inst, format string, args ...any) {
+	if r.cfg.Logf != nil {
+		r.cfg.Logf(inst, format, args...)
+	}
+}
+
+func (r *runner) warnf(inst, format string, args ...any) {
+	if r.cfg.Warnf != nil {
+		r.cfg.Warnf(inst, format, args...)
+		return
+	}
+	r.logf(inst, format, args...)
+}
+
+// cleanUp destroys every existing instance of the swarm's type.
+func (r *runner) cleanUp(ctx context.Context) error {
+	insts, err := r.backend.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, inst := range insts {
+		if inst.Type != r.cfg.Type {
+			continue
+		}
+		r.logf(inst.Name, "Destroying instance %s...", inst.Name)
+		if err := r.backend.Destroy(ctx, inst.Name); err != nil {
+			return err
+		}
+		if r.cfg.Hooks.Destroyed != nil {
+			r.cfg.Hooks.Destroyed(inst.Name)
+		}
+	}
+	return nil
+}
+
+// slot runs one slot of the pool, setting up an instance and iterating on
+// it, and replacing it as needed, until the slot is drained, its instance
+// gives up, or the swarm stops. It returns ErrStop to stop the swarm.
+func (r *runner) slot(ctx context.Context, drain <-chan struct{}) (err error) {
+	hooks := r.cfg.Hooks
+	s := &Slot{Type: r.cfg.Type, drain: drain}
+	if hooks.NewSlot != nil {
+		var ok bool
+		if ctx, ok = hooks.NewSlot(ctx, s); !ok {
+			return nil
+		}
+	}
+	if hooks.SlotDone != nil {
+		defer func() { hooks.SlotDone(s, err) }()
+	}
+	defer r.release(s)
+	for {
+		// Don't bother setting up an instance for a drained slot.
+		setupCtx, cancelSetup := WithDrain(ctx, drain)
+		ok := r.setUp(setupCtx, s)
+		cancelSetup()
+		if !ok {
+			return nil
+		}
+		next, err := r.ended(s, r.iterate(ctx, s))
+		switch next {
+		case Replace:
+			r.destroy(ctx, s)
+			s.Instance = ""
+		case Refresh:
+		default:
+			return err
+		}
+	}
+}
+
+// setUp creates s's instance if it has none, and pushes GOROOT to it. It
+// reports whether the instance is ready.
+func (r *runner) setUp(ctx context.Context, s *Slot) bool {
+	hooks := r.cfg.Hooks
+	if hooks.SetUp != nil {
+		return hooks.SetUp(ctx, s)
+	}
+	if s.Instance == "" {
+		var inst string
+		err := r.retry.Do(ctx, func() error {
+			var err error
+			inst, err = r.backend.Create(ctx, s.Type)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				r.warnf("", "Aborting instance creation due to too many errors: %v", err)
+			}
+			return false
+		}
+		s.Instance = inst
+		r.logf(inst, "Created instance %s...", inst)
+		if hooks.Created != nil {
+			hooks.Created(inst)
+		}
+	}
+	inst := s.Instance
+	if err := r.retry.Do(ctx, func() error { return r.backend.Push(ctx, inst) }); err != nil {
+		if ctx.Err() == nil {
+			r.warnf(inst, "Giving up on %s due to too many errors while pushing: %v", inst, err)
+		}
+		return false
+	}
+	return true
+}
+
+// iterate runs the command on s's instance in a loop, until the slot is
+// drained or there's a reason to stop, which it returns.
+func (r *runner) iterate(ctx context.Context, s *Slot) error {
+	hooks := r.cfg.Hooks
+	inst := s.Instance
+	s.InfraErrors, s.TotalInfraErrors = 0, 0
+	for {
+		select {
+		case <-s.drain:
+			r.logf(inst, "Draining %s.", inst)
+			return nil
+		default:
+		}
+		status, output, err := r.runOnce(ctx, s)
+		if errors.Is(err, ErrSkip) {
+			continue
+		}
+		if errors.Is(err, ErrDone) {
+			return nil
+		}
+		var ie *InfraError
+		if errors.As(err, &ie) {
+			// Don't let a hiccup talking to the instance end
+			// the swarm, but don't retry forever either.
+			s.InfraErrors++
+			s.TotalInfraErrors++
+			if hooks.InfraError != nil {
+				if err := hooks.InfraError(ctx, s, err); err != nil {
+					return err
+				}
+			}
+			if s.InfraErrors >= r.retry.Attempts {
+				r.warnf(inst, "Giving up on %s due to too many infrastructure errors: %v", inst, err)
+				return nil
+			}
+			wait := r.retry.Delay(s.InfraErrors)
+			r.logf(inst, "Retrying on %s in %s after %v.", inst, wait.Round(time.Millisecond), err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			case <-s.drain:
+			}
+			continue
+		}
+		s.InfraErrors = 0
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.res.Iterations[status]++
+		r.mu.Unlock()
+		if hooks.Iteration != nil {
+			hooks.Iteration(inst, status, output)
+		}
+		switch status {
+		case Pass, FailUnmatched:
+			if hooks.Passed != nil {
+				if err := hooks.Passed(ctx, s, status); err != nil {
+					return err
+				}
+			}
+			continue
+		case FailMatched:
+		default:
+			return fmt.Errorf("unexpected status %s", status)
+		}
+		f := Failure{Instance: inst, Time: time.Now(), Output: output}
+		keep := false
+		if hooks.Failure != nil {
+			err := hooks.Failure(ctx, &f)
+			switch {
+			case errors.Is(err, ErrContinue):
+				keep = true
+			case err != nil:
+				return err
+			}
+		}
+		r.mu.Lock()
+		r.res.Failures = append(r.res.Failures, f)
+		r.mu.Unlock()
+		switch {
+		case keep:
+			continue
+		case r.cfg.KeepGoing:
+			// Stop testing on this instance, but let the
+			// others keep testing.
+			return nil
+		}
+		return ErrStop
+	}
+}
+
+// runOnce runs one iteration on s's instance.
+func (r *runner) runOnce(ctx context.Context, s *Slot) (Status, []byte, error) {
+	if r.cfg.Hooks.Iterate != nil {
+		return r.cfg.Hooks.Iterate(ctx, s)
+	}
+	inst := s.Instance
+	output, err := r.backend.Run(ctx, inst, r.cfg.Env, r.cfg.Command...)
+	if ctx.Err() != nil {
+		return ExecutionError, output, ctx.Err()
+	}
+	status, err := Classify(inst, output, err)
+	if err != nil {
+		return status, output, err
+	}
+	if status == FailUnmatched && (r.cfg.Match == nil || r.cfg.Match(output)) {
+		status = FailMatched
+		r.logf(inst, "Discovered failure on %s.", inst)
+	}
+	return status, output, nil
+}
+
+// ended decides what s does once the iterations on its instance end
+// with err.
+func (r *runner) ended(s *Slot, err error) (Next, error) {
+	if r.cfg.Hooks.Ended != nil {
+		return r.cfg.Hooks.Ended(s, err)
+	}
+	var lost *LostBuilderError
+	if errors.As(err, &lost) {
+		// Replace the lost builder with a fresh instance, rather
+		// than shrinking the pool.
+		r.warnf(s.Instance, "Lost builder %s, replacing it.", s.Instance)
+		return Replace, nil
+	}
+	return Exit, err
+}
+
+// release disposes of s's instance, if it has one, as s exits.
+func (r *runner) release(s *Slot) {
+	if s.Instance == "" {
+		return
+	}
+	if r.cfg.Hooks.Release != nil {
+		r.cfg.Hooks.Release(s)
+		return
+	}
+	if r.cfg.Clean.AtExit() {
+		r.logf(s.Instance, "Destroying instance %s...", s.Instance)
+		r.destroy(context.Background(), s)
+	}
+}
+
+// destroy destroys s's instance.
+func (r *runner) destroy(ctx context.Context, s *Slot) {
+	inst := s.Instance
+	if err := r.backend.Destroy(ctx, inst); err != nil {
+		r.warnf(inst, "Error destroying instance %s: %v", inst, err)
+		return
+	}
+	if r.cfg.Hooks.Destroyed != nil {
+		r.cfg.Hooks.Destroyed(inst)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRetry retries quickly, for tests.
+var testRetry = RetryPolicy{Attempts: 3}
+
+// failAt returns a Fake outcome that passes, except for the runs in fails,
+// which fail with the given output.
+func failAt(output string, fails ...int) func(inst string, n int) FakeOutcome {
+	return func(inst string, n int) FakeOutcome {
+		if slices.Contains(fails, n) {
+			return FakeOutcome{Output: output, ExitCode: 2}
+		}
+		return FakeOutcome{Output: "ok\n"}
+	}
+}
+
+// matchFatal matches the output of a runtime crash.
+func matchFatal(output []byte) bool {
+	return bytes.Contains(output, []byte("fatal error:"))
+}
+
+func checkCalls(t *testing.T, f *Fake, want ...string) {
+	t.Helper()
+	if got := f.Calls(); !slices.Equal(got, want) {
+		t.Errorf("calls:\n\t%s\nwant:\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestRunMatch(t *testing.T) {
+	f := &Fake{Outcome: failAt("fatal error: boom\n", 2)}
+	cfg := &Config{
+		Type:    "linux-amd64",
+		Command: []string{"go", "test"},
+		Match:   matchFatal,
+		Clean:   CleanExit,
+		Retry:   testRetry,
+		Backend: f,
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 1 || res.Failures[0].Instance != "fake-linux-amd64-0" || string(res.Failures[0].Output) != "fatal error: boom\n" {
+		t.Errorf("failures = %+v, want one on fake-linux-amd64-0", res.Failures)
+	}
+	if res.Iterations[Pass] != 2 || res.Iterations[FailMatched] != 1 {
+		t.Errorf("iterations = %v, want 2 passes and 1 matching failure", res.Iterations)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunUnmatched(t *testing.T) {
+	f := &Fake{Outcome: func(inst string, n int) FakeOutcome {
+		switch n {
+		case 0:
+			return FakeOutcome{Output: "--- FAIL: TestOther\n", ExitCode: 1}
+		case 1:
+			return FakeOutcome{Output: "fatal error: boom\n", ExitCode: 2}
+		}
+		return FakeOutcome{}
+	}}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Match: matchFatal, Retry: testRetry, Backend: f}
+	var statuses []Status
+	cfg.Hooks.Iteration = func(inst string, status Status, output []byte) {
+		statuses = append(statuses, status)
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := []Status{FailUnmatched, FailMatched}; !slices.Equal(statuses, want) {
+		t.Errorf("iterations = %v, want %v", statuses, want)
+	}
+	if len(res.Failures) != 1 {
+		t.Errorf("failures = %+v, want 1", res.Failures)
+	}
+	// Without -clean=exit, the instance is left alone.
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+	)
+}
+
+func TestRunRetrySetUp(t *testing.T) {
+	f := &Fake{CreateFailures: 2, PushFailures: 1, Outcome: failAt("fatal error: boom\n", 0)}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	if _, err := cfg.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"create linux-amd64",
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunGiveUpCreate(t *testing.T) {
+	f := &Fake{CreateFailures: 3}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 0 {
+		t.Errorf("failures = %+v, want none", res.Failures)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"create linux-amd64",
+		"create linux-amd64",
+	)
+}
+
+func TestRunGiveUpPush(t *testing.T) {
+	f := &Fake{PushFailures: 3}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	if _, err := cfg.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// The instance is still cleaned up.
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"push fake-linux-amd64-0",
+		"push fake-linux-amd64-0",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunInfraErrors(t *testing.T) {
+	f := &Fake{Outcome: func(inst string, n int) FakeOutcome {
+		if n < 2 {
+			return FakeOutcome{Err: &InfraError{Instance: inst, Output: []byte("connection reset")}}
+		}
+		return FakeOutcome{Output: "fatal error: boom\n", ExitCode: 2}
+	}}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 1 {
+		t.Errorf("failures = %+v, want 1", res.Failures)
+	}
+	// Infrastructure errors aren't iterations.
+	if res.Iterations[ExecutionError] != 0 || res.Iterations[FailMatched] != 1 {
+		t.Errorf("iterations = %v, want 1 matching failure", res.Iterations)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunGiveUpInfraErrors(t *testing.T) {
+	f := &Fake{Outcome: func(inst string, n int) FakeOutcome {
+		if n == 0 {
+			return FakeOutcome{Output: "ok\n"}
+		}
+		return FakeOutcome{Err: &InfraError{Instance: inst, Output: []byte("connection reset")}}
+	}}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 0 || res.Iterations[Pass] != 1 {
+		t.Errorf("result = %+v, want 1 pass and no failures", res)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"run fake-linux-amd64-0 go test",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunLostBuilder(t *testing.T) {
+	f := &Fake{Outcome: func(inst string, n int) FakeOutcome {
+		if inst == "fake-linux-amd64-0" {
+			return FakeOutcome{Err: &LostBuilderError{inst}}
+		}
+		return FakeOutcome{Output: "fatal error: boom\n", ExitCode: 2}
+	}}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	var destroyed []string
+	cfg.Hooks.Destroyed = func(inst string) {
+		destroyed = append(destroyed, inst)
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 1 || res.Failures[0].Instance != "fake-linux-amd64-1" {
+		t.Errorf("failures = %+v, want one on the replacement", res.Failures)
+	}
+	if want := []string{"fake-linux-amd64-0", "fake-linux-amd64-1"}; !slices.Equal(destroyed, want) {
+		t.Errorf("destroyed %v, want %v", destroyed, want)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"run fake-linux-amd64-0 go test",
+		"destroy fake-linux-amd64-0",
+		"create linux-amd64",
+		"push fake-linux-amd64-1",
+		"run fake-linux-amd64-1 go test",
+		"destroy fake-linux-amd64-1",
+	)
+}
+
+func TestRunKeepGoing(t *testing.T) {
+	f := &Fake{Outcome: failAt("fatal error: boom\n", 1)}
+	cfg := &Config{
+		Type:      "linux-amd64",
+		Command:   []string{"go", "test"},
+		Instances: 3,
+		KeepGoing: true,
+		Clean:     CleanExit,
+		Retry:     testRetry,
+		Backend:   f,
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var insts []string
+	for _, f := range res.Failures {
+		insts = append(insts, f.Instance)
+	}
+	slices.Sort(insts)
+	if want := []string{"fake-linux-amd64-0", "fake-linux-amd64-1", "fake-linux-amd64-2"}; !slices.Equal(insts, want) {
+		t.Errorf("failures on %v, want %v", insts, want)
+	}
+	// Every instance stops at its first matching failure, and is
+	// cleaned up.
+	counts := make(map[string]int)
+	for _, c := range f.Calls() {
+		op, _, _ := strings.Cut(c, " ")
+		counts[op]++
+	}
+	if counts["create"] != 3 || counts["run"] != 6 || counts["destroy"] != 3 {
+		t.Errorf("calls = %v, want 3 creates, 6 runs, and 3 destroys", f.Calls())
+	}
+	if insts, _ := f.List(context.Background()); len(insts) != 0 {
+		t.Errorf("instances left: %v", insts)
+	}
+}
+
+func TestRunCleanStart(t *testing.T) {
+	f := new(Fake)
+	ctx := context.Background()
+	old, _ := f.Create(ctx, "linux-amd64")
+	other, _ := f.Create(ctx, "linux-arm64")
+	f.Outcome = func(inst string, n int) FakeOutcome {
+		return FakeOutcome{Output: "fatal error: boom\n", ExitCode: 2}
+	}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanAlways, Retry: testRetry, Backend: f}
+	if _, err := cfg.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"create linux-arm64",
+		"destroy "+old,
+		"create linux-amd64",
+		"push fake-linux-amd64-2",
+		"run fake-linux-amd64-2 go test",
+		"destroy fake-linux-amd64-2",
+	)
+	// Only instances of the swarm's type are cleaned up.
+	if insts, _ := f.List(ctx); len(insts) != 1 || insts[0].Name != other {
+		t.Errorf("instances left: %v, want only %s", insts, other)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	f := &Fake{Outcome: failAt("fatal error: boom\n", 1, 3)}
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Clean: CleanExit, Retry: testRetry, Backend: f}
+	var created []string
+	cfg.Hooks.Created = func(inst string) {
+		created = append(created, inst)
+	}
+	// Keep going after the first failure only.
+	failures := 0
+	cfg.Hooks.Failure = func(ctx context.Context, f *Failure) error {
+		if failures++; failures == 1 {
+			return ErrContinue
+		}
+		return nil
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Failures) != 2 || res.Iterations[Pass] != 2 {
+		t.Errorf("result = %+v, want 2 passes and 2 failures", res)
+	}
+	if want := []string{"fake-linux-amd64-0"}; !slices.Equal(created, want) {
+		t.Errorf("created %v, want %v", created, want)
+	}
+}
+
+func TestRunIterateHook(t *testing.T) {
+	f := new(Fake)
+	cfg := &Config{Type: "linux-amd64", Clean: CleanExit, Retry: testRetry, Backend: f}
+	n := 0
+	cfg.Hooks.Iterate = func(ctx context.Context, s *Slot) (Status, []byte, error) {
+		switch n++; n {
+		case 1:
+			return Pass, nil, ErrSkip
+		case 2:
+			return Pass, nil, nil
+		}
+		return ExecutionError, nil, ErrDone
+	}
+	res, err := cfg.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// Skipped iterations don't count.
+	if res.Iterations[Pass] != 1 || n != 3 {
+		t.Errorf("iterations = %v after %d calls, want 1 pass after 3", res.Iterations, n)
+	}
+	checkCalls(t, f,
+		"create linux-amd64",
+		"push fake-linux-amd64-0",
+		"destroy fake-linux-amd64-0",
+	)
+}
+
+func TestRunCanceled(t *testing.T) {
+	f := new(Fake)
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &Config{Type: "linux-amd64", Command: []string{"go", "test"}, Instances: 2, Clean: CleanExit, Retry: testRetry, Backend: f}
+	cfg.Hooks.Iteration = func(inst string, status Status, output []byte) {
+		cancel()
+	}
+	if _, err := cfg.Run(ctx); err != context.Canceled {
+		t.Errorf("Run = %v, want %v", err, context.Canceled)
+	}
+	if insts, _ := f.List(context.Background()); len(insts) != 0 {
+		t.Errorf("instances left: %v", insts)
+	}
+}
+
+// checkResizeAfterWait resizes p over and over while stop, which ends every
+// slot, takes effect, and checks that no slot runs once p is done.
+func checkResizeAfterWait(t *testing.T, p *Pool, running *atomic.Int32, stop func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.Resize(2)
+			}
+		}
+	}()
+	p.Resize(2)
+	stop()
+	err := p.wait()
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d slots running after wait returned", n)
+	}
+}
+
+func TestPoolResizeWhileDraining(t *testing.T) {
+	var running atomic.Int32
+	p := newPool(context.Background(), func(ctx context.Context, drain <-chan struct{}) error {
+		running.Add(1)
+		defer running.Add(-1)
+		<-drain
+		return nil
+	})
+	checkResizeAfterWait(t, p, &running, p.DrainAll)
+}
+
+func TestPoolResizeWhileExiting(t *testing.T) {
+	var running atomic.Int32
+	var exit atomic.Bool
+	p := newPool(context.Background(), func(ctx context.Context, drain <-chan struct{}) error {
+		running.Add(1)
+		defer running.Add(-1)
+		// Give up on our own, as when every instance fails to be created.
+		for !exit.Load() {
+			select {
+			case <-drain:
+				return nil
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return nil
+	})
+	checkResizeAfterWait(t, p, &running, func() { exit.Store(true) })
+	select {
+	case <-p.Exhausted():
+	default:
+		t.Errorf("pool not exhausted after every slot exited")
+	}
+}
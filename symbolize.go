@@ -0,0 +1,119 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var reportSource uint
+
+func init() {
+	flag.UintVar(&reportSource, "report-source", 0, "in each failure's report, show this many lines of the local GOROOT's source around each frame of the failing goroutine's stack (0 shows just where each frame is)")
+}
+
+// remoteGOROOTSrc is the part of a path on an instance that leads to the
+// source of the GOROOT pushed to it: everything up to it varies with the
+// instance's work directory.
+const remoteGOROOTSrc = "/go/src/"
+
+// localFile returns the path in the local GOROOT, goroot, of file, a path
+// on an instance from a stack trace, or "" if it isn't in the pushed
+// GOROOT or doesn't exist locally.
+func localFile(goroot, file string) string {
+	file = strings.ReplaceAll(file, `\`, "/")
+	_, rel, ok := strings.Cut(file, remoteGOROOTSrc)
+	if !ok {
+		return ""
+	}
+	path := filepath.Join(goroot, "src", filepath.FromSlash(rel))
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// failingGoroutine returns the goroutine of output most relevant to the
+// failure: the first distinctive one of a hang, or otherwise the first
+// one, which panicked or threw.
+func failingGoroutine(output []byte) (goroutineStack, bool) {
+	gs := parseGoroutines(output)
+	if len(gs) == 0 {
+		return goroutineStack{}, false
+	}
+	for _, m := range hangMarkers {
+		if !bytes.Contains(output, []byte(m)) {
+			continue
+		}
+		for _, g := range gs {
+			if !g.idle() {
+				return g, true
+			}
+		}
+	}
+	return gs[0], true
+}
+
+// annotateStack returns the stack of the failing goroutine of output, with
+// each frame in the GOROOT pushed to the instance pointing at the same file
+// in the local GOROOT, and -report-source lines of source around it. It
+// returns "" if output has no stack trace or the local GOROOT is unknown.
+func annotateStack(output []byte) string {
+	goroot, _ := pushRoot()
+	if goroot == "" {
+		return ""
+	}
+	g, ok := failingGoroutine(output)
+	if !ok {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "goroutine [%s]:\n", g.state)
+	for i, fn := range g.funcs {
+		fmt.Fprintf(&b, "%s\n", fn)
+		if i >= len(g.files) {
+			continue
+		}
+		file, line, _ := strings.Cut(g.files[i], ":")
+		local := localFile(goroot, file)
+		if local == "" {
+			fmt.Fprintf(&b, "\t%s\n", g.files[i])
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s:%s\n", local, line)
+		if n, err := strconv.Atoi(line); err == nil && reportSource > 0 {
+			writeSource(&b, local, n, int(reportSource))
+		}
+	}
+	return b.String()
+}
+
+// writeSource writes the lines of file around line, context on each side,
+// marking line itself.
+func writeSource(b *strings.Builder, file string, line, context int) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan() && n <= line+context; n++ {
+		if n < line-context {
+			continue
+		}
+		mark := " "
+		if n == line {
+			mark = ">"
+		}
+		fmt.Fprintf(b, "\t\t%s%5d  %s\n", mark, n, sc.Text())
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// templateData is what templates in the command's arguments and
+// environment variables may refer to, like {{.Instance}}.
+type templateData struct {
+	Instance  string // name of the instance
+	Type      string // type of the instance
+	Iteration int    // number of iterations the instance has completed
+	Shard     int    // shard of the work the instance runs, from 0
+	Shards    int    // total number of shards
+	Seed      int64  // random seed for the iteration
+	Command   int    // index of the command in -commands, or -1
+}
+
+// GOOS returns the GOOS of the instance, as far as its type tells, for
+// templates like {{if eq .GOOS "windows"}}.
+func (d templateData) GOOS() string {
+	goos, _ := typePlatform(d.Type)
+	return goos
+}
+
+// GOARCH returns the GOARCH of the instance, as far as its type tells.
+func (d templateData) GOARCH() string {
+	_, goarch := typePlatform(d.Type)
+	return goarch
+}
+
+// Exe returns the suffix of executables on the instance: .exe on Windows.
+func (d templateData) Exe() string {
+	if d.GOOS() == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// iterationEnv returns the environment variables telling the command which
+// part of the work to do, so that a wrapper can split a corpus across the
+// pool, and which random seed to use.
+func iterationEnv(data templateData) []string {
+	return []string{
+		fmt.Sprintf("GOSWARM_SHARD=%d", data.Shard),
+		fmt.Sprintf("GOSWARM_TOTAL_SHARDS=%d", data.Shards),
+		fmt.Sprintf("GOSWARM_SEED=%d", data.Seed),
+	}
+}
+
+// templates are the parsed templates in the command and environment,
+// by their text. It's written only before the pool starts.
+var templates = make(map[string]*template.Template)
+
+// parseTemplates parses the templates in each of strs, reporting any
+// that are malformed.
+func parseTemplates(strs ...[]string) error {
+	for _, ss := range strs {
+		for _, s := range ss {
+			if !strings.Contains(s, "{{") {
+				continue
+			}
+			t, err := template.New("").Option("missingkey=error").Parse(s)
+			if err != nil {
+				return fmt.Errorf("parsing template %q: %v", s, err)
+			}
+			// Catch references to unknown fields now, rather than
+			// on the first iteration.
+			if err := t.Execute(io.Discard, templateData{}); err != nil {
+				return fmt.Errorf("template %q: %v", s, err)
+			}
+			templates[s] = t
+		}
+	}
+	return nil
+}
+
+// expandTemplates returns ss with its templates expanded with data.
+func expandTemplates(ss []string, data templateData) ([]string, error) {
+	var out []string
+	for _, s := range ss {
+		t, ok := templates[s]
+		if !ok {
+			out = append(out, s)
+			continue
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("expanding template %q: %v", s, err)
+		}
+		out = append(out, b.String())
+	}
+	return out, nil
+}
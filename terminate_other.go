@@ -0,0 +1,12 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// terminateSignals returns no signals on platforms without SIGTERM.
+func terminateSignals() []os.Signal { return nil }
@@ -0,0 +1,19 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminateSignals returns the signals that end the session without
+// waiting for in-flight iterations. Closing the console window, logging
+// off, and shutting down deliver SIGTERM, after which Windows only gives
+// the process a few seconds to clean up. (Ctrl-C and Ctrl-Break are
+// os.Interrupt.)
+func terminateSignals() []os.Signal {
+	return []os.Signal{syscall.SIGTERM}
+}
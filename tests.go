@@ -0,0 +1,103 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// testFailRe matches go test's report of a failed test, benchmark, or
+	// subtest of either.
+	testFailRe = regexp.MustCompile(`^\s*--- FAIL: (\S+)`)
+
+	// runningTestRe matches a test still running when go test timed out.
+	runningTestRe = regexp.MustCompile(`^\t(\S+) \(`)
+)
+
+// failedTests returns the names of the tests and benchmarks that failed in
+// output, the output of go test or go test -json, leaving out tests whose
+// subtests are listed. Tests running when go test timed out count as
+// failed.
+func failedTests(output []byte) []string {
+	seen := make(map[string]bool)
+	running := false
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "{") {
+			var ev struct{ Action, Test, Output string }
+			if json.Unmarshal([]byte(line), &ev) != nil {
+				continue
+			}
+			if ev.Action == "fail" && ev.Test != "" {
+				seen[ev.Test] = true
+				continue
+			}
+			// Timeouts are only reported in the output.
+			line = strings.TrimSuffix(ev.Output, "\n")
+		}
+		if running {
+			if m := runningTestRe.FindStringSubmatch(line); m != nil {
+				seen[m[1]] = true
+				continue
+			}
+			running = false
+		}
+		if line == "running tests:" {
+			running = true
+		} else if m := testFailRe.FindStringSubmatch(line); m != nil {
+			seen[m[1]] = true
+		}
+	}
+	var tests []string
+	for t := range seen {
+		leaf := true
+		for u := range seen {
+			leaf = leaf && !strings.HasPrefix(u, t+"/")
+		}
+		if leaf {
+			tests = append(tests, t)
+		}
+	}
+	sort.Strings(tests)
+	return tests
+}
+
+// writeFailedTests writes how many of the session's matching failures each
+// test failed in, most often first.
+func (st *sessionStatus) writeFailedTests(w io.Writer) {
+	counts := make(map[string]int)
+	for _, f := range st.Failures {
+		for _, t := range f.Tests {
+			counts[t]++
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	var tests []string
+	for t := range counts {
+		tests = append(tests, t)
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		if counts[tests[i]] != counts[tests[j]] {
+			return counts[tests[i]] > counts[tests[j]]
+		}
+		return tests[i] < tests[j]
+	})
+	fmt.Fprintf(w, "  failing tests:\n")
+	for _, t := range tests {
+		fmt.Fprintf(w, "    %s (%d of %d failures)\n", t, counts[t], len(st.Failures))
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timingStats summarizes how long iterations took to run the command.
+type timingStats struct {
+	Count int           `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+
+	// Buckets counts iterations by duration, using timingBuckets as
+	// upper bounds; the last bucket has no upper bound.
+	Buckets []int `json:"buckets"`
+}
+
+// timingBuckets are the upper bounds of the histogram buckets, in a
+// 1-2-5 sequence, fine-grained enough for both quick tests and all.bash.
+var timingBuckets = func() []time.Duration {
+	var b []time.Duration
+	for d := time.Millisecond; d <= time.Hour; d *= 10 {
+		b = append(b, d, 2*d, 5*d)
+	}
+	return b
+}()
+
+// recordDuration records how long an iteration took to run the command.
+func (s *session) recordDuration(d time.Duration) {
+	s.mu.Lock()
+	s.durations = append(s.durations, d)
+	s.mu.Unlock()
+}
+
+// newTimingStats summarizes durations, or returns nil if there are none.
+func newTimingStats(durations []time.Duration) *timingStats {
+	if len(durations) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	quantile := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	ts := &timingStats{
+		Count:   len(sorted),
+		Min:     sorted[0],
+		P50:     quantile(0.5),
+		P90:     quantile(0.9),
+		P99:     quantile(0.99),
+		Max:     sorted[len(sorted)-1],
+		Buckets: make([]int, len(timingBuckets)+1),
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+		i := sort.Search(len(timingBuckets), func(i int) bool { return timingBuckets[i] >= d })
+		ts.Buckets[i]++
+	}
+	ts.Mean = total / time.Duration(len(sorted))
+	return ts
+}
+
+// recordSetup records how long it took to create an instance, or to push
+// to one.
+func (s *session) recordSetup(op string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch op {
+	case "create":
+		s.createDurations = append(s.createDurations, d)
+	case "push":
+		s.pushDurations = append(s.pushDurations, d)
+	}
+}
+
+// histogramWidth is the width of the longest bar of the histogram.
+const histogramWidth = 40
+
+// writePercentiles writes the percentiles of the times of what, if any.
+func (ts *timingStats) writePercentiles(w io.Writer, what string) {
+	if ts == nil {
+		return
+	}
+	round := func(d time.Duration) time.Duration {
+		switch {
+		case d >= time.Minute:
+			return d.Round(time.Second)
+		case d >= time.Second:
+			return d.Round(10 * time.Millisecond)
+		}
+		return d.Round(time.Millisecond)
+	}
+	fmt.Fprintf(w, "  %s times: min %s, mean %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		what, round(ts.Min), round(ts.Mean), round(ts.P50), round(ts.P90), round(ts.P99), round(ts.Max))
+}
+
+// write writes the percentiles and a histogram of the iteration times,
+// and calls out outliers.
+func (ts *timingStats) write(w io.Writer) {
+	ts.writePercentiles(w, "iteration")
+	if ts.Count < 2 {
+		return
+	}
+	first, last, most := -1, 0, 0
+	for i, n := range ts.Buckets {
+		if n == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		most = max(most, n)
+	}
+	for i := first; i <= last; i++ {
+		label := fmt.Sprintf("> %s", timingBuckets[len(timingBuckets)-1])
+		if i < len(timingBuckets) {
+			label = fmt.Sprintf("<= %s", timingBuckets[i])
+		}
+		n := ts.Buckets[i]
+		bar := strings.Repeat("#", (n*histogramWidth+most-1)/most)
+		fmt.Fprintf(w, "    %8s %-*s %d\n", label, histogramWidth, bar, n)
+	}
+	// Big outliers are often the first sign of a scheduling or GC
+	// pathology, even if the command passed.
+	if ts.P50 > 0 && ts.Max >= 5*ts.P50 {
+		fmt.Fprintf(w, "  slowest iteration took %.1fx the median\n", float64(ts.Max)/float64(ts.P50))
+	}
+}
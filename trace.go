@@ -0,0 +1,206 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var traceEndpoint string
+
+func init() {
+	flag.StringVar(&traceEndpoint, "otlp", "", "OTLP/HTTP collector endpoint (e.g. http://localhost:4318) to which to export traces of gomote operations")
+}
+
+// span is a single traced operation. A nil *span is valid and does nothing,
+// which is what startSpan returns when tracing is disabled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	attrs    []string // key/value pairs
+}
+
+type spanKey struct{}
+
+// startSpan starts a new span named name as a child of the span in ctx,
+// if any. attrs is a list of alternating attribute keys and values.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if traceEndpoint == "" {
+		return ctx, nil
+	}
+	s := &span{name: name, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// End completes the span, marking it as failed if err is non-nil,
+// and queues it for export.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	js := otlpSpan{
+		TraceID:   hex.EncodeToString(s.traceID[:]),
+		SpanID:    hex.EncodeToString(s.spanID[:]),
+		Name:      s.name,
+		Kind:      1, // SPAN_KIND_INTERNAL
+		StartTime: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if s.parentID != ([8]byte{}) {
+		js.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		js.Attributes = append(js.Attributes, otlpAttr(s.attrs[i], s.attrs[i+1]))
+	}
+	if err != nil {
+		js.Status = &otlpStatus{Code: 2, Message: err.Error()} // STATUS_CODE_ERROR
+	}
+	exporter.mu.Lock()
+	exporter.spans = append(exporter.spans, js)
+	exporter.mu.Unlock()
+}
+
+// exporter buffers finished spans until they're flushed.
+var exporter struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// exportTraces periodically flushes finished spans to the OTLP endpoint.
+// The returned function stops the exporter, performs a final flush, and
+// should be called before exit.
+func exportTraces() (stop func()) {
+	if traceEndpoint == "" {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(5 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				flushTraces()
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+		flushTraces()
+	}
+}
+
+func flushTraces() {
+	exporter.mu.Lock()
+	spans := exporter.spans
+	exporter.spans = nil
+	exporter.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", "goswarm")}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/mknyszek/goswarm"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("Failed to encode traces: %v", err)
+		return
+	}
+	url := strings.TrimSuffix(traceEndpoint, "/") + "/v1/traces"
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to export traces: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to export traces: %s", resp.Status)
+	}
+}
+
+// The following types are the subset of the OTLP/JSON trace encoding
+// that goswarm produces.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttr(k, v string) otlpAttribute {
+	return otlpAttribute{Key: k, Value: otlpValue{StringValue: v}}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mknyszek/goswarm/gomote"
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var transcript bool
+
+func init() {
+	flag.BoolVar(&transcript, "transcript", false, "record every gomote invocation, with its duration, exit status, and the end of its output, to goswarm-transcript-TIME.log in the artifacts directory, to debug goswarm's interaction with gomote")
+}
+
+// transcriptLines is how many lines at the end of each invocation's output
+// the transcript keeps.
+const transcriptLines = 20
+
+// transcriptOut is the open transcript, if any.
+var transcriptOut struct {
+	sync.Mutex
+	f *os.File
+}
+
+// openTranscript starts recording gomote invocations to a transcript, with
+// -transcript. The returned function stops.
+func openTranscript() (stop func(), err error) {
+	if !transcript {
+		return func() {}, nil
+	}
+	path := uniquePath(filepath.Join(artifactsDir, fmt.Sprintf("goswarm-transcript-%s.log", time.Now().Format("20060102T150405"))))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	recordArtifact(path)
+	transcriptOut.f = f
+	gomote.Observe = writeInvocation
+	return func() {
+		transcriptOut.Lock()
+		defer transcriptOut.Unlock()
+		transcriptOut.f.Close()
+		transcriptOut.f = nil
+	}, nil
+}
+
+// writeInvocation writes inv to the transcript.
+func writeInvocation(inv gomote.Invocation) {
+	var b strings.Builder
+	status := "ok"
+	if inv.Err != nil {
+		status = inv.Err.Error()
+	}
+	var args []string
+	for _, a := range inv.Args {
+		args = append(args, swarm.ShellQuote(a))
+	}
+	fmt.Fprintf(&b, "%s gomote %s\n", logPrefix(inv.Start), redactString(strings.Join(args, " ")))
+	fmt.Fprintf(&b, "\t%s: %s\n", inv.Duration.Round(time.Millisecond), status)
+	if out := tailLines(redact(inv.Output), transcriptLines); out != "" {
+		for _, line := range strings.Split(out, "\n") {
+			fmt.Fprintf(&b, "\t| %s\n", line)
+		}
+	}
+	transcriptOut.Lock()
+	defer transcriptOut.Unlock()
+	if transcriptOut.f != nil {
+		transcriptOut.f.WriteString(b.String())
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	transferConcurrency uint
+	downloadRate        float64
+)
+
+func init() {
+	flag.UintVar(&transferConcurrency, "transfer-concurrency", 0, "maximum number of bulk transfers, pushes and archive downloads together, to run at once, so they don't saturate the local network link and slow down every other gomote operation; 0 means no limit")
+	flag.Float64Var(&downloadRate, "download-rate", 0, "maximum total rate, in MiB per second, at which to download archives; 0 means no limit")
+}
+
+// transferLimiter bounds the bulk transfers in flight.
+var transferLimiter = new(limiter)
+
+// limitTransfer calls f, a push or archive download, once transferLimiter
+// allows it.
+func limitTransfer(ctx context.Context, f func() error) error {
+	if err := transferLimiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer transferLimiter.release()
+	return f()
+}
+
+// downloads paces archive downloads to -download-rate, across all of them.
+var downloads struct {
+	sync.Mutex
+	next time.Time // when the bytes downloaded so far are paid for
+}
+
+// throttledWriter is a writer that writes no faster than -download-rate
+// allows, shared with every other throttledWriter.
+type throttledWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+// throttle returns w, throttled to -download-rate.
+func throttle(ctx context.Context, w io.Writer) io.Writer {
+	if downloadRate <= 0 {
+		return w
+	}
+	return &throttledWriter{ctx, w}
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	cost := time.Duration(float64(len(b)) / (downloadRate * (1 << 20)) * float64(time.Second))
+	downloads.Lock()
+	now := time.Now()
+	if downloads.next.Before(now) {
+		downloads.next = now
+	}
+	wait := downloads.next.Sub(now)
+	downloads.next = downloads.next.Add(cost)
+	downloads.Unlock()
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		}
+	}
+	return t.w.Write(b)
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+var trendAlpha float64
+
+func init() {
+	flag.Float64Var(&trendAlpha, "trend-alert", 0.01, "at the end of the session, warn about failures occurring significantly more often than in previous sessions of the same command against older commits, at this significance level (0 disables the check)")
+}
+
+// minTrendBaseline is the fewest iterations of previous sessions a failure
+// rate is compared to: fewer say too little about how often it used to
+// occur.
+const minTrendBaseline = 50
+
+// gorootCommit returns the commit checked out in goroot, and when it was
+// committed, or "" if it isn't a git checkout.
+func gorootCommit(goroot string) (string, *time.Time) {
+	out, err := exec.Command("git", "-C", goroot, "log", "-1", "--format=%H %cI").Output()
+	if err != nil {
+		return "", nil
+	}
+	hash, date, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return hash, nil
+	}
+	return hash, &t
+}
+
+// isBaseline reports whether prev, a previous session, is one to compare r
+// to: it ran the same command on the same instance types, against an older
+// commit if r's commit is known.
+func isBaseline(r, prev historyRecord) bool {
+	if !slices.Equal(prev.Command, r.Command) || !slices.Equal(prev.Types, r.Types) {
+		return false
+	}
+	if r.Commit == "" {
+		return prev.Start.Before(r.Start)
+	}
+	if prev.Commit == "" || prev.Commit == r.Commit {
+		return false
+	}
+	if r.CommitTime != nil && prev.CommitTime != nil {
+		return prev.CommitTime.Before(*r.CommitTime)
+	}
+	return prev.Start.Before(r.Start)
+}
+
+// failureCounts returns how many times each failure signature occurred in
+// r.
+func failureCounts(r historyRecord) map[string]int {
+	counts := make(map[string]int)
+	for _, f := range append(r.Failures[:len(r.Failures):len(r.Failures)], r.Unmatched...) {
+		if f.Signature != "" {
+			counts[f.Signature] += max(f.Count, 1)
+		}
+	}
+	return counts
+}
+
+// poissonTail returns the probability of at least k occurrences of an
+// event occurring lambda times on average.
+func poissonTail(k int, lambda float64) float64 {
+	p, term := 0.0, math.Exp(-lambda)
+	for i := 0; i < k; i++ {
+		p += term
+		term *= lambda / float64(i+1)
+	}
+	return max(1-p, 0)
+}
+
+// warnTrends warns about the failures of r, a session just ended, that
+// occurred significantly more often than in previous sessions against
+// older commits, at the -trend-alert significance level: an early sign of
+// a regression.
+func warnTrends(r historyRecord) {
+	if r.Iterations == 0 {
+		return
+	}
+	recs, err := loadHistory()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Not checking failure trends: reading session history: %v", err))
+		return
+	}
+	base, baseSessions := make(map[string]int), 0
+	baseIters := 0
+	for _, prev := range recs {
+		if !isBaseline(r, prev) {
+			continue
+		}
+		baseSessions++
+		baseIters += prev.Iterations
+		for sig, n := range failureCounts(prev) {
+			base[sig] += n
+		}
+	}
+	if baseIters < minTrendBaseline {
+		return
+	}
+	for sig, k := range failureCounts(r) {
+		// Half an occurrence for failures never seen before, so that
+		// they can stand out without dividing by zero.
+		baseRate := (float64(base[sig]) + 0.5) / float64(baseIters)
+		rate := float64(k) / float64(r.Iterations)
+		if rate <= 2*baseRate {
+			continue
+		}
+		p := poissonTail(k, baseRate*float64(r.Iterations))
+		if p >= trendAlpha {
+			continue
+		}
+		slog.Warn(fmt.Sprintf("Failure %s occurred in %d of %d iterations (%.2f%%), up from %d of %d iterations (%.2f%%) in %d previous sessions against older commits (p=%.2g): a possible regression.",
+			sig, k, r.Iterations, 100*rate, base[sig], baseIters, 100*float64(base[sig])/float64(baseIters), baseSessions, p))
+	}
+}
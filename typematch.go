@@ -0,0 +1,100 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// matchInstanceType finds typ among the valid instance types typs.
+// Besides an exact match, it accepts a unique prefix or, failing that,
+// a unique substring of a valid type. Otherwise, the returned error
+// suggests the closest valid types.
+func matchInstanceType(typ string, typs []string) (string, error) {
+	var prefix, substr []string
+	for _, t := range typs {
+		if t == typ {
+			return t, nil
+		}
+		if strings.HasPrefix(t, typ) {
+			prefix = append(prefix, t)
+		}
+		if strings.Contains(t, typ) {
+			substr = append(substr, t)
+		}
+	}
+	if len(prefix) == 1 {
+		return prefix[0], nil
+	}
+	if len(prefix) == 0 && len(substr) == 1 {
+		return substr[0], nil
+	}
+	if len(prefix) > 1 || len(substr) > 1 {
+		amb := prefix
+		if len(amb) == 0 {
+			amb = substr
+		}
+		return "", fmt.Errorf("ambiguous instance type %s: could be any of %s", typ, strings.Join(amb, ", "))
+	}
+	if s := suggestInstanceTypes(typ, typs); len(s) > 0 {
+		return "", fmt.Errorf("invalid instance type: %s; did you mean %s?", typ, strings.Join(s, " or "))
+	}
+	return "", fmt.Errorf("invalid instance type: %s", typ)
+}
+
+// suggestInstanceTypes returns up to three valid types closest to typ
+// by edit distance, excluding any that are too different to be useful.
+func suggestInstanceTypes(typ string, typs []string) []string {
+	type candidate struct {
+		typ  string
+		dist int
+	}
+	var cands []candidate
+	for _, t := range typs {
+		d := editDistance(typ, t)
+		if d <= len(typ)/3+1 {
+			cands = append(cands, candidate{t, d})
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].dist < cands[j].dist })
+	var s []string
+	for i := 0; i < len(cands) && i < 3; i++ {
+		s = append(s, cands[i].typ)
+	}
+	return s
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testTypes = []string{
+	"linux-amd64",
+	"linux-amd64-longtest",
+	"linux-arm64",
+	"linux-arm64-longtest",
+	"windows-amd64-2016",
+	"darwin-arm64-13",
+}
+
+func TestMatchInstanceType(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want string
+		err  string
+	}{
+		{typ: "linux-amd64", want: "linux-amd64"},
+		{typ: "linux-arm64-long", want: "linux-arm64-longtest"},
+		{typ: "windows", want: "windows-amd64-2016"},
+		{typ: "darwin-arm64", want: "darwin-arm64-13"},
+		{typ: "2016", want: "windows-amd64-2016"},
+		{typ: "linux", err: "ambiguous instance type linux: could be any of linux-amd64, linux-amd64-longtest, linux-arm64, linux-arm64-longtest"},
+		{typ: "longtest", err: "ambiguous instance type longtest: could be any of linux-amd64-longtest, linux-arm64-longtest"},
+		{typ: "linux-amd46", err: "invalid instance type: linux-amd46; did you mean linux-amd64 or linux-arm64?"},
+		{typ: "freebsd-riscv64", err: "invalid instance type: freebsd-riscv64"},
+	}
+	for _, tt := range tests {
+		got, err := matchInstanceType(tt.typ, testTypes)
+		switch {
+		case tt.err != "":
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("matchInstanceType(%q) = %q, %v, want error %q", tt.typ, got, err, tt.err)
+			}
+		case err != nil || got != tt.want:
+			t.Errorf("matchInstanceType(%q) = %q, %v, want %q", tt.typ, got, err, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"linux-amd64", "linux-amd64", 0},
+		{"linux-amd46", "linux-amd64", 2},
+		{"linux-arm64", "linux-amd64", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestInstanceTypesLimit(t *testing.T) {
+	typs := []string{"linux-386", "linux-amd64", "linux-arm", "linux-arm64", "linux-mips"}
+	if s := suggestInstanceTypes("linux-am", typs); len(s) > 3 {
+		t.Errorf("suggestInstanceTypes = %v, want at most 3", s)
+	}
+	if s := suggestInstanceTypes("xyz", typs); len(s) != 0 {
+		t.Errorf("suggestInstanceTypes(%q) = %v, want none", "xyz", strings.Join(s, ", "))
+	}
+}
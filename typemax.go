@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var typeMax stringSetVar
+
+func init() {
+	flag.Var(&typeMax, "type-max", "maximum number of instances of an instance type, as TYPE=N, so that a pool spread across several types leaves some of a scarce one for others, may be specified multiple times")
+}
+
+// typeCaps is the maximum number of instances of each instance type with
+// a -type-max.
+var typeCaps map[string]int
+
+// setUpTypeMax resolves the types of -type-max against the session's
+// types, typs.
+func setUpTypeMax(ctx context.Context, typs []string) error {
+	typeCaps = make(map[string]int)
+	for _, v := range typeMax {
+		typ, count, _ := strings.Cut(v, "=")
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return usageErrorf("-type-max: %q is not of the form TYPE=N, with N at least 1", v)
+		}
+		t, err := sessionType(ctx, "-type-max", typ, typs)
+		if err != nil {
+			return err
+		}
+		typeCaps[t] = n
+	}
+	return nil
+}
+
+// capToTypeMax caps the pool at the total of -type-max, if every one of
+// the session's types, typs, has one.
+func capToTypeMax(typs []string) {
+	if len(typeCaps) < len(typs) {
+		return
+	}
+	total := 0
+	for _, n := range typeCaps {
+		total += n
+	}
+	if int(instances) > total {
+		log.Printf("Capping the pool at %d instances, the total of -type-max.", total)
+		instances = uint(total)
+	}
+}
+
+// sessionType resolves typ, given to the flag name, to one of the session's
+// types, typs.
+func sessionType(ctx context.Context, name, typ string, typs []string) (string, error) {
+	t, err := resolveInstanceType(ctx, typ)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(typs, t) {
+		return "", usageErrorf("%s: %s is not one of the session's instance types", name, t)
+	}
+	return t, nil
+}
+
+// atTypeMax reports whether there are already live instances of type typ
+// of -type-max.
+func atTypeMax(typ string, live int) bool {
+	n, ok := typeCaps[typ]
+	return ok && live >= n
+}
+
+// writeTypeMax describes the maximums of -type-max for printPlan.
+func writeTypeMax(w io.Writer, typs []string) {
+	for _, typ := range typs {
+		if n, ok := typeCaps[typ]; ok {
+			fmt.Fprintf(w, "# at most %d of type %s\n", n, typ)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+// Instance types may need quirks of their own, which the configuration
+// file can set up in a table per type, applied whenever the type is used:
+//
+//	[type.windows-arm64-11]
+//	create = ["-setup"]                # extra flags for gomote create
+//	setup = ["mkdir C:\\temp"]         # run on each instance after pushing
+//	push = false                       # don't push GOROOT to it
+//	bootstrap = true                   # push a bootstrap toolchain, with -bootstrap auto
+//	env = ["GO_TEST_TIMEOUT_SCALE=2"]  # for the command, before -e
+//	scripts = ["all.bash=all.rc"]      # scripts to run in place of others
+const typeTablePrefix = "type."
+
+// typeOptionKeys are the keys allowed in a type's table.
+var typeOptionKeys = []string{"create", "setup", "push", "bootstrap", "env", "scripts"}
+
+// typeQuirks are the quirks instance types are known to have, by
+// path.Match pattern of the type, so that nobody has to remember them. A
+// type's table in the configuration file overrides them, key by key.
+var typeQuirks = map[string]map[string][]string{
+	// Plan 9 has rc scripts in place of bash scripts.
+	"plan9-*": {"scripts": {"make.bash=make.rc", "all.bash=all.rc", "run.bash=run.rc"}},
+}
+
+// checkTypeOptions checks the type tables of the configuration file.
+func checkTypeOptions() error {
+	for table, opts := range userConfig {
+		if !strings.HasPrefix(table, typeTablePrefix) {
+			continue
+		}
+		for key, vals := range opts {
+			if !slices.Contains(typeOptionKeys, key) {
+				return fmt.Errorf("[%s]: unknown option %q, expected one of %s", table, key, strings.Join(typeOptionKeys, ", "))
+			}
+			switch key {
+			case "push", "bootstrap":
+				if _, err := strconv.ParseBool(strings.Join(vals, "")); err != nil {
+					return fmt.Errorf("[%s]: %s must be true or false", table, key)
+				}
+			case "scripts":
+				for _, v := range vals {
+					if _, _, ok := strings.Cut(v, "="); !ok {
+						return fmt.Errorf("[%s]: scripts must be like \"all.bash=all.rc\", not %q", table, v)
+					}
+				}
+			}
+		}
+		if len(opts["create"]) > 0 && backendName != "gomote" {
+			return fmt.Errorf("[%s]: create options are only supported by the gomote backend", table)
+		}
+	}
+	return nil
+}
+
+// typeOption returns the value of key in the table of type typ, or else
+// the known quirk, if any.
+func typeOption(typ, key string) ([]string, bool) {
+	if v, ok := userConfig[typeTablePrefix+typ][key]; ok {
+		return v, true
+	}
+	var patterns []string
+	for p := range typeQuirks {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, typ); ok {
+			v, ok := typeQuirks[p][key]
+			if ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// typeBool returns the boolean option key of type typ, or def if it's
+// unset.
+func typeBool(typ, key string, def bool) bool {
+	v, ok := typeOption(typ, key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(strings.Join(v, ""))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// typePush reports whether to push GOROOT to instances of type typ.
+func typePush(typ string) bool {
+	return typeBool(typ, "push", true)
+}
+
+// typeBootstrap reports whether to push a bootstrap toolchain to instances
+// of type typ: as -bootstrap says, unless it's auto and the type says
+// otherwise.
+func typeBootstrap(typ string) bool {
+	if _, ok := backend.(swarm.Bootstrapper); !ok || bootstrapMode != "auto" {
+		return putBootstrap
+	}
+	return typeBool(typ, "bootstrap", putBootstrap)
+}
+
+// typeEnv returns the environment variables of type typ, which come before
+// -e, so that -e can override them.
+func typeEnv(typ string) []string {
+	v, _ := typeOption(typ, "env")
+	return v
+}
+
+// typeScript returns the script instances of type typ run in place of
+// the script name, like all.rc for all.bash, or name itself.
+func typeScript(typ, name string) string {
+	v, _ := typeOption(typ, "scripts")
+	for _, s := range v {
+		if from, to, _ := strings.Cut(s, "="); from == name {
+			return to
+		}
+	}
+	return name
+}
+
+// typeScriptCommand returns cmd with its program replaced according to
+// the scripts option of type typ, keeping its directory.
+func typeScriptCommand(typ string, cmd []string) []string {
+	if len(cmd) == 0 || strings.Contains(cmd[0], "{{") {
+		return cmd
+	}
+	dir, name := path.Split(cmd[0])
+	if s := typeScript(typ, name); s != name {
+		cmd = append([]string{dir + s}, cmd[1:]...)
+	}
+	return cmd
+}
+
+// typeCreateArgs returns the extra gomote create flags of each type.
+func typeCreateArgs() map[string][]string {
+	args := make(map[string][]string)
+	for table, opts := range userConfig {
+		if typ, ok := strings.CutPrefix(table, typeTablePrefix); ok && len(opts["create"]) > 0 {
+			args[typ] = opts["create"]
+		}
+	}
+	return args
+}
+
+// typeSetup returns the setup commands of type typ.
+func typeSetup(typ string) []string {
+	v, _ := typeOption(typ, "setup")
+	return v
+}
+
+// runTypeSetup runs the setup commands of inst's type, typ, on it,
+// retrying infrastructure errors. It returns an error if any fails.
+func runTypeSetup(ctx context.Context, inst, typ string) error {
+	for _, s := range typeSetup(typ) {
+		var out []byte
+		var runErr error
+		err := retry(ctx, "setup", inst, func(ctx context.Context) error {
+			var err error
+			out, err = backend.Run(ctx, inst, nil, inRunDir(shellCommand(typ, s))...)
+			var ie *swarm.InfraError
+			var lost *swarm.LostBuilderError
+			if errors.As(err, &ie) || errors.As(err, &lost) || errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			runErr = err
+			return nil
+		})
+		if err == nil {
+			err = runErr
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v\n%s", s, err, tailLines(out, int(consoleLines)))
+		}
+		instDetailf(inst, "Ran setup command %q on %s.", s, inst)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withConfig sets userConfig to cfg, and the backend to name, for the rest
+// of the test.
+func withConfig(t *testing.T, name string, cfg config) {
+	oldCfg, oldName := userConfig, backendName
+	t.Cleanup(func() { userConfig, backendName = oldCfg, oldName })
+	userConfig, backendName = cfg, name
+}
+
+func TestTypeOptions(t *testing.T) {
+	withConfig(t, "gomote", config{
+		"type.windows-arm64-11": {
+			"create": {"-setup"},
+			"setup":  {`mkdir C:\temp`},
+			"push":   {"false"},
+			"env":    {"GO_TEST_TIMEOUT_SCALE=2"},
+		},
+		"type.plan9-arm": {
+			"scripts": {"all.bash=all9.rc"},
+		},
+		"type.linux-amd64": {
+			"push": {"true"},
+		},
+		"defaults": {
+			"create": {"-not-a-type"},
+		},
+	})
+	tests := []struct {
+		typ     string
+		setup   []string
+		env     []string
+		push    bool
+		command []string
+	}{
+		{
+			typ:     "windows-arm64-11",
+			setup:   []string{`mkdir C:\temp`},
+			env:     []string{"GO_TEST_TIMEOUT_SCALE=2"},
+			push:    false,
+			command: []string{"go/src/all.bash"},
+		},
+		{
+			typ:     "linux-amd64",
+			push:    true,
+			command: []string{"go/src/all.bash"},
+		},
+		{
+			// Not the windows-arm64-11 table, which must match exactly.
+			typ:     "windows-arm64",
+			push:    true,
+			command: []string{"go/src/all.bash"},
+		},
+		{
+			// The known quirk.
+			typ:     "plan9-386",
+			push:    true,
+			command: []string{"go/src/all.rc"},
+		},
+		{
+			// The table overrides the quirk.
+			typ:     "plan9-arm",
+			push:    true,
+			command: []string{"go/src/all9.rc"},
+		},
+	}
+	for _, tt := range tests {
+		if got := typeSetup(tt.typ); !slices.Equal(got, tt.setup) {
+			t.Errorf("typeSetup(%q) = %q, want %q", tt.typ, got, tt.setup)
+		}
+		if got := typeEnv(tt.typ); !slices.Equal(got, tt.env) {
+			t.Errorf("typeEnv(%q) = %q, want %q", tt.typ, got, tt.env)
+		}
+		if got := typePush(tt.typ); got != tt.push {
+			t.Errorf("typePush(%q) = %v, want %v", tt.typ, got, tt.push)
+		}
+		if got := typeScriptCommand(tt.typ, []string{"go/src/all.bash"}); !slices.Equal(got, tt.command) {
+			t.Errorf("typeScriptCommand(%q, all.bash) = %q, want %q", tt.typ, got, tt.command)
+		}
+	}
+	want := map[string][]string{"windows-arm64-11": {"-setup"}}
+	if got := typeCreateArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("typeCreateArgs() = %q, want %q", got, want)
+	}
+	if err := checkTypeOptions(); err != nil {
+		t.Errorf("checkTypeOptions: %v", err)
+	}
+}
+
+func TestCheckTypeOptionsError(t *testing.T) {
+	tests := []struct {
+		backend string
+		opts    map[string][]string
+		err     string
+	}{
+		{"gomote", map[string][]string{"pushh": {"false"}}, `[type.linux-amd64]: unknown option "pushh"`},
+		{"gomote", map[string][]string{"push": {"no"}}, "push must be true or false"},
+		{"gomote", map[string][]string{"bootstrap": {"1", "0"}}, "bootstrap must be true or false"},
+		{"gomote", map[string][]string{"scripts": {"all.rc"}}, `scripts must be like "all.bash=all.rc", not "all.rc"`},
+		{"ssh", map[string][]string{"create": {"-setup"}}, "create options are only supported by the gomote backend"},
+	}
+	for _, tt := range tests {
+		withConfig(t, tt.backend, config{"type.linux-amd64": tt.opts})
+		if err := checkTypeOptions(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("checkTypeOptions with %v = %v, want an error containing %q", tt.opts, err, tt.err)
+		}
+	}
+}
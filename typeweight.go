@@ -0,0 +1,59 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var typeWeight stringSetVar
+
+func init() {
+	flag.Var(&typeWeight, "type-weight", "relative share of the pool for an instance type, as TYPE=W, to concentrate a pool spread across several types where the failure is most likely to reproduce (types without one weigh 1), may be specified multiple times")
+}
+
+// typeWeights is the weight of each instance type with a -type-weight.
+var typeWeights map[string]float64
+
+// setUpTypeWeight resolves the types of -type-weight against the session's
+// types, typs.
+func setUpTypeWeight(ctx context.Context, typs []string) error {
+	typeWeights = make(map[string]float64)
+	for _, v := range typeWeight {
+		typ, weight, _ := strings.Cut(v, "=")
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w <= 0 {
+			return usageErrorf("-type-weight: %q is not of the form TYPE=W, with W positive", v)
+		}
+		t, err := sessionType(ctx, "-type-weight", typ, typs)
+		if err != nil {
+			return err
+		}
+		typeWeights[t] = w
+	}
+	return nil
+}
+
+// weightOf returns the weight of type typ.
+func weightOf(typ string) float64 {
+	if w, ok := typeWeights[typ]; ok {
+		return w
+	}
+	return 1
+}
+
+// writeTypeWeight describes the weight of each type for printPlan.
+func writeTypeWeight(w io.Writer, typs []string) {
+	var shares []string
+	for _, typ := range typs {
+		shares = append(shares, fmt.Sprintf("%s=%g", typ, weightOf(typ)))
+	}
+	fmt.Fprintf(w, "# weights: %s\n", strings.Join(shares, " "))
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var maxUnmatched uint
+
+func init() {
+	flag.UintVar(&maxUnmatched, "max-unmatched", 100, "maximum number of unmatched failure outputs to keep, deleting the oldest ones beyond that (0 means no limit)")
+}
+
+// unmatchedDir returns the directory holding unmatched failure outputs.
+func unmatchedDir() string {
+	return filepath.Join(artifactsDir, "unmatched")
+}
+
+// unmatchedOutput is a saved unmatched failure output, standing in for every
+// unmatched failure with the same signature.
+type unmatchedOutput struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"` // number of failures with this signature
+
+	sig   [sha256.Size]byte
+	insts map[string]bool // instances that produced this failure
+}
+
+// Patterns for parts of failure outputs that vary between otherwise
+// identical failures.
+var (
+	timestampRe = regexp.MustCompile(`\d{4}[-/]\d\d[-/]\d\d[ T]\d\d:\d\d:\d\d(\.\d+)?Z?`)
+	hexRe       = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	durationRe  = regexp.MustCompile(`\b\d+(\.\d+)?(ns|µs|us|ms|s|m|h)\b`)
+	goroutineRe = regexp.MustCompile(`goroutine \d+`)
+	pidRe       = regexp.MustCompile(`(?i)\bpid[ =:]+\d+`)
+	tmpPathRe   = regexp.MustCompile(`/tmp/\S+`)
+)
+
+// failureSignature returns a signature of a failure's output on inst that
+// ignores details like addresses, timings, and temporary paths, so that
+// recurrences of the same failure have the same signature.
+func failureSignature(inst string, output []byte) [sha256.Size]byte {
+	b := bytes.ReplaceAll(output, []byte(inst), []byte("INSTANCE"))
+	b = timestampRe.ReplaceAll(b, []byte("TIME"))
+	b = hexRe.ReplaceAll(b, []byte("0xX"))
+	b = durationRe.ReplaceAll(b, []byte("DURATION"))
+	b = goroutineRe.ReplaceAll(b, []byte("goroutine N"))
+	b = pidRe.ReplaceAll(b, []byte("pid N"))
+	b = tmpPathRe.ReplaceAll(b, []byte("TMP"))
+	return sha256.Sum256(b)
+}
+
+// saveUnmatched writes the output of an unmatched failure on inst to the
+// artifacts directory and returns its path. If an output with the same
+// signature was already saved, it counts another occurrence of it instead,
+// and returns its path and true. Beyond -max-unmatched outputs, the oldest
+// ones are deleted.
+func (s *session) saveUnmatched(inst string, output []byte) (string, bool, error) {
+	sig := failureSignature(inst, output)
+	s.mu.Lock()
+	if u, ok := s.unmatchedSeen[sig]; ok {
+		u.Count++
+		u.insts[inst] = true
+		s.mu.Unlock()
+		return u.Path, true, nil
+	}
+	s.mu.Unlock()
+
+	if err := os.MkdirAll(unmatchedDir(), 0o755); err != nil {
+		return "", false, err
+	}
+	name := fmt.Sprintf("%s-%s.out", inst, time.Now().Format("20060102T150405.000"))
+	path := filepath.Join(unmatchedDir(), name)
+	if err := os.WriteFile(path, output, 0o644); err != nil {
+		return "", false, err
+	}
+	addArtifact(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unmatchedSeen == nil {
+		s.unmatchedSeen = make(map[[sha256.Size]byte]*unmatchedOutput)
+	}
+	u := &unmatchedOutput{Path: path, Count: 1, sig: sig, insts: map[string]bool{inst: true}}
+	s.unmatchedSeen[sig] = u
+	s.unmatched = append(s.unmatched, u)
+	for maxUnmatched > 0 && len(s.unmatched) > int(maxUnmatched) {
+		old := s.unmatched[0]
+		s.unmatched = s.unmatched[1:]
+		if err := removeArtifact(old.Path); err != nil {
+			log.Printf("Failed to remove old unmatched failure output: %v", err)
+		}
+		delete(s.unmatchedSeen, old.sig)
+	}
+	return path, false, nil
+}
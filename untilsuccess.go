@@ -0,0 +1,63 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var untilSuccess bool
+
+func init() {
+	flag.BoolVar(&untilSuccess, "until-success", false, "the inverse of the default: keep running, collecting failures, until the command passes, then keep that run's output and archive for comparison")
+}
+
+// passRecord is the run that ended an -until-success session.
+type passRecord struct {
+	Instance string `json:"instance"`
+	Output   string `json:"output"`
+	Archive  string `json:"archive,omitempty"`
+	Seed     int64  `json:"seed"`
+}
+
+// recordPass keeps the output and archive of the passing run on inst,
+// for -until-success.
+func recordPass(ctx context.Context, inst string, results []byte, seed int64) error {
+	name := inst + ".pass"
+	outName := filepath.Join(artifactsDir, name+".out")
+	if err := os.WriteFile(outName, results, 0o644); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	addArtifact(outName)
+	instLogf(inst, "Wrote output of passing run on %s to %s.", inst, outName)
+	tarName, _, err := downloadArchive(ctx, inst, name)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.pass == nil {
+		sess.pass = &passRecord{Instance: inst, Output: outName, Archive: tarName, Seed: seed}
+	}
+	return nil
+}
+
+// writePass writes the passing run of an -until-success session, if any.
+func (st *sessionStatus) writePass(w io.Writer) {
+	if st.Pass == nil {
+		return
+	}
+	paths := []string{st.Pass.Output}
+	if st.Pass.Archive != "" {
+		paths = append(paths, st.Pass.Archive)
+	}
+	fmt.Fprintf(w, "  passing run:\n    %s: %s [seed %d]\n", st.Pass.Instance, strings.Join(paths, ", "), st.Pass.Seed)
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var verifyIters uint
+
+func init() {
+	flag.UintVar(&verifyIters, "verify", 0, "fix-verification mode: succeed once this many iterations have run across the pool without a matching failure, and fail as soon as one matches")
+}
+
+// cleanIterations returns the number of iterations that ran the command
+// without a matching failure.
+func (s *session) cleanIterations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results[swarm.Pass.String()] + s.results[swarm.FailUnmatched.String()]
+}
+
+// verified reports whether -verify's iterations have all run without a
+// matching failure.
+func verified() bool {
+	return verifyIters > 0 && sess.cleanIterations() >= int(verifyIters) && len(sess.status().Failures) == 0
+}
+
+// writeVerifySummary writes the outcome of -verify.
+func writeVerifySummary(w io.Writer) {
+	clean := sess.cleanIterations()
+	switch {
+	case len(sess.status().Failures) > 0:
+		fmt.Fprintf(w, "Verification failed: a matching failure appeared after %d clean iterations.\n", clean)
+	case clean >= int(verifyIters):
+		fmt.Fprintf(w, "Verified: %d iterations without a matching failure.\n", clean)
+	default:
+		fmt.Fprintf(w, "Not verified: only %d of %d iterations ran.\n", clean, verifyIters)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var watchTree bool
+
+func init() {
+	flag.BoolVar(&watchTree, "watch", false, "watch the Go tree being pushed for changes, and re-push it to every instance once each finishes its current iteration")
+}
+
+// watchInterval is how often -watch checks the tree for changes.
+const watchInterval = 2 * time.Second
+
+// pushGen counts the changes to the tree seen by -watch. Instances pushed
+// before the latest change need to be pushed again.
+var pushGen atomic.Int64
+
+// errTreeChanged is returned by runInstanceLoop when the tree pushed to
+// the instance changed, and it needs to be pushed again.
+var errTreeChanged = errors.New("the Go tree changed")
+
+// treeStamp returns a hash of the names, sizes, and modification times of
+// the files in goroot, which changes when any of them does. Build outputs
+// and .git are skipped, since they're not pushed.
+func treeStamp(goroot string) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(goroot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(goroot, path)
+		if d.IsDir() {
+			switch rel {
+			case ".git", "bin", "pkg":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum, err
+}
+
+// watchGOROOT polls goroot for changes until ctx is done. Once a change
+// settles, it bumps pushGen so that every instance is pushed again.
+func watchGOROOT(ctx context.Context, goroot string) {
+	last, err := treeStamp(goroot)
+	if err != nil {
+		log.Printf("Failed to watch %s: %v", goroot, err)
+		return
+	}
+	changed := false
+	t := time.NewTicker(watchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		stamp, err := treeStamp(goroot)
+		if err != nil {
+			// Probably caught in the middle of an edit.
+			continue
+		}
+		if stamp != last {
+			// Wait for the tree to settle, rather than pushing
+			// a half-saved change.
+			last, changed = stamp, true
+			continue
+		}
+		if changed {
+			changed = false
+			pushGen.Add(1)
+			log.Printf("%s changed, pushing it to every instance again.", goroot)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var wipePaths stringSetVar
+
+func init() {
+	flag.Var(&wipePaths, "wipe", "a path, relative to the instance's work directory, to remove between iterations, may be specified multiple times")
+}
+
+// wipeWorkspace removes wipePaths on inst, so that state left behind by
+// one iteration (like a full disk) doesn't affect the next.
+func wipeWorkspace(ctx context.Context, inst string) {
+	if len(wipePaths) == 0 {
+		return
+	}
+	rm, ok := backend.(swarm.Remover)
+	if !ok {
+		return
+	}
+	err := retry(ctx, "rm", inst, func(ctx context.Context) error {
+		return limitOp(ctx, func() error { return rm.Rm(ctx, inst, wipePaths...) })
+	})
+	if err != nil {
+		log.Printf("Error wiping workspace on %s: %v", inst, unwrap(err))
+	}
+}
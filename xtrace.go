@@ -0,0 +1,37 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mknyszek/goswarm/swarm"
+)
+
+var traceGomote bool
+
+func init() {
+	for _, fs := range []*flag.FlagSet{flag.CommandLine, cleanFlags, typesFlags, doctorFlags} {
+		fs.BoolVar(&traceGomote, "x", false, "print each gomote command to stderr as it's run, as in sh -x, ready to copy and paste to repeat a step by hand")
+	}
+}
+
+// printGomoteCommand prints the gomote invocation of args, with the
+// variables env added to its environment, as a shell command.
+func printGomoteCommand(env, args []string) {
+	var words []string
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		words = append(words, k+"="+swarm.ShellQuote(v))
+	}
+	words = append(words, "gomote")
+	for _, a := range args {
+		words = append(words, swarm.ShellQuote(a))
+	}
+	fmt.Fprintf(os.Stderr, "+ %s\n", redactString(strings.Join(words, " ")))
+}